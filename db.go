@@ -0,0 +1,102 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/database"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Connect to the postgres database configured in the database section
+// and POSTGRES_* environment variables
+func openPostgres(ctx *cli.Context) (*database.Database, error) {
+	conf, err := config.ParseConf(ctx.Path("config"))
+	if err != nil {
+		logrus.WithContext(ctx.Context).WithError(err).Fatal("Error loading config, exiting…")
+	}
+	if conf.Logger != nil {
+		logrus.SetLevel(conf.Logger.Level)
+	}
+	if backend := conf.Database.BackendOrDefault(); backend != config.DatabasePostgres {
+		return nil, fmt.Errorf("Schema migrations are only used by the postgres backend (configured backend: %s)", backend)
+	}
+	postgres, _, err := database.OpenPostgres(conf.Database)
+	if err != nil {
+		return nil, err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx.Context, 10*time.Second)
+	defer cancel()
+	if err := postgres.PingContext(pingCtx); err != nil {
+		postgres.Close()
+		return nil, fmt.Errorf("Could not connect to postgres database: %s", err)
+	}
+	return database.NewDatabase(postgres), nil
+}
+
+var dbCommand = &cli.Command{
+	Name:  "db",
+	Usage: "manage the postgres database",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "migrate",
+			Usage: "apply pending schema migrations",
+			Action: func(ctx *cli.Context) error {
+				db, err := openPostgres(ctx)
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+				applied, err := db.Migrate(ctx.Context)
+				if err != nil {
+					return err
+				}
+				if len(applied) == 0 {
+					fmt.Println("Database schema is up to date.")
+					return nil
+				}
+				for _, m := range applied {
+					fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "show applied and pending schema migrations",
+			Action: func(ctx *cli.Context) error {
+				db, err := openPostgres(ctx)
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+				migrations, err := db.MigrationStatus(ctx.Context)
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+				for _, m := range migrations {
+					at := "pending"
+					if m.AppliedAt != nil {
+						at = m.AppliedAt.Format(time.RFC3339)
+					}
+					fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, at)
+				}
+				return w.Flush()
+			},
+		},
+	},
+}
@@ -7,8 +7,12 @@ package app_api
 
 import (
 	"github.com/nextmn/srv6/internal/ctrl"
-	"github.com/nextmn/srv6/internal/database"
+	ctrl_api "github.com/nextmn/srv6/internal/ctrl/api"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/events"
+	"github.com/nextmn/srv6/internal/gtpu"
 	"github.com/nextmn/srv6/internal/iproute2"
+	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
 )
 
 type Registry interface {
@@ -16,10 +20,25 @@ type Registry interface {
 	TunIface(name string) (*iproute2.TunIface, bool)
 	RegisterTunIface(iface *iproute2.TunIface) error
 	DeleteTunIface(name string)
+	GTPUSocket(name string) (*iproute2.GTPUSocket, bool)
+	RegisterGTPUSocket(socket *iproute2.GTPUSocket) error
+	DeleteGTPUSocket(name string)
 	RegisterControllerRegistry(*ctrl.ControllerRegistry)
 	ControllerRegistry() (*ctrl.ControllerRegistry, bool)
 	DeleteControllerRegistry()
-	RegisterDB(*database.Database)
-	DB() (*database.Database, bool)
+	RegisterDB(database_api.RuleStore)
+	DB() (database_api.RuleStore, bool)
 	DeleteDB()
+	RegisterRulesWriter(database_api.RulesWriter)
+	RulesWriter() (database_api.RulesWriter, bool)
+	DeleteRulesWriter()
+	RegisterPathManager(*gtpu.PathManager)
+	PathManager() (*gtpu.PathManager, bool)
+	DeletePathManager()
+	RegisterNetFunc(iface string, n netfunc_api.NetFunc)
+	NetFuncStats() map[string]netfunc_api.Stats
+	DeleteNetFunc(iface string)
+	Events() *events.Hub
+	RegisterDataplaneManager(ctrl_api.DataplaneManager)
+	DataplaneManager() (ctrl_api.DataplaneManager, bool)
 }
@@ -0,0 +1,317 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package app
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/constants"
+	ctrl_api "github.com/nextmn/srv6/internal/ctrl/api"
+	"github.com/nextmn/srv6/internal/tasks"
+	tasks_api "github.com/nextmn/srv6/internal/tasks/api"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DataplaneManager adds and deletes endpoints and headends at runtime.
+// Their interfaces, routes and network functions are created by tasks,
+// started and stopped as a group.
+type DataplaneManager struct {
+	mu        sync.Mutex
+	config    *config.SRv6Config
+	tasks     tasks_api.Registry
+	registry  app_api.Registry
+	endpoints []ctrl_api.ManagedEndpoint
+	headends  []ctrl_api.ManagedHeadend
+	reserved  map[string]struct{} // names of interfaces and sockets in use
+}
+
+// Create a new DataplaneManager
+func NewDataplaneManager(conf *config.SRv6Config, tasks tasks_api.Registry, registry app_api.Registry) *DataplaneManager {
+	return &DataplaneManager{
+		config:    conf,
+		tasks:     tasks,
+		registry:  registry,
+		endpoints: make([]ctrl_api.ManagedEndpoint, 0),
+		headends:  make([]ctrl_api.ManagedHeadend, 0),
+		reserved:  make(map[string]struct{}),
+	}
+}
+
+// Endpoint of the configuration file
+func (m *DataplaneManager) addStaticEndpoint(e *config.Endpoint, iface string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints = append(m.endpoints, ctrl_api.ManagedEndpoint{Endpoint: e, Interface: iface, Static: true})
+	if iface != "" {
+		m.reserved[iface] = struct{}{}
+	}
+}
+
+// Headend of the configuration file
+func (m *DataplaneManager) addStaticHeadend(h *config.Headend, iface string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.headends = append(m.headends, ctrl_api.ManagedHeadend{Headend: h, Interface: iface, Static: true})
+	if iface != "" {
+		m.reserved[iface] = struct{}{}
+	}
+}
+
+// First free name with this prefix; must be called with the lock held
+func (m *DataplaneManager) reserve(prefix string) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		if _, ok := m.reserved[name]; ok {
+			continue
+		}
+		if _, ok := m.registry.TunIface(name); ok {
+			continue
+		}
+		if _, ok := m.registry.GTPUSocket(name); ok {
+			continue
+		}
+		m.reserved[name] = struct{}{}
+		return name
+	}
+}
+
+// Warn when packets will not be routed to the table of the prefix
+func warnIfNotCovered(outer *netip.Prefix, p netip.Prefix, what string) {
+	if outer == nil || !outer.Contains(p.Addr()) || outer.Bits() > p.Bits() {
+		logrus.WithFields(logrus.Fields{"prefix": p}).Warnf("Prefix is not included in %s: packets may not be routed to it", what)
+	}
+}
+
+func endpointGroup(prefix netip.Prefix) string {
+	return "endpoint/" + prefix.Masked().String()
+}
+
+func headendGroup(name string) string {
+	return "headend/" + name
+}
+
+func (m *DataplaneManager) findEndpoint(prefix netip.Prefix) int {
+	for i, e := range m.endpoints {
+		if p, err := netip.ParsePrefix(e.Endpoint.Prefix); err == nil && p.Masked() == prefix.Masked() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *DataplaneManager) findHeadend(name string) int {
+	for i, h := range m.headends {
+		if h.Headend.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// All endpoints
+func (m *DataplaneManager) Endpoints() []ctrl_api.ManagedEndpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endpoints := make([]ctrl_api.ManagedEndpoint, len(m.endpoints))
+	copy(endpoints, m.endpoints)
+	return endpoints
+}
+
+// Endpoint with this prefix
+func (m *DataplaneManager) Endpoint(prefix netip.Prefix) (ctrl_api.ManagedEndpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findEndpoint(prefix)
+	if i < 0 {
+		return ctrl_api.ManagedEndpoint{}, ctrl_api.ErrNotFound
+	}
+	return m.endpoints[i], nil
+}
+
+// Create the interface, route and network function of a new endpoint
+func (m *DataplaneManager) AddEndpoint(e *config.Endpoint) (ctrl_api.ManagedEndpoint, error) {
+	if e == nil {
+		return ctrl_api.ManagedEndpoint{}, fmt.Errorf("%w: missing endpoint", ctrl_api.ErrInvalid)
+	}
+	prefix, err := netip.ParsePrefix(e.Prefix)
+	if err != nil || !prefix.Addr().Is6() {
+		return ctrl_api.ManagedEndpoint{}, fmt.Errorf("%w: prefix %q is not an IPv6 prefix", ctrl_api.ErrInvalid, e.Prefix)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.findEndpoint(prefix) >= 0 {
+		return ctrl_api.ManagedEndpoint{}, fmt.Errorf("%w: endpoint %s", ctrl_api.ErrAlreadyExists, prefix)
+	}
+	var locator *netip.Prefix
+	if m.config.Locator != nil {
+		locator = &m.config.Locator.Prefix
+	}
+	warnIfNotCovered(locator, prefix, "the locator")
+
+	managed := ctrl_api.ManagedEndpoint{Endpoint: e}
+	var group []tasks_api.Task
+	switch e.Provider {
+	case config.ProviderLinux:
+		group = []tasks_api.Task{
+			tasks.NewTaskLinuxEndpoint(fmt.Sprintf("linux.endpoint/%s", e.Prefix), e, constants.RT_TABLE_NEXTMN_IPV6, constants.IFACE_LINUX),
+		}
+	case config.ProviderNextMN:
+		managed.Interface = m.reserve(constants.IFACE_GOLANG_SRV6_PREFIX)
+		group = []tasks_api.Task{
+			tasks.NewTaskTunIface(fmt.Sprintf("nextmn.tun.golang-srv6/%s", e.Prefix), managed.Interface, m.config.Dataplane.TunQueuesOrDefault(), m.config.Dataplane.OffloadEnabled(), m.registry),
+			tasks.NewTaskNextMNEndpoint(fmt.Sprintf("nextmn.endpoint/%s", e.Prefix), e, constants.RT_TABLE_NEXTMN_IPV6, managed.Interface, m.config.Dataplane, m.registry),
+		}
+	default:
+		return ctrl_api.ManagedEndpoint{}, fmt.Errorf("%w: provider %s cannot be used at runtime", ctrl_api.ErrInvalid, e.Provider)
+	}
+	if err := m.tasks.Start(endpointGroup(prefix), group...); err != nil {
+		delete(m.reserved, managed.Interface)
+		return ctrl_api.ManagedEndpoint{}, err
+	}
+	m.endpoints = append(m.endpoints, managed)
+	return managed, nil
+}
+
+// Delete the network function, route and interface of an endpoint added at runtime
+func (m *DataplaneManager) DeleteEndpoint(prefix netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findEndpoint(prefix)
+	if i < 0 {
+		return ctrl_api.ErrNotFound
+	}
+	e := m.endpoints[i]
+	if e.Static {
+		return fmt.Errorf("%w: endpoint %s", ctrl_api.ErrStatic, prefix)
+	}
+	// on failure, the endpoint is kept: its interface may still exist
+	if err := m.tasks.Stop(endpointGroup(prefix)); err != nil {
+		return err
+	}
+	m.endpoints = append(m.endpoints[:i], m.endpoints[i+1:]...)
+	delete(m.reserved, e.Interface)
+	return nil
+}
+
+// All headends
+func (m *DataplaneManager) Headends() []ctrl_api.ManagedHeadend {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	headends := make([]ctrl_api.ManagedHeadend, len(m.headends))
+	copy(headends, m.headends)
+	return headends
+}
+
+// Headend with this name
+func (m *DataplaneManager) Headend(name string) (ctrl_api.ManagedHeadend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findHeadend(name)
+	if i < 0 {
+		return ctrl_api.ManagedHeadend{}, ctrl_api.ErrNotFound
+	}
+	return m.headends[i], nil
+}
+
+// Create the interface (or socket), route and network function of a new headend
+func (m *DataplaneManager) AddHeadend(h *config.Headend) (ctrl_api.ManagedHeadend, error) {
+	if h == nil {
+		return ctrl_api.ManagedHeadend{}, fmt.Errorf("%w: missing headend", ctrl_api.ErrInvalid)
+	}
+	if h.Name == "" || strings.ContainsAny(h.Name, "/?#") {
+		return ctrl_api.ManagedHeadend{}, fmt.Errorf("%w: name %q", ctrl_api.ErrInvalid, h.Name)
+	}
+	to, err := netip.ParsePrefix(h.To)
+	if err != nil || !to.Addr().Is4() {
+		return ctrl_api.ManagedHeadend{}, fmt.Errorf("%w: prefix %q is not an IPv4 prefix", ctrl_api.ErrInvalid, h.To)
+	}
+	if h.Ingress == config.IngressUDPSocket && (h.Behavior != config.H_M_GTP4_D || h.Provider == config.ProviderLinux) {
+		return ctrl_api.ManagedHeadend{}, fmt.Errorf("%w: ingress %s requires behavior %s with a NextMN provider", ctrl_api.ErrInvalid, h.Ingress, config.H_M_GTP4_D)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.findHeadend(h.Name) >= 0 {
+		return ctrl_api.ManagedHeadend{}, fmt.Errorf("%w: headend %s", ctrl_api.ErrAlreadyExists, h.Name)
+	}
+	if h.Behavior == config.H_M_GTP4_D {
+		warnIfNotCovered(m.config.GTP4HeadendPrefix, to, "gtp4-headend-prefix")
+	} else {
+		warnIfNotCovered(m.config.IPV4HeadendPrefix, to, "ipv4-headend-prefix")
+	}
+
+	managed := ctrl_api.ManagedHeadend{Headend: h}
+	var group []tasks_api.Task
+	switch h.Provider {
+	case config.ProviderLinux:
+		group = []tasks_api.Task{
+			tasks.NewTaskLinuxHeadend(fmt.Sprintf("linux.headend/%s", h.Name), h, constants.RT_TABLE_NEXTMN_IPV4, constants.IFACE_LINUX),
+		}
+	case config.ProviderNextMN, config.ProviderNextMNWithController:
+		if h.Ingress == config.IngressUDPSocket {
+			managed.Interface = m.reserve(constants.SOCKET_GTP4_PREFIX)
+			group = []tasks_api.Task{
+				tasks.NewTaskGTPUSocket(fmt.Sprintf("nextmn.socket.gtp4/%s", h.Name), managed.Interface, h.To, m.config.Dataplane.TunQueuesOrDefault(), m.registry),
+				tasks.NewTaskNextMNHeadendSocket(fmt.Sprintf("nextmn.headend.gtp4-socket/%s", h.Name), h, managed.Interface, m.config.Dataplane, m.registry),
+			}
+			break
+		}
+		// same names of tasks as in the configuration file
+		provider := "nextmn"
+		if h.Provider == config.ProviderNextMNWithController {
+			provider = "nextmn-ctrl"
+		}
+		kind, ifacePrefix := "ipv4", constants.IFACE_GOLANG_IPV4_PREFIX
+		if h.Behavior == config.H_M_GTP4_D {
+			kind, ifacePrefix = "gtp4", constants.IFACE_GOLANG_GTP4_PREFIX
+		}
+		managed.Interface = m.reserve(ifacePrefix)
+		tun := tasks.NewTaskTunIface(fmt.Sprintf("%s.tun.golang-%s/%s", provider, kind, h.Name), managed.Interface, m.config.Dataplane.TunQueuesOrDefault(), m.config.Dataplane.OffloadEnabled(), m.registry)
+		t_name := fmt.Sprintf("%s.headend.%s/%s", provider, kind, h.Name)
+		if h.Provider == config.ProviderNextMN {
+			group = []tasks_api.Task{tun, tasks.NewTaskNextMNHeadend(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, managed.Interface, m.config.Dataplane, m.registry)}
+		} else {
+			group = []tasks_api.Task{tun, tasks.NewTaskNextMNHeadendWithCtrl(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, managed.Interface, m.config.Dataplane, m.registry)}
+		}
+	default:
+		return ctrl_api.ManagedHeadend{}, fmt.Errorf("%w: provider %s cannot be used at runtime", ctrl_api.ErrInvalid, h.Provider)
+	}
+	if h.Behavior == config.H_M_GTP4_D && m.config.GTPUPathManagement != nil {
+		logrus.WithFields(logrus.Fields{"headend": h.Name}).Info("GTP-U paths of headends added at runtime are not monitored")
+	}
+	if err := m.tasks.Start(headendGroup(h.Name), group...); err != nil {
+		delete(m.reserved, managed.Interface)
+		return ctrl_api.ManagedHeadend{}, err
+	}
+	m.headends = append(m.headends, managed)
+	return managed, nil
+}
+
+// Delete the network function, route and interface (or socket) of a headend added at runtime
+func (m *DataplaneManager) DeleteHeadend(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findHeadend(name)
+	if i < 0 {
+		return ctrl_api.ErrNotFound
+	}
+	h := m.headends[i]
+	if h.Static {
+		return fmt.Errorf("%w: headend %s", ctrl_api.ErrStatic, name)
+	}
+	// on failure, the headend is kept: its interface (or socket) may still exist
+	if err := m.tasks.Stop(headendGroup(name)); err != nil {
+		return err
+	}
+	m.headends = append(m.headends[:i], m.headends[i+1:]...)
+	delete(m.reserved, h.Interface)
+	return nil
+}
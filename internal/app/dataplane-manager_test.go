@@ -0,0 +1,159 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/nextmn/srv6/internal/config"
+	ctrl_api "github.com/nextmn/srv6/internal/ctrl/api"
+	"github.com/nextmn/srv6/internal/iana"
+	tasks_api "github.com/nextmn/srv6/internal/tasks/api"
+)
+
+// Task registry recording started groups, without running their tasks
+type fakeTasks struct {
+	groups   map[string]bool
+	stopErrs int // number of calls to Stop failing
+}
+
+func (f *fakeTasks) Register(task tasks_api.Task)  {}
+func (f *fakeTasks) Run(ctx context.Context) error { return nil }
+
+func (f *fakeTasks) Start(group string, tasks ...tasks_api.Task) error {
+	f.groups[group] = true
+	return nil
+}
+
+func (f *fakeTasks) Stop(group string) error {
+	if f.stopErrs > 0 {
+		f.stopErrs--
+		return fmt.Errorf("Unable to delete interface")
+	}
+	delete(f.groups, group)
+	return nil
+}
+
+func newTestManager() (*DataplaneManager, *fakeTasks) {
+	tasks := &fakeTasks{groups: make(map[string]bool)}
+	return NewDataplaneManager(&config.SRv6Config{}, tasks, NewRegistry(nil)), tasks
+}
+
+func TestAddEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		endpoint *config.Endpoint
+		err      error
+	}{
+		{"missing endpoint", nil, ctrl_api.ErrInvalid},
+		{"IPv4 prefix", &config.Endpoint{Provider: config.ProviderNextMN, Prefix: "10.0.0.0/24", Behavior: iana.End_DX4}, ctrl_api.ErrInvalid},
+		{"eBPF provider", &config.Endpoint{Provider: config.ProviderEBPF, Prefix: "fd00:1::/80", Behavior: iana.End_DX4}, ctrl_api.ErrInvalid},
+		{"NextMN provider", &config.Endpoint{Provider: config.ProviderNextMN, Prefix: "fd00:1::/80", Behavior: iana.End_DX4}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager()
+			_, err := m.AddEndpoint(tt.endpoint)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAddEndpointTwice(t *testing.T) {
+	m, _ := newTestManager()
+	e1, err := m.AddEndpoint(&config.Endpoint{Provider: config.ProviderNextMN, Prefix: "fd00:1::/80", Behavior: iana.End_DX4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same prefix, not masked
+	if _, err := m.AddEndpoint(&config.Endpoint{Provider: config.ProviderNextMN, Prefix: "fd00:1::1/80", Behavior: iana.End_DX4}); !errors.Is(err, ctrl_api.ErrAlreadyExists) {
+		t.Errorf("got error %v, want %v", err, ctrl_api.ErrAlreadyExists)
+	}
+	e2, err := m.AddEndpoint(&config.Endpoint{Provider: config.ProviderNextMN, Prefix: "fd00:2::/80", Behavior: iana.End_DX4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e1.Interface == e2.Interface {
+		t.Errorf("interface %s used twice", e1.Interface)
+	}
+}
+
+func TestDeleteStatic(t *testing.T) {
+	m, _ := newTestManager()
+	m.addStaticEndpoint(&config.Endpoint{Provider: config.ProviderLinux, Prefix: "fd00:1::/80", Behavior: iana.End_DX4}, "")
+	m.addStaticHeadend(&config.Headend{Name: "h1", Provider: config.ProviderLinux, To: "10.0.0.0/24"}, "")
+	if err := m.DeleteEndpoint(netip.MustParsePrefix("fd00:1::/80")); !errors.Is(err, ctrl_api.ErrStatic) {
+		t.Errorf("got error %v, want %v", err, ctrl_api.ErrStatic)
+	}
+	if err := m.DeleteHeadend("h1"); !errors.Is(err, ctrl_api.ErrStatic) {
+		t.Errorf("got error %v, want %v", err, ctrl_api.ErrStatic)
+	}
+	if err := m.DeleteHeadend("h2"); !errors.Is(err, ctrl_api.ErrNotFound) {
+		t.Errorf("got error %v, want %v", err, ctrl_api.ErrNotFound)
+	}
+}
+
+// An endpoint whose tasks could not be stopped is kept, with its interface
+func TestDeleteEndpointFailure(t *testing.T) {
+	m, tasks := newTestManager()
+	prefix := netip.MustParsePrefix("fd00:1::/80")
+	e, err := m.AddEndpoint(&config.Endpoint{Provider: config.ProviderNextMN, Prefix: prefix.String(), Behavior: iana.End_DX4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks.stopErrs = 1
+	if err := m.DeleteEndpoint(prefix); err == nil {
+		t.Fatal("failure of Stop not returned")
+	}
+	if _, err := m.Endpoint(prefix); err != nil {
+		t.Errorf("endpoint not kept: %s", err)
+	}
+	if _, ok := m.reserved[e.Interface]; !ok {
+		t.Errorf("interface %s not reserved anymore", e.Interface)
+	}
+	if err := m.DeleteEndpoint(prefix); err != nil {
+		t.Fatalf("retry failed: %s", err)
+	}
+	if _, err := m.Endpoint(prefix); !errors.Is(err, ctrl_api.ErrNotFound) {
+		t.Errorf("got error %v, want %v", err, ctrl_api.ErrNotFound)
+	}
+	if _, ok := m.reserved[e.Interface]; ok {
+		t.Errorf("interface %s still reserved", e.Interface)
+	}
+	if len(tasks.groups) != 0 {
+		t.Errorf("groups %v still started", tasks.groups)
+	}
+}
+
+// A headend whose tasks could not be stopped is kept, with its interface
+func TestDeleteHeadendFailure(t *testing.T) {
+	m, tasks := newTestManager()
+	h, err := m.AddHeadend(&config.Headend{Name: "h1", Provider: config.ProviderNextMN, Behavior: config.H_Encaps, To: "10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks.stopErrs = 1
+	if err := m.DeleteHeadend("h1"); err == nil {
+		t.Fatal("failure of Stop not returned")
+	}
+	if _, err := m.Headend("h1"); err != nil {
+		t.Errorf("headend not kept: %s", err)
+	}
+	if _, ok := m.reserved[h.Interface]; !ok {
+		t.Errorf("interface %s not reserved anymore", h.Interface)
+	}
+	if err := m.DeleteHeadend("h1"); err != nil {
+		t.Fatalf("retry failed: %s", err)
+	}
+	if _, ok := m.reserved[h.Interface]; ok {
+		t.Errorf("interface %s still reserved", h.Interface)
+	}
+}
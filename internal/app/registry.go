@@ -7,32 +7,53 @@ package app
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/nextmn/srv6/internal/ctrl"
-	"github.com/nextmn/srv6/internal/database"
+	ctrl_api "github.com/nextmn/srv6/internal/ctrl/api"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/events"
+	"github.com/nextmn/srv6/internal/gtpu"
 	"github.com/nextmn/srv6/internal/iproute2"
+	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
 )
 
 type Registry struct {
 	ifaces             map[string]*iproute2.TunIface
+	sockets            map[string]*iproute2.GTPUSocket
+	ifacesMu           sync.RWMutex // ifaces and sockets are added at runtime
 	controllerRegistry *ctrl.ControllerRegistry
-	db                 *database.Database
+	db                 database_api.RuleStore
+	rulesWriter        database_api.RulesWriter
+	pathManager        *gtpu.PathManager
+	netfuncs           map[string]netfunc_api.NetFunc // read by the http server
+	netfuncsMu         sync.RWMutex
+	events             *events.Hub
+	dataplaneManager   ctrl_api.DataplaneManager
 }
 
-func NewRegistry() *Registry {
+func NewRegistry(events *events.Hub) *Registry {
 	return &Registry{
+		events:             events,
 		ifaces:             make(map[string]*iproute2.TunIface),
+		sockets:            make(map[string]*iproute2.GTPUSocket),
 		controllerRegistry: nil,
 		db:                 nil,
+		pathManager:        nil,
+		netfuncs:           make(map[string]netfunc_api.NetFunc),
 	}
 }
 
 func (r *Registry) TunIface(name string) (*iproute2.TunIface, bool) {
+	r.ifacesMu.RLock()
+	defer r.ifacesMu.RUnlock()
 	iface, exists := r.ifaces[name]
 	return iface, exists
 }
 
 func (r *Registry) RegisterTunIface(iface *iproute2.TunIface) error {
+	r.ifacesMu.Lock()
+	defer r.ifacesMu.Unlock()
 	if _, exists := r.ifaces[iface.Name()]; exists {
 		return fmt.Errorf("Iface %s is already registered.", iface.Name())
 	}
@@ -41,9 +62,34 @@ func (r *Registry) RegisterTunIface(iface *iproute2.TunIface) error {
 }
 
 func (r *Registry) DeleteTunIface(name string) {
+	r.ifacesMu.Lock()
+	defer r.ifacesMu.Unlock()
 	delete(r.ifaces, name)
 }
 
+func (r *Registry) GTPUSocket(name string) (*iproute2.GTPUSocket, bool) {
+	r.ifacesMu.RLock()
+	defer r.ifacesMu.RUnlock()
+	socket, exists := r.sockets[name]
+	return socket, exists
+}
+
+func (r *Registry) RegisterGTPUSocket(socket *iproute2.GTPUSocket) error {
+	r.ifacesMu.Lock()
+	defer r.ifacesMu.Unlock()
+	if _, exists := r.sockets[socket.Name()]; exists {
+		return fmt.Errorf("Socket %s is already registered.", socket.Name())
+	}
+	r.sockets[socket.Name()] = socket
+	return nil
+}
+
+func (r *Registry) DeleteGTPUSocket(name string) {
+	r.ifacesMu.Lock()
+	defer r.ifacesMu.Unlock()
+	delete(r.sockets, name)
+}
+
 func (r *Registry) RegisterControllerRegistry(cr *ctrl.ControllerRegistry) {
 	r.controllerRegistry = cr
 }
@@ -58,11 +104,11 @@ func (r *Registry) DeleteControllerRegistry() {
 	r.controllerRegistry = nil
 }
 
-func (r *Registry) RegisterDB(db *database.Database) {
+func (r *Registry) RegisterDB(db database_api.RuleStore) {
 	r.db = db
 }
 
-func (r *Registry) DB() (*database.Database, bool) {
+func (r *Registry) DB() (database_api.RuleStore, bool) {
 	if r.db == nil {
 		return nil, false
 	}
@@ -71,3 +117,72 @@ func (r *Registry) DB() (*database.Database, bool) {
 func (r *Registry) DeleteDB() {
 	r.db = nil
 }
+
+func (r *Registry) RegisterRulesWriter(w database_api.RulesWriter) {
+	r.rulesWriter = w
+}
+
+// Writes of rules serialized with the REST API
+func (r *Registry) RulesWriter() (database_api.RulesWriter, bool) {
+	if r.rulesWriter == nil {
+		return nil, false
+	}
+	return r.rulesWriter, true
+}
+func (r *Registry) DeleteRulesWriter() {
+	r.rulesWriter = nil
+}
+
+func (r *Registry) RegisterPathManager(pm *gtpu.PathManager) {
+	r.pathManager = pm
+}
+
+func (r *Registry) PathManager() (*gtpu.PathManager, bool) {
+	if r.pathManager == nil {
+		return nil, false
+	}
+	return r.pathManager, true
+}
+func (r *Registry) DeletePathManager() {
+	r.pathManager = nil
+}
+
+func (r *Registry) RegisterNetFunc(iface string, n netfunc_api.NetFunc) {
+	r.netfuncsMu.Lock()
+	defer r.netfuncsMu.Unlock()
+	r.netfuncs[iface] = n
+}
+
+// Stats of each NetFunc, by interface name
+func (r *Registry) NetFuncStats() map[string]netfunc_api.Stats {
+	r.netfuncsMu.RLock()
+	defer r.netfuncsMu.RUnlock()
+	stats := make(map[string]netfunc_api.Stats, len(r.netfuncs))
+	for iface, n := range r.netfuncs {
+		stats[iface] = n.Stats()
+	}
+	return stats
+}
+
+func (r *Registry) DeleteNetFunc(iface string) {
+	r.netfuncsMu.Lock()
+	defer r.netfuncsMu.Unlock()
+	delete(r.netfuncs, iface)
+}
+
+// Events published by tasks
+func (r *Registry) Events() *events.Hub {
+	return r.events
+}
+
+func (r *Registry) RegisterDataplaneManager(m ctrl_api.DataplaneManager) {
+	r.dataplaneManager = m
+}
+
+// Endpoints and headends managed at runtime
+func (r *Registry) DataplaneManager() (ctrl_api.DataplaneManager, bool) {
+	if r.dataplaneManager == nil {
+		return nil, false
+	}
+	return r.dataplaneManager, true
+}
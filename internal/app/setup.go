@@ -8,26 +8,33 @@ package app
 import (
 	"context"
 	"fmt"
+	"net/netip"
 
 	app_api "github.com/nextmn/srv6/internal/app/api"
 	"github.com/nextmn/srv6/internal/config"
 	"github.com/nextmn/srv6/internal/constants"
+	"github.com/nextmn/srv6/internal/events"
 	"github.com/nextmn/srv6/internal/tasks"
 	tasks_api "github.com/nextmn/srv6/internal/tasks/api"
 )
 
 type Setup struct {
-	config   *config.SRv6Config
-	tasks    tasks_api.Registry
-	registry app_api.Registry
+	config    *config.SRv6Config
+	tasks     tasks_api.Registry
+	registry  app_api.Registry
+	dataplane *DataplaneManager
 }
 
 func NewSetup(config *config.SRv6Config) *Setup {
-	return &Setup{
+	hub := events.NewHub(events.DefaultHistory)
+	s := &Setup{
 		config:   config,
-		tasks:    tasks.NewRegistry(),
-		registry: NewRegistry(),
+		tasks:    tasks.NewRegistry(hub),
+		registry: NewRegistry(hub),
 	}
+	s.dataplane = NewDataplaneManager(config, s.tasks, s.registry)
+	s.registry.RegisterDataplaneManager(s.dataplane)
+	return s
 }
 
 // Add tasks to setup
@@ -45,17 +52,20 @@ func (s *Setup) AddTasks(ctx context.Context) {
 	s.tasks.Register(tasks.NewMultiHook("hook.pre.init", preInitHook, "hook.post.exit", postExitHook))
 
 	// 0.2 database
-	s.tasks.Register(tasks.NewDBTask("database", s.registry))
+	s.tasks.Register(tasks.NewDBTask("database", s.config.Database, s.registry))
 
 	// 0.3 http server
 
-	s.tasks.Register(tasks.NewHttpServerTask("ctrl.rest-api", s.config.Control.BindAddr, s.registry))
+	s.tasks.Register(tasks.NewHttpServerTask("ctrl.rest-api", s.config.Control, s.registry))
 
 	// 0.4 controller registry
 	if s.config.Locator != nil {
-		s.tasks.Register(tasks.NewControllerRegistryTask("ctrl.registry", s.config.ControllerURI, s.config.BackboneIP, *s.config.Locator, s.config.Control.Uri, s.registry))
+		s.tasks.Register(tasks.NewControllerRegistryTask("ctrl.registry", s.config.ControllerURI, s.config.BackboneIP, *s.config.Locator, s.config.Control.Uri, s.config.Control.ControllerClient, s.registry))
 	}
 
+	// 0.5 expiry of rules
+	s.tasks.Register(tasks.NewTaskRulesExpiry("ctrl.rules-expiry", s.config.RulesExpiry, s.registry))
+
 	// 1.  ifaces
 	// 1.1 iface linux (type dummy)
 	s.tasks.Register(tasks.NewTaskDummyIface("iproute2.iface.linux", constants.IFACE_LINUX))
@@ -63,29 +73,36 @@ func (s *Setup) AddTasks(ctx context.Context) {
 	for i, e := range s.config.Endpoints.Filter(config.ProviderNextMN) {
 		t_name := fmt.Sprintf("nextmn.tun.golang-srv6/%s", e.Prefix)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_SRV6_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.registry))
+		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.config.Dataplane.TunQueuesOrDefault(), s.config.Dataplane.OffloadEnabled(), s.registry))
 	}
 	// 1.3 ifaces golang-gtp4-* (tun via water)
-	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMN, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMN, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn.tun.golang-gtp4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_GTP4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.registry))
+		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.config.Dataplane.TunQueuesOrDefault(), s.config.Dataplane.OffloadEnabled(), s.registry))
 	}
-	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn-ctrl.tun.golang-gtp4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_GTP4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.registry))
+		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.config.Dataplane.TunQueuesOrDefault(), s.config.Dataplane.OffloadEnabled(), s.registry))
 	}
 	// 1.4 ifaces golang-ipv4-* (tun via water)
-	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMN, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMN, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn.tun.golang-ipv4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_IPV4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.registry))
+		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.config.Dataplane.TunQueuesOrDefault(), s.config.Dataplane.OffloadEnabled(), s.registry))
 	}
-	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn-ctrl.tun.golang-ipv4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_IPV4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.registry))
+		s.tasks.Register(tasks.NewTaskTunIface(t_name, iface_name, s.config.Dataplane.TunQueuesOrDefault(), s.config.Dataplane.OffloadEnabled(), s.registry))
+	}
+
+	// 1.5 sockets nextmn-gtp4-sock-* (H.M.GTP4.D without tun)
+	for i, h := range s.config.Headends.FilterWithIngress(config.IngressUDPSocket) {
+		t_name := fmt.Sprintf("nextmn.socket.gtp4/%s", h.Name)
+		socket_name := fmt.Sprintf("%s%d", constants.SOCKET_GTP4_PREFIX, i)
+		s.tasks.Register(tasks.NewTaskGTPUSocket(t_name, socket_name, h.To, s.config.Dataplane.TunQueuesOrDefault(), s.registry))
 	}
 
 	// 2.  ip routes
@@ -95,48 +112,93 @@ func (s *Setup) AddTasks(ctx context.Context) {
 	s.tasks.Register(tasks.NewTaskBlackhole("iproute2.route.nextmn-ipv4.blackhole", constants.RT_TABLE_NEXTMN_IPV4))
 
 	// 3.  endpoints + headends
+	// 3.0 GTP-U path management (used by gtp4 headends to handle Echo Responses)
+	if s.config.GTPUPathManagement != nil {
+		var defaultSource *netip.Addr
+		if s.config.GTP4HeadendPrefix != nil && s.config.GTP4HeadendPrefix.IsSingleIP() {
+			addr := s.config.GTP4HeadendPrefix.Addr()
+			defaultSource = &addr
+		}
+		headends := make(map[string]string)
+		for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMN, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
+			headends[fmt.Sprintf("%s%d", constants.IFACE_GOLANG_GTP4_PREFIX, i)] = h.To
+		}
+		for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
+			headends[fmt.Sprintf("%s%d", constants.IFACE_GOLANG_GTP4_PREFIX, i)] = h.To
+		}
+		for i, h := range s.config.Headends.FilterWithIngress(config.IngressUDPSocket) {
+			headends[fmt.Sprintf("%s%d", constants.SOCKET_GTP4_PREFIX, i)] = h.To
+		}
+		s.tasks.Register(tasks.NewTaskGTPUPathManagement("gtpu.path-management", s.config.GTPUPathManagement, defaultSource, headends, s.registry))
+	}
 	// 3.1 linux headends
 	if s.config.LinuxHeadendSetSourceAddress != nil {
 		s.tasks.Register(tasks.NewTaskLinuxHeadendSetSourceAddress("linux.headend.set-source-address", *s.config.LinuxHeadendSetSourceAddress))
 	}
 	for _, h := range s.config.Headends.Filter(config.ProviderLinux) {
 		t_name := fmt.Sprintf("linux.headend/%s", h.Name)
+		s.dataplane.addStaticHeadend(h, "")
 		s.tasks.Register(tasks.NewTaskLinuxHeadend(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, constants.IFACE_LINUX))
 	}
 	// 3.1 linux endpoints
 	for _, e := range s.config.Endpoints.Filter(config.ProviderLinux) {
 		t_name := fmt.Sprintf("linux.endpoint/%s", e.Prefix)
+		s.dataplane.addStaticEndpoint(e, "")
 		s.tasks.Register(tasks.NewTaskLinuxEndpoint(t_name, e, constants.RT_TABLE_NEXTMN_IPV6, constants.IFACE_LINUX))
 	}
 	// 3.2 nextmn endpoints
 	for i, e := range s.config.Endpoints.Filter(config.ProviderNextMN) {
 		t_name := fmt.Sprintf("nextmn.endpoint/%s", e.Prefix)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_SRV6_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskNextMNEndpoint(t_name, e, constants.RT_TABLE_NEXTMN_IPV6, iface_name, s.registry))
+		s.dataplane.addStaticEndpoint(e, iface_name)
+		s.tasks.Register(tasks.NewTaskNextMNEndpoint(t_name, e, constants.RT_TABLE_NEXTMN_IPV6, iface_name, s.config.Dataplane, s.registry))
 	}
 	// 3.3 nextmn ipv4 headends
-	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMN, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMN, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn.headend.ipv4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_IPV4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskNextMNHeadend(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.registry))
+		s.dataplane.addStaticHeadend(h, iface_name)
+		s.tasks.Register(tasks.NewTaskNextMNHeadend(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.config.Dataplane, s.registry))
 	}
 	// 3.4 nextmn gtp4 headends
-	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMN, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMN, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn.headend.gtp4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_GTP4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskNextMNHeadend(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.registry))
+		s.dataplane.addStaticHeadend(h, iface_name)
+		s.tasks.Register(tasks.NewTaskNextMNHeadend(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.config.Dataplane, s.registry))
 	}
 	// 3.5 nextmn-ctrl ipv4 headends
-	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithoutBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn-ctrl.headend.ipv4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_IPV4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskNextMNHeadendWithCtrl(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.registry))
+		s.dataplane.addStaticHeadend(h, iface_name)
+		s.tasks.Register(tasks.NewTaskNextMNHeadendWithCtrl(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.config.Dataplane, s.registry))
 	}
 	// 3.6 nextmn-ctrl gtp4 headends
-	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D) {
+	for i, h := range s.config.Headends.FilterWithBehavior(config.ProviderNextMNWithController, config.H_M_GTP4_D).FilterWithIngress(config.IngressTun) {
 		t_name := fmt.Sprintf("nextmn-ctrl.headend.gtp4/%s", h.Name)
 		iface_name := fmt.Sprintf("%s%d", constants.IFACE_GOLANG_GTP4_PREFIX, i)
-		s.tasks.Register(tasks.NewTaskNextMNHeadendWithCtrl(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.registry))
+		s.dataplane.addStaticHeadend(h, iface_name)
+		s.tasks.Register(tasks.NewTaskNextMNHeadendWithCtrl(t_name, h, constants.RT_TABLE_NEXTMN_IPV4, iface_name, s.config.Dataplane, s.registry))
+	}
+	// 3.7 nextmn and nextmn-ctrl gtp4 headends (udp socket)
+	for i, h := range s.config.Headends.FilterWithIngress(config.IngressUDPSocket) {
+		t_name := fmt.Sprintf("nextmn.headend.gtp4-socket/%s", h.Name)
+		socket_name := fmt.Sprintf("%s%d", constants.SOCKET_GTP4_PREFIX, i)
+		s.dataplane.addStaticHeadend(h, socket_name)
+		s.tasks.Register(tasks.NewTaskNextMNHeadendSocket(t_name, h, socket_name, s.config.Dataplane, s.registry))
+	}
+	// 3.8 ebpf endpoints
+	for _, e := range s.config.Endpoints.Filter(config.ProviderEBPF) {
+		t_name := fmt.Sprintf("ebpf.endpoint/%s", e.Prefix)
+		s.dataplane.addStaticEndpoint(e, "")
+		s.tasks.Register(tasks.NewTaskEBPFEndpoint(t_name, e))
+	}
+	// 3.9 ebpf headends
+	for _, h := range s.config.Headends.Filter(config.ProviderEBPF) {
+		t_name := fmt.Sprintf("ebpf.headend/%s", h.Name)
+		s.dataplane.addStaticHeadend(h, "")
+		s.tasks.Register(tasks.NewTaskEBPFHeadend(t_name, h, s.registry))
 	}
 
 	// 4.  ip rules
@@ -6,5 +6,5 @@
 package config
 
 type BehaviorOptions struct {
-	SourceAddress *string `yaml:"set-source-address,omitempty"` // mandatory for End.M.GTP6.(E|D)
+	SourceAddress *string `yaml:"set-source-address,omitempty" json:"set-source-address,omitempty"` // mandatory for End.M.GTP6.(E|D)
 }
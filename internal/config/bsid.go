@@ -12,8 +12,8 @@ import (
 )
 
 type Bsid struct {
-	BsidPrefix   *string  `yaml:"bsid-prefix,omitempty"`
-	SegmentsList []string `yaml:"segments-list"`
+	BsidPrefix   *string  `yaml:"bsid-prefix,omitempty" json:"bsid-prefix,omitempty"`
+	SegmentsList []string `yaml:"segments-list" json:"segments-list"`
 }
 
 func (a *Bsid) ToIPRoute2() string {
@@ -38,6 +38,10 @@ type SRv6Config struct {
 	Control       Control            `yaml:"control"`
 	ControllerURI jsonapi.ControlURI `yaml:"controller-uri"` // example: http://192.0.2.2:8080
 
+	// rules received from the controller
+	Database    *Database    `yaml:"database,omitempty"`
+	RulesExpiry *RulesExpiry `yaml:"rules-expiry,omitempty"` // rules with a lifetime or an inactivity timeout
+
 	// Backbone IPv6 address
 	BackboneIP n4tosrv6.BackboneIP `yaml:"backbone-ip"`
 
@@ -47,8 +51,15 @@ type SRv6Config struct {
 	IPV4HeadendPrefix            *netip.Prefix `yaml:"ipv4-headend-prefix,omitempty"` // example of prefix: 10.0.0.1/32 (if you use a single IPV4 headend) or 10.0.1.0/24 (with more headends)
 	Headends                     Headends      `yaml:"headends"`
 
+	// GTP-U path management (Echo Requests sent to gNBs)
+	GTPUPathManagement *GTPUPathManagement `yaml:"gtpu-path-management,omitempty"`
+
 	// endpoints
 	Locator   *n4tosrv6.Locator `yaml:"locator,omitempty"` // example of locator: fd00:51D5:0000:1::/64
 	Endpoints Endpoints         `yaml:"endpoints"`
-	Logger    *Logger           `yaml:"logger,omitempty"`
+
+	// worker pools of NextMN endpoints and headends
+	Dataplane *Dataplane `yaml:"dataplane,omitempty"`
+
+	Logger *Logger `yaml:"logger,omitempty"`
 }
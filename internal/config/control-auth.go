@@ -0,0 +1,79 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Authentication of clients of the control API.
+// A client is authenticated with a bearer token, or with a TLS client certificate.
+type ControlAuth struct {
+	Tokens             []AuthToken       `yaml:"tokens,omitempty"`
+	ClientCertificates []AuthCertificate `yaml:"client-certificates,omitempty"` // requires `control.tls.client-ca`
+}
+
+// Static bearer token
+type AuthToken struct {
+	File string   `yaml:"file"` // file containing the token
+	Role AuthRole `yaml:"role"` // default: read-only
+}
+
+// TLS client certificate, verified with `control.tls.client-ca`
+type AuthCertificate struct {
+	CommonName string   `yaml:"common-name"` // common name of the subject
+	Role       AuthRole `yaml:"role"`        // default: read-only
+}
+
+// Role of an authenticated client
+type AuthRole uint32
+
+const (
+	AuthRoleReadOnly  AuthRole = iota // GET and HEAD requests only
+	AuthRoleReadWrite                 // all requests
+)
+
+func (r AuthRole) String() string {
+	switch r {
+	case AuthRoleReadOnly:
+		return "read-only"
+	case AuthRoleReadWrite:
+		return "read-write"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to AuthRole
+func (r *AuthRole) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "read-only":
+		*r = AuthRoleReadOnly
+	case "read-write":
+		*r = AuthRoleReadWrite
+	default:
+		return fmt.Errorf("Unknown role")
+	}
+	return nil
+}
+
+// TLS on the control API; files are reloaded when they change
+type ControlTLS struct {
+	Cert     string  `yaml:"cert"`                // certificate of the server (PEM)
+	Key      string  `yaml:"key"`                 // private key of the server (PEM)
+	ClientCA *string `yaml:"client-ca,omitempty"` // CAs used to verify client certificates (PEM)
+}
+
+// Credentials and TLS of requests to `controller-uri`; files are reloaded when they change
+type ControllerClient struct {
+	TokenFile *string `yaml:"token-file,omitempty"` // file containing a bearer token
+	CA        *string `yaml:"ca,omitempty"`         // CAs used to verify the controller (PEM); default: system CAs
+	Cert      *string `yaml:"cert,omitempty"`       // client certificate (PEM)
+	Key       *string `yaml:"key,omitempty"`        // private key of the client certificate (PEM)
+}
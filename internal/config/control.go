@@ -12,6 +12,11 @@ import (
 )
 
 type Control struct {
-	Uri      jsonapi.ControlURI `yaml:"uri"`       // may contain domain name instead of ip address
-	BindAddr netip.AddrPort     `yaml:"bind-addr"` // in the form `ip:port`
+	Uri          jsonapi.ControlURI `yaml:"uri"`                     // may contain domain name instead of ip address
+	BindAddr     netip.AddrPort     `yaml:"bind-addr"`               // in the form `ip:port`
+	RulesOverlap RulesOverlap       `yaml:"rules-overlap,omitempty"` // default: warn
+
+	TLS              *ControlTLS       `yaml:"tls,omitempty"`               // default: plain http
+	Auth             *ControlAuth      `yaml:"auth,omitempty"`              // default: no authentication
+	ControllerClient *ControllerClient `yaml:"controller-client,omitempty"` // default: no credentials
 }
@@ -0,0 +1,79 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// Monitoring of the connection to the postgres backend
+type HealthCheck struct {
+	Interval      *time.Duration `yaml:"interval,omitempty"`       // delay between two checks
+	Timeout       *time.Duration `yaml:"timeout,omitempty"`        // timeout of a check
+	FailurePolicy FailurePolicy  `yaml:"failure-policy,omitempty"` // fail-closed (default) or fail-open
+}
+
+func (h *HealthCheck) IntervalOrDefault() time.Duration {
+	if h == nil || h.Interval == nil {
+		return DefaultHealthCheckInterval
+	}
+	return *h.Interval
+}
+
+func (h *HealthCheck) TimeoutOrDefault() time.Duration {
+	if h == nil || h.Timeout == nil {
+		return DefaultHealthCheckTimeout
+	}
+	return *h.Timeout
+}
+
+func (h *HealthCheck) FailurePolicyOrDefault() FailurePolicy {
+	if h == nil {
+		return FailClosed
+	}
+	return h.FailurePolicy
+}
+
+// Lookups of the dataplane while the database is unreachable
+type FailurePolicy uint32
+
+const (
+	FailClosed FailurePolicy = iota // lookups fail: packets are dropped
+	FailOpen                        // lookups are served from the last known rules
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailClosed:
+		return "fail-closed"
+	case FailOpen:
+		return "fail-open"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to FailurePolicy
+func (p *FailurePolicy) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "fail-closed", "":
+		*p = FailClosed
+	case "fail-open":
+		*p = FailOpen
+	default:
+		return fmt.Errorf("Unknown failure policy")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule store of the controller mode
+type Database struct {
+	Backend   DatabaseBackend `yaml:"backend"`              // default: postgres
+	Path      *string         `yaml:"path,omitempty"`       // file of the bolt backend
+	CacheSize *int            `yaml:"cache-size,omitempty"` // lookup cache of the postgres backend, 0 to disable
+
+	// Connection to the postgres backend; POSTGRES_* environment variables take precedence
+	Host         *string      `yaml:"host,omitempty"`
+	Port         *uint16      `yaml:"port,omitempty"`          // default: 5432
+	User         *string      `yaml:"user,omitempty"`          // default: postgres
+	DBName       *string      `yaml:"dbname,omitempty"`        // default: user
+	PasswordFile *string      `yaml:"password-file,omitempty"` // not required with a unix socket
+	UnixSocket   *string      `yaml:"unix-socket,omitempty"`   // directory of the unix socket, used instead of host and port
+	SSLMode      *PostgresSSL `yaml:"sslmode,omitempty"`       // default: disable
+	SSLRootCert  *string      `yaml:"sslrootcert,omitempty"`   // CA certificate of the server
+	SSLCert      *string      `yaml:"sslcert,omitempty"`       // client certificate
+	SSLKey       *string      `yaml:"sslkey,omitempty"`        // key of the client certificate
+
+	// Pool of connections to the postgres backend
+	MaxOpenConns     *int           `yaml:"max-open-conns,omitempty"`    // default: unlimited
+	MaxIdleConns     *int           `yaml:"max-idle-conns,omitempty"`    // default: 2
+	ConnMaxLifetime  *time.Duration `yaml:"conn-max-lifetime,omitempty"` // default: unlimited
+	StatementTimeout *time.Duration `yaml:"statement-timeout,omitempty"` // default: no timeout
+
+	HealthCheck *HealthCheck `yaml:"health-check,omitempty"` // postgres backend only
+}
+
+// Default file of the bolt backend
+const DefaultDatabasePath = "/var/lib/nextmn-srv6/rules.db"
+
+// Default number of entries of the lookup cache
+const DefaultDatabaseCacheSize = 65536
+
+func (d *Database) BackendOrDefault() DatabaseBackend {
+	if d == nil {
+		return DatabasePostgres
+	}
+	return d.Backend
+}
+
+func (d *Database) PathOrDefault() string {
+	if d == nil || d.Path == nil {
+		return DefaultDatabasePath
+	}
+	return *d.Path
+}
+
+func (d *Database) CacheSizeOrDefault() int {
+	if d == nil || d.CacheSize == nil {
+		return DefaultDatabaseCacheSize
+	}
+	return *d.CacheSize
+}
+
+func (d *Database) SSLModeOrDefault() PostgresSSL {
+	if d == nil || d.SSLMode == nil {
+		return PostgresSSLDisable
+	}
+	return *d.SSLMode
+}
+
+type DatabaseBackend uint32
+
+const (
+	DatabasePostgres DatabaseBackend = iota // configured with POSTGRES_* environment variables
+	DatabaseMemory                          // rules are lost on exit
+	DatabaseBolt                            // embedded database, stored in a file
+)
+
+func (db DatabaseBackend) String() string {
+	switch db {
+	case DatabasePostgres:
+		return "postgres"
+	case DatabaseMemory:
+		return "memory"
+	case DatabaseBolt:
+		return "bolt"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to DatabaseBackend
+func (db *DatabaseBackend) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "postgres", "postgresql":
+		*db = DatabasePostgres
+	case "memory", "in-memory":
+		*db = DatabaseMemory
+	case "bolt", "bbolt", "embedded":
+		*db = DatabaseBolt
+	default:
+		return fmt.Errorf("Unknown database backend")
+	}
+	return nil
+}
+
+// TLS mode of the connection to the postgres database
+type PostgresSSL uint32
+
+const (
+	PostgresSSLDisable    PostgresSSL = iota // no TLS
+	PostgresSSLRequire                       // TLS, without verification of the server certificate
+	PostgresSSLVerifyCA                      // TLS, the server certificate is signed by the CA
+	PostgresSSLVerifyFull                    // TLS, the server certificate is signed by the CA and matches the host
+)
+
+func (s PostgresSSL) String() string {
+	switch s {
+	case PostgresSSLDisable:
+		return "disable"
+	case PostgresSSLRequire:
+		return "require"
+	case PostgresSSLVerifyCA:
+		return "verify-ca"
+	case PostgresSSLVerifyFull:
+		return "verify-full"
+	default:
+		return "Unknown"
+	}
+}
+
+// Parse a TLS mode, as in libpq
+func ParsePostgresSSL(s string) (PostgresSSL, error) {
+	switch strings.ToLower(s) {
+	case "disable":
+		return PostgresSSLDisable, nil
+	case "require":
+		return PostgresSSLRequire, nil
+	case "verify-ca":
+		return PostgresSSLVerifyCA, nil
+	case "verify-full":
+		return PostgresSSLVerifyFull, nil
+	default:
+		return PostgresSSLDisable, fmt.Errorf("Unknown sslmode %s", s)
+	}
+}
+
+// Unmarshal YAML to PostgresSSL
+func (s *PostgresSSL) UnmarshalYAML(n *yaml.Node) error {
+	mode, err := ParsePostgresSSL(n.Value)
+	if err != nil {
+		return err
+	}
+	*s = mode
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import "runtime"
+
+const DefaultQueueSize = 1024
+
+// Packet processing options of NextMN endpoints and headends (one worker pool per TUN interface)
+type Dataplane struct {
+	Workers   *int `yaml:"workers,omitempty"`    // default: number of CPUs
+	QueueSize *int `yaml:"queue-size,omitempty"` // packets waiting for each worker
+	TunQueues *int `yaml:"tun-queues,omitempty"` // queues of each TUN interface, default: number of CPUs
+	Offload   bool `yaml:"offload,omitempty"`    // use virtio-net headers to read TSO/USO super-packets, and write USO super-packets
+}
+
+func (d *Dataplane) WorkersOrDefault() int {
+	if d == nil || d.Workers == nil || *d.Workers < 1 {
+		return runtime.NumCPU()
+	}
+	return *d.Workers
+}
+
+func (d *Dataplane) QueueSizeOrDefault() int {
+	if d == nil || d.QueueSize == nil || *d.QueueSize < 1 {
+		return DefaultQueueSize
+	}
+	return *d.QueueSize
+}
+
+func (d *Dataplane) TunQueuesOrDefault() int {
+	if d == nil || d.TunQueues == nil || *d.TunQueues < 1 {
+		return runtime.NumCPU()
+	}
+	return *d.TunQueues
+}
+
+func (d *Dataplane) OffloadEnabled() bool {
+	return d != nil && d.Offload
+}
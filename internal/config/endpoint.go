@@ -12,6 +12,7 @@ type Endpoint struct {
 	Prefix   string                `yaml:"prefix"`   // Prefix = LOC+FUNC example of prefix: fd00:51D5:0000:1:1:11/80
 	Behavior iana.EndpointBehavior `yaml:"behavior"` // example of behavior: End.DX4
 	Options  *BehaviorOptions      `yaml:"options,omitempty"`
+	Iface    *string               `yaml:"interface,omitempty"` // interface where the program is attached (eBPF provider)
 }
 type Endpoints []*Endpoint
 
@@ -0,0 +1,92 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultGTPUEchoInterval = 60 * time.Second
+	DefaultGTPUEchoTimeout  = 3 * time.Second // T3-RESPONSE
+	DefaultGTPUEchoRetries  = 3               // N3-REQUESTS
+)
+
+type GTPUPathManagement struct {
+	Interval       *time.Duration    `yaml:"interval,omitempty"`         // delay between two Echo Requests to the same peer
+	Timeout        *time.Duration    `yaml:"timeout,omitempty"`          // T3-RESPONSE
+	Retries        *int              `yaml:"retries,omitempty"`          // N3-REQUESTS
+	OnFailure      PathFailureAction `yaml:"on-failure,omitempty"`       // none, disable-rules, or switch-rules
+	LearnFromRules bool              `yaml:"learn-from-rules,omitempty"` // probe gNBs of uplink rules
+	Peers          []GTPUPeer        `yaml:"peers,omitempty"`
+}
+
+type GTPUPeer struct {
+	Address netip.Addr  `yaml:"address"`
+	Source  *netip.Addr `yaml:"source,omitempty"` // address of a GTP4 headend, mandatory if gtp4-headend-prefix is not a single address
+}
+
+func (p *GTPUPathManagement) IntervalOrDefault() time.Duration {
+	if p.Interval == nil {
+		return DefaultGTPUEchoInterval
+	}
+	return *p.Interval
+}
+
+func (p *GTPUPathManagement) TimeoutOrDefault() time.Duration {
+	if p.Timeout == nil {
+		return DefaultGTPUEchoTimeout
+	}
+	return *p.Timeout
+}
+
+func (p *GTPUPathManagement) RetriesOrDefault() int {
+	if p.Retries == nil {
+		return DefaultGTPUEchoRetries
+	}
+	return *p.Retries
+}
+
+type PathFailureAction int
+
+const (
+	PathFailureNone         PathFailureAction = iota // only report the failure
+	PathFailureDisableRules                          // disable rules using this peer, and enable them again on recovery
+	PathFailureSwitchRules                           // switch to a disabled backup rule not using this peer (or disable if there is no backup)
+)
+
+func (a PathFailureAction) String() string {
+	switch a {
+	case PathFailureNone:
+		return "none"
+	case PathFailureDisableRules:
+		return "disable-rules"
+	case PathFailureSwitchRules:
+		return "switch-rules"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to PathFailureAction
+func (a *PathFailureAction) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "none", "":
+		*a = PathFailureNone
+	case "disable-rules":
+		*a = PathFailureDisableRules
+	case "switch-rules":
+		*a = PathFailureSwitchRules
+	default:
+		return fmt.Errorf("Unknown path failure action")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How packets are received by a headend of the NextMN providers
+type HeadendIngress uint32
+
+const (
+	IngressTun       HeadendIngress = iota // IPv4 packets routed to a TUN interface
+	IngressUDPSocket                       // GTP-U payloads received on a UDP socket (H.M.GTP4.D only)
+)
+
+func (hi HeadendIngress) String() string {
+	switch hi {
+	case IngressTun:
+		return "tun"
+	case IngressUDPSocket:
+		return "udp-socket"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to HeadendIngress
+func (hi *HeadendIngress) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "tun":
+		*hi = IngressTun
+	case "udp-socket", "udp", "socket":
+		*hi = IngressUDPSocket
+	default:
+		return fmt.Errorf("Unknown headend ingress")
+	}
+	return nil
+}
@@ -12,7 +12,9 @@ type Headend struct {
 	Behavior            HeadendBehavior `yaml:"behavior"`
 	Policy              *[]Policy       `yaml:"policy,omitempty"`
 	SourceAddressPrefix *string         `yaml:"source-address-prefix"`
-	MTU                 *string         `yaml:"mtu,omitempty"` // suggested value is 1400 (same as UERANSIM) if the path includes a End.M.GTP4.E
+	MTU                 *string         `yaml:"mtu,omitempty"`       // suggested value is 1400 (same as UERANSIM) if the path includes a End.M.GTP4.E
+	Iface               *string         `yaml:"interface,omitempty"` // interface where the program is attached (eBPF provider)
+	Ingress             HeadendIngress  `yaml:"ingress,omitempty"`   // NextMN providers only, default is tun
 }
 
 type Headends []*Headend
@@ -46,3 +48,13 @@ func (he Headends) FilterWithoutBehavior(provider Provider, behavior HeadendBeha
 	}
 	return newList
 }
+
+func (he Headends) FilterWithIngress(ingress HeadendIngress) Headends {
+	newList := make([]*Headend, 0)
+	for _, e := range he {
+		if e.Ingress == ingress {
+			newList = append(newList, e)
+		}
+	}
+	return newList
+}
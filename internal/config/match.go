@@ -6,6 +6,6 @@
 package config
 
 type Match struct {
-	Teid                     *uint32 `yaml:"teid,omitempty"`
-	InnerHeaderIPv4SrcPrefix *string `yaml:"inner-header-ipv4-src-prefix,omitempty"` // e.g. 192.168.0.1/32, Teid must be present
+	Teid                     *uint32 `yaml:"teid,omitempty" json:"teid,omitempty"`
+	InnerHeaderIPv4SrcPrefix *string `yaml:"inner-header-ipv4-src-prefix,omitempty" json:"inner-header-ipv4-src-prefix,omitempty"` // e.g. 192.168.0.1/32, Teid must be present
 }
@@ -6,6 +6,6 @@
 package config
 
 type Policy struct {
-	Match *Match `yaml:"match,omitempty"`
-	Bsid  Bsid   `yaml:"bsid"`
+	Match *Match `yaml:"match,omitempty" json:"match,omitempty"`
+	Bsid  Bsid   `yaml:"bsid" json:"bsid"`
 }
@@ -18,6 +18,7 @@ const (
 	ProviderLinux Provider = iota
 	ProviderNextMN
 	ProviderNextMNWithController
+	ProviderEBPF
 )
 
 func (p Provider) String() string {
@@ -28,6 +29,8 @@ func (p Provider) String() string {
 		return "NextMN"
 	case ProviderNextMNWithController:
 		return "NextMN (via controller)"
+	case ProviderEBPF:
+		return "eBPF"
 	default:
 		return "Unknown provider"
 	}
@@ -42,6 +45,8 @@ func (p *Provider) UnmarshalYAML(n *yaml.Node) error {
 		*p = ProviderNextMN
 	case "nextmn-ctrl", "nextmnwithcontroller", "nextmn-with-controller", "nextmn-via-controller":
 		*p = ProviderNextMNWithController
+	case "ebpf":
+		*p = ProviderEBPF
 	default:
 		return fmt.Errorf("Unknown provider")
 	}
@@ -0,0 +1,73 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultRulesExpiryInterval = 10 * time.Second
+
+// Expiry of rules with a lifetime or an inactivity timeout
+type RulesExpiry struct {
+	Interval *time.Duration `yaml:"interval,omitempty"` // delay between two checks of rules
+	Action   ExpiryAction   `yaml:"action,omitempty"`   // delete (default) or disable
+	Notify   bool           `yaml:"notify,omitempty"`   // notify the controller of expired rules
+}
+
+func (e *RulesExpiry) IntervalOrDefault() time.Duration {
+	if e == nil || e.Interval == nil {
+		return DefaultRulesExpiryInterval
+	}
+	return *e.Interval
+}
+
+func (e *RulesExpiry) ActionOrDefault() ExpiryAction {
+	if e == nil {
+		return ExpiryActionDelete
+	}
+	return e.Action
+}
+
+func (e *RulesExpiry) NotifyEnabled() bool {
+	return e != nil && e.Notify
+}
+
+// What to do with expired rules
+type ExpiryAction uint32
+
+const (
+	ExpiryActionDelete  ExpiryAction = iota // expired rules are deleted
+	ExpiryActionDisable                     // expired rules are disabled, and can be enabled again by the controller
+)
+
+func (a ExpiryAction) String() string {
+	switch a {
+	case ExpiryActionDelete:
+		return "delete"
+	case ExpiryActionDisable:
+		return "disable"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to ExpiryAction
+func (a *ExpiryAction) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "delete", "":
+		*a = ExpiryActionDelete
+	case "disable":
+		*a = ExpiryActionDisable
+	default:
+		return fmt.Errorf("Unknown expiry action")
+	}
+	return nil
+}
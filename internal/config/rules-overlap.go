@@ -0,0 +1,46 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// What to do when a rule posted or enabled with the REST API has the same match
+// and the same priority as an enabled rule
+type RulesOverlap uint32
+
+const (
+	RulesOverlapWarn   RulesOverlap = iota // rule is accepted, and a warning is logged
+	RulesOverlapReject                     // rule is rejected with 409 Conflict
+)
+
+func (ro RulesOverlap) String() string {
+	switch ro {
+	case RulesOverlapWarn:
+		return "warn"
+	case RulesOverlapReject:
+		return "reject"
+	default:
+		return "Unknown"
+	}
+}
+
+// Unmarshal YAML to RulesOverlap
+func (ro *RulesOverlap) UnmarshalYAML(n *yaml.Node) error {
+	switch strings.ToLower(n.Value) {
+	case "warn":
+		*ro = RulesOverlapWarn
+	case "reject":
+		*ro = RulesOverlapReject
+	default:
+		return fmt.Errorf("Unknown rules overlap policy")
+	}
+	return nil
+}
@@ -11,8 +11,15 @@ const GTPU_PORT_INT = 2152
 
 const GTPU_MESSAGE_TYPE_ECHO_REQUEST = 1
 const GTPU_MESSAGE_TYPE_ECHO_RESPONSE = 2
+const GTPU_MESSAGE_TYPE_ERROR_INDICATION = 26
+const GTPU_MESSAGE_TYPE_END_MARKER = 254
 const GTPU_MESSAGE_TYPE_GPDU = 255
 
+// GTP-U Information Elements (TS 129.281 section 8)
+const GTPU_IE_RECOVERY = 14
+const GTPU_IE_TEID_DATA_I = 16
+const GTPU_IE_GTPU_PEER_ADDRESS = 133
+
 // iproute2 rt protos
 const RT_PROTO_NEXTMN = "nextmn"
 
@@ -27,3 +34,9 @@ const IFACE_LINUX = "nextmn-linux"
 const IFACE_GOLANG_SRV6_PREFIX = "nextmn-srv6-"
 const IFACE_GOLANG_IPV4_PREFIX = "nextmn-ipv4-" // ipv4 excluding gtp4
 const IFACE_GOLANG_GTP4_PREFIX = "nextmn-gtp4-"
+
+// UDP sockets (H.M.GTP4.D without TUN interface)
+const SOCKET_GTP4_PREFIX = "nextmn-gtp4-sock-"
+
+// HTTP client (requests to the controller)
+const USER_AGENT = "go-github-nextmn-srv6"
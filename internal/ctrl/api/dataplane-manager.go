@@ -0,0 +1,51 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl_api
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/nextmn/srv6/internal/config"
+)
+
+// Returned when no endpoint or headend matches
+var ErrNotFound = errors.New("Not found")
+
+// Returned when an endpoint with the same prefix, or a headend with the same name, exists
+var ErrAlreadyExists = errors.New("Already exists")
+
+// Returned when an endpoint or a headend is invalid, or its provider is not supported at runtime
+var ErrInvalid = errors.New("Invalid endpoint or headend")
+
+// Returned when deleting an endpoint or a headend of the configuration file
+var ErrStatic = errors.New("Defined in the configuration file")
+
+// Endpoint and the tun interface used by its network function
+type ManagedEndpoint struct {
+	Endpoint  *config.Endpoint
+	Interface string // empty for the Linux and eBPF providers
+	Static    bool   // from the configuration file
+}
+
+// Headend and the interface (or socket) used by its network function
+type ManagedHeadend struct {
+	Headend   *config.Headend
+	Interface string // empty for the Linux and eBPF providers
+	Static    bool   // from the configuration file
+}
+
+// DataplaneManager adds and deletes endpoints and headends at runtime
+type DataplaneManager interface {
+	Endpoints() []ManagedEndpoint
+	Endpoint(prefix netip.Prefix) (ManagedEndpoint, error)
+	AddEndpoint(e *config.Endpoint) (ManagedEndpoint, error)
+	DeleteEndpoint(prefix netip.Prefix) error
+	Headends() []ManagedHeadend
+	Headend(name string) (ManagedHeadend, error)
+	AddHeadend(h *config.Headend) (ManagedHeadend, error)
+	DeleteHeadend(name string) error
+}
@@ -0,0 +1,21 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl_api
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+type DataplaneRegistryHTTP interface {
+	GetEndpoints(c *gin.Context)
+	GetEndpoint(c *gin.Context)
+	PostEndpoint(c *gin.Context)
+	DeleteEndpoint(c *gin.Context)
+	GetHeadends(c *gin.Context)
+	GetHeadend(c *gin.Context)
+	PostHeadend(c *gin.Context)
+	DeleteHeadend(c *gin.Context)
+}
@@ -18,4 +18,9 @@ type RulesRegistryHTTP interface {
 	SwitchRule(c *gin.Context)
 	PostRule(c *gin.Context)
 	UpdateAction(c *gin.Context)
+	BatchRules(c *gin.Context)
+	ResetCounters(c *gin.Context)
+	SetPathDown(c *gin.Context)
+	SetPathUp(c *gin.Context)
+	GetOverlaps(c *gin.Context)
 }
@@ -0,0 +1,131 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/nextmn/srv6/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/sirupsen/logrus"
+)
+
+type token struct {
+	value []byte
+	role  config.AuthRole
+}
+
+// Authenticator checks credentials of clients of the control API
+type Authenticator struct {
+	tokens       []token
+	certificates map[string]config.AuthRole // by common name
+}
+
+// Content of a file, without the final newline
+func readToken(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Could not read token file %s: %w", file, err)
+	}
+	t := strings.TrimRight(string(b), "\r\n")
+	if t == "" {
+		return "", fmt.Errorf("Token file %s is empty", file)
+	}
+	return t, nil
+}
+
+// Create a new Authenticator, reading tokens from their files
+func NewAuthenticator(conf *config.ControlAuth) (*Authenticator, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("Missing authentication configuration")
+	}
+	if len(conf.Tokens) == 0 && len(conf.ClientCertificates) == 0 {
+		return nil, fmt.Errorf("Authentication is enabled, but no token or client certificate is allowed")
+	}
+	a := &Authenticator{
+		tokens:       make([]token, 0, len(conf.Tokens)),
+		certificates: make(map[string]config.AuthRole, len(conf.ClientCertificates)),
+	}
+	for _, t := range conf.Tokens {
+		value, err := readToken(t.File)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = append(a.tokens, token{value: []byte(value), role: t.Role})
+	}
+	for _, c := range conf.ClientCertificates {
+		if c.CommonName == "" {
+			return nil, fmt.Errorf("Missing common name of client certificate")
+		}
+		if _, ok := a.certificates[c.CommonName]; ok {
+			return nil, fmt.Errorf("Client certificate %s is listed twice", c.CommonName)
+		}
+		a.certificates[c.CommonName] = c.Role
+	}
+	return a, nil
+}
+
+// Role of the client, from its bearer token or its verified client certificate
+func (a *Authenticator) authenticate(r *http.Request) (config.AuthRole, string, bool) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, value, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return 0, "", false
+		}
+		v := []byte(strings.TrimSpace(value))
+		found := false
+		var role config.AuthRole
+		// compare with all tokens, in constant time
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(v, t.value) == 1 && !found {
+				found = true
+				role = t.role
+			}
+		}
+		return role, "token", found
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		role, ok := a.certificates[cn]
+		return role, "certificate " + cn, ok
+	}
+	return 0, "", false
+}
+
+func allowed(role config.AuthRole, method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return role == config.AuthRoleReadWrite
+	}
+}
+
+// Middleware answering 401 Unauthorized to unauthenticated clients,
+// and 403 Forbidden to read-only clients attempting to modify the router
+func (a *Authenticator) Authorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, client, ok := a.authenticate(c.Request)
+		if !ok {
+			logrus.WithFields(logrus.Fields{"remote": c.ClientIP(), "method": c.Request.Method, "path": c.Request.URL.Path}).Warning("Unauthenticated request to the control API")
+			c.Header("WWW-Authenticate", `Bearer realm="srv6"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, jsonapi.MessageWithError{Message: "authentication required", Error: fmt.Errorf("missing or invalid credentials")})
+			return
+		}
+		if !allowed(role, c.Request.Method) {
+			logrus.WithFields(logrus.Fields{"remote": c.ClientIP(), "client": client, "method": c.Request.Method, "path": c.Request.URL.Path}).Warning("Forbidden request to the control API")
+			c.AbortWithStatusJSON(http.StatusForbidden, jsonapi.MessageWithError{Message: "forbidden", Error: fmt.Errorf("role %s does not allow %s requests", role, c.Request.Method)})
+			return
+		}
+		c.Next()
+	}
+}
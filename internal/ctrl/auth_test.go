@@ -0,0 +1,95 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nextmn/srv6/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func writeToken(t *testing.T, value string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte(value+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth, err := NewAuthenticator(&config.ControlAuth{
+		Tokens: []config.AuthToken{
+			{File: writeToken(t, "reader"), Role: config.AuthRoleReadOnly},
+			{File: writeToken(t, "writer"), Role: config.AuthRoleReadWrite},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(auth.Authorize())
+	r.GET("/rules", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/rules", func(c *gin.Context) { c.Status(http.StatusCreated) })
+
+	for _, tt := range []struct {
+		name          string
+		method        string
+		authorization string
+		status        int
+	}{
+		{"no credentials", http.MethodGet, "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "Bearer other", http.StatusUnauthorized},
+		{"token prefix", http.MethodGet, "Bearer read", http.StatusUnauthorized},
+		{"other scheme", http.MethodGet, "Basic cmVhZGVyOg==", http.StatusUnauthorized},
+		{"read-only GET", http.MethodGet, "Bearer reader", http.StatusOK},
+		{"read-only POST", http.MethodPost, "Bearer reader", http.StatusForbidden},
+		{"read-write GET", http.MethodGet, "Bearer writer", http.StatusOK},
+		{"read-write POST", http.MethodPost, "bearer writer", http.StatusCreated},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/rules", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		conf *config.ControlAuth
+	}{
+		{"missing configuration", nil},
+		{"no credentials", &config.ControlAuth{}},
+		{"missing token file", &config.ControlAuth{Tokens: []config.AuthToken{{File: filepath.Join(t.TempDir(), "missing")}}}},
+		{"empty token file", &config.ControlAuth{Tokens: []config.AuthToken{{File: writeToken(t, "")}}}},
+		{"missing common name", &config.ControlAuth{ClientCertificates: []config.AuthCertificate{{}}}},
+		{"common name listed twice", &config.ControlAuth{ClientCertificates: []config.AuthCertificate{{CommonName: "ctrl"}, {CommonName: "ctrl"}}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAuthenticator(tt.conf); err == nil {
+				t.Error("invalid configuration accepted")
+			}
+		})
+	}
+}
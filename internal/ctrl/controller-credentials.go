@@ -0,0 +1,59 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+)
+
+// Credentials sent with requests to the controller
+type ControllerCredentials struct {
+	token     string
+	transport http.RoundTripper // nil when default TLS settings are used
+}
+
+// Load credentials from their files
+func NewControllerCredentials(conf *config.ControllerClient) (*ControllerCredentials, error) {
+	c := &ControllerCredentials{}
+	if conf == nil {
+		return c, nil
+	}
+	if conf.TokenFile != nil {
+		t, err := readToken(*conf.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = t
+	}
+	if conf.Cert != nil || conf.Key != nil || conf.CA != nil {
+		tlsConf, err := clientTLSConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConf
+		c.transport = transport
+	}
+	return c, nil
+}
+
+// Http client using the credentials; a timeout of 0 means no timeout
+func (c *ControllerCredentials) Client(timeout time.Duration) http.Client {
+	if c == nil {
+		return http.Client{Timeout: timeout}
+	}
+	return http.Client{Transport: c.transport, Timeout: timeout}
+}
+
+// Add the bearer token to the request
+func (c *ControllerCredentials) Authorize(req *http.Request) {
+	if c != nil && c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
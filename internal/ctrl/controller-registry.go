@@ -16,4 +16,5 @@ type ControllerRegistry struct {
 	Locator          n4tosrv6.Locator
 	Backbone         n4tosrv6.BackboneIP
 	Resource         string
+	Credentials      *ControllerCredentials // sent with requests to the controller
 }
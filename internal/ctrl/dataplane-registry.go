@@ -0,0 +1,251 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/nextmn/srv6/internal/config"
+	ctrl_api "github.com/nextmn/srv6/internal/ctrl/api"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// DataplaneRegistry exposes endpoints and headends with the REST API
+type DataplaneRegistry struct {
+	manager ctrl_api.DataplaneManager
+}
+
+func NewDataplaneRegistry(manager ctrl_api.DataplaneManager) *DataplaneRegistry {
+	return &DataplaneRegistry{
+		manager: manager,
+	}
+}
+
+// Names of providers, as in the configuration file
+func providerName(p config.Provider) string {
+	switch p {
+	case config.ProviderLinux:
+		return "linux"
+	case config.ProviderNextMN:
+		return "nextmn"
+	case config.ProviderNextMNWithController:
+		return "nextmn-ctrl"
+	case config.ProviderEBPF:
+		return "ebpf"
+	default:
+		return "unknown"
+	}
+}
+
+type endpointJSON struct {
+	Provider  string                  `json:"provider"`
+	Prefix    string                  `json:"prefix"`
+	Behavior  string                  `json:"behavior"`
+	Options   *config.BehaviorOptions `json:"options,omitempty"`
+	Interface string                  `json:"interface,omitempty"`
+	Static    bool                    `json:"static"` // from the configuration file
+}
+
+func newEndpointJSON(e ctrl_api.ManagedEndpoint) endpointJSON {
+	return endpointJSON{
+		Provider:  providerName(e.Endpoint.Provider),
+		Prefix:    e.Endpoint.Prefix,
+		Behavior:  e.Endpoint.Behavior.String(),
+		Options:   e.Endpoint.Options,
+		Interface: e.Interface,
+		Static:    e.Static,
+	}
+}
+
+type headendJSON struct {
+	Name                string           `json:"name"`
+	To                  string           `json:"to"`
+	Provider            string           `json:"provider"`
+	Behavior            string           `json:"behavior"`
+	Policy              *[]config.Policy `json:"policy,omitempty"`
+	SourceAddressPrefix *string          `json:"source-address-prefix,omitempty"`
+	MTU                 *string          `json:"mtu,omitempty"`
+	Ingress             string           `json:"ingress"`
+	Interface           string           `json:"interface,omitempty"`
+	Static              bool             `json:"static"` // from the configuration file
+}
+
+func newHeadendJSON(h ctrl_api.ManagedHeadend) headendJSON {
+	return headendJSON{
+		Name:                h.Headend.Name,
+		To:                  h.Headend.To,
+		Provider:            providerName(h.Headend.Provider),
+		Behavior:            h.Headend.Behavior.String(),
+		Policy:              h.Headend.Policy,
+		SourceAddressPrefix: h.Headend.SourceAddressPrefix,
+		MTU:                 h.Headend.MTU,
+		Ingress:             h.Headend.Ingress.String(),
+		Interface:           h.Interface,
+		Static:              h.Static,
+	}
+}
+
+// Decode the body with the syntax of the configuration file (JSON is valid YAML).
+// Returns false if the request has been answered.
+func bindConfig(c *gin.Context, v any) bool {
+	b, err := io.ReadAll(c.Request.Body)
+	if err == nil {
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		err = d.Decode(v)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return false
+	}
+	return true
+}
+
+// Answer the request with an error of the DataplaneManager:
+// 404 for unknown endpoints and headends, 409 for duplicates and static ones,
+// 422 for invalid ones, and 500 otherwise
+func managerError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, ctrl_api.ErrNotFound):
+		c.JSON(http.StatusNotFound, jsonapi.MessageWithError{Message: "not found", Error: err})
+	case errors.Is(err, ctrl_api.ErrAlreadyExists):
+		c.JSON(http.StatusConflict, jsonapi.MessageWithError{Message: "already exists", Error: err})
+	case errors.Is(err, ctrl_api.ErrStatic):
+		c.JSON(http.StatusConflict, jsonapi.MessageWithError{Message: "defined in the configuration file", Error: err})
+	case errors.Is(err, ctrl_api.ErrInvalid):
+		c.JSON(http.StatusUnprocessableEntity, jsonapi.MessageWithError{Message: "invalid endpoint or headend", Error: err})
+	default:
+		logrus.WithError(err).Error(strings.ToUpper(message[:1]) + message[1:])
+		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: message, Error: err})
+	}
+}
+
+// Prefix of the endpoint, returns false if the request has been answered
+func endpointPrefix(c *gin.Context) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(c.Param("prefix"))
+	if err != nil {
+		logrus.WithError(err).Error("Bad prefix")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "bad prefix", Error: err})
+		return prefix, false
+	}
+	return prefix, true
+}
+
+// List endpoints
+func (dr *DataplaneRegistry) GetEndpoints(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	endpoints := dr.manager.Endpoints()
+	res := make([]endpointJSON, 0, len(endpoints))
+	for _, e := range endpoints {
+		res = append(res, newEndpointJSON(e))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// Get an endpoint
+func (dr *DataplaneRegistry) GetEndpoint(c *gin.Context) {
+	prefix, ok := endpointPrefix(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	e, err := dr.manager.Endpoint(prefix)
+	if err != nil {
+		managerError(c, err, "could not get endpoint")
+		return
+	}
+	c.JSON(http.StatusOK, newEndpointJSON(e))
+}
+
+// Add an endpoint
+func (dr *DataplaneRegistry) PostEndpoint(c *gin.Context) {
+	var endpoint config.Endpoint
+	if !bindConfig(c, &endpoint) {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	e, err := dr.manager.AddEndpoint(&endpoint)
+	if err != nil {
+		managerError(c, err, "could not add endpoint")
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/endpoints/%s", url.PathEscape(e.Endpoint.Prefix)))
+	c.JSON(http.StatusCreated, newEndpointJSON(e))
+}
+
+// Delete an endpoint
+func (dr *DataplaneRegistry) DeleteEndpoint(c *gin.Context) {
+	prefix, ok := endpointPrefix(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	if err := dr.manager.DeleteEndpoint(prefix); err != nil {
+		managerError(c, err, "could not delete endpoint")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// List headends
+func (dr *DataplaneRegistry) GetHeadends(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	headends := dr.manager.Headends()
+	res := make([]headendJSON, 0, len(headends))
+	for _, h := range headends {
+		res = append(res, newHeadendJSON(h))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// Get a headend
+func (dr *DataplaneRegistry) GetHeadend(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	h, err := dr.manager.Headend(c.Param("name"))
+	if err != nil {
+		managerError(c, err, "could not get headend")
+		return
+	}
+	c.JSON(http.StatusOK, newHeadendJSON(h))
+}
+
+// Add a headend
+func (dr *DataplaneRegistry) PostHeadend(c *gin.Context) {
+	var headend config.Headend
+	if !bindConfig(c, &headend) {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	h, err := dr.manager.AddHeadend(&headend)
+	if err != nil {
+		managerError(c, err, "could not add headend")
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/headends/%s", url.PathEscape(h.Headend.Name)))
+	c.JSON(http.StatusCreated, newHeadendJSON(h))
+}
+
+// Delete a headend
+func (dr *DataplaneRegistry) DeleteHeadend(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	if err := dr.manager.DeleteHeadend(c.Param("name")); err != nil {
+		managerError(c, err, "could not delete headend")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,339 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// OpenAPI 3 document of the control API, served at /openapi.json
+//
+//go:embed openapi.json
+var openapiJSON []byte
+
+// Subset of the OpenAPI document used to validate requests
+type openAPI struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"` // path or query
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+// Subset of JSON Schema used by the document
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Enum                 []any              `json:"enum"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"` // false, or a schema
+	Items                *schema            `json:"items"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+}
+
+var openapi = func() *openAPI {
+	var o openAPI
+	if err := json.Unmarshal(openapiJSON, &o); err != nil {
+		panic(fmt.Sprintf("Malformed OpenAPI document: %s", err))
+	}
+	return &o
+}()
+
+// Serve the OpenAPI document
+func OpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openapiJSON)
+}
+
+var ginParam = regexp.MustCompile(`:([^/]+)`)
+
+// Operation of the document for this route of gin (e.g. /rules/:uuid)
+func (o *openAPI) operation(method string, route string) (*operation, bool) {
+	op, ok := o.Paths[ginParam.ReplaceAllString(route, "{$1}")][strings.ToLower(method)]
+	return op, ok
+}
+
+// Warn about routes missing from the document
+func CheckRoutes(routes gin.RoutesInfo) {
+	for _, r := range routes {
+		if _, ok := openapi.operation(r.Method, r.Path); !ok {
+			logrus.WithFields(logrus.Fields{"method": r.Method, "path": r.Path}).Warning("Route is missing from the OpenAPI document")
+		}
+	}
+}
+
+// Middleware rejecting requests not matching the OpenAPI document with 400 Bad Request
+func ValidateRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := openapi.validateRequest(c); err != nil {
+			logrus.WithError(err).Info("Request does not match the API specification")
+			c.AbortWithStatusJSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "request does not match the API specification", Error: err})
+			return
+		}
+		c.Next()
+	}
+}
+
+func (o *openAPI) validateRequest(c *gin.Context) error {
+	op, ok := o.operation(c.Request.Method, c.FullPath())
+	if !ok {
+		// unknown routes are answered by gin
+		return nil
+	}
+	for _, p := range op.Parameters {
+		var value string
+		var present bool
+		switch p.In {
+		case "path":
+			value = c.Param(p.Name)
+			present = value != ""
+		case "query":
+			value, present = c.GetQuery(p.Name)
+		default:
+			continue
+		}
+		if !present {
+			if p.Required {
+				return fmt.Errorf("Missing %s parameter %s", p.In, p.Name)
+			}
+			continue
+		}
+		if err := o.validateParameter(p.Schema, value, p.Name); err != nil {
+			return err
+		}
+	}
+	if op.RequestBody == nil {
+		return nil
+	}
+	content, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	b, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return fmt.Errorf("Could not read body: %s", err)
+	}
+	// the body is read again by the handler
+	c.Request.Body = io.NopCloser(bytes.NewReader(b))
+	if len(bytes.TrimSpace(b)) == 0 {
+		if op.RequestBody.Required {
+			return fmt.Errorf("Missing body")
+		}
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return fmt.Errorf("Malformed JSON body: %s", err)
+	}
+	return o.validate(content.Schema, v, "body")
+}
+
+// Parameters are strings, converted according to their schema
+func (o *openAPI) validateParameter(s *schema, value string, name string) error {
+	s = o.resolve(s)
+	if s == nil {
+		return nil
+	}
+	var v any = value
+	switch s.Type {
+	case "integer", "number":
+		v = json.Number(value)
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", name, value)
+		}
+		v = b
+	}
+	return o.validate(s, v, name)
+}
+
+// Follow $ref to components of the document
+func (o *openAPI) resolve(s *schema) *schema {
+	for s != nil && s.Ref != "" {
+		s = o.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// Validate the decoded JSON value v; path locates v in errors
+func (o *openAPI) validate(s *schema, v any, path string) error {
+	s = o.resolve(s)
+	if s == nil {
+		return nil
+	}
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, v) {
+		return fmt.Errorf("%s: %v is not one of %v", path, v, s.Enum)
+	}
+	switch s.Type {
+	case "object":
+		m, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: an object is expected", path)
+		}
+		return o.validateObject(s, m, path)
+	case "array":
+		a, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: an array is expected", path)
+		}
+		if s.MinItems != nil && len(a) < *s.MinItems {
+			return fmt.Errorf("%s: at least %d items are expected", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(a) > *s.MaxItems {
+			return fmt.Errorf("%s: at most %d items are expected", path, *s.MaxItems)
+		}
+		for i, item := range a {
+			if err := o.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: a string is expected", path)
+		}
+		return validateFormat(s.Format, str, path)
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: a number is expected", path)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", path, n)
+		}
+		if s.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return fmt.Errorf("%s: %s is not an integer", path, n)
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: %s is lower than %v", path, n, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: %s is greater than %v", path, n, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: a boolean is expected", path)
+		}
+	}
+	return nil
+}
+
+// Names of properties are matched case-insensitively, as with encoding/json
+func (o *openAPI) validateObject(s *schema, m map[string]any, path string) error {
+	property := func(key string) (string, bool) {
+		if _, ok := s.Properties[key]; ok {
+			return key, true
+		}
+		for name := range s.Properties {
+			if strings.EqualFold(name, key) {
+				return name, true
+			}
+		}
+		return "", false
+	}
+	var additional *schema
+	allowed := true
+	if len(s.AdditionalProperties) > 0 {
+		if string(s.AdditionalProperties) == "false" {
+			allowed = false
+		} else if err := json.Unmarshal(s.AdditionalProperties, &additional); err != nil {
+			return fmt.Errorf("%s: malformed schema: %s", path, err)
+		}
+	}
+	found := make(map[string]struct{}, len(m))
+	for key, value := range m {
+		name, ok := property(key)
+		if !ok {
+			if !allowed {
+				return fmt.Errorf("%s: unknown property %q", path, key)
+			}
+			if err := o.validate(additional, value, path+"."+key); err != nil {
+				return err
+			}
+			continue
+		}
+		found[name] = struct{}{}
+		if value == nil {
+			// null is decoded as the zero value
+			continue
+		}
+		if err := o.validate(s.Properties[name], value, path+"."+name); err != nil {
+			return err
+		}
+	}
+	for _, name := range s.Required {
+		if _, ok := found[name]; !ok {
+			return fmt.Errorf("%s: missing property %q", path, name)
+		}
+	}
+	return nil
+}
+
+func validateFormat(format string, s string, path string) error {
+	switch format {
+	case "uuid":
+		if _, err := uuid.FromString(s); err != nil {
+			return fmt.Errorf("%s: %q is not a UUID", path, s)
+		}
+	case "ip", "ipv4", "ipv6":
+		addr, err := netip.ParseAddr(s)
+		if err != nil || (format == "ipv4" && !addr.Is4()) || (format == "ipv6" && !addr.Is6()) {
+			return fmt.Errorf("%s: %q is not an %s address", path, s, strings.Replace(format, "ip", "IP", 1))
+		}
+	case "ip-prefix":
+		if _, err := netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("%s: %q is not an IP prefix", path, s)
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return fmt.Errorf("%s: %q is not a RFC 3339 date-time", path, s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidateRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(ValidateRequests())
+	// the body must still be readable by handlers
+	ok := func(c *gin.Context) {
+		if _, err := io.ReadAll(c.Request.Body); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+	r.POST("/rules", ok)
+	r.DELETE("/rules/:uuid", ok)
+	r.PATCH("/rules/:uuid/paths/:index/down", ok)
+	r.PATCH("/rules/:uuid/update-action", ok)
+	r.GET("/unknown", ok)
+
+	rule, err := json.Marshal(apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "2b7a3f4e-6f1c-4a8e-9d5b-3c2e1f0a9b8c"
+	for _, tt := range []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"valid rule", http.MethodPost, "/rules", string(rule), http.StatusOK},
+		{"case-insensitive properties", http.MethodPost, "/rules", `{"TYPE": "downlink", "Action": {"srh": ["fc00:1::1"]}}`, http.StatusOK},
+		{"missing body", http.MethodPost, "/rules", "", http.StatusBadRequest},
+		{"malformed body", http.MethodPost, "/rules", `{"type":`, http.StatusBadRequest},
+		{"unknown property", http.MethodPost, "/rules", `{"type": "uplink", "action": {"srh": ["fc00:1::1"]}, "other": 1}`, http.StatusBadRequest},
+		{"missing property", http.MethodPost, "/rules", `{"type": "uplink"}`, http.StatusBadRequest},
+		{"wrong type", http.MethodPost, "/rules", `{"type": "uplink", "enabled": "yes", "action": {"srh": ["fc00:1::1"]}}`, http.StatusBadRequest},
+		{"not in enum", http.MethodPost, "/rules", `{"type": "sideways", "action": {"srh": ["fc00:1::1"]}}`, http.StatusBadRequest},
+		{"not an integer", http.MethodPost, "/rules", `{"type": "uplink", "priority": 1.5, "action": {"srh": ["fc00:1::1"]}}`, http.StatusBadRequest},
+		{"valid UUID", http.MethodDelete, "/rules/" + id, "", http.StatusOK},
+		{"bad UUID", http.MethodDelete, "/rules/not-a-uuid", "", http.StatusBadRequest},
+		{"valid index", http.MethodPatch, "/rules/" + id + "/paths/0/down", "", http.StatusOK},
+		{"negative index", http.MethodPatch, "/rules/" + id + "/paths/-1/down", "", http.StatusBadRequest},
+		{"index not a number", http.MethodPatch, "/rules/" + id + "/paths/first/down", "", http.StatusBadRequest},
+		{"action with paths", http.MethodPatch, "/rules/" + id + "/update-action", `{"srh": ["fc00:1::1"], "paths": [{"srh": ["fc00:2::1"], "weight": 2}]}`, http.StatusOK},
+		{"path without SRH", http.MethodPatch, "/rules/" + id + "/update-action", `{"srh": ["fc00:1::1"], "paths": [{"weight": 2}]}`, http.StatusBadRequest},
+		{"route not in document", http.MethodGet, "/unknown", "", http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"slices"
+	"strings"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+)
+
+// Two enabled rules matching the same packets with the same priority:
+// the rule used is only decided by their UUID
+type Overlap struct {
+	Type  string       `json:"type"`
+	Rules [2]uuid.UUID `json:"rules"`
+}
+
+// Returns true if r1 and r2 are matching the same packets with the same precedence
+func ambiguous(r1, r2 database_api.Rule) bool {
+	if r1.Type != r2.Type || r1.Priority != r2.Priority {
+		return false
+	}
+	ue1, ok1 := r1.UE()
+	ue2, ok2 := r2.UE()
+	if ok1 != ok2 || ue1 != ue2 {
+		return false
+	}
+	if r1.Type != "uplink" {
+		return true
+	}
+	s1, ok1 := r1.Service()
+	s2, ok2 := r2.Service()
+	if ok1 != ok2 || s1 != s2 {
+		return false
+	}
+	h1, h2 := r1.Match.Header, r2.Match.Header
+	if h1 == nil || h2 == nil || h1.FTeid != h2.FTeid {
+		return false
+	}
+	// same gNB prefix: otherwise the longest prefix is used
+	for _, p1 := range h1.OuterIpSrc {
+		for _, p2 := range h2.OuterIpSrc {
+			if p1.Masked() == p2.Masked() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Enabled rules that would be ambiguous with r, except the rule ignored
+func overlapsWith(rules database_api.RuleMap, r database_api.Rule, ignored ...uuid.UUID) []uuid.UUID {
+	ret := make([]uuid.UUID, 0)
+	for id, other := range rules {
+		if !other.Enabled || slices.Contains(ignored, id) {
+			continue
+		}
+		if ambiguous(r, other) {
+			ret = append(ret, id)
+		}
+	}
+	slices.SortFunc(ret, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+	return ret
+}
+
+// Ambiguous pairs of enabled rules
+func Overlaps(rules database_api.RuleMap) []Overlap {
+	ids := make([]uuid.UUID, 0, len(rules))
+	for id, r := range rules {
+		if r.Enabled {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+	overlaps := make([]Overlap, 0)
+	for i, id1 := range ids {
+		for _, id2 := range ids[i+1:] {
+			if ambiguous(rules[id1], rules[id2]) {
+				overlaps = append(overlaps, Overlap{Type: rules[id1].Type, Rules: [2]uuid.UUID{id1, id2}})
+			}
+		}
+	}
+	return overlaps
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/database"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+)
+
+func TestAmbiguous(t *testing.T) {
+	rule := apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t)
+	for _, tt := range []struct {
+		name  string
+		other database_api.Rule
+		want  bool
+	}{
+		{"same match", apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t), true},
+		{"same masked gNB prefix", apitest.Uplink{GNB: "10.0.1.1/24"}.Rule(t), true},
+		{"other priority", apitest.Uplink{GNB: "10.0.1.0/24", Priority: 1}.Rule(t), false},
+		{"other TEID", apitest.Uplink{GNB: "10.0.1.0/24", TEID: 2}.Rule(t), false},
+		{"longer gNB prefix", apitest.Uplink{GNB: "10.0.1.1/32"}.Rule(t), false},
+		{"UE prefix", apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.0/16"}.Rule(t), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ambiguous(rule, tt.other); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if got := ambiguous(tt.other, rule); got != tt.want {
+				t.Errorf("not symmetric: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlapsWith(t *testing.T) {
+	r1, r2, r3 := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	disabled := apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t)
+	disabled.Enabled = false
+	rules := database_api.RuleMap{
+		r1: apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+		r2: disabled,
+		r3: apitest.Uplink{GNB: "10.0.1.0/24", TEID: 2}.Rule(t),
+	}
+	rule := apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t)
+	if o := overlapsWith(rules, rule); len(o) != 1 || o[0] != r1 {
+		t.Errorf("got overlaps %v, want [%s]", o, r1)
+	}
+	if o := overlapsWith(rules, rule, r1); len(o) != 0 {
+		t.Errorf("got overlaps %v with ignored rule, want none", o)
+	}
+	if o := Overlaps(rules); len(o) != 0 {
+		t.Errorf("got overlaps %v, want none", o)
+	}
+}
+
+// Memory store with slow reads, so rules read by concurrent requests are outdated by their writes
+type slowStore struct {
+	*database.Memory
+}
+
+func (s slowStore) GetRules(ctx context.Context) (database_api.RuleMap, error) {
+	rules, err := s.Memory.GetRules(ctx)
+	time.Sleep(10 * time.Millisecond)
+	return rules, err
+}
+
+// Concurrent requests cannot both pass the overlap check
+func TestPostRuleOverlapsConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rr := NewRulesRegistry(slowStore{database.NewMemory()}, config.RulesOverlapReject, nil)
+	r := gin.New()
+	r.POST("/rules", rr.PostRule)
+	body, err := json.Marshal(apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 8
+	statuses := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/rules", bytes.NewReader(body)))
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("got %d rules created, want 1", created)
+	}
+}
+
+func TestBatchOverlaps(t *testing.T) {
+	r1, r2, r3 := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	disabled := apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t)
+	disabled.Enabled = false
+	create := func(teid uint32) database_api.BatchOperation {
+		r := apitest.Uplink{GNB: "10.0.1.0/24", TEID: teid}.Rule(t)
+		return database_api.BatchOperation{Op: database_api.BatchCreate, Rule: &r}
+	}
+	op := func(o database_api.BatchOp, id uuid.UUID) database_api.BatchOperation {
+		return database_api.BatchOperation{Op: o, Uuid: &id}
+	}
+	for _, tt := range []struct {
+		name     string
+		ops      []database_api.BatchOperation
+		want     int       // index of the operation, or -1
+		overlaps uuid.UUID // rule overlapped, when want is not -1
+	}{
+		{"create ambiguous", []database_api.BatchOperation{create(2), create(1)}, 1, r1},
+		{"create unambiguous", []database_api.BatchOperation{create(3)}, -1, uuid.Nil},
+		{"enable ambiguous", []database_api.BatchOperation{op(database_api.BatchEnable, r2)}, 0, r1},
+		{"enable enabled rule", []database_api.BatchOperation{op(database_api.BatchEnable, r1)}, -1, uuid.Nil},
+		{"enable unknown rule", []database_api.BatchOperation{op(database_api.BatchEnable, uuid.Must(uuid.NewV4()))}, -1, uuid.Nil},
+		{"disable then create", []database_api.BatchOperation{op(database_api.BatchDisable, r1), create(1)}, -1, uuid.Nil},
+		{"create then disable", []database_api.BatchOperation{create(1), op(database_api.BatchDisable, r1)}, -1, uuid.Nil},
+		{"delete then enable", []database_api.BatchOperation{op(database_api.BatchDelete, r1), op(database_api.BatchEnable, r2)}, -1, uuid.Nil},
+		{"enable then disable", []database_api.BatchOperation{op(database_api.BatchEnable, r2), op(database_api.BatchDisable, r2)}, -1, uuid.Nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// operations are simulated on the map
+			rules := database_api.RuleMap{
+				r1: apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+				r2: disabled,
+				r3: apitest.Uplink{GNB: "10.0.1.0/24", TEID: 2, Priority: 1}.Rule(t),
+			}
+			got, overlaps := batchOverlaps(rules, tt.ops)
+			if got != tt.want {
+				t.Fatalf("got operation %d, want %d", got, tt.want)
+			}
+			if tt.want >= 0 && (len(overlaps) != 1 || overlaps[0] != tt.overlaps) {
+				t.Errorf("got overlaps %v, want [%s]", overlaps, tt.overlaps)
+			}
+		})
+	}
+}
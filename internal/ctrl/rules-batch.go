@@ -0,0 +1,188 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Response to a batch of operations on rules
+type BatchResponse struct {
+	Message string                     `json:"message,omitempty"`
+	Error   string                     `json:"error,omitempty"`
+	Results []database_api.BatchResult `json:"results"`
+	Created []uuid.UUID                `json:"created"` // UUIDs of created rules, in the order of operations
+}
+
+// Operation of the batch that would enable a rule ambiguous with other enabled rules, or -1.
+// Operations are simulated on rules; operations referencing unknown rules are left to the database.
+func batchOverlaps(rules database_api.RuleMap, ops []database_api.BatchOperation) (int, []uuid.UUID) {
+	enabledBy := make(map[uuid.UUID]int) // rules enabled by the batch, and the operation enabling them
+	for i, op := range ops {
+		var id uuid.UUID
+		if op.Op == database_api.BatchCreate {
+			if op.Rule == nil {
+				continue
+			}
+			// placeholder until the rule is created
+			id = uuid.Must(uuid.NewV4())
+			rules[id] = op.Rule.Normalized()
+			if op.Rule.Enabled {
+				enabledBy[id] = i
+			}
+			continue
+		}
+		if op.Uuid == nil {
+			continue
+		}
+		id = *op.Uuid
+		r, ok := rules[id]
+		if !ok {
+			continue
+		}
+		switch op.Op {
+		case database_api.BatchEnable:
+			if !r.Enabled {
+				enabledBy[id] = i
+			}
+			r.Enabled = true
+		case database_api.BatchDisable:
+			r.Enabled = false
+			delete(enabledBy, id)
+		case database_api.BatchDelete:
+			delete(rules, id)
+			delete(enabledBy, id)
+			continue
+		}
+		rules[id] = r
+	}
+	first := -1
+	var overlaps []uuid.UUID
+	for id, i := range enabledBy {
+		if !rules[id].Enabled {
+			continue
+		}
+		if o := overlapsWith(rules, rules[id], id); len(o) > 0 && (first == -1 || i < first) {
+			first = i
+			overlaps = o
+		}
+	}
+	return first, overlaps
+}
+
+// Events of the operations of a batch
+var batchEvents = map[database_api.BatchOp]events_api.EventType{
+	database_api.BatchCreate:  events_api.RuleCreated,
+	database_api.BatchUpdate:  events_api.RuleUpdated,
+	database_api.BatchEnable:  events_api.RuleEnabled,
+	database_api.BatchDisable: events_api.RuleDisabled,
+	database_api.BatchDelete:  events_api.RuleDeleted,
+}
+
+// Apply a list of operations on rules, all-or-nothing
+func (rr *RulesRegistry) BatchRules(c *gin.Context) {
+	var ops []database_api.BatchOperation
+	if err := c.BindJSON(&ops); err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, BatchResponse{Message: "could not deserialize", Error: err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	if len(ops) == 0 {
+		c.JSON(http.StatusBadRequest, BatchResponse{Message: "empty batch", Results: []database_api.BatchResult{}, Created: []uuid.UUID{}})
+		return
+	}
+	rr.writes.Lock()
+	defer rr.writes.Unlock()
+	rules, err := rr.db.GetRules(c)
+	if err != nil {
+		logrus.WithError(err).Error("Could not get all rules from database")
+		c.JSON(http.StatusInternalServerError, BatchResponse{Message: "could not get all rules from database", Error: err.Error()})
+		return
+	}
+	if i, overlaps := batchOverlaps(rules, ops); i >= 0 {
+		logrus.WithFields(logrus.Fields{"operation": i, "overlaps": overlaps, "policy": rr.overlap}).Warning("Rule enabled by batch has the same match and priority as enabled rules")
+		if rr.overlap == config.RulesOverlapReject {
+			err := &database_api.BatchError{Index: i, Err: fmt.Errorf("ambiguous with rules %v", overlaps)}
+			c.JSON(http.StatusConflict, BatchResponse{
+				Message: "rule has the same match and priority as enabled rules",
+				Error:   err.Error(),
+				Results: database_api.NewBatchResults(ops, nil, err),
+				Created: []uuid.UUID{},
+			})
+			return
+		}
+	}
+	ids, err := rr.db.ApplyBatch(c, ops)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var be *database_api.BatchError
+		switch {
+		case errors.Is(err, database_api.ErrRuleNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, database_api.ErrInvalidRule):
+			status = http.StatusUnprocessableEntity
+		case errors.As(err, &be) && be.Invalid:
+			status = http.StatusBadRequest
+		}
+		logrus.WithError(err).Error("Could not apply batch in the database")
+		c.JSON(status, BatchResponse{
+			Message: "batch not applied",
+			Error:   err.Error(),
+			Results: database_api.NewBatchResults(ops, nil, err),
+			Created: []uuid.UUID{},
+		})
+		return
+	}
+	created := make([]uuid.UUID, 0)
+	for i, op := range ops {
+		if op.Op == database_api.BatchCreate {
+			created = append(created, ids[i])
+		}
+		rr.publish(c, batchEvents[op.Op], ids[i])
+	}
+	c.JSON(http.StatusOK, BatchResponse{
+		Results: database_api.NewBatchResults(ops, ids, nil),
+		Created: created,
+	})
+}
+
+// Changes of rules made by tasks, serialized with the writes of the API
+func (rr *RulesRegistry) UpdateRules(ctx context.Context, update func(rules database_api.RuleMap, apply database_api.ApplyFunc)) error {
+	rr.writes.Lock()
+	defer rr.writes.Unlock()
+	rules, err := rr.db.GetRules(ctx)
+	if err != nil {
+		return err
+	}
+	update(rules, func(ops ...database_api.BatchOperation) error {
+		// rules changed by previous operations
+		current, err := rr.db.GetRules(ctx)
+		if err != nil {
+			return err
+		}
+		if i, overlaps := batchOverlaps(current, ops); i >= 0 {
+			logrus.WithFields(logrus.Fields{"operation": i, "overlaps": overlaps, "policy": rr.overlap}).Warning("Rule enabled by a task has the same match and priority as enabled rules")
+			if rr.overlap == config.RulesOverlapReject {
+				return &database_api.BatchError{Index: i, Err: fmt.Errorf("%w: ambiguous with rules %v", database_api.ErrRulesOverlap, overlaps)}
+			}
+		}
+		_, err = rr.db.ApplyBatch(ctx, ops)
+		return err
+	})
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/constants"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Sent to the controller when a rule expires
+type ExpiredRule struct {
+	Uuid    uuid.UUID                 `json:"uuid"`
+	Reason  database_api.ExpiryReason `json:"reason"`
+	Action  string                    `json:"action"` // "deleted" or "disabled"
+	Locator n4tosrv6.Locator          `json:"locator"`
+}
+
+// RulesExpiry disables or deletes rules reaching their lifetime or their inactivity timeout
+type RulesExpiry struct {
+	interval   time.Duration
+	action     config.ExpiryAction
+	rules      database_api.RuleStore
+	controller *ControllerRegistry // nil when notifications are disabled
+	httpClient http.Client
+	events     events_api.Publisher
+}
+
+func NewRulesExpiry(conf *config.RulesExpiry, rules database_api.RuleStore, controller *ControllerRegistry, events events_api.Publisher) (*RulesExpiry, error) {
+	if rules == nil {
+		return nil, fmt.Errorf("Expiry of rules requires a database")
+	}
+	if conf.IntervalOrDefault() <= 0 {
+		return nil, fmt.Errorf("Interval must be positive")
+	}
+	if conf.NotifyEnabled() && controller == nil {
+		return nil, fmt.Errorf("Notification of expired rules requires a controller (locator is not set)")
+	}
+	if !conf.NotifyEnabled() {
+		controller = nil
+	}
+	var credentials *ControllerCredentials
+	if controller != nil {
+		credentials = controller.Credentials
+	}
+	return &RulesExpiry{
+		interval:   conf.IntervalOrDefault(),
+		action:     conf.ActionOrDefault(),
+		rules:      rules,
+		controller: controller,
+		httpClient: credentials.Client(conf.IntervalOrDefault()),
+		events:     events,
+	}, nil
+}
+
+// Run until ctx is done
+func (e *RulesExpiry) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.expire(ctx, now)
+		}
+	}
+}
+
+// Disable or delete rules expired at this time
+func (e *RulesExpiry) expire(ctx context.Context, now time.Time) {
+	rules, err := e.rules.GetRules(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Could not get rules to check their expiry")
+		return
+	}
+	for id, r := range rules {
+		reason, expired := r.Expired(now)
+		if !expired {
+			continue
+		}
+		var action string
+		switch e.action {
+		case config.ExpiryActionDisable:
+			if !r.Enabled {
+				// already disabled
+				continue
+			}
+			err = e.rules.DisableRule(ctx, id)
+			action = "disabled"
+		default:
+			err = e.rules.DeleteRule(ctx, id)
+			action = "deleted"
+		}
+		if errors.Is(err, database_api.ErrRuleNotFound) {
+			// deleted meanwhile
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{"rule": id, "reason": reason}).Error("Could not expire rule")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"rule": id, "reason": reason, "action": action}).Info("Rule expired")
+		if e.events != nil {
+			e.events.Publish(events_api.RuleExpired, events_api.RuleEvent{Uuid: id, Reason: reason, Action: action, Source: "expiry"})
+		}
+		if e.controller != nil {
+			e.notify(ctx, ExpiredRule{Uuid: id, Reason: reason, Action: action, Locator: e.controller.Locator})
+		}
+	}
+}
+
+// Notify the controller of an expired rule
+func (e *RulesExpiry) notify(ctx context.Context, expired ExpiredRule) {
+	reqBody, err := json.Marshal(expired)
+	if err != nil {
+		logrus.WithError(err).Error("Could not notify controller of expired rule")
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.controller.RemoteControlURI.JoinPath("expired-rules").String(), bytes.NewBuffer(reqBody))
+	if err != nil {
+		logrus.WithError(err).Error("Could not notify controller of expired rule")
+		return
+	}
+	req.Header.Add("User-Agent", constants.USER_AGENT)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	e.controller.Credentials.Authorize(req)
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"rule": expired.Uuid}).Error("Could not notify controller of expired rule")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		logrus.WithFields(logrus.Fields{"rule": expired.Uuid, "status": resp.StatusCode}).Error("Controller refused notification of expired rule")
+	}
+}
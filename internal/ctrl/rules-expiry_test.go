@@ -0,0 +1,143 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/database"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/gofrs/uuid"
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+// Actions on expired rules published as events
+type expiryEvents struct {
+	mu      sync.Mutex
+	actions map[uuid.UUID]string
+}
+
+func (e *expiryEvents) Publish(t events_api.EventType, data any) {
+	if t != events_api.RuleExpired {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ev := data.(events_api.RuleEvent)
+	e.actions[ev.Uuid] = ev.Action
+}
+
+func TestRulesExpiry(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name   string
+		action config.ExpiryAction
+		notify bool
+		want   []string // action on each rule: "deleted", "disabled", or empty
+	}{
+		{"delete", config.ExpiryActionDelete, false, []string{"deleted", "deleted", "deleted", ""}},
+		{"disable", config.ExpiryActionDisable, false, []string{"disabled", "", "disabled", ""}},
+		{"notify", config.ExpiryActionDelete, true, []string{"deleted", "deleted", "deleted", ""}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := []database_api.Rule{
+				apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),                 // lifetime reached
+				apitest.Uplink{GNB: "10.0.2.0/24", Disabled: true}.Rule(t), // lifetime reached, disabled
+				apitest.Uplink{GNB: "10.0.3.0/24"}.Rule(t),                 // inactive
+				apitest.Uplink{GNB: "10.0.4.0/24"}.Rule(t),                 // not expired
+			}
+			rules[0].ExpiresAt = &now
+			rules[1].ExpiresAt = &now
+			rules[2].InactivityTimeout = 60
+			later := now.Add(2 * time.Hour)
+			rules[3].ExpiresAt = &later
+			store := database.NewMemory()
+			ids := make([]uuid.UUID, len(rules))
+			for i, r := range rules {
+				id, err := store.InsertRule(context.Background(), r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[i] = *id
+			}
+
+			var mu sync.Mutex
+			notified := make(map[uuid.UUID]string)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var expired ExpiredRule
+				if r.URL.Path != "/expired-rules" || json.NewDecoder(r.Body).Decode(&expired) != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				mu.Lock()
+				notified[expired.Uuid] = expired.Action
+				mu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+			uri, err := jsonapi.ParseControlURI(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			controller := &ControllerRegistry{
+				RemoteControlURI: *uri,
+				Locator:          n4tosrv6.Locator{Prefix: netip.MustParsePrefix("fc00:1::/48")},
+			}
+			events := &expiryEvents{actions: make(map[uuid.UUID]string)}
+			e, err := NewRulesExpiry(&config.RulesExpiry{Action: tt.action, Notify: tt.notify}, store, controller, events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.expire(context.Background(), now.Add(time.Hour))
+
+			want := make(map[uuid.UUID]string)
+			for i, id := range ids {
+				r, err := store.GetRule(context.Background(), id)
+				switch tt.want[i] {
+				case "deleted":
+					if err == nil {
+						t.Errorf("rule %d not deleted", i)
+					}
+				case "disabled":
+					if err != nil || r.Enabled {
+						t.Errorf("rule %d not disabled (error: %v)", i, err)
+					}
+				default:
+					if err != nil || r.Enabled != rules[i].Enabled {
+						t.Errorf("rule %d changed (error: %v)", i, err)
+					}
+				}
+				if tt.want[i] != "" {
+					want[ids[i]] = tt.want[i]
+				}
+			}
+			if !maps.Equal(events.actions, want) {
+				t.Errorf("got events %v, want %v", events.actions, want)
+			}
+			if !tt.notify {
+				want = map[uuid.UUID]string{}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !maps.Equal(notified, want) {
+				t.Errorf("got notifications %v, want %v", notified, want)
+			}
+		})
+	}
+}
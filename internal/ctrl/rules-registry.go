@@ -6,13 +6,18 @@
 package ctrl
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/nextmn/srv6/internal/database"
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	events_api "github.com/nextmn/srv6/internal/events/api"
 
 	"github.com/nextmn/json-api/jsonapi"
-	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gofrs/uuid"
@@ -21,13 +26,95 @@ import (
 
 // A RulesRegistry contains rules for an headend
 type RulesRegistry struct {
-	db *database.Database
+	db      database_api.RuleStore
+	overlap config.RulesOverlap
+	events  events_api.Publisher // changes of rules
+
+	// held from the overlap check to the write it allows,
+	// so concurrent requests cannot enable ambiguous rules
+	writes sync.Mutex
 }
 
-func NewRulesRegistry(db *database.Database) *RulesRegistry {
+func NewRulesRegistry(db database_api.RuleStore, overlap config.RulesOverlap, events events_api.Publisher) *RulesRegistry {
 	return &RulesRegistry{
-		db: db,
+		db:      db,
+		overlap: overlap,
+		events:  events,
+	}
+}
+
+// Publish a change of a rule made through the API.
+// Created and updated rules are included in the event.
+func (rr *RulesRegistry) publish(c *gin.Context, t events_api.EventType, id uuid.UUID) {
+	if rr.events == nil {
+		return
+	}
+	ev := events_api.RuleEvent{Uuid: id, Source: "api"}
+	if t == events_api.RuleCreated || t == events_api.RuleUpdated {
+		if r, err := rr.db.GetRule(c, id); err == nil {
+			ev.Rule = &r
+		}
+	}
+	rr.events.Publish(t, ev)
+}
+
+// Check the rule r, once enabled, is not ambiguous with enabled rules (except ignored ones).
+// Returns false if the request has been answered.
+func (rr *RulesRegistry) checkOverlaps(c *gin.Context, r database_api.Rule, ignored ...uuid.UUID) bool {
+	rules, err := rr.db.GetRules(c)
+	if err != nil {
+		logrus.WithError(err).Error("Could not get all rules from database")
+		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not get all rules from database", Error: err})
+		return false
+	}
+	overlaps := overlapsWith(rules, r, ignored...)
+	if len(overlaps) == 0 {
+		return true
+	}
+	logrus.WithFields(logrus.Fields{"overlaps": overlaps, "policy": rr.overlap}).Warning("Rule has the same match and priority as enabled rules")
+	if rr.overlap == config.RulesOverlapReject {
+		c.JSON(http.StatusConflict, jsonapi.MessageWithError{Message: "rule has the same match and priority as enabled rules", Error: fmt.Errorf("ambiguous with rules %v", overlaps)})
+		return false
+	}
+	return true
+}
+
+// Answer the request with an error of the RuleStore:
+// 404 for unknown rules and paths, 422 for invalid rules, and 500 otherwise
+func storeError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, database_api.ErrRuleNotFound):
+		c.JSON(http.StatusNotFound, jsonapi.MessageWithError{Message: "rule not found", Error: err})
+	case errors.Is(err, database_api.ErrPathNotFound):
+		c.JSON(http.StatusNotFound, jsonapi.MessageWithError{Message: "path not found", Error: err})
+	case errors.Is(err, database_api.ErrInvalidRule):
+		c.JSON(http.StatusUnprocessableEntity, jsonapi.MessageWithError{Message: "invalid rule", Error: err})
+	default:
+		logrus.WithError(err).Error(strings.ToUpper(message[:1]) + message[1:])
+		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: message, Error: err})
+	}
+}
+
+// Get a rule, returns false if the request has been answered
+func (rr *RulesRegistry) getRule(c *gin.Context, id uuid.UUID) (database_api.Rule, bool) {
+	r, err := rr.db.GetRule(c, id)
+	if err != nil {
+		storeError(c, err, "could not get rule from database")
+		return r, false
 	}
+	return r, true
+}
+
+// List enabled rules matching the same packets with the same priority
+func (rr *RulesRegistry) GetOverlaps(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	rules, err := rr.db.GetRules(c)
+	if err != nil {
+		logrus.WithError(err).Error("Could not get all rules from database")
+		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not get all rules from database", Error: err})
+		return
+	}
+	c.JSON(http.StatusOK, Overlaps(rules))
 }
 
 func (rr *RulesRegistry) GetRule(c *gin.Context) {
@@ -39,10 +126,8 @@ func (rr *RulesRegistry) GetRule(c *gin.Context) {
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
-	rule, err := rr.db.GetRule(c, iduuid)
-	if err != nil {
-		logrus.WithError(err).Error("Could not get rule from database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not get rule from database", Error: err})
+	rule, ok := rr.getRule(c, iduuid)
+	if !ok {
 		return
 	}
 	c.JSON(http.StatusOK, rule)
@@ -67,12 +152,11 @@ func (rr *RulesRegistry) DeleteRule(c *gin.Context) {
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
-	err = rr.db.DeleteRule(c, iduuid)
-	if err != nil {
-		logrus.WithError(err).Error("Could not delete rule in the database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not delete rule in the database", Error: err})
+	if err := rr.db.DeleteRule(c, iduuid); err != nil {
+		storeError(c, err, "could not delete rule in the database")
 		return
 	}
+	rr.publish(c, events_api.RuleDeleted, iduuid)
 	c.Status(http.StatusNoContent) // successful deletion
 }
 
@@ -85,13 +169,20 @@ func (rr *RulesRegistry) EnableRule(c *gin.Context) {
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
-	err = rr.db.EnableRule(c, iduuid)
-	if err != nil {
-		logrus.WithError(err).Error("Could not enable rule in the database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not enable rule in the database", Error: err})
+	rr.writes.Lock()
+	defer rr.writes.Unlock()
+	r, ok := rr.getRule(c, iduuid)
+	if !ok {
+		return
+	}
+	if !r.Enabled && !rr.checkOverlaps(c, r, iduuid) {
 		return
-		//TODO: check if rule not found
 	}
+	if err := rr.db.EnableRule(c, iduuid); err != nil {
+		storeError(c, err, "could not enable rule in the database")
+		return
+	}
+	rr.publish(c, events_api.RuleEnabled, iduuid)
 	c.Status(http.StatusNoContent)
 }
 
@@ -104,13 +195,11 @@ func (rr *RulesRegistry) DisableRule(c *gin.Context) {
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
-	err = rr.db.DisableRule(c, iduuid)
-	if err != nil {
-		logrus.WithError(err).Error("Could not disable rule in the database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not disable rule in the database", Error: err})
+	if err := rr.db.DisableRule(c, iduuid); err != nil {
+		storeError(c, err, "could not disable rule in the database")
 		return
-		//TODO: check if rule not found
 	}
+	rr.publish(c, events_api.RuleDisabled, iduuid)
 	c.Status(http.StatusNoContent)
 }
 
@@ -130,33 +219,55 @@ func (rr *RulesRegistry) SwitchRule(c *gin.Context) {
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
-	err = rr.db.SwitchRule(c, iduuidEnable, iduuidDisable)
-	if err != nil {
-		logrus.WithError(err).Error("Could not Switch rule in the database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not switch rule in the database", Error: err})
+	rr.writes.Lock()
+	defer rr.writes.Unlock()
+	r, ok := rr.getRule(c, iduuidEnable)
+	if !ok {
+		return
+	}
+	if !rr.checkOverlaps(c, r, iduuidEnable, iduuidDisable) {
+		return
+	}
+	if _, ok := rr.getRule(c, iduuidDisable); !ok {
 		return
-		//TODO: check if rule not found
 	}
+	if err := rr.db.SwitchRule(c, iduuidEnable, iduuidDisable); err != nil {
+		storeError(c, err, "could not switch rule in the database")
+		return
+	}
+	rr.publish(c, events_api.RuleEnabled, iduuidEnable)
+	rr.publish(c, events_api.RuleDisabled, iduuidDisable)
 	c.Status(http.StatusNoContent)
 }
 
 // Post a new rule
 func (rr *RulesRegistry) PostRule(c *gin.Context) {
-	var rule n4tosrv6.Rule
+	var rule database_api.Rule
 	if err := c.BindJSON(&rule); err != nil {
 		logrus.WithError(err).Error("could not deserialize")
 		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
+	rr.writes.Lock()
+	defer rr.writes.Unlock()
+	if rule.Enabled && !rr.checkOverlaps(c, rule) {
+		return
+	}
 	id, err := rr.db.InsertRule(c, rule)
 	if err != nil {
-		logrus.WithError(err).Error("Could not insert rule in the database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "failed to insert rule", Error: err})
+		storeError(c, err, "failed to insert rule")
 		return
 	}
 	c.Header("Location", fmt.Sprintf("/rules/%s", id))
-	c.JSON(http.StatusCreated, rule)
+	stored, ok := rr.getRule(c, *id)
+	if !ok {
+		return
+	}
+	if rr.events != nil {
+		rr.events.Publish(events_api.RuleCreated, events_api.RuleEvent{Uuid: *id, Rule: &stored, Source: "api"})
+	}
+	c.JSON(http.StatusCreated, stored)
 }
 
 // Update action of a rule
@@ -168,18 +279,82 @@ func (rr *RulesRegistry) UpdateAction(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "bad uuid", Error: err})
 		return
 	}
-	var action n4tosrv6.Action
+	var action database_api.ActionUpdate
 	if err := c.BindJSON(&action); err != nil {
 		logrus.WithError(err).Error("could not deserialize")
 		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
 		return
 	}
 	c.Header("Cache-Control", "no-cache")
-	err = rr.db.UpdateAction(c, iduuid_rule, action)
+	r, ok := rr.getRule(c, iduuid_rule)
+	if !ok {
+		return
+	}
+	if r.Enabled {
+		// the action is updated anyway: the overlap already exists
+		if rules, err := rr.db.GetRules(c); err == nil {
+			if o := overlapsWith(rules, r, iduuid_rule); len(o) > 0 {
+				logrus.WithFields(logrus.Fields{"uuid": iduuid_rule, "overlaps": o}).Warning("Updated rule has the same match and priority as enabled rules")
+			}
+		}
+	}
+	if err := rr.db.UpdateAction(c, iduuid_rule, action); err != nil {
+		storeError(c, err, "could not update Action for this rule in the database")
+		return
+	}
+	rr.publish(c, events_api.RuleUpdated, iduuid_rule)
+	c.Status(http.StatusNoContent)
+}
+
+// Reset counters of a rule
+func (rr *RulesRegistry) ResetCounters(c *gin.Context) {
+	id := c.Param("uuid")
+	iduuid, err := uuid.FromString(id)
+	if err != nil {
+		logrus.WithError(err).Error("Bad UUID")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "bad uuid", Error: err})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	if _, ok := rr.getRule(c, iduuid); !ok {
+		return
+	}
+	if err := rr.db.ResetCounters(c, iduuid); err != nil {
+		storeError(c, err, "could not reset counters of rule in the database")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Mark a path of a rule as down
+func (rr *RulesRegistry) SetPathDown(c *gin.Context) {
+	rr.setPathState(c, true)
+}
+
+// Mark a path of a rule as up
+func (rr *RulesRegistry) SetPathUp(c *gin.Context) {
+	rr.setPathState(c, false)
+}
+
+func (rr *RulesRegistry) setPathState(c *gin.Context, down bool) {
+	id := c.Param("uuid")
+	iduuid, err := uuid.FromString(id)
 	if err != nil {
-		logrus.WithError(err).Error("Could not update Action for this rule in the database")
-		c.JSON(http.StatusInternalServerError, jsonapi.MessageWithError{Message: "could not update Action for this rule in the database", Error: err})
+		logrus.WithError(err).Error("Bad UUID")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "bad uuid", Error: err})
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		logrus.WithError(err).Error("Bad path index")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "bad path index", Error: err})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	if err := rr.db.SetPathState(c, iduuid, index, down); err != nil {
+		storeError(c, err, "could not set state of path in the database")
 		return
 	}
+	rr.publish(c, events_api.RuleUpdated, iduuid)
 	c.Status(http.StatusNoContent)
 }
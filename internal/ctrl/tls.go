@@ -0,0 +1,213 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Files are checked for changes at most once per interval, on TLS handshakes
+const tlsReloadInterval = 1 * time.Second
+
+// Certificate and CAs loaded from PEM files, and reloaded when the files change,
+// so they can be rotated without restarting the router
+type tlsFiles struct {
+	cert string // optional, with key
+	key  string
+	ca   string // optional
+
+	mu          sync.Mutex
+	checked     time.Time
+	modTimes    map[string]time.Time
+	certificate *tls.Certificate
+	pool        *x509.CertPool
+}
+
+// Load the files; they must be valid at startup
+func newTLSFiles(cert *string, key *string, ca *string) (*tlsFiles, error) {
+	if (cert == nil) != (key == nil) {
+		return nil, fmt.Errorf("Certificate and key must be provided together")
+	}
+	f := &tlsFiles{}
+	if cert != nil {
+		f.cert = *cert
+		f.key = *key
+	}
+	if ca != nil {
+		f.ca = *ca
+	}
+	modTimes, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(modTimes); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+func (f *tlsFiles) files() []string {
+	files := make([]string, 0, 3)
+	for _, file := range []string{f.cert, f.key, f.ca} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Modification times of the files
+func (f *tlsFiles) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time, 3)
+	for _, file := range f.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %w", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Must be called with the lock held, except from newTLSFiles
+func (f *tlsFiles) load(modTimes map[string]time.Time) error {
+	var certificate *tls.Certificate
+	if f.cert != "" {
+		c, err := tls.LoadX509KeyPair(f.cert, f.key)
+		if err != nil {
+			return fmt.Errorf("Could not load certificate %s: %w", f.cert, err)
+		}
+		certificate = &c
+	}
+	var pool *x509.CertPool
+	if f.ca != "" {
+		pem, err := os.ReadFile(f.ca)
+		if err != nil {
+			return fmt.Errorf("Could not read CA file %s: %w", f.ca, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificate found in CA file %s", f.ca)
+		}
+	}
+	f.certificate = certificate
+	f.pool = pool
+	f.modTimes = modTimes
+	return nil
+}
+
+// Current certificate and CAs, reloaded if the files changed.
+// On reload failure (e.g. a certificate written before its key), previous ones are kept.
+func (f *tlsFiles) get() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.checked) < tlsReloadInterval {
+		return f.certificate, f.pool
+	}
+	f.checked = now
+	modTimes, err := f.stat()
+	if err != nil {
+		logrus.WithError(err).Error("Could not reload TLS files")
+		return f.certificate, f.pool
+	}
+	changed := false
+	for file, t := range modTimes {
+		if !t.Equal(f.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return f.certificate, f.pool
+	}
+	if err := f.load(modTimes); err != nil {
+		logrus.WithError(err).Error("Could not reload TLS files")
+		return f.certificate, f.pool
+	}
+	logrus.WithFields(logrus.Fields{"files": f.files()}).Info("TLS files reloaded")
+	return f.certificate, f.pool
+}
+
+// TLS configuration of the control API.
+// Client certificates are optional, so clients can also authenticate with a bearer token.
+func ServerTLSConfig(conf *config.ControlTLS) (*tls.Config, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("Missing TLS configuration")
+	}
+	files, err := newTLSFiles(&conf.Cert, &conf.Key, conf.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load TLS files of the control API: %w", err)
+	}
+	tlsConf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	// each handshake uses the current certificate and client CAs
+	tlsConf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		certificate, pool := files.get()
+		c := tlsConf.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates = []tls.Certificate{*certificate}
+		if pool != nil {
+			c.ClientCAs = pool
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		return c, nil
+	}
+	return tlsConf, nil
+}
+
+// TLS configuration of requests to the controller
+func clientTLSConfig(conf *config.ControllerClient) (*tls.Config, error) {
+	files, err := newTLSFiles(conf.Cert, conf.Key, conf.CA)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load TLS files of the controller client: %w", err)
+	}
+	tlsConf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _ := files.get()
+			if certificate == nil {
+				// no certificate is sent
+				return &tls.Certificate{}, nil
+			}
+			return certificate, nil
+		},
+	}
+	if conf.CA != nil {
+		// RootCAs cannot change after the creation of the transport:
+		// the chain is verified with the current CAs instead
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, pool := files.get()
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("No certificate sent by the controller")
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ctrl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+)
+
+// A CA issuing certificates of tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// Certificate and key (PEM) of 127.0.0.1, usable by servers and clients
+func (ca *testCA) issue(t *testing.T, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// Write a file, with a modification time different from the previous one
+func writeTLSFile(t *testing.T, file string, data []byte, modTime time.Time) string {
+	t.Helper()
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Serial number of a certificate
+func serialOf(t *testing.T, c *tls.Certificate) int64 {
+	t.Helper()
+	if c == nil {
+		t.Fatal("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestNewTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	certPEM, keyPEM := ca.issue(t, 2)
+	now := time.Now()
+	cert := writeTLSFile(t, filepath.Join(dir, "cert.pem"), certPEM, now)
+	key := writeTLSFile(t, filepath.Join(dir, "key.pem"), keyPEM, now)
+	caFile := writeTLSFile(t, filepath.Join(dir, "ca.pem"), ca.pem, now)
+	garbage := writeTLSFile(t, filepath.Join(dir, "garbage.pem"), []byte("garbage"), now)
+	missing := filepath.Join(dir, "missing.pem")
+	for _, tt := range []struct {
+		name         string
+		cert, key    *string
+		ca           *string
+		ok           bool
+		certificate  bool
+		certificates bool // CAs loaded
+	}{
+		{name: "none", ok: true},
+		{name: "certificate", cert: &cert, key: &key, ok: true, certificate: true},
+		{name: "CA", ca: &caFile, ok: true, certificates: true},
+		{name: "certificate and CA", cert: &cert, key: &key, ca: &caFile, ok: true, certificate: true, certificates: true},
+		{name: "certificate without key", cert: &cert},
+		{name: "key without certificate", key: &key},
+		{name: "missing certificate", cert: &missing, key: &key},
+		{name: "missing CA", ca: &missing},
+		{name: "invalid certificate", cert: &garbage, key: &key},
+		{name: "mismatched key", cert: &caFile, key: &key},
+		{name: "invalid CA", ca: &garbage},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newTLSFiles(tt.cert, tt.key, tt.ca)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("files loaded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificate, pool := f.get()
+			if (certificate != nil) != tt.certificate || (pool != nil) != tt.certificates {
+				t.Errorf("got certificate %v and CAs %v, want %v and %v", certificate != nil, pool != nil, tt.certificate, tt.certificates)
+			}
+		})
+	}
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	for _, tt := range []struct {
+		name   string
+		change func(t *testing.T, cert, key string, modTime time.Time)
+		check  bool // the reload interval has elapsed
+		want   int64
+	}{
+		{"unchanged", func(t *testing.T, cert, key string, modTime time.Time) {}, true, 2},
+		{"changed", func(t *testing.T, cert, key string, modTime time.Time) {
+			certPEM, keyPEM := ca.issue(t, 3)
+			writeTLSFile(t, cert, certPEM, modTime)
+			writeTLSFile(t, key, keyPEM, modTime)
+		}, true, 3},
+		{"changed within the interval", func(t *testing.T, cert, key string, modTime time.Time) {
+			certPEM, keyPEM := ca.issue(t, 3)
+			writeTLSFile(t, cert, certPEM, modTime)
+			writeTLSFile(t, key, keyPEM, modTime)
+		}, false, 2},
+		{"certificate without its key", func(t *testing.T, cert, key string, modTime time.Time) {
+			certPEM, _ := ca.issue(t, 3)
+			writeTLSFile(t, cert, certPEM, modTime)
+		}, true, 2},
+		{"invalid certificate", func(t *testing.T, cert, key string, modTime time.Time) {
+			writeTLSFile(t, cert, []byte("garbage"), modTime)
+		}, true, 2},
+		{"removed key", func(t *testing.T, cert, key string, modTime time.Time) {
+			if err := os.Remove(key); err != nil {
+				t.Fatal(err)
+			}
+		}, true, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPEM, keyPEM := ca.issue(t, 2)
+			modTime := time.Now().Add(-time.Hour)
+			cert := writeTLSFile(t, filepath.Join(dir, "cert.pem"), certPEM, modTime)
+			key := writeTLSFile(t, filepath.Join(dir, "key.pem"), keyPEM, modTime)
+			f, err := newTLSFiles(&cert, &key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, cert, key, time.Now())
+			if tt.check {
+				f.checked = time.Now().Add(-tlsReloadInterval)
+			}
+			certificate, _ := f.get()
+			if got := serialOf(t, certificate); got != tt.want {
+				t.Errorf("got certificate %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// Client certificates are optional, and verified with the client CAs
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	now := time.Now()
+	certPEM, keyPEM := ca.issue(t, 2)
+	clientCA := writeTLSFile(t, filepath.Join(dir, "client-ca.pem"), ca.pem, now)
+	conf, err := ServerTLSConfig(&config.ControlTLS{
+		Cert:     writeTLSFile(t, filepath.Join(dir, "cert.pem"), certPEM, now),
+		Key:      writeTLSFile(t, filepath.Join(dir, "key.pem"), keyPEM, now),
+		ClientCA: &clientCA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = conf
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	for _, tt := range []struct {
+		name   string
+		client *testCA // issuer of the client certificate, nil for no certificate
+		status int     // 0 if the handshake fails
+	}{
+		{"no client certificate", nil, http.StatusOK},
+		{"client certificate", ca, http.StatusAccepted},
+		{"client certificate of another CA", other, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConf := &tls.Config{RootCAs: roots}
+			if tt.client != nil {
+				certPEM, keyPEM := tt.client.issue(t, 4)
+				c, err := tls.X509KeyPair(certPEM, keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// sent even if not issued by a CA requested by the server
+				tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &c, nil }
+			}
+			client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+			resp, err := client.Get(srv.URL)
+			if tt.status == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got status %d, want a handshake failure", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); got != 2 {
+				t.Errorf("got server certificate %d, want 2", got)
+			}
+		})
+	}
+}
+
+// The controller is verified with the CAs of the configuration
+func TestClientTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	now := time.Now()
+	caFile := writeTLSFile(t, filepath.Join(dir, "ca.pem"), ca.pem, now)
+	clientPEM, clientKeyPEM := ca.issue(t, 3)
+	cert := writeTLSFile(t, filepath.Join(dir, "cert.pem"), clientPEM, now)
+	key := writeTLSFile(t, filepath.Join(dir, "key.pem"), clientKeyPEM, now)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	for _, tt := range []struct {
+		name       string
+		server     *testCA // issuer of the certificate of the controller
+		clientAuth tls.ClientAuthType
+		conf       config.ControllerClient
+		ok         bool
+	}{
+		{"verified", ca, tls.NoClientCert, config.ControllerClient{CA: &caFile}, true},
+		{"other CA", other, tls.NoClientCert, config.ControllerClient{CA: &caFile}, false},
+		{"client certificate", ca, tls.RequireAndVerifyClientCert, config.ControllerClient{CA: &caFile, Cert: &cert, Key: &key}, true},
+		{"no client certificate", ca, tls.RequireAndVerifyClientCert, config.ControllerClient{CA: &caFile}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			certPEM, keyPEM := tt.server.issue(t, 2)
+			c, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{c}, ClientAuth: tt.clientAuth, ClientCAs: clientCAs}
+			srv.StartTLS()
+			defer srv.Close()
+			tlsConf, err := clientTLSConfig(&tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
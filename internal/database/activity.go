@@ -0,0 +1,117 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Delay between two writes of the activity and counters of rules to the database
+const FlushInterval = 5 * time.Second
+
+// Stores recording activity of rules matched by lookups not done by the store itself (e.g. cache hits)
+type activityRecorder interface {
+	touch(id uuid.UUID, at time.Time)
+}
+
+// Record activity of a rule, written to the database by FlushActivity
+func (db *Database) touch(id uuid.UUID, at time.Time) {
+	v, ok := db.activity.Load(id)
+	if !ok {
+		v, _ = db.activity.LoadOrStore(id, &atomic.Int64{})
+	}
+	v.(*atomic.Int64).Store(at.UnixNano())
+}
+
+// Last activity of a rule, including activity not yet written to the database
+func (db *Database) lastActive(id uuid.UUID, stored time.Time) *time.Time {
+	if v, ok := db.activity.Load(id); ok {
+		if t := time.Unix(0, v.(*atomic.Int64).Load()); t.After(stored) {
+			return &t
+		}
+	}
+	return &stored
+}
+
+// Write activity of rules to the database
+func (db *Database) FlushActivity(ctx context.Context) error {
+	pending := map[uuid.UUID]int64{}
+	db.activity.Range(func(k, v any) bool {
+		ns := v.(*atomic.Int64).Load()
+		pending[k.(uuid.UUID)] = ns
+		// activity recorded meanwhile is kept for the next flush
+		if v.(*atomic.Int64).Load() == ns {
+			db.activity.CompareAndDelete(k, v)
+		}
+		return true
+	})
+	if len(pending) == 0 {
+		return nil
+	}
+	stmt, ok := db.statement(ctx, nil, "update_last_active")
+	if !ok {
+		return fmt.Errorf("Procedure not registered")
+	}
+	ids := make([]string, 0, len(pending))
+	times := make([]string, 0, len(pending))
+	for id, ns := range pending {
+		ids = append(ids, id.String())
+		times = append(times, time.Unix(0, ns).Format(time.RFC3339Nano))
+	}
+	if _, err := stmt.ExecContext(ctx, pq.Array(ids), pq.Array(times)); err != nil {
+		// retried on next flush
+		for id, ns := range pending {
+			a := &atomic.Int64{}
+			a.Store(ns)
+			db.activity.LoadOrStore(id, a)
+		}
+		return err
+	}
+	return nil
+}
+
+// Write activity and counters of rules to the database periodically, until ctx is done
+func (db *Database) RunFlush(ctx context.Context) {
+	runFlush(ctx, flusher{"activity of rules", db.FlushActivity}, flusher{"counters of rules", db.FlushCounters})
+}
+
+// Function writing data kept in memory to the database
+type flusher struct {
+	what  string
+	flush func(ctx context.Context) error
+}
+
+// Call flushers every FlushInterval, and a last time when ctx is done
+func runFlush(ctx context.Context, flushers ...flusher) {
+	flushAll := func(ctx context.Context) {
+		for _, f := range flushers {
+			if err := f.flush(ctx); err != nil {
+				logrus.WithError(err).Warningf("Could not write %s to the database", f.what)
+			}
+		}
+	}
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// last flush, the context being canceled
+			flushCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			flushAll(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			flushAll(ctx)
+		}
+	}
+}
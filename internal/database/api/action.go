@@ -0,0 +1,26 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+
+	"github.com/gofrs/uuid"
+)
+
+// Result of a lookup: the action of the rule matching the packet
+type Action struct {
+	n4tosrv6.Action
+	Paths []Path    // weighted candidates to the SRH of the action (see SRHForFlow)
+	Rule  uuid.UUID // rule matching the packet
+}
+
+// New action of a rule: paths of the rule are replaced too,
+// so a rule updated without paths has a single segment list
+type ActionUpdate struct {
+	n4tosrv6.Action
+	Paths []Path `json:"paths,omitempty"`
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+// Rules shared by tests of the rule stores and their users
+package apitest
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+// F-TEID of uplink rules with the default TEID
+var Fteid = jsonapi.Fteid{Teid: 1, Addr: netip.MustParseAddr("10.0.0.100")}
+
+// SRH with a single segment
+func SRH(t testing.TB, segment string) n4tosrv6.SRH {
+	t.Helper()
+	srh, err := n4tosrv6.NewSRH([]string{segment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *srh
+}
+
+// An uplink rule, enabled unless Disabled is set
+type Uplink struct {
+	GNB      string // prefix of gNBs, or address of a single gNB
+	TEID     uint32 // default: TEID of Fteid
+	Priority int32
+	Disabled bool
+	UE       string // UE prefix (optional)
+	UEIP     string // UE IP Address in the match of the GTP header (optional)
+	Service  string // destination of the payload (optional)
+}
+
+func (u Uplink) Rule(t testing.TB) database_api.Rule {
+	t.Helper()
+	gnb, err := netip.ParsePrefix(u.GNB)
+	if !strings.Contains(u.GNB, "/") {
+		var a netip.Addr
+		a, err = netip.ParseAddr(u.GNB)
+		gnb = netip.PrefixFrom(a, a.BitLen())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fteid := Fteid
+	if u.TEID != 0 {
+		fteid.Teid = u.TEID
+	}
+	r := database_api.Rule{
+		Rule: n4tosrv6.Rule{
+			Enabled: !u.Disabled,
+			Type:    "uplink",
+			Match: n4tosrv6.Match{
+				Header: &n4tosrv6.GtpHeader{
+					OuterIpSrc: []netip.Prefix{gnb},
+					FTeid:      fteid,
+				},
+			},
+			Action: n4tosrv6.Action{SRH: SRH(t, "fc00:1::1")},
+		},
+		Priority: u.Priority,
+	}
+	if u.UE != "" {
+		p, err := netip.ParsePrefix(u.UE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.UEPrefix = &p
+	}
+	if u.UEIP != "" {
+		a, err := netip.ParseAddr(u.UEIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Match.Header.InnerIpSrc = &a
+	}
+	if u.Service != "" {
+		a, err := netip.ParseAddr(u.Service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Match.Payload = &n4tosrv6.Payload{Dst: a}
+	}
+	return r
+}
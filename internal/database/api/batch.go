@@ -0,0 +1,93 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofrs/uuid"
+)
+
+type BatchOp string
+
+const (
+	BatchCreate  BatchOp = "create"
+	BatchUpdate  BatchOp = "update" // update of the action
+	BatchEnable  BatchOp = "enable"
+	BatchDisable BatchOp = "disable"
+	BatchDelete  BatchOp = "delete"
+)
+
+// An operation of a batch
+type BatchOperation struct {
+	Op     BatchOp       `json:"op"`
+	Uuid   *uuid.UUID    `json:"uuid,omitempty"`   // rule of update, enable, disable, and delete operations
+	Rule   *Rule         `json:"rule,omitempty"`   // create
+	Action *ActionUpdate `json:"action,omitempty"` // update
+}
+
+type BatchStatus string
+
+const (
+	BatchStatusApplied    BatchStatus = "applied"
+	BatchStatusFailed     BatchStatus = "failed"
+	BatchStatusNotApplied BatchStatus = "not-applied" // another operation of the batch failed
+)
+
+// Result of an operation of a batch
+type BatchResult struct {
+	Op     BatchOp     `json:"op"`
+	Uuid   *uuid.UUID  `json:"uuid,omitempty"` // rule of the operation, or created rule
+	Status BatchStatus `json:"status"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Error of the operation Index of a batch: no operation of the batch is applied
+type BatchError struct {
+	Index   int
+	Err     error
+	Invalid bool // the operation is malformed
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("Operation %d of the batch failed: %s", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Stores applying a batch of operations atomically: all operations are applied, or none
+type Batch interface {
+	// Returns UUIDs of the rules of each operation, including created rules
+	ApplyBatch(ctx context.Context, ops []BatchOperation) ([]uuid.UUID, error)
+}
+
+// Results of a batch, from the UUIDs returned by ApplyBatch, or its error
+func NewBatchResults(ops []BatchOperation, ids []uuid.UUID, err error) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	failed := -1
+	if be, ok := err.(*BatchError); ok {
+		failed = be.Index
+	}
+	for i, op := range ops {
+		results[i] = BatchResult{Op: op.Op, Uuid: op.Uuid, Status: BatchStatusApplied}
+		if i < len(ids) && ids[i] != uuid.Nil {
+			id := ids[i]
+			results[i].Uuid = &id
+		}
+		switch {
+		case err == nil:
+		case i == failed:
+			results[i].Status = BatchStatusFailed
+			results[i].Error = err.(*BatchError).Err.Error()
+		default:
+			results[i].Status = BatchStatusNotApplied
+		}
+	}
+	return results
+}
@@ -0,0 +1,22 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+// Counters of a lookup cache
+type CacheStats struct {
+	Active        bool   `json:"active"` // false while changes of rules are not notified
+	Entries       int    `json:"entries"`
+	MaxEntries    int    `json:"max-entries"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+// A RuleStore with a cache of lookups
+type CachedRuleStore interface {
+	RuleStore
+	CacheStats() CacheStats
+}
@@ -0,0 +1,25 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Traffic forwarded by a rule: uplink rules count uplink T-PDUs, and downlink rules downlink packets
+type Counters struct {
+	Packets uint64     `json:"packets"`
+	Bytes   uint64     `json:"bytes"`              // size of the user packets, before encapsulation
+	LastHit *time.Time `json:"last-hit,omitempty"` // nil if the rule never forwarded a packet
+}
+
+// Stores recording traffic forwarded by headends
+type Traffic interface {
+	// Count a packet of this size forwarded with the rule; must not block
+	CountTraffic(id uuid.UUID, size int)
+}
@@ -8,10 +8,9 @@ package database_api
 import (
 	"context"
 	"net/netip"
-
-	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
 )
 
 type Downlink interface {
-	GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (n4tosrv6.Action, error)
+	Traffic
+	GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (Action, error)
 }
@@ -0,0 +1,26 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import "errors"
+
+// Returned by lookups when no enabled rule is matching the packet
+var ErrNoMatchingRule = errors.New("No matching rule")
+
+// Returned when no rule has this UUID
+var ErrRuleNotFound = errors.New("Rule not found")
+
+// Returned when a rule or an action is semantically invalid
+var ErrInvalidRule = errors.New("Invalid rule")
+
+// Returned when a rule has no path with this index
+var ErrPathNotFound = errors.New("Path not found")
+
+// Returned when enabling a rule would make it ambiguous with enabled rules, and overlaps are rejected
+var ErrRulesOverlap = errors.New("Rule has the same match and priority as enabled rules")
+
+// Returned by lookups while the database is unreachable
+var ErrDatabaseUnavailable = errors.New("Database unavailable")
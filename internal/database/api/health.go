@@ -0,0 +1,39 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import "time"
+
+// State of the connection to the database
+type HealthState string
+
+const (
+	HealthUp   HealthState = "up"
+	HealthDown HealthState = "down"
+)
+
+// Health of a database
+type Health struct {
+	State         HealthState `json:"state"`
+	Since         *time.Time  `json:"since,omitempty"`      // last change of state
+	LastCheck     *time.Time  `json:"last-check,omitempty"` // last health check
+	Error         string      `json:"error,omitempty"`      // error of the last failed check, while down
+	FailurePolicy string      `json:"failure-policy,omitempty"`
+	Fallback      bool        `json:"fallback,omitempty"`       // lookups are served from the last known rules
+	FallbackRules int         `json:"fallback-rules,omitempty"` // number of last known rules
+	Reconnections uint64      `json:"reconnections"`
+}
+
+// Lookups are served by the dataplane while the database is down
+func (h Health) Ready() bool {
+	return h.State == HealthUp || h.Fallback
+}
+
+// A RuleStore with a monitored connection to the database
+type MonitoredRuleStore interface {
+	RuleStore
+	Health() Health
+}
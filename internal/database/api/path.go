@@ -0,0 +1,74 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"math"
+
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+// Maximum number of paths of a rule
+const MaxPaths = 16
+
+// A weighted segment list of a rule
+type Path struct {
+	SRH    n4tosrv6.SRH `json:"srh"`
+	Weight uint32       `json:"weight,omitempty"` // default: 1
+	Down   bool         `json:"down,omitempty"`   // paths down are not selected
+}
+
+func (p Path) WeightOrDefault() uint32 {
+	if p.Weight == 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// Segment list used for a flow.
+// Paths are selected with weighted rendezvous hashing: when a path is down, only its flows
+// are moved to other paths. When no path is up, the SRH of the action is used.
+func (a Action) SRHForFlow(flow uint64) n4tosrv6.SRH {
+	best := -1
+	bestScore := math.Inf(1)
+	for i, p := range a.Paths {
+		if p.Down {
+			continue
+		}
+		if score := -math.Log(unitHash(flow, uint64(i))) / float64(p.WeightOrDefault()); score < bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	if best < 0 {
+		return a.SRH
+	}
+	return a.Paths[best].SRH
+}
+
+// Segment lists of the paths up, or the SRH of the action when no path is up
+func (a Action) SRHsUp() []n4tosrv6.SRH {
+	srhs := make([]n4tosrv6.SRH, 0, len(a.Paths))
+	for _, p := range a.Paths {
+		if !p.Down {
+			srhs = append(srhs, p.SRH)
+		}
+	}
+	if len(srhs) == 0 {
+		return []n4tosrv6.SRH{a.SRH}
+	}
+	return srhs
+}
+
+// Hash of (flow, index), uniformly distributed in (0, 1)
+func unitHash(flow uint64, index uint64) float64 {
+	// splitmix64 finalizer
+	h := flow ^ ((index + 1) * 0x9E3779B97F4A7C15)
+	h = (h ^ (h >> 30)) * 0xBF58476D1CE4E5B9
+	h = (h ^ (h >> 27)) * 0x94D049BB133111EB
+	h ^= h >> 31
+	return (float64(h>>11) + 0.5) / (1 << 53)
+}
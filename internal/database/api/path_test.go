@@ -0,0 +1,161 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+const testFlows = 20000
+
+func srh(t *testing.T, segment string) n4tosrv6.SRH {
+	t.Helper()
+	s, err := n4tosrv6.NewSRH([]string{segment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *s
+}
+
+// Index of the path used for the flow, or -1 for the SRH of the action
+func pathIndex(a Action, flow uint64) int {
+	first := a.SRHForFlow(flow)[0].String()
+	for i, p := range a.Paths {
+		if p.SRH[0].String() == first {
+			return i
+		}
+	}
+	return -1
+}
+
+func testAction(t *testing.T, weights ...uint32) Action {
+	a := Action{Action: n4tosrv6.Action{SRH: srh(t, "fc00::1")}}
+	for i, w := range weights {
+		a.Paths = append(a.Paths, Path{SRH: srh(t, "fc00:"+string(rune('1'+i))+"::1"), Weight: w})
+	}
+	return a
+}
+
+func TestSRHForFlowWeights(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		weights []uint32
+	}{
+		{"single path", []uint32{1}},
+		{"default weights", []uint32{0, 0}},
+		{"equal weights", []uint32{5, 5, 5}},
+		{"unequal weights", []uint32{1, 3}},
+		{"heavy path", []uint32{1, 1, 8}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testAction(t, tt.weights...)
+			total := 0.0
+			for _, p := range a.Paths {
+				total += float64(p.WeightOrDefault())
+			}
+			counts := make([]int, len(a.Paths))
+			for flow := uint64(0); flow < testFlows; flow++ {
+				i := pathIndex(a, flow)
+				if i < 0 {
+					t.Fatalf("flow %d: SRH of the action used while paths are up", flow)
+				}
+				counts[i]++
+			}
+			for i, p := range a.Paths {
+				want := float64(p.WeightOrDefault()) / total
+				got := float64(counts[i]) / testFlows
+				if math.Abs(got-want) > 0.02 {
+					t.Errorf("path %d: got %.3f of flows, want %.3f", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// When a path is down, only its flows are moved
+func TestSRHForFlowPathDown(t *testing.T) {
+	a := testAction(t, 1, 2, 1)
+	before := make([]int, testFlows)
+	for flow := range before {
+		before[flow] = pathIndex(a, uint64(flow))
+	}
+	a.Paths[1].Down = true
+	for flow, was := range before {
+		now := pathIndex(a, uint64(flow))
+		switch {
+		case now == 1:
+			t.Fatalf("flow %d: path down used", flow)
+		case was != 1 && now != was:
+			t.Fatalf("flow %d: moved from path %d to path %d", flow, was, now)
+		}
+	}
+}
+
+func TestSRHForFlowFallback(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		action Action
+	}{
+		{"no path", testAction(t)},
+		{"all paths down", func() Action {
+			a := testAction(t, 1, 1)
+			a.Paths[0].Down = true
+			a.Paths[1].Down = true
+			return a
+		}()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.action.SRHForFlow(42)[0].String(); got != tt.action.SRH[0].String() {
+				t.Errorf("got segment %s, want the SRH of the action", got)
+			}
+		})
+	}
+}
+
+func TestSRHForFlowDeterministic(t *testing.T) {
+	a := testAction(t, 1, 1, 1)
+	for flow := uint64(0); flow < 100; flow++ {
+		if pathIndex(a, flow) != pathIndex(a, flow) {
+			t.Fatalf("flow %d: different paths for the same flow", flow)
+		}
+	}
+}
+
+func TestSRHsUp(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		down []bool // state of each path
+		want []int  // index of paths used, -1 for the SRH of the action
+	}{
+		{"no path", nil, []int{-1}},
+		{"all paths up", []bool{false, false, false}, []int{0, 1, 2}},
+		{"path down", []bool{false, true, false}, []int{0, 2}},
+		{"all paths down", []bool{true, true}, []int{-1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testAction(t, make([]uint32, len(tt.down))...)
+			for i, down := range tt.down {
+				a.Paths[i].Down = down
+			}
+			got := a.SRHsUp()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d segment lists, want %d", len(got), len(tt.want))
+			}
+			for i, j := range tt.want {
+				want := a.SRH
+				if j >= 0 {
+					want = a.Paths[j].SRH
+				}
+				if got[i][0].String() != want[0].String() {
+					t.Errorf("segment list %d: got %s, want %s", i, got[i][0], want[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+
+	"github.com/gofrs/uuid"
+)
+
+// A rule of the controller, with fields not part of n4tosrv6.Rule.
+//
+// When several enabled rules are matching a packet, the rule with the highest Priority is used;
+// rules with the same priority are ordered by specificity (Service IP Address, length of the UE prefix,
+// then longest gNB prefix), and finally by UUID.
+type Rule struct {
+	n4tosrv6.Rule
+	Priority int32 `json:"priority"` // default: 0
+
+	// IPv4 or IPv6 prefix of UEs (e.g. framed route, or /64 prefix of an IPv6 PDU Session),
+	// used instead of Match.Header.InnerIpSrc (uplink) or Match.Payload.Dst (downlink).
+	UEPrefix *netip.Prefix `json:"ue-prefix,omitempty"`
+
+	// Weighted segment lists: headends select one of the paths which are not down for each flow,
+	// and use Action.SRH when all paths are down.
+	Paths []Path `json:"paths,omitempty"`
+
+	// Lifetime of the rule: it expires at ExpiresAt, or when it has not been active
+	// for InactivityTimeout seconds (similar to PFCP inactivity timers). Expired rules are
+	// disabled or deleted by the rules expiry task.
+	ExpiresAt         *time.Time `json:"expires-at,omitempty"`
+	InactivityTimeout uint32     `json:"inactivity-timeout,omitempty"` // seconds, 0: no inactivity timeout
+
+	// Last time the rule has been matched by the dataplane, created, or enabled.
+	// Set by the RuleStore: ignored on insertion.
+	LastActive *time.Time `json:"last-active,omitempty"`
+
+	// Traffic forwarded by controller-driven headends.
+	// Set by the RuleStore: ignored on insertion.
+	Counters *Counters `json:"counters,omitempty"`
+}
+
+// Reason of the expiry of a rule
+type ExpiryReason string
+
+const (
+	ExpiryLifetime   ExpiryReason = "lifetime"   // ExpiresAt is reached
+	ExpiryInactivity ExpiryReason = "inactivity" // InactivityTimeout is reached
+)
+
+// Returns the reason of the expiry of the rule, false if the rule has not expired.
+// Only enabled rules are subject to inactivity.
+func (r Rule) Expired(now time.Time) (ExpiryReason, bool) {
+	if r.ExpiresAt != nil && !now.Before(*r.ExpiresAt) {
+		return ExpiryLifetime, true
+	}
+	if r.Enabled && r.InactivityTimeout > 0 && r.LastActive != nil &&
+		now.Sub(*r.LastActive) >= time.Duration(r.InactivityTimeout)*time.Second {
+		return ExpiryInactivity, true
+	}
+	return "", false
+}
+
+// Prefix of UEs matched by the rule, false if any UE is matched
+func (r Rule) UE() (netip.Prefix, bool) {
+	if r.UEPrefix != nil {
+		return r.UEPrefix.Masked(), true
+	}
+	switch r.Type {
+	case "uplink":
+		if r.Match.Header != nil && r.Match.Header.InnerIpSrc != nil {
+			return netip.PrefixFrom(*r.Match.Header.InnerIpSrc, r.Match.Header.InnerIpSrc.BitLen()), true
+		}
+	case "downlink":
+		if r.Match.Payload != nil {
+			return netip.PrefixFrom(r.Match.Payload.Dst, r.Match.Payload.Dst.BitLen()), true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Service IP Address matched by an uplink rule, false if any service is matched
+func (r Rule) Service() (netip.Addr, bool) {
+	if r.Type != "uplink" || r.Match.Payload == nil {
+		return netip.Addr{}, false
+	}
+	return r.Match.Payload.Dst, true
+}
+
+// Returns the rule with its UE in canonical form:
+// a single UE IP Address is set in Match, and a prefix in UEPrefix.
+// A /0 prefix matches any UE.
+func (r Rule) Normalized() Rule {
+	ue, ok := r.UE()
+	if !ok {
+		return r
+	}
+	r.UEPrefix = nil
+	if r.Type == "uplink" && r.Match.Header != nil {
+		h := *r.Match.Header
+		h.InnerIpSrc = nil
+		r.Match.Header = &h
+	} else if r.Type == "downlink" {
+		r.Match.Payload = nil
+	}
+	switch {
+	case ue.Bits() == 0:
+	case !ue.IsSingleIP():
+		r.UEPrefix = &ue
+	case r.Type == "uplink" && r.Match.Header != nil:
+		a := ue.Addr()
+		r.Match.Header.InnerIpSrc = &a
+	case r.Type == "downlink":
+		r.Match.Payload = &n4tosrv6.Payload{Dst: ue.Addr()}
+	}
+	return r
+}
+
+type RuleMap map[uuid.UUID]Rule
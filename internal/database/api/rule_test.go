@@ -0,0 +1,126 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api_test
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+func prefix(s string) *netip.Prefix {
+	p := netip.MustParsePrefix(s)
+	return &p
+}
+
+func addr(s string) *netip.Addr {
+	a := netip.MustParseAddr(s)
+	return &a
+}
+
+func downlinkRule(ueIp *netip.Addr, uePrefix *netip.Prefix) database_api.Rule {
+	r := database_api.Rule{Rule: n4tosrv6.Rule{Type: "downlink"}, UEPrefix: uePrefix}
+	if ueIp != nil {
+		r.Match.Payload = &n4tosrv6.Payload{Dst: *ueIp}
+	}
+	return r
+}
+
+func TestNormalized(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		rule       database_api.Rule
+		ue         string // expected UE prefix, empty if any UE is matched
+		inMatch    bool   // UE IP Address expected in Match
+		inUEPrefix bool   // UE prefix expected in UEPrefix
+	}{
+		{"uplink without UE", apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t), "", false, false},
+		{"uplink UE IP Address", apitest.Uplink{GNB: "10.0.1.0/24", UEIP: "10.45.0.1"}.Rule(t), "10.45.0.1/32", true, false},
+		{"uplink /32 UE prefix", apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.1/32"}.Rule(t), "10.45.0.1/32", true, false},
+		{"uplink UE prefix", apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.1/16"}.Rule(t), "10.45.0.0/16", false, true},
+		{"uplink IPv6 UE prefix", apitest.Uplink{GNB: "10.0.1.0/24", UE: "2001:db8:1::/64"}.Rule(t), "2001:db8:1::/64", false, true},
+		{"uplink /0 UE prefix", apitest.Uplink{GNB: "10.0.1.0/24", UE: "0.0.0.0/0"}.Rule(t), "", false, false},
+		{"downlink UE IP Address", downlinkRule(addr("10.45.0.1"), nil), "10.45.0.1/32", true, false},
+		{"downlink /128 UE prefix", downlinkRule(nil, prefix("2001:db8::1/128")), "2001:db8::1/128", true, false},
+		{"downlink UE prefix", downlinkRule(nil, prefix("10.45.0.0/16")), "10.45.0.0/16", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.rule.Normalized()
+			got := ""
+			if ue, ok := r.UE(); ok {
+				got = ue.String()
+			}
+			if got != tt.ue {
+				t.Errorf("got UE %q, want %q", got, tt.ue)
+			}
+			inMatch := (r.Type == "uplink" && r.Match.Header.InnerIpSrc != nil) || (r.Type == "downlink" && r.Match.Payload != nil)
+			if inMatch != tt.inMatch {
+				t.Errorf("got UE IP Address in Match %v, want %v", inMatch, tt.inMatch)
+			}
+			if inUEPrefix := r.UEPrefix != nil; inUEPrefix != tt.inUEPrefix {
+				t.Errorf("got UEPrefix %v, want %v", inUEPrefix, tt.inUEPrefix)
+			}
+			ue1, ok1 := r.UE()
+			ue2, ok2 := r.Normalized().UE()
+			if ok1 != ok2 || ue1 != ue2 {
+				t.Error("Normalized is not idempotent")
+			}
+		})
+	}
+}
+
+// Normalized must not modify the header of the original rule
+func TestNormalizedCopiesHeader(t *testing.T) {
+	r := apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.1/32"}.Rule(t)
+	r.Normalized()
+	if r.Match.Header.InnerIpSrc != nil {
+		t.Error("header of the original rule modified")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	for _, tt := range []struct {
+		name              string
+		disabled          bool
+		expiresAt         *time.Time
+		inactivityTimeout uint32
+		lastActive        *time.Time
+		want              database_api.ExpiryReason // empty if not expired
+	}{
+		{name: "no lifetime"},
+		{name: "before lifetime", expiresAt: at(time.Second)},
+		{name: "lifetime reached", expiresAt: at(0), want: database_api.ExpiryLifetime},
+		{name: "after lifetime", expiresAt: at(-time.Second), want: database_api.ExpiryLifetime},
+		{name: "disabled after lifetime", disabled: true, expiresAt: at(-time.Second), want: database_api.ExpiryLifetime},
+		{name: "active", inactivityTimeout: 10, lastActive: at(-9 * time.Second)},
+		{name: "inactivity timeout reached", inactivityTimeout: 10, lastActive: at(-10 * time.Second), want: database_api.ExpiryInactivity},
+		{name: "disabled and inactive", disabled: true, inactivityTimeout: 10, lastActive: at(-time.Hour)},
+		{name: "never active", inactivityTimeout: 10},
+		{name: "no inactivity timeout", lastActive: at(-time.Hour)},
+		{name: "lifetime before inactivity", expiresAt: at(0), inactivityTimeout: 10, lastActive: at(-time.Hour), want: database_api.ExpiryLifetime},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := apitest.Uplink{GNB: "10.0.1.0/24", Disabled: tt.disabled}.Rule(t)
+			r.ExpiresAt = tt.expiresAt
+			r.InactivityTimeout = tt.inactivityTimeout
+			r.LastActive = tt.lastActive
+			reason, expired := r.Expired(now)
+			if reason != tt.want || expired != (tt.want != "") {
+				t.Errorf("got %q, %v, want %q, %v", reason, expired, tt.want, tt.want != "")
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+)
+
+type Rules interface {
+	GetRules(ctx context.Context) (RuleMap, error)
+	EnableRule(ctx context.Context, uuid uuid.UUID) error
+	DisableRule(ctx context.Context, uuid uuid.UUID) error
+	SwitchRule(ctx context.Context, uuidEnable uuid.UUID, uuidDisable uuid.UUID) error
+}
+
+// Applies operations on rules, all-or-nothing
+type ApplyFunc func(ops ...BatchOperation) error
+
+// A RulesWriter changes rules on behalf of tasks (e.g. on GTP-U path failure),
+// serialized with the writes of the REST API
+type RulesWriter interface {
+	// Call update with the current rules, while other writes are blocked.
+	// Operations given to apply are checked against the overlap policy of the API.
+	UpdateRules(ctx context.Context, update func(rules RuleMap, apply ApplyFunc)) error
+}
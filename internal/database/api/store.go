@@ -0,0 +1,27 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database_api
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+)
+
+// A RuleStore contains rules of the controller, and is used by
+// controller-driven headends and the REST API
+type RuleStore interface {
+	Rules
+	Uplink
+	Downlink
+	Batch
+	InsertRule(ctx context.Context, r Rule) (*uuid.UUID, error)
+	GetRule(ctx context.Context, uuid uuid.UUID) (Rule, error)
+	DeleteRule(ctx context.Context, uuid uuid.UUID) error
+	UpdateAction(ctx context.Context, uuidRule uuid.UUID, action ActionUpdate) error
+	ResetCounters(ctx context.Context, uuid uuid.UUID) error
+	SetPathState(ctx context.Context, uuid uuid.UUID, index int, down bool) error
+}
@@ -10,9 +10,10 @@ import (
 	"net/netip"
 
 	"github.com/nextmn/json-api/jsonapi"
-	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
 )
 
 type Uplink interface {
-	GetUplinkAction(ctx context.Context, UplinkFTeid jsonapi.Fteid, GnbIp netip.Addr, UeIp netip.Addr, ServiceIp netip.Addr) (n4tosrv6.Action, error)
+	Traffic
+	GetUplinkAction(ctx context.Context, UplinkFTeid jsonapi.Fteid, GnbIp netip.Addr, UeIp netip.Addr, ServiceIp netip.Addr) (Action, error)
+	GetUplinkEndMarkerAction(ctx context.Context, UplinkFTeid jsonapi.Fteid, GnbIp netip.Addr) (Action, error)
 }
@@ -0,0 +1,247 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Check operations of a batch could be applied.
+// exists reports if a rule existed before the batch; rules created by the batch cannot be referenced.
+func checkBatch(ops []database_api.BatchOperation, exists func(uuid.UUID) (bool, error)) error {
+	deleted := make(map[uuid.UUID]struct{})
+	for i, op := range ops {
+		if err := checkOperation(op); err != nil {
+			return &database_api.BatchError{Index: i, Err: err, Invalid: true}
+		}
+		if op.Op == database_api.BatchCreate {
+			continue
+		}
+		ok, err := exists(*op.Uuid)
+		if err != nil {
+			return &database_api.BatchError{Index: i, Err: err}
+		}
+		if _, del := deleted[*op.Uuid]; !ok || del {
+			return &database_api.BatchError{Index: i, Err: database_api.ErrRuleNotFound}
+		}
+		if op.Op == database_api.BatchDelete {
+			deleted[*op.Uuid] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Check the arguments of an operation
+func checkOperation(op database_api.BatchOperation) error {
+	switch op.Op {
+	case database_api.BatchCreate:
+		if op.Rule == nil {
+			return fmt.Errorf("Missing rule")
+		}
+		return checkRule(*op.Rule)
+	case database_api.BatchUpdate:
+		if op.Action == nil {
+			return fmt.Errorf("Missing action")
+		}
+		if err := checkAction(*op.Action); err != nil {
+			return err
+		}
+	case database_api.BatchEnable, database_api.BatchDisable, database_api.BatchDelete:
+	default:
+		return fmt.Errorf("Unknown operation %q", op.Op)
+	}
+	if op.Uuid == nil {
+		return fmt.Errorf("Missing UUID")
+	}
+	return nil
+}
+
+// UUIDs of the rules of a checked batch, including new UUIDs for created rules
+func batchIds(ops []database_api.BatchOperation) ([]uuid.UUID, error) {
+	ids := make([]uuid.UUID, len(ops))
+	for i, op := range ops {
+		if op.Op != database_api.BatchCreate {
+			ids[i] = *op.Uuid
+			continue
+		}
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func (m *Memory) ApplyBatch(ctx context.Context, ops []database_api.BatchOperation) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := checkBatch(ops, m.exists); err != nil {
+		return nil, err
+	}
+	ids, err := batchIds(ops)
+	if err != nil {
+		return nil, err
+	}
+	m.applyBatch(ops, ids)
+	return ids, nil
+}
+
+// Existence of a rule; m.mu must be held
+func (m *Memory) exists(id uuid.UUID) (bool, error) {
+	_, ok := m.rules[id]
+	return ok, nil
+}
+
+// Apply a checked batch; m.mu must be held
+func (m *Memory) applyBatch(ops []database_api.BatchOperation, ids []uuid.UUID) {
+	now := time.Now().UnixNano()
+	for i, op := range ops {
+		switch op.Op {
+		case database_api.BatchCreate:
+			m.add(ids[i], op.Rule.Normalized())
+		case database_api.BatchUpdate:
+			r := m.rules[ids[i]]
+			r.Action = op.Action.Action
+			r.Paths = op.Action.Paths
+			m.rules[ids[i]] = r
+		case database_api.BatchEnable:
+			m.set(ids[i], true, now)
+		case database_api.BatchDisable:
+			m.set(ids[i], false, now)
+		case database_api.BatchDelete:
+			m.remove(ids[i])
+		}
+	}
+}
+
+// The batch is written in a single bbolt transaction, then applied in memory
+func (b *Bolt) ApplyBatch(ctx context.Context, ops []database_api.BatchOperation) ([]uuid.UUID, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// b.mu serializes writes: rules in memory cannot change until the end of the batch
+	b.Memory.mu.RLock()
+	err := checkBatch(ops, b.Memory.exists)
+	b.Memory.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := batchIds(ops)
+	if err != nil {
+		return nil, err
+	}
+	// resulting state of the rules modified by the batch
+	modified := make(database_api.RuleMap)
+	deleted := make(map[uuid.UUID]struct{})
+	for i, op := range ops {
+		id := ids[i]
+		if op.Op == database_api.BatchCreate {
+			modified[id] = op.Rule.Normalized()
+			continue
+		}
+		if op.Op == database_api.BatchDelete {
+			delete(modified, id)
+			deleted[id] = struct{}{}
+			continue
+		}
+		r, ok := modified[id]
+		if !ok {
+			if r, err = b.Memory.GetRule(ctx, id); err != nil {
+				return nil, &database_api.BatchError{Index: i, Err: err}
+			}
+		}
+		switch op.Op {
+		case database_api.BatchUpdate:
+			r.Action = op.Action.Action
+			r.Paths = op.Action.Paths
+		case database_api.BatchEnable:
+			r.Enabled = true
+		case database_api.BatchDisable:
+			r.Enabled = false
+		}
+		modified[id] = r
+	}
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketRules)
+		for id := range deleted {
+			if err := bucket.Delete(id.Bytes()); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltBucketCounters).Delete(id.Bytes()); err != nil {
+				return err
+			}
+		}
+		return putRules(bucket, modified)
+	}); err != nil {
+		return nil, err
+	}
+	b.Memory.mu.Lock()
+	defer b.Memory.mu.Unlock()
+	b.Memory.applyBatch(ops, ids)
+	return ids, nil
+}
+
+// The batch is applied in a single transaction
+func (db *Database) ApplyBatch(ctx context.Context, ops []database_api.BatchOperation) ([]uuid.UUID, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := checkBatch(ops, func(id uuid.UUID) (bool, error) {
+		// rules are locked until the end of the transaction
+		return db.exists(ctx, tx, id)
+	}); err != nil {
+		return nil, err
+	}
+	ids := make([]uuid.UUID, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case database_api.BatchCreate:
+			var id *uuid.UUID
+			id, err = db.insertRule(ctx, tx, *op.Rule)
+			if id != nil {
+				ids[i] = *id
+			}
+		case database_api.BatchUpdate:
+			ids[i] = *op.Uuid
+			err = db.updateAction(ctx, tx, *op.Uuid, *op.Action)
+		case database_api.BatchEnable:
+			ids[i] = *op.Uuid
+			err = db.enableRule(ctx, tx, *op.Uuid)
+		case database_api.BatchDisable:
+			ids[i] = *op.Uuid
+			err = db.disableRule(ctx, tx, *op.Uuid)
+		case database_api.BatchDelete:
+			ids[i] = *op.Uuid
+			err = db.deleteRule(ctx, tx, *op.Uuid)
+		}
+		if err != nil {
+			return nil, &database_api.BatchError{Index: i, Err: err}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if op.Op == database_api.BatchDelete {
+			db.traffic.Delete(ids[i])
+		}
+	}
+	return ids, nil
+}
+
+func (c *Cache) ApplyBatch(ctx context.Context, ops []database_api.BatchOperation) ([]uuid.UUID, error) {
+	defer c.InvalidateAll()
+	return c.RuleStore.ApplyBatch(ctx, ops)
+}
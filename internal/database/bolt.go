@@ -0,0 +1,207 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket containing rules, encoded in JSON, indexed by UUID
+var boltBucketRules = []byte("rules")
+
+// Bolt is a RuleStore persisted in an embedded bbolt database.
+// Rules are also kept in memory, where lookups are done with the same semantics as Memory.
+type Bolt struct {
+	*Memory
+	db *bolt.DB
+	mu sync.Mutex // serializes writes, for the memory to be in the same state as the file
+}
+
+// Open the bbolt database, and load its rules
+func OpenBolt(path string) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("Could not create directory of bolt database: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Could not open bolt database %s: %w", path, err)
+	}
+	b := &Bolt{
+		Memory: NewMemory(),
+		db:     db,
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltBucketRules)
+		if err != nil {
+			return err
+		}
+		if err := bucket.ForEach(func(k, v []byte) error {
+			id, err := uuid.FromBytes(k)
+			if err != nil {
+				return err
+			}
+			var r database_api.Rule
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("Could not decode rule %s: %w", id, err)
+			}
+			if err := checkRule(r); err != nil {
+				return fmt.Errorf("Rule %s: %w", id, err)
+			}
+			b.Memory.insert(id, r.Normalized())
+			return nil
+		}); err != nil {
+			return err
+		}
+		return b.loadCounters(tx)
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not load bolt database %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// Close the bbolt database
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// Store rules in the bbolt database
+func (b *Bolt) put(rules database_api.RuleMap) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putRules(tx.Bucket(boltBucketRules), rules)
+	})
+}
+
+// Store rules in the bucket
+func putRules(bucket *bolt.Bucket, rules database_api.RuleMap) error {
+	for id, r := range rules {
+		// activity is only kept in memory, and counters are stored in their own bucket
+		r.LastActive = nil
+		r.Counters = nil
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(id.Bytes(), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) InsertRule(ctx context.Context, r database_api.Rule) (*uuid.UUID, error) {
+	if err := checkRule(r); err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	r = r.Normalized()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.put(database_api.RuleMap{id: r}); err != nil {
+		return nil, err
+	}
+	b.Memory.insert(id, r)
+	return &id, nil
+}
+
+// Set enabled state of rules
+func (b *Bolt) setEnabled(ctx context.Context, state map[uuid.UUID]bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rules := make(database_api.RuleMap, len(state))
+	for id, enabled := range state {
+		r, err := b.Memory.GetRule(ctx, id)
+		if err != nil {
+			return err
+		}
+		r.Enabled = enabled
+		rules[id] = r
+	}
+	if err := b.put(rules); err != nil {
+		return err
+	}
+	return b.Memory.setEnabled(state)
+}
+
+func (b *Bolt) EnableRule(ctx context.Context, id uuid.UUID) error {
+	return b.setEnabled(ctx, map[uuid.UUID]bool{id: true})
+}
+
+func (b *Bolt) DisableRule(ctx context.Context, id uuid.UUID) error {
+	return b.setEnabled(ctx, map[uuid.UUID]bool{id: false})
+}
+
+func (b *Bolt) SwitchRule(ctx context.Context, uuidEnable uuid.UUID, uuidDisable uuid.UUID) error {
+	return b.setEnabled(ctx, map[uuid.UUID]bool{uuidEnable: true, uuidDisable: false})
+}
+
+func (b *Bolt) DeleteRule(ctx context.Context, id uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.Memory.GetRule(ctx, id); err != nil {
+		return err
+	}
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltBucketCounters).Delete(id.Bytes()); err != nil {
+			return err
+		}
+		return tx.Bucket(boltBucketRules).Delete(id.Bytes())
+	}); err != nil {
+		return err
+	}
+	return b.Memory.DeleteRule(ctx, id)
+}
+
+func (b *Bolt) UpdateAction(ctx context.Context, uuidRule uuid.UUID, action database_api.ActionUpdate) error {
+	if err := checkAction(action); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, err := b.Memory.GetRule(ctx, uuidRule)
+	if err != nil {
+		return err
+	}
+	r.Action = action.Action
+	r.Paths = action.Paths
+	if err := b.put(database_api.RuleMap{uuidRule: r}); err != nil {
+		return err
+	}
+	return b.Memory.UpdateAction(ctx, uuidRule, action)
+}
+
+func (b *Bolt) SetPathState(ctx context.Context, id uuid.UUID, index int, down bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, err := b.Memory.GetRule(ctx, id)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(r.Paths) {
+		return database_api.ErrPathNotFound
+	}
+	r.Paths = slices.Clone(r.Paths)
+	r.Paths[index].Down = down
+	if err := b.put(database_api.RuleMap{id: r}); err != nil {
+		return err
+	}
+	return b.Memory.SetPathState(ctx, id, index, down)
+}
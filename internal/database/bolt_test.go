@@ -0,0 +1,240 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gofrs/uuid"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Rules of the store encoded in JSON, without their activity and counters
+func storedRules(t *testing.T, b *Bolt) string {
+	t.Helper()
+	rules, err := b.GetRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, r := range rules {
+		r.LastActive = nil
+		r.Counters = nil
+		rules[id] = r
+	}
+	v, err := json.Marshal(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(v)
+}
+
+// Rules are the same after reopening the database
+func TestBoltReopen(t *testing.T) {
+	ctx := context.Background()
+	src := netip.MustParseAddr("10.0.0.100")
+	action := func(segments ...string) database_api.ActionUpdate {
+		a := database_api.ActionUpdate{Action: n4tosrv6.Action{SRH: apitest.SRH(t, "fc00:1::1"), SourceGtp4: &src}}
+		for _, s := range segments {
+			a.Paths = append(a.Paths, database_api.Path{SRH: apitest.SRH(t, s)})
+		}
+		return a
+	}
+	for _, tt := range []struct {
+		name   string
+		update func(b *Bolt, ids []uuid.UUID) error // ids of an enabled rule, and of a disabled rule
+	}{
+		{"inserted", func(b *Bolt, ids []uuid.UUID) error { return nil }},
+		{"enabled", func(b *Bolt, ids []uuid.UUID) error { return b.EnableRule(ctx, ids[1]) }},
+		{"disabled", func(b *Bolt, ids []uuid.UUID) error { return b.DisableRule(ctx, ids[0]) }},
+		{"switched", func(b *Bolt, ids []uuid.UUID) error { return b.SwitchRule(ctx, ids[1], ids[0]) }},
+		{"deleted", func(b *Bolt, ids []uuid.UUID) error { return b.DeleteRule(ctx, ids[0]) }},
+		{"action updated", func(b *Bolt, ids []uuid.UUID) error {
+			return b.UpdateAction(ctx, ids[0], action("fc00:2::1", "fc00:3::1"))
+		}},
+		{"path down", func(b *Bolt, ids []uuid.UUID) error {
+			if err := b.UpdateAction(ctx, ids[0], action("fc00:2::1")); err != nil {
+				return err
+			}
+			return b.SetPathState(ctx, ids[0], 0, true)
+		}},
+		{"batch", func(b *Bolt, ids []uuid.UUID) error {
+			r := apitest.Uplink{GNB: "10.0.2.0/24"}.Rule(t)
+			_, err := b.ApplyBatch(ctx, []database_api.BatchOperation{
+				{Op: database_api.BatchCreate, Rule: &r},
+				{Op: database_api.BatchDisable, Uuid: &ids[0]},
+				{Op: database_api.BatchDelete, Uuid: &ids[1]},
+			})
+			return err
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db", "rules.db")
+			b, err := OpenBolt(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uuid.UUID
+			for _, r := range []database_api.Rule{
+				apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+				apitest.Uplink{GNB: "10.0.1.0/24", Priority: 1, Disabled: true}.Rule(t),
+			} {
+				id, err := b.InsertRule(ctx, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, *id)
+			}
+			if err := tt.update(b, ids); err != nil {
+				t.Fatal(err)
+			}
+			want := storedRules(t, b)
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			b, err = OpenBolt(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if got := storedRules(t, b); got != want {
+				t.Errorf("got rules %s after reopening, want %s", got, want)
+			}
+		})
+	}
+}
+
+// Lookups use rules loaded from the database
+func TestBoltReopenLookup(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rules.db")
+	b, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ip := netip.MustParseAddr("10.45.0.1")
+	action, err := b.GetUplinkAction(ctx, apitest.Fteid, netip.MustParseAddr("10.0.1.1"), ip, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Rule != *id {
+		t.Errorf("got rule %s, want %s", action.Rule, *id)
+	}
+	if err := b.DeleteRule(ctx, *id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetUplinkAction(ctx, apitest.Fteid, netip.MustParseAddr("10.0.1.1"), ip, ip); !errors.Is(err, database_api.ErrNoMatchingRule) {
+		t.Errorf("got error %v after deletion, want %v", err, database_api.ErrNoMatchingRule)
+	}
+}
+
+// Failed writes do not change the rules
+func TestBoltNotFound(t *testing.T) {
+	ctx := context.Background()
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "rules.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	id, err := b.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := uuid.Must(uuid.NewV4())
+	want := storedRules(t, b)
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{"enable", b.EnableRule(ctx, unknown)},
+		{"switch", b.SwitchRule(ctx, *id, unknown)},
+		{"delete", b.DeleteRule(ctx, unknown)},
+		{"path state", b.SetPathState(ctx, unknown, 0, true)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, database_api.ErrRuleNotFound) {
+				t.Errorf("got error %v, want %v", tt.err, database_api.ErrRuleNotFound)
+			}
+		})
+	}
+	if err := b.SetPathState(ctx, *id, 0, true); !errors.Is(err, database_api.ErrPathNotFound) {
+		t.Errorf("got error %v, want %v", err, database_api.ErrPathNotFound)
+	}
+	if got := storedRules(t, b); got != want {
+		t.Errorf("got rules %s, want %s", got, want)
+	}
+}
+
+// Invalid rules stored in the database are not loaded
+func TestOpenBoltInvalid(t *testing.T) {
+	invalid := apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t)
+	invalid.Match.Header = nil
+	for _, tt := range []struct {
+		name  string
+		key   []byte
+		value func(t *testing.T) []byte
+	}{
+		{"not JSON", uuid.Must(uuid.NewV4()).Bytes(), func(t *testing.T) []byte { return []byte("{") }},
+		{"invalid rule", uuid.Must(uuid.NewV4()).Bytes(), func(t *testing.T) []byte {
+			v, err := json.Marshal(invalid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}},
+		{"invalid UUID", []byte("rule"), func(t *testing.T) []byte {
+			v, err := json.Marshal(apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.db")
+			db, err := bolt.Open(path, 0o600, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Update(func(tx *bolt.Tx) error {
+				bucket, err := tx.CreateBucket(boltBucketRules)
+				if err != nil {
+					return err
+				}
+				return bucket.Put(tt.key, tt.value(t))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := OpenBolt(path); err == nil {
+				b.Close()
+				t.Errorf("rules loaded, want an error")
+			}
+		})
+	}
+}
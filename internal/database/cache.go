@@ -0,0 +1,277 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+)
+
+// Key of an uplink lookup; UE and Service are invalid for End Markers
+type uplinkKey struct {
+	Gnb     netip.Addr
+	UE      netip.Addr
+	Service netip.Addr
+}
+
+// Result of a lookup
+type cacheEntry struct {
+	action database_api.Action
+	err    error // nil or ErrNoMatchingRule
+}
+
+// Cache of lookups in front of a RuleStore.
+// Entries are only stored while the cache is active, i.e. while changes
+// of rules are notified (see Listener).
+type Cache struct {
+	database_api.RuleStore
+	maxEntries int
+	active     atomic.Bool
+
+	mu         sync.RWMutex
+	generation uint64 // incremented on each invalidation
+	entries    int
+	uplink     map[jsonapi.Fteid]map[uplinkKey]cacheEntry
+	downlink   map[netip.Addr]cacheEntry
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+// Create a new Cache of maxEntries lookups in front of store
+func NewCache(store database_api.RuleStore, maxEntries int) *Cache {
+	return &Cache{
+		RuleStore:  store,
+		maxEntries: maxEntries,
+		uplink:     make(map[jsonapi.Fteid]map[uplinkKey]cacheEntry),
+		downlink:   make(map[netip.Addr]cacheEntry),
+	}
+}
+
+// Counters of the Cache
+func (c *Cache) CacheStats() database_api.CacheStats {
+	c.mu.RLock()
+	entries := c.entries
+	c.mu.RUnlock()
+	return database_api.CacheStats{
+		Active:        c.active.Load(),
+		Entries:       entries,
+		MaxEntries:    c.maxEntries,
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+// Health of the underlying store
+func (c *Cache) Health() database_api.Health {
+	if m, ok := c.RuleStore.(database_api.MonitoredRuleStore); ok {
+		return m.Health()
+	}
+	return database_api.Health{State: database_api.HealthUp}
+}
+
+// Activate or deactivate the Cache. Entries are removed in both cases.
+func (c *Cache) SetActive(active bool) {
+	c.InvalidateAll()
+	c.active.Store(active)
+}
+
+// Remove all entries
+func (c *Cache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = 0
+	clear(c.uplink)
+	clear(c.downlink)
+	c.invalidations.Add(1)
+}
+
+// Remove entries of uplink lookups for this FTeid
+func (c *Cache) InvalidateUplink(fteid jsonapi.Fteid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries -= len(c.uplink[fteid])
+	delete(c.uplink, fteid)
+	c.invalidations.Add(1)
+}
+
+// Remove entries of downlink lookups
+func (c *Cache) InvalidateDownlink() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries -= len(c.downlink)
+	clear(c.downlink)
+	c.invalidations.Add(1)
+}
+
+// Record activity of the rule of a cache hit in the underlying store
+func (c *Cache) touch(e cacheEntry) {
+	if e.err != nil {
+		return
+	}
+	if a, ok := c.RuleStore.(activityRecorder); ok {
+		a.touch(e.action.Rule, time.Now())
+	}
+}
+
+// Returns the current generation, or false if entries must not be stored
+func (c *Cache) begin() (uint64, bool) {
+	if !c.active.Load() {
+		return 0, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation, true
+}
+
+// Returns true if the entry can be stored: the lookup succeeded,
+// and no invalidation happened since the beginning of the lookup
+func (c *Cache) storable(generation uint64, err error) bool {
+	if err != nil && !errors.Is(err, database_api.ErrNoMatchingRule) {
+		return false
+	}
+	if c.generation != generation || !c.active.Load() {
+		return false
+	}
+	if c.entries >= c.maxEntries {
+		// all entries are dropped instead of tracking usage
+		c.entries = 0
+		clear(c.uplink)
+		clear(c.downlink)
+	}
+	return true
+}
+
+func (c *Cache) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (database_api.Action, error) {
+	key := uplinkKey{Gnb: gnbIp, UE: ueIp, Service: serviceIp}
+	return c.getUplinkAction(uplinkFTeid, key, func() (database_api.Action, error) {
+		return c.RuleStore.GetUplinkAction(ctx, uplinkFTeid, gnbIp, ueIp, serviceIp)
+	})
+}
+
+func (c *Cache) GetUplinkEndMarkerAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr) (database_api.Action, error) {
+	key := uplinkKey{Gnb: gnbIp}
+	return c.getUplinkAction(uplinkFTeid, key, func() (database_api.Action, error) {
+		return c.RuleStore.GetUplinkEndMarkerAction(ctx, uplinkFTeid, gnbIp)
+	})
+}
+
+func (c *Cache) getUplinkAction(uplinkFTeid jsonapi.Fteid, key uplinkKey, lookup func() (database_api.Action, error)) (database_api.Action, error) {
+	c.mu.RLock()
+	e, ok := c.uplink[uplinkFTeid][key]
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		c.touch(e)
+		return e.action, e.err
+	}
+	c.misses.Add(1)
+	generation, ok := c.begin()
+	action, err := lookup()
+	if !ok {
+		return action, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.storable(generation, err) {
+		m, ok := c.uplink[uplinkFTeid]
+		if !ok {
+			m = make(map[uplinkKey]cacheEntry)
+			c.uplink[uplinkFTeid] = m
+		}
+		if _, ok := m[key]; !ok {
+			c.entries++
+		}
+		m[key] = cacheEntry{action: action, err: err}
+	}
+	return action, err
+}
+
+func (c *Cache) GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (database_api.Action, error) {
+	c.mu.RLock()
+	e, ok := c.downlink[ueIp]
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		c.touch(e)
+		return e.action, e.err
+	}
+	c.misses.Add(1)
+	generation, ok := c.begin()
+	action, err := c.RuleStore.GetDownlinkAction(ctx, ueIp)
+	if !ok {
+		return action, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.storable(generation, err) {
+		if _, ok := c.downlink[ueIp]; !ok {
+			c.entries++
+		}
+		c.downlink[ueIp] = cacheEntry{action: action, err: err}
+	}
+	return action, err
+}
+
+// Changes made through the Cache are applied without waiting for the notification
+
+func (c *Cache) InsertRule(ctx context.Context, r database_api.Rule) (*uuid.UUID, error) {
+	id, err := c.RuleStore.InsertRule(ctx, r)
+	if err != nil {
+		return id, err
+	}
+	if r.Type == "uplink" && r.Match.Header != nil {
+		c.InvalidateUplink(r.Match.Header.FTeid)
+	} else {
+		c.InvalidateDownlink()
+	}
+	return id, nil
+}
+
+func (c *Cache) EnableRule(ctx context.Context, id uuid.UUID) error {
+	defer c.InvalidateAll()
+	return c.RuleStore.EnableRule(ctx, id)
+}
+
+func (c *Cache) DisableRule(ctx context.Context, id uuid.UUID) error {
+	defer c.InvalidateAll()
+	return c.RuleStore.DisableRule(ctx, id)
+}
+
+func (c *Cache) SwitchRule(ctx context.Context, uuidEnable uuid.UUID, uuidDisable uuid.UUID) error {
+	defer c.InvalidateAll()
+	return c.RuleStore.SwitchRule(ctx, uuidEnable, uuidDisable)
+}
+
+func (c *Cache) DeleteRule(ctx context.Context, id uuid.UUID) error {
+	defer c.InvalidateAll()
+	return c.RuleStore.DeleteRule(ctx, id)
+}
+
+func (c *Cache) UpdateAction(ctx context.Context, uuidRule uuid.UUID, action database_api.ActionUpdate) error {
+	defer c.InvalidateAll()
+	return c.RuleStore.UpdateAction(ctx, uuidRule, action)
+}
+
+func (c *Cache) SetPathState(ctx context.Context, id uuid.UUID, index int, down bool) error {
+	defer c.InvalidateAll()
+	return c.RuleStore.SetPathState(ctx, id, index, down)
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gofrs/uuid"
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+// A Memory whose lookups can fail, or run a function before returning
+type lookupStore struct {
+	*Memory
+	err    error
+	during func() // called once, during the next lookup
+}
+
+func (s *lookupStore) lookup() error {
+	if s.during != nil {
+		during := s.during
+		s.during = nil
+		during()
+	}
+	return s.err
+}
+
+func (s *lookupStore) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (database_api.Action, error) {
+	if err := s.lookup(); err != nil {
+		return database_api.Action{}, err
+	}
+	return s.Memory.GetUplinkAction(ctx, uplinkFTeid, gnbIp, ueIp, serviceIp)
+}
+
+func (s *lookupStore) GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (database_api.Action, error) {
+	if err := s.lookup(); err != nil {
+		return database_api.Action{}, err
+	}
+	return s.Memory.GetDownlinkAction(ctx, ueIp)
+}
+
+var (
+	cacheGnb = netip.MustParseAddr("10.0.1.1")
+	cacheUE  = netip.MustParseAddr("10.45.0.1")
+)
+
+func cacheUplink(c *Cache) error {
+	_, err := c.GetUplinkAction(context.Background(), apitest.Fteid, cacheGnb, cacheUE, cacheUE)
+	return err
+}
+
+func cacheDownlink(c *Cache) error {
+	_, err := c.GetDownlinkAction(context.Background(), cacheUE)
+	return err
+}
+
+// Results of lookups are only stored when no invalidation happened during the lookup
+func TestCacheGeneration(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		inactive bool
+		err      error
+		during   func(c *Cache)
+		stored   bool
+	}{
+		{name: "stored", stored: true},
+		{name: "inactive", inactive: true},
+		{name: "no matching rule", err: database_api.ErrNoMatchingRule, stored: true},
+		{name: "database unavailable", err: database_api.ErrDatabaseUnavailable},
+		{name: "all invalidated", during: func(c *Cache) { c.InvalidateAll() }},
+		{name: "uplink invalidated", during: func(c *Cache) { c.InvalidateUplink(apitest.Fteid) }},
+		{name: "downlink invalidated", during: func(c *Cache) { c.InvalidateDownlink() }},
+		{name: "deactivated", during: func(c *Cache) { c.SetActive(false) }},
+		{name: "reactivated", during: func(c *Cache) {
+			c.SetActive(false)
+			c.SetActive(true)
+		}},
+	} {
+		for name, lookup := range map[string]func(*Cache) error{"uplink": cacheUplink, "downlink": cacheDownlink} {
+			t.Run(tt.name+" "+name, func(t *testing.T) {
+				s := &lookupStore{Memory: NewMemory(), err: tt.err}
+				insertAll(t, s.Memory, []database_api.Rule{apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t), downlink(t, "", 0)})
+				c := NewCache(s, 10)
+				c.SetActive(!tt.inactive)
+				if tt.during != nil {
+					s.during = func() { tt.during(c) }
+				}
+				if err := lookup(c); !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				entries, hits := 0, uint64(0)
+				if tt.stored {
+					entries, hits = 1, 1
+				}
+				if got := c.CacheStats().Entries; got != entries {
+					t.Errorf("got %d entries, want %d", got, entries)
+				}
+				if err := lookup(c); !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				if got := c.CacheStats().Hits; got != hits {
+					t.Errorf("got %d hits, want %d", got, hits)
+				}
+			})
+		}
+	}
+}
+
+// Changes of rules made through the Cache remove the entries they affect
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name     string
+		update   func(t *testing.T, c *Cache, ids []uuid.UUID) error // ids of the uplink rule, its disabled backup, and the downlink rule
+		entries  int
+		uplink   error // result of lookups after the change
+		downlink error
+	}{
+		{
+			name: "uplink rule inserted",
+			update: func(t *testing.T, c *Cache, ids []uuid.UUID) error {
+				_, err := c.InsertRule(ctx, apitest.Uplink{GNB: "10.0.2.0/24"}.Rule(t))
+				return err
+			},
+			entries: 1,
+		},
+		{
+			name: "downlink rule inserted",
+			update: func(t *testing.T, c *Cache, ids []uuid.UUID) error {
+				_, err := c.InsertRule(ctx, downlink(t, "10.46.0.0/16", 0))
+				return err
+			},
+			entries: 1,
+		},
+		{
+			name:   "uplink rule disabled",
+			update: func(t *testing.T, c *Cache, ids []uuid.UUID) error { return c.DisableRule(ctx, ids[0]) },
+			uplink: database_api.ErrNoMatchingRule,
+		},
+		{
+			name:     "downlink rule deleted",
+			update:   func(t *testing.T, c *Cache, ids []uuid.UUID) error { return c.DeleteRule(ctx, ids[2]) },
+			downlink: database_api.ErrNoMatchingRule,
+		},
+		{
+			name:   "rules switched",
+			update: func(t *testing.T, c *Cache, ids []uuid.UUID) error { return c.SwitchRule(ctx, ids[1], ids[0]) },
+		},
+		{
+			name: "batch",
+			update: func(t *testing.T, c *Cache, ids []uuid.UUID) error {
+				_, err := c.ApplyBatch(ctx, []database_api.BatchOperation{
+					{Op: database_api.BatchDisable, Uuid: &ids[0]},
+					{Op: database_api.BatchDisable, Uuid: &ids[2]},
+				})
+				return err
+			},
+			uplink:   database_api.ErrNoMatchingRule,
+			downlink: database_api.ErrNoMatchingRule,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemory()
+			ids := insertAll(t, m, []database_api.Rule{
+				apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+				apitest.Uplink{GNB: "10.0.1.0/24", Priority: 1, Disabled: true}.Rule(t),
+				downlink(t, "", 0),
+			})
+			c := NewCache(m, 10)
+			c.SetActive(true)
+			if err := cacheUplink(c); err != nil {
+				t.Fatal(err)
+			}
+			if err := cacheDownlink(c); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.update(t, c, ids); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.CacheStats().Entries; got != tt.entries {
+				t.Errorf("got %d entries, want %d", got, tt.entries)
+			}
+			if err := cacheUplink(c); !errors.Is(err, tt.uplink) {
+				t.Errorf("got uplink error %v, want %v", err, tt.uplink)
+			}
+			if err := cacheDownlink(c); !errors.Is(err, tt.downlink) {
+				t.Errorf("got downlink error %v, want %v", err, tt.downlink)
+			}
+		})
+	}
+}
+
+// Entries are dropped when the cache is full
+func TestCacheMaxEntries(t *testing.T) {
+	m := NewMemory()
+	insertAll(t, m, []database_api.Rule{downlink(t, "", 0)})
+	c := NewCache(m, 2)
+	c.SetActive(true)
+	for i, want := range []int{1, 2, 1, 2} {
+		ue := netip.AddrFrom4([4]byte{10, 45, 0, byte(i)})
+		if _, err := c.GetDownlinkAction(context.Background(), ue); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.CacheStats().Entries; got != want {
+			t.Errorf("lookup %d: got %d entries, want %d", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nextmn/srv6/internal/config"
+)
+
+// Value from the environment variable if set, otherwise from the configuration
+func fromEnv(name string, conf *string) (string, bool) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	if conf != nil {
+		return *conf, true
+	}
+	return "", false
+}
+
+// Content of a file, without the final newline
+func readSecret(file string, what string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Could not read file %s to get postgres %s", file, what)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Quote a value of a connection string
+func quoteConninfo(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// Connection string of the postgres database, from the configuration
+// and POSTGRES_* environment variables (which take precedence)
+func PostgresConninfo(conf *config.Database) (string, error) {
+	if conf == nil {
+		conf = &config.Database{}
+	}
+	params := make([]string, 0)
+	add := func(key string, value string) {
+		params = append(params, key+"="+quoteConninfo(value))
+	}
+
+	user, ok := os.LookupEnv("POSTGRES_USER")
+	if !ok {
+		if userFile, ok := os.LookupEnv("POSTGRES_USER_FILE"); ok {
+			u, err := readSecret(userFile, "user")
+			if err != nil {
+				return "", err
+			}
+			user = u
+		} else if conf.User != nil {
+			user = *conf.User
+		} else {
+			user = "postgres"
+		}
+	}
+	dbname, ok := fromEnv("POSTGRES_DB", conf.DBName)
+	if !ok {
+		dbname = user
+	}
+
+	if unixSocket, ok := fromEnv("POSTGRES_UNIX_SOCKET_PATH", conf.UnixSocket); ok {
+		unixSocketPath := path.Clean(unixSocket)
+		if unixSocketPath != "/" {
+			unixSocketPath += "/"
+		}
+		add("host", unixSocketPath)
+	} else {
+		host, ok := fromEnv("POSTGRES_HOST", conf.Host)
+		if !ok {
+			return "", fmt.Errorf("No host provided for postgres")
+		}
+		port := "5432"
+		if conf.Port != nil {
+			port = strconv.Itoa(int(*conf.Port))
+		}
+		if p, ok := os.LookupEnv("POSTGRES_PORT"); ok {
+			port = p
+		}
+		password, ok := os.LookupEnv("POSTGRES_PASSWORD")
+		if !ok {
+			passwordFile, ok := fromEnv("POSTGRES_PASSWORD_FILE", conf.PasswordFile)
+			if !ok {
+				return "", fmt.Errorf("No password provided for postgres")
+			}
+			p, err := readSecret(passwordFile, "password")
+			if err != nil {
+				return "", err
+			}
+			password = p
+		}
+		add("host", host)
+		add("port", port)
+		add("password", password)
+	}
+	add("user", user)
+	add("dbname", dbname)
+
+	sslmode := conf.SSLModeOrDefault()
+	if s, ok := os.LookupEnv("POSTGRES_SSLMODE"); ok {
+		mode, err := config.ParsePostgresSSL(s)
+		if err != nil {
+			return "", err
+		}
+		sslmode = mode
+	}
+	add("sslmode", sslmode.String())
+	if sslmode != config.PostgresSSLDisable {
+		rootCert, hasRootCert := fromEnv("POSTGRES_SSLROOTCERT", conf.SSLRootCert)
+		cert, hasCert := fromEnv("POSTGRES_SSLCERT", conf.SSLCert)
+		key, hasKey := fromEnv("POSTGRES_SSLKEY", conf.SSLKey)
+		if hasCert != hasKey {
+			return "", fmt.Errorf("Client certificate and key for postgres must be provided together")
+		}
+		if (sslmode == config.PostgresSSLVerifyCA || sslmode == config.PostgresSSLVerifyFull) && !hasRootCert {
+			return "", fmt.Errorf("sslmode %s requires the CA certificate of the postgres server (sslrootcert)", sslmode)
+		}
+		if hasRootCert {
+			add("sslrootcert", rootCert)
+		}
+		if hasCert {
+			add("sslcert", cert)
+			add("sslkey", key)
+		}
+	}
+	if conf.StatementTimeout != nil {
+		// run-time parameter of the session, in milliseconds
+		params = append(params, fmt.Sprintf("statement_timeout=%d", conf.StatementTimeout.Milliseconds()))
+	}
+	return strings.Join(params, " "), nil
+}
+
+// Open the postgres database, and configure its pool of connections.
+// Returns the connection string, also used by listeners.
+func OpenPostgres(conf *config.Database) (*sql.DB, string, error) {
+	conninfo, err := PostgresConninfo(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	db, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error while openning postgres database: %s", err)
+	}
+	if conf != nil {
+		if conf.MaxOpenConns != nil {
+			db.SetMaxOpenConns(*conf.MaxOpenConns)
+		}
+		if conf.MaxIdleConns != nil {
+			db.SetMaxIdleConns(*conf.MaxIdleConns)
+		}
+		if conf.ConnMaxLifetime != nil {
+			db.SetConnMaxLifetime(*conf.ConnMaxLifetime)
+		}
+	}
+	return db, conninfo, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+)
+
+func TestQuoteConninfo(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string
+	}{
+		{"", `''`},
+		{"postgres", `'postgres'`},
+		{"with space", `'with space'`},
+		{"it's", `'it\'s'`},
+		{`back\slash`, `'back\\slash'`},
+		{`\'`, `'\\\''`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := quoteConninfo(tt.value); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Environment variables read by PostgresConninfo
+var postgresEnv = []string{
+	"POSTGRES_USER", "POSTGRES_USER_FILE", "POSTGRES_DB", "POSTGRES_UNIX_SOCKET_PATH",
+	"POSTGRES_HOST", "POSTGRES_PORT", "POSTGRES_PASSWORD", "POSTGRES_PASSWORD_FILE",
+	"POSTGRES_SSLMODE", "POSTGRES_SSLROOTCERT", "POSTGRES_SSLCERT", "POSTGRES_SSLKEY",
+}
+
+func TestPostgresConninfo(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	userFile := filepath.Join(dir, "user")
+	if err := os.WriteFile(userFile, []byte("srv6\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	port := uint16(5433)
+	verifyFull := config.PostgresSSLVerifyFull
+	require := config.PostgresSSLRequire
+	timeout := 1500 * time.Millisecond
+	for _, tt := range []struct {
+		name string
+		conf *config.Database
+		env  map[string]string
+		want string // connection string, or beginning of the error
+		err  bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"POSTGRES_HOST": "db", "POSTGRES_PASSWORD": "secret"},
+			want: "host='db' port='5432' password='secret' user='postgres' dbname='postgres' sslmode='disable'",
+		},
+		{
+			name: "configuration",
+			conf: &config.Database{Host: str("db"), Port: &port, User: str("srv6"), DBName: str("rules"), PasswordFile: &passwordFile, StatementTimeout: &timeout},
+			want: "host='db' port='5433' password='from file' user='srv6' dbname='rules' sslmode='disable' statement_timeout=1500",
+		},
+		{
+			name: "environment before configuration",
+			conf: &config.Database{Host: str("db"), Port: &port, User: str("srv6"), DBName: str("rules"), PasswordFile: str("/nonexistent")},
+			env:  map[string]string{"POSTGRES_HOST": "db2", "POSTGRES_PORT": "5434", "POSTGRES_USER": "admin", "POSTGRES_DB": "other", "POSTGRES_PASSWORD": "secret"},
+			want: "host='db2' port='5434' password='secret' user='admin' dbname='other' sslmode='disable'",
+		},
+		{
+			name: "password file from environment",
+			conf: &config.Database{Host: str("db"), PasswordFile: str("/nonexistent")},
+			env:  map[string]string{"POSTGRES_PASSWORD_FILE": passwordFile},
+			want: "host='db' port='5432' password='from file' user='postgres' dbname='postgres' sslmode='disable'",
+		},
+		{
+			name: "user file",
+			conf: &config.Database{User: str("other"), UnixSocket: str("/run/postgresql")},
+			env:  map[string]string{"POSTGRES_USER_FILE": userFile},
+			want: "host='/run/postgresql/' user='srv6' dbname='srv6' sslmode='disable'",
+		},
+		{
+			name: "unix socket before host",
+			conf: &config.Database{Host: str("db"), UnixSocket: str("/run/postgresql/")},
+			want: "host='/run/postgresql/' user='postgres' dbname='postgres' sslmode='disable'",
+		},
+		{
+			name: "quoted values",
+			env:  map[string]string{"POSTGRES_HOST": "db", "POSTGRES_PASSWORD": `it's a \ secret`},
+			want: `host='db' port='5432' password='it\'s a \\ secret' user='postgres' dbname='postgres' sslmode='disable'`,
+		},
+		{
+			name: "TLS",
+			conf: &config.Database{UnixSocket: str("/"), SSLMode: &verifyFull, SSLRootCert: str("/ca.pem"), SSLCert: str("/cert.pem"), SSLKey: str("/key.pem")},
+			want: "host='/' user='postgres' dbname='postgres' sslmode='verify-full' sslrootcert='/ca.pem' sslcert='/cert.pem' sslkey='/key.pem'",
+		},
+		{
+			name: "sslmode from environment",
+			conf: &config.Database{UnixSocket: str("/"), SSLMode: &verifyFull},
+			env:  map[string]string{"POSTGRES_SSLMODE": "require"},
+			want: "host='/' user='postgres' dbname='postgres' sslmode='require'",
+		},
+		{
+			name: "certificates ignored without TLS",
+			conf: &config.Database{UnixSocket: str("/"), SSLCert: str("/cert.pem")},
+			want: "host='/' user='postgres' dbname='postgres' sslmode='disable'",
+		},
+		{
+			name: "no host",
+			env:  map[string]string{"POSTGRES_PASSWORD": "secret"},
+			want: "No host provided",
+			err:  true,
+		},
+		{
+			name: "no password",
+			conf: &config.Database{Host: str("db")},
+			want: "No password provided",
+			err:  true,
+		},
+		{
+			name: "unreadable password file",
+			conf: &config.Database{Host: str("db"), PasswordFile: str(filepath.Join(dir, "nonexistent"))},
+			want: "Could not read file",
+			err:  true,
+		},
+		{
+			name: "unknown sslmode",
+			conf: &config.Database{UnixSocket: str("/")},
+			env:  map[string]string{"POSTGRES_SSLMODE": "prefer"},
+			want: "Unknown sslmode",
+			err:  true,
+		},
+		{
+			name: "verification without CA certificate",
+			conf: &config.Database{UnixSocket: str("/"), SSLMode: &verifyFull},
+			want: "sslmode verify-full requires",
+			err:  true,
+		},
+		{
+			name: "certificate without key",
+			conf: &config.Database{UnixSocket: str("/"), SSLMode: &require, SSLCert: str("/cert.pem")},
+			want: "Client certificate and key",
+			err:  true,
+		},
+		{
+			name: "key from environment",
+			conf: &config.Database{UnixSocket: str("/"), SSLMode: &require, SSLCert: str("/cert.pem")},
+			env:  map[string]string{"POSTGRES_SSLKEY": "/key.pem"},
+			want: "host='/' user='postgres' dbname='postgres' sslmode='require' sslcert='/cert.pem' sslkey='/key.pem'",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range postgresEnv {
+				// restored at the end of the test
+				t.Setenv(name, "")
+				os.Unsetenv(name)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			got, err := PostgresConninfo(tt.conf)
+			if tt.err {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+					t.Fatalf("got error %v, want %s", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Traffic of a rule, updated by headends without locking
+type counter struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	lastHit atomic.Int64 // unix nanoseconds, 0 if never hit
+	dirty   atomic.Bool  // changed since last written (bolt)
+}
+
+// Count a packet
+func (c *counter) add(size int, now int64) {
+	c.packets.Add(1)
+	c.bytes.Add(uint64(size))
+	c.lastHit.Store(now)
+	c.dirty.Store(true)
+}
+
+// Set the counter
+func (c *counter) store(v database_api.Counters) {
+	c.packets.Store(v.Packets)
+	c.bytes.Store(v.Bytes)
+	c.lastHit.Store(0)
+	if v.LastHit != nil {
+		c.lastHit.Store(v.LastHit.UnixNano())
+	}
+	c.dirty.Store(true)
+}
+
+// Value of the counter
+func (c *counter) load() database_api.Counters {
+	v := database_api.Counters{Packets: c.packets.Load(), Bytes: c.bytes.Load()}
+	if ns := c.lastHit.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		v.LastHit = &t
+	}
+	return v
+}
+
+// Value of the counter, which is reset to zero (last hit is kept)
+func (c *counter) drain() database_api.Counters {
+	v := database_api.Counters{Packets: c.packets.Swap(0), Bytes: c.bytes.Swap(0)}
+	if ns := c.lastHit.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		v.LastHit = &t
+	}
+	return v
+}
+
+// Sum of counters
+func addCounters(a, b database_api.Counters) database_api.Counters {
+	sum := database_api.Counters{Packets: a.Packets + b.Packets, Bytes: a.Bytes + b.Bytes, LastHit: a.LastHit}
+	if b.LastHit != nil && (sum.LastHit == nil || b.LastHit.After(*sum.LastHit)) {
+		sum.LastHit = b.LastHit
+	}
+	return sum
+}
+
+func (m *Memory) CountTraffic(id uuid.UUID, size int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if c, ok := m.traffic[id]; ok {
+		c.add(size, time.Now().UnixNano())
+	}
+}
+
+func (m *Memory) ResetCounters(ctx context.Context, id uuid.UUID) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.traffic[id]
+	if !ok {
+		return database_api.ErrRuleNotFound
+	}
+	c.store(database_api.Counters{})
+	return nil
+}
+
+// Bucket containing counters of rules, encoded in JSON, indexed by UUID
+var boltBucketCounters = []byte("counters")
+
+// Load counters from the bbolt database; counters of unknown rules are removed
+func (b *Bolt) loadCounters(tx *bolt.Tx) error {
+	bucket, err := tx.CreateBucketIfNotExists(boltBucketCounters)
+	if err != nil {
+		return err
+	}
+	unknown := make([][]byte, 0)
+	if err := bucket.ForEach(func(k, v []byte) error {
+		id, err := uuid.FromBytes(k)
+		if err != nil {
+			return err
+		}
+		c, ok := b.Memory.traffic[id]
+		if !ok {
+			unknown = append(unknown, k)
+			return nil
+		}
+		var counters database_api.Counters
+		if err := json.Unmarshal(v, &counters); err != nil {
+			return fmt.Errorf("Could not decode counters of rule %s: %w", id, err)
+		}
+		c.store(counters)
+		c.dirty.Store(false)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range unknown {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write counters changed since the last flush to the bbolt database
+func (b *Bolt) FlushCounters(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Memory.mu.RLock()
+	dirty := make(map[uuid.UUID]*counter)
+	for id, c := range b.Memory.traffic {
+		if c.dirty.Swap(false) {
+			dirty[id] = c
+		}
+	}
+	b.Memory.mu.RUnlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketCounters)
+		for id, c := range dirty {
+			v, err := json.Marshal(c.load())
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(id.Bytes(), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		// retried on next flush
+		for _, c := range dirty {
+			c.dirty.Store(true)
+		}
+		return err
+	}
+	return nil
+}
+
+// Counters reset are written immediately
+func (b *Bolt) ResetCounters(ctx context.Context, id uuid.UUID) error {
+	if err := b.Memory.ResetCounters(ctx, id); err != nil {
+		return err
+	}
+	return b.FlushCounters(ctx)
+}
+
+// Write counters of rules to the bbolt database periodically, until ctx is done
+func (b *Bolt) RunFlush(ctx context.Context) {
+	runFlush(ctx, flusher{"counters of rules", b.FlushCounters})
+}
+
+// Record traffic of a rule, written to the database by FlushCounters
+func (db *Database) CountTraffic(id uuid.UUID, size int) {
+	v, ok := db.traffic.Load(id)
+	if !ok {
+		v, _ = db.traffic.LoadOrStore(id, &counter{})
+	}
+	v.(*counter).add(size, time.Now().UnixNano())
+}
+
+// Traffic of a rule not yet written to the database
+func (db *Database) pendingCounters(id uuid.UUID) database_api.Counters {
+	if v, ok := db.traffic.Load(id); ok {
+		return v.(*counter).load()
+	}
+	return database_api.Counters{}
+}
+
+// Add traffic recorded since the last flush to counters of rules in the database
+func (db *Database) FlushCounters(ctx context.Context) error {
+	type entry struct {
+		c *counter
+		d database_api.Counters
+	}
+	pending := make(map[uuid.UUID]entry)
+	db.traffic.Range(func(k, v any) bool {
+		if d := v.(*counter).drain(); d.Packets > 0 {
+			pending[k.(uuid.UUID)] = entry{c: v.(*counter), d: d}
+		}
+		return true
+	})
+	if len(pending) == 0 {
+		return nil
+	}
+	stmt, ok := db.statement(ctx, nil, "add_rule_counters")
+	if !ok {
+		return fmt.Errorf("Procedure not registered")
+	}
+	ids := make([]string, 0, len(pending))
+	packets := make([]int64, 0, len(pending))
+	bytes := make([]int64, 0, len(pending))
+	lastHits := make([]string, 0, len(pending))
+	for id, e := range pending {
+		ids = append(ids, id.String())
+		packets = append(packets, int64(e.d.Packets))
+		bytes = append(bytes, int64(e.d.Bytes))
+		lastHits = append(lastHits, e.d.LastHit.Format(time.RFC3339Nano))
+	}
+	if _, err := stmt.ExecContext(ctx, pq.Array(ids), pq.Array(packets), pq.Array(bytes), pq.Array(lastHits)); err != nil {
+		// retried on next flush
+		for _, e := range pending {
+			e.c.packets.Add(e.d.Packets)
+			e.c.bytes.Add(e.d.Bytes)
+		}
+		return err
+	}
+	return nil
+}
+
+// Counters of a rule, including traffic not yet written to the database
+func (db *Database) getCounters(ctx context.Context, id uuid.UUID) (database_api.Counters, error) {
+	stmt, ok := db.statement(ctx, nil, "get_rule_counters")
+	if !ok {
+		return database_api.Counters{}, fmt.Errorf("Procedure not registered")
+	}
+	stored, err := scanCounters(stmt.QueryRowContext(ctx, id.String()).Scan, nil)
+	if err == sql.ErrNoRows {
+		// no traffic written yet
+		err = nil
+	}
+	if err != nil {
+		return database_api.Counters{}, err
+	}
+	return addCounters(stored, db.pendingCounters(id)), nil
+}
+
+// Counters of all rules, including traffic not yet written to the database
+func (db *Database) getAllCounters(ctx context.Context) (map[uuid.UUID]database_api.Counters, error) {
+	stmt, ok := db.statement(ctx, nil, "get_all_rule_counters")
+	if !ok {
+		return nil, fmt.Errorf("Procedure not registered")
+	}
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counters := make(map[uuid.UUID]database_api.Counters)
+	for rows.Next() {
+		var id uuid.UUID
+		c, err := scanCounters(rows.Scan, &id)
+		if err != nil {
+			return nil, err
+		}
+		counters[id] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	db.traffic.Range(func(k, v any) bool {
+		id := k.(uuid.UUID)
+		counters[id] = addCounters(counters[id], v.(*counter).load())
+		return true
+	})
+	return counters, nil
+}
+
+// Scan counters, preceded by the UUID of the rule if id is not nil
+func scanCounters(scan func(dest ...any) error, id *uuid.UUID) (database_api.Counters, error) {
+	var packets, bytes int64
+	var lastHit sql.NullTime
+	dest := []any{&packets, &bytes, &lastHit}
+	if id != nil {
+		dest = append([]any{id}, dest...)
+	}
+	if err := scan(dest...); err != nil {
+		return database_api.Counters{}, err
+	}
+	c := database_api.Counters{Packets: uint64(packets), Bytes: uint64(bytes)}
+	if lastHit.Valid {
+		c.LastHit = &lastHit.Time
+	}
+	return c, nil
+}
+
+func (db *Database) ResetCounters(ctx context.Context, id uuid.UUID) error {
+	stmt, ok := db.statement(ctx, nil, "reset_rule_counters")
+	if !ok {
+		return fmt.Errorf("Procedure not registered")
+	}
+	if v, ok := db.traffic.Load(id); ok {
+		v.(*counter).store(database_api.Counters{})
+	}
+	_, err := stmt.ExecContext(ctx, id.String())
+	return err
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gofrs/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAddCounters(t *testing.T) {
+	t1 := time.Unix(1, 0)
+	t2 := time.Unix(2, 0)
+	for _, tt := range []struct {
+		name string
+		a, b database_api.Counters
+		want database_api.Counters
+	}{
+		{"zero", database_api.Counters{}, database_api.Counters{}, database_api.Counters{}},
+		{"sum", database_api.Counters{Packets: 1, Bytes: 100}, database_api.Counters{Packets: 2, Bytes: 50}, database_api.Counters{Packets: 3, Bytes: 150}},
+		{"first hit", database_api.Counters{LastHit: &t1}, database_api.Counters{}, database_api.Counters{LastHit: &t1}},
+		{"second hit", database_api.Counters{}, database_api.Counters{LastHit: &t1}, database_api.Counters{LastHit: &t1}},
+		{"latest hit first", database_api.Counters{LastHit: &t2}, database_api.Counters{LastHit: &t1}, database_api.Counters{LastHit: &t2}},
+		{"latest hit second", database_api.Counters{LastHit: &t1}, database_api.Counters{LastHit: &t2}, database_api.Counters{LastHit: &t2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addCounters(tt.a, tt.b)
+			if got.Packets != tt.want.Packets || got.Bytes != tt.want.Bytes {
+				t.Errorf("got %d packets and %d bytes, want %d and %d", got.Packets, got.Bytes, tt.want.Packets, tt.want.Bytes)
+			}
+			if (got.LastHit == nil) != (tt.want.LastHit == nil) || (got.LastHit != nil && !got.LastHit.Equal(*tt.want.LastHit)) {
+				t.Errorf("got last hit %v, want %v", got.LastHit, tt.want.LastHit)
+			}
+		})
+	}
+}
+
+func TestCounterDrain(t *testing.T) {
+	var c counter
+	if v := c.load(); v.LastHit != nil {
+		t.Errorf("got last hit %v before the first packet, want none", v.LastHit)
+	}
+	c.add(100, 1)
+	c.add(50, 2)
+	v := c.drain()
+	if v.Packets != 2 || v.Bytes != 150 || v.LastHit == nil || v.LastHit.UnixNano() != 2 {
+		t.Errorf("got %+v, want 2 packets, 150 bytes, and last hit at 2ns", v)
+	}
+	v = c.load()
+	if v.Packets != 0 || v.Bytes != 0 || v.LastHit == nil {
+		t.Errorf("got %+v after drain, want no traffic, and the last hit kept", v)
+	}
+}
+
+// Counters of a rule of the store
+func ruleCounters(t *testing.T, s database_api.RuleStore, id uuid.UUID) database_api.Counters {
+	t.Helper()
+	r, err := s.GetRule(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Counters == nil {
+		t.Fatal("no counters")
+	}
+	return *r.Counters
+}
+
+func TestMemoryCounters(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	ids := insertAll(t, m, []database_api.Rule{apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t), downlink(t, "", 0)})
+	m.CountTraffic(ids[0], 100)
+	m.CountTraffic(ids[0], 50)
+	m.CountTraffic(ids[1], 10)
+	// ignored
+	m.CountTraffic(uuid.Must(uuid.NewV4()), 10)
+	if c := ruleCounters(t, m, ids[0]); c.Packets != 2 || c.Bytes != 150 || c.LastHit == nil {
+		t.Errorf("got %+v, want 2 packets and 150 bytes", c)
+	}
+	if err := m.ResetCounters(ctx, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if c := ruleCounters(t, m, ids[0]); c.Packets != 0 || c.Bytes != 0 || c.LastHit != nil {
+		t.Errorf("got %+v after reset, want zero", c)
+	}
+	if c := ruleCounters(t, m, ids[1]); c.Packets != 1 || c.Bytes != 10 {
+		t.Errorf("got %+v for the other rule, want 1 packet and 10 bytes", c)
+	}
+	if err := m.ResetCounters(ctx, uuid.Must(uuid.NewV4())); !errors.Is(err, database_api.ErrRuleNotFound) {
+		t.Errorf("got error %v, want %v", err, database_api.ErrRuleNotFound)
+	}
+}
+
+// Counters are written by FlushCounters and on reset, and loaded when reopening the database
+func TestBoltCounters(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name    string
+		update  func(b *Bolt, id uuid.UUID) error
+		packets uint64 // after reopening
+		bytes   uint64
+	}{
+		{"not flushed", func(b *Bolt, id uuid.UUID) error { return nil }, 0, 0},
+		{"flushed", func(b *Bolt, id uuid.UUID) error { return b.FlushCounters(ctx) }, 2, 150},
+		{"flushed twice", func(b *Bolt, id uuid.UUID) error {
+			if err := b.FlushCounters(ctx); err != nil {
+				return err
+			}
+			b.CountTraffic(id, 10)
+			return b.FlushCounters(ctx)
+		}, 3, 160},
+		{"reset", func(b *Bolt, id uuid.UUID) error {
+			if err := b.FlushCounters(ctx); err != nil {
+				return err
+			}
+			return b.ResetCounters(ctx, id)
+		}, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.db")
+			b, err := OpenBolt(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := b.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.CountTraffic(*id, 100)
+			b.CountTraffic(*id, 50)
+			if err := tt.update(b, *id); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			b, err = OpenBolt(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if c := ruleCounters(t, b, *id); c.Packets != tt.packets || c.Bytes != tt.bytes {
+				t.Errorf("got %d packets and %d bytes, want %d and %d", c.Packets, c.Bytes, tt.packets, tt.bytes)
+			}
+		})
+	}
+}
+
+// Counters of deleted rules are removed from the database
+func TestBoltCountersDeleted(t *testing.T) {
+	ctx := context.Background()
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "rules.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var ids []uuid.UUID
+	for _, gnb := range []string{"10.0.1.0/24", "10.0.2.0/24"} {
+		id, err := b.InsertRule(ctx, apitest.Uplink{GNB: gnb}.Rule(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.CountTraffic(*id, 100)
+		ids = append(ids, *id)
+	}
+	if err := b.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteRule(ctx, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ApplyBatch(ctx, []database_api.BatchOperation{{Op: database_api.BatchDelete, Uuid: &ids[1]}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(boltBucketCounters).Stats().KeyN; n != 0 {
+			t.Errorf("got %d counters, want none", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,13 +9,19 @@ import (
 	"context"
 	"database/sql"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/netip"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nextmn/json-api/jsonapi"
 	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
 
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
 	"github.com/gofrs/uuid"
 	"github.com/lib/pq"
 )
@@ -27,16 +33,10 @@ var database_sql string
 
 type Database struct {
 	*sql.DB
-	stmt map[string]*sql.Stmt
-}
-
-func (db *Database) prepare(ctx context.Context, name string, query string) error {
-	s, err := db.PrepareContext(ctx, query)
-	if err != nil {
-		return fmt.Errorf("Could not prepare statement %s: %s", name, err)
-	}
-	db.stmt[name] = s
-	return nil
+	stmtMu   sync.RWMutex // stmt is replaced by Reprepare
+	stmt     map[string]*sql.Stmt
+	activity sync.Map // uuid.UUID -> *atomic.Int64: activity of rules not yet written (see FlushActivity)
+	traffic  sync.Map // uuid.UUID -> *counter: traffic of rules not yet written (see FlushCounters)
 }
 
 func NewDatabase(db *sql.DB) *Database {
@@ -47,11 +47,19 @@ func NewDatabase(db *sql.DB) *Database {
 }
 
 func (db *Database) Init(ctx context.Context) error {
+	if _, err := db.Migrate(ctx); err != nil {
+		return fmt.Errorf("Could not migrate database: %s", err)
+	}
 	_, err := db.Exec(database_sql)
 	if err != nil {
 		return fmt.Errorf("Could not initialize database: %s", err)
 	}
-	l := map[string]string{}
+	return db.Reprepare(ctx)
+}
+
+// Prepare statements of all procedures
+func (db *Database) prepareAll(ctx context.Context) (map[string]*sql.Stmt, error) {
+	stmt := make(map[string]*sql.Stmt, len(procedures))
 	// use generated code
 	for k, v := range procedures {
 		args := []string{}
@@ -62,69 +70,111 @@ func (db *Database) Init(ctx context.Context) error {
 			args = append(args, "NULL")
 		}
 		strargs := strings.Join(args, ", ")
+		query := fmt.Sprintf("SELECT * FROM %s(%s)", k, strargs)
 		if v.is_procedure {
-			l[k] = fmt.Sprintf("CALL %s(%s)", k, strargs)
-		} else {
-			l[k] = fmt.Sprintf("SELECT * FROM %s(%s)", k, strargs)
+			query = fmt.Sprintf("CALL %s(%s)", k, strargs)
 		}
-
+		s, err := db.PrepareContext(ctx, query)
+		if err != nil {
+			for _, p := range stmt {
+				p.Close()
+			}
+			return nil, fmt.Errorf("Could not prepare statement %s: %s", k, err)
+		}
+		stmt[k] = s
 	}
+	return stmt, nil
+}
 
-	for k, v := range l {
-		if err := db.prepare(ctx, k, v); err != nil {
-			return fmt.Errorf("Could not prepare statement %s: %s", k, err)
-		}
+// Prepare statements again, e.g. after a reconnection to the database.
+// Previous statements are closed once queries using them are done.
+func (db *Database) Reprepare(ctx context.Context) error {
+	stmt, err := db.prepareAll(ctx)
+	if err != nil {
+		return err
+	}
+	db.stmtMu.Lock()
+	old := db.stmt
+	db.stmt = stmt
+	db.stmtMu.Unlock()
+	for _, s := range old {
+		s.Close()
 	}
 	return nil
 }
 
+// Prepared statement, used in the transaction tx if not nil
+func (db *Database) statement(ctx context.Context, tx *sql.Tx, name string) (*sql.Stmt, bool) {
+	db.stmtMu.RLock()
+	stmt, ok := db.stmt[name]
+	db.stmtMu.RUnlock()
+	if ok && tx != nil {
+		stmt = tx.StmtContext(ctx, stmt)
+	}
+	return stmt, ok
+}
+
 func (db *Database) Exit() {
+	db.stmtMu.Lock()
+	defer db.stmtMu.Unlock()
 	for k, v := range db.stmt {
 		v.Close()
 		delete(db.stmt, k)
 	}
 }
 
-func (db *Database) InsertRule(ctx context.Context, r n4tosrv6.Rule) (*uuid.UUID, error) {
+func (db *Database) InsertRule(ctx context.Context, r database_api.Rule) (*uuid.UUID, error) {
+	return db.insertRule(ctx, nil, r)
+}
+
+func (db *Database) insertRule(ctx context.Context, tx *sql.Tx, r database_api.Rule) (*uuid.UUID, error) {
+	if err := checkRule(r); err != nil {
+		return nil, err
+	}
 	srh := []string{}
 	for _, ip := range r.Action.SRH {
 		srh = append(srh, ip.String())
 	}
+	var expiresAt *string
+	if r.ExpiresAt != nil {
+		t := r.ExpiresAt.Format(time.RFC3339Nano)
+		expiresAt = &t
+	}
+	paths, err := json.Marshal(r.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if r.Paths == nil {
+		paths = []byte("[]")
+	}
+	// a /0 prefix matches any UE, of any IP version
+	ue := "0.0.0.0/0"
+	if p, ok := r.UE(); ok {
+		ue = p.String()
+	}
 	switch r.Type {
 	case "uplink":
-		var inneripsrc string
-		var inneripdst string
+		inneripsrc := ue
+		inneripdst := "0.0.0.0/0"
 		var outeripsrc []string
-		if r.Match.Header.InnerIpSrc == nil {
-			inneripsrc = "0.0.0.0/0"
-		} else {
-			inneripsrc = r.Match.Header.InnerIpSrc.String() + "/32"
-		}
-		if r.Match.Payload == nil {
-			inneripdst = "0.0.0.0/0"
-		} else {
-			inneripdst = r.Match.Payload.Dst.String() + "/32"
+		if service, ok := r.Service(); ok {
+			inneripdst = netip.PrefixFrom(service, service.BitLen()).String()
 		}
 		for _, i := range r.Match.Header.OuterIpSrc {
 			outeripsrc = append(outeripsrc, i.String())
 		}
 
-		if stmt, ok := db.stmt["insert_uplink_rule"]; ok {
+		if stmt, ok := db.statement(ctx, tx, "insert_uplink_rule"); ok {
 			var id uuid.UUID
-			err := stmt.QueryRowContext(ctx, r.Enabled, inneripsrc, pq.Array(outeripsrc), r.Match.Header.FTeid.Teid, r.Match.Header.FTeid.Addr.String(), inneripdst, pq.Array(srh)).Scan(&id)
+			err := stmt.QueryRowContext(ctx, r.Enabled, r.Priority, inneripsrc, pq.Array(outeripsrc), r.Match.Header.FTeid.Teid, r.Match.Header.FTeid.Addr.String(), inneripdst, pq.Array(srh), string(paths), expiresAt, r.InactivityTimeout).Scan(&id)
 			return &id, err
 		} else {
 			return nil, fmt.Errorf("Procedure not registered")
 		}
 	case "downlink":
-		if stmt, ok := db.stmt["insert_downlink_rule"]; ok {
+		if stmt, ok := db.statement(ctx, tx, "insert_downlink_rule"); ok {
 			var id uuid.UUID
-			var dst string
-			if r.Match.Payload == nil {
-				dst = "0.0.0.0/0"
-			} else {
-				dst = r.Match.Payload.Dst.String() + "/32"
-			}
+			dst := ue
 			src_ipv6 := "::"
 			if r.Action.SourceGtp4 != nil {
 				src_ipv6 = r.Action.SourceGtp4.String()
@@ -132,7 +182,7 @@ func (db *Database) InsertRule(ctx context.Context, r n4tosrv6.Rule) (*uuid.UUID
 				return nil, fmt.Errorf("Empty SourceGtp4 for downlink Action")
 			}
 
-			err := stmt.QueryRowContext(ctx, r.Enabled, dst, pq.Array(srh), src_ipv6).Scan(&id)
+			err := stmt.QueryRowContext(ctx, r.Enabled, r.Priority, dst, pq.Array(srh), string(paths), src_ipv6, expiresAt, r.InactivityTimeout).Scan(&id)
 			return &id, err
 		} else {
 			return nil, fmt.Errorf("Procedure not registered")
@@ -142,9 +192,10 @@ func (db *Database) InsertRule(ctx context.Context, r n4tosrv6.Rule) (*uuid.UUID
 	}
 }
 
-func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule, error) {
+func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (database_api.Rule, error) {
 	var type_uplink bool
 	var enabled bool
+	var priority int32
 	var action_srh []string
 	var action_source_gtp4 *string
 	var match_ue_ip string
@@ -152,10 +203,17 @@ func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule,
 	var match_service_ip *string
 	var match_uplink_teid *uint32
 	var match_uplink_upf *string
-	if stmt, ok := db.stmt["get_rule"]; ok {
-		err := stmt.QueryRowContext(ctx, uuid.String()).Scan(&type_uplink, &enabled, pq.Array(&action_srh), &action_source_gtp4, &match_ue_ip, pq.Array(&match_gnb_ip), &match_uplink_teid, &match_uplink_upf, &match_service_ip)
+	var expires_at *time.Time
+	var inactivity_timeout uint32
+	var last_active time.Time
+	var action_paths []byte
+	if stmt, ok := db.statement(ctx, nil, "get_rule"); ok {
+		err := stmt.QueryRowContext(ctx, uuid.String()).Scan(&type_uplink, &enabled, &priority, pq.Array(&action_srh), &action_source_gtp4, &match_ue_ip, pq.Array(&match_gnb_ip), &match_uplink_teid, &match_uplink_upf, &match_service_ip, &expires_at, &inactivity_timeout, &last_active, &action_paths)
+		if errors.Is(err, sql.ErrNoRows) {
+			return database_api.Rule{}, database_api.ErrRuleNotFound
+		}
 		if err != nil {
-			return n4tosrv6.Rule{}, err
+			return database_api.Rule{}, err
 		}
 		rule := n4tosrv6.Rule{
 			Enabled: enabled,
@@ -169,14 +227,14 @@ func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule,
 			for _, i := range match_gnb_ip {
 				p, err := netip.ParsePrefix(i)
 				if err != nil {
-					return n4tosrv6.Rule{}, err
+					return database_api.Rule{}, err
 				}
 				rule.Match.Header.OuterIpSrc = append(rule.Match.Header.OuterIpSrc, p)
 			}
 			if match_uplink_upf != nil && match_uplink_teid != nil {
 				addr, err := netip.ParseAddr(*match_uplink_upf)
 				if err != nil {
-					return n4tosrv6.Rule{}, err
+					return database_api.Rule{}, err
 				}
 				rule.Match.Header.FTeid = jsonapi.Fteid{
 					Teid: *match_uplink_teid,
@@ -185,7 +243,7 @@ func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule,
 			}
 			if match_service_ip != nil {
 				p, err := netip.ParsePrefix(*match_service_ip)
-				if err == nil && p.Bits() == 32 {
+				if err == nil && p.Bits() > 0 && p.IsSingleIP() {
 					rule.Match.Payload = &n4tosrv6.Payload{
 						Dst: p.Addr(),
 					}
@@ -194,20 +252,9 @@ func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule,
 		} else {
 			rule.Type = "downlink"
 		}
-		p, err := netip.ParsePrefix(match_ue_ip)
-		if err == nil && p.Bits() == 32 {
-			if type_uplink {
-				a := p.Addr()
-				rule.Match.Header.InnerIpSrc = &a
-			} else {
-				rule.Match.Payload = &n4tosrv6.Payload{
-					Dst: p.Addr(),
-				}
-			}
-		}
 		srh, err := n4tosrv6.NewSRH(action_srh)
 		if err != nil {
-			return n4tosrv6.Rule{}, err
+			return database_api.Rule{}, err
 		}
 
 		if action_source_gtp4 == nil {
@@ -219,7 +266,7 @@ func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule,
 
 			source_gtp4, err := netip.ParseAddr(*action_source_gtp4)
 			if err != nil {
-				return n4tosrv6.Rule{}, err
+				return database_api.Rule{}, err
 			}
 
 			rule.Action = n4tosrv6.Action{
@@ -227,15 +274,29 @@ func (db *Database) GetRule(ctx context.Context, uuid uuid.UUID) (n4tosrv6.Rule,
 				SourceGtp4: &source_gtp4,
 			}
 		}
-		return rule, err
+		r := database_api.Rule{Rule: rule, Priority: priority, ExpiresAt: expires_at, InactivityTimeout: inactivity_timeout}
+		if r.Paths, err = decodePaths(action_paths); err != nil {
+			return database_api.Rule{}, err
+		}
+		if p, err := netip.ParsePrefix(match_ue_ip); err == nil {
+			r.UEPrefix = &p
+		}
+		r.LastActive = db.lastActive(uuid, last_active)
+		counters, err := db.getCounters(ctx, uuid)
+		if err != nil {
+			return database_api.Rule{}, err
+		}
+		r.Counters = &counters
+		return r.Normalized(), nil
 	}
-	return n4tosrv6.Rule{}, fmt.Errorf("Procedure not registered")
+	return database_api.Rule{}, fmt.Errorf("Procedure not registered")
 }
 
-func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
+func (db *Database) GetRules(ctx context.Context) (database_api.RuleMap, error) {
 	var uuid uuid.UUID
 	var type_uplink bool
 	var enabled bool
+	var priority int32
 	var action_srh []string
 	var action_source_gtp4 *string
 	var match_ue_ip string
@@ -243,21 +304,26 @@ func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
 	var match_uplink_teid *uint32
 	var match_uplink_upf *string
 	var match_service_ip *string
-	m := n4tosrv6.RuleMap{}
-	if stmt, ok := db.stmt["get_all_rules"]; ok {
+	var expires_at *time.Time
+	var inactivity_timeout uint32
+	var last_active time.Time
+	var action_paths []byte
+	m := database_api.RuleMap{}
+	if stmt, ok := db.statement(ctx, nil, "get_all_rules"); ok {
 		rows, err := stmt.QueryContext(ctx)
 		if err != nil {
-			return m, nil
+			return database_api.RuleMap{}, err
 		}
+		defer rows.Close()
 		for rows.Next() {
 			select {
 			case <-ctx.Done():
 				// avoid looping if no longer necessary
-				return n4tosrv6.RuleMap{}, ctx.Err()
+				return database_api.RuleMap{}, ctx.Err()
 			default:
-				err := rows.Scan(&uuid, &type_uplink, &enabled, pq.Array(&action_srh), &action_source_gtp4, &match_ue_ip, pq.Array(&match_gnb_ip), &match_uplink_teid, &match_uplink_upf, &match_service_ip)
+				err := rows.Scan(&uuid, &type_uplink, &enabled, &priority, pq.Array(&action_srh), &action_source_gtp4, &match_ue_ip, pq.Array(&match_gnb_ip), &match_uplink_teid, &match_uplink_upf, &match_service_ip, &expires_at, &inactivity_timeout, &last_active, &action_paths)
 				if err != nil {
-					return m, err
+					return database_api.RuleMap{}, err
 				}
 				rule := n4tosrv6.Rule{
 					Enabled: enabled,
@@ -270,14 +336,14 @@ func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
 					for _, i := range match_gnb_ip {
 						p, err := netip.ParsePrefix(i)
 						if err != nil {
-							return n4tosrv6.RuleMap{}, err
+							return database_api.RuleMap{}, err
 						}
 						rule.Match.Header.OuterIpSrc = append(rule.Match.Header.OuterIpSrc, p)
 					}
 					if match_uplink_upf != nil && match_uplink_teid != nil {
 						addr, err := netip.ParseAddr(*match_uplink_upf)
 						if err != nil {
-							return n4tosrv6.RuleMap{}, err
+							return database_api.RuleMap{}, err
 						}
 						rule.Match.Header.FTeid = jsonapi.Fteid{
 							Teid: *match_uplink_teid,
@@ -286,7 +352,7 @@ func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
 					}
 					if match_service_ip != nil {
 						p, err := netip.ParsePrefix(*match_service_ip)
-						if err == nil && p.Bits() == 32 {
+						if err == nil && p.Bits() > 0 && p.IsSingleIP() {
 							rule.Match.Payload = &n4tosrv6.Payload{
 								Dst: p.Addr(),
 							}
@@ -295,21 +361,10 @@ func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
 				} else {
 					rule.Type = "downlink"
 				}
-				p, err := netip.ParsePrefix(match_ue_ip)
-				if err == nil && p.Bits() == 32 {
-					if type_uplink {
-						a := p.Addr()
-						rule.Match.Header.InnerIpSrc = &a
-					} else {
-						rule.Match.Payload = &n4tosrv6.Payload{
-							Dst: p.Addr(),
-						}
-					}
-				}
 
 				srh, err := n4tosrv6.NewSRH(action_srh)
 				if err != nil {
-					return n4tosrv6.RuleMap{}, err
+					return database_api.RuleMap{}, err
 				}
 
 				if action_source_gtp4 == nil {
@@ -320,7 +375,7 @@ func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
 				} else {
 					source_gtp4, err := netip.ParseAddr(*action_source_gtp4)
 					if err != nil {
-						return n4tosrv6.RuleMap{}, err
+						return database_api.RuleMap{}, err
 					}
 
 					rule.Action = n4tosrv6.Action{
@@ -328,17 +383,80 @@ func (db *Database) GetRules(ctx context.Context) (n4tosrv6.RuleMap, error) {
 						SourceGtp4: &source_gtp4,
 					}
 				}
-				m[uuid] = rule
+				r := database_api.Rule{Rule: rule, Priority: priority, ExpiresAt: expires_at, InactivityTimeout: inactivity_timeout}
+				if r.Paths, err = decodePaths(action_paths); err != nil {
+					return database_api.RuleMap{}, err
+				}
+				if p, err := netip.ParsePrefix(match_ue_ip); err == nil {
+					r.UEPrefix = &p
+				}
+				r.LastActive = db.lastActive(uuid, last_active)
+				m[uuid] = r.Normalized()
 			}
 		}
+		if err := rows.Err(); err != nil {
+			return database_api.RuleMap{}, err
+		}
+		counters, err := db.getAllCounters(ctx)
+		if err != nil {
+			return database_api.RuleMap{}, err
+		}
+		for id, r := range m {
+			c := counters[id]
+			r.Counters = &c
+			m[id] = r
+		}
 		return m, nil
 
 	}
-	return n4tosrv6.RuleMap{}, fmt.Errorf("Procedure not registered")
+	return database_api.RuleMap{}, fmt.Errorf("Procedure not registered")
 }
 
-func (db *Database) EnableRule(ctx context.Context, uuid uuid.UUID) error {
-	if stmt, ok := db.stmt["enable_rule"]; ok {
+// Reports if the rule exists; in a transaction, the rule is locked until its end
+func (db *Database) exists(ctx context.Context, tx *sql.Tx, id uuid.UUID) (bool, error) {
+	var row *sql.Row
+	if tx != nil {
+		row = tx.QueryRowContext(ctx, "SELECT uuid FROM rule WHERE uuid = $1 FOR UPDATE", id.String())
+	} else {
+		row = db.QueryRowContext(ctx, "SELECT uuid FROM rule WHERE uuid = $1", id.String())
+	}
+	err := row.Scan(new(string))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Run f in a transaction, once rules are checked to exist
+func (db *Database) withRules(ctx context.Context, ids []uuid.UUID, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		ok, err := db.exists(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return database_api.ErrRuleNotFound
+		}
+	}
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *Database) EnableRule(ctx context.Context, id uuid.UUID) error {
+	return db.withRules(ctx, []uuid.UUID{id}, func(tx *sql.Tx) error {
+		return db.enableRule(ctx, tx, id)
+	})
+}
+
+func (db *Database) enableRule(ctx context.Context, tx *sql.Tx, uuid uuid.UUID) error {
+	if stmt, ok := db.statement(ctx, tx, "enable_rule"); ok {
 		_, err := stmt.ExecContext(ctx, uuid.String())
 		return err
 	} else {
@@ -346,8 +464,14 @@ func (db *Database) EnableRule(ctx context.Context, uuid uuid.UUID) error {
 	}
 }
 
-func (db *Database) DisableRule(ctx context.Context, uuid uuid.UUID) error {
-	if stmt, ok := db.stmt["disable_rule"]; ok {
+func (db *Database) DisableRule(ctx context.Context, id uuid.UUID) error {
+	return db.withRules(ctx, []uuid.UUID{id}, func(tx *sql.Tx) error {
+		return db.disableRule(ctx, tx, id)
+	})
+}
+
+func (db *Database) disableRule(ctx context.Context, tx *sql.Tx, uuid uuid.UUID) error {
+	if stmt, ok := db.statement(ctx, tx, "disable_rule"); ok {
 		_, err := stmt.ExecContext(ctx, uuid.String())
 		return err
 	} else {
@@ -356,7 +480,13 @@ func (db *Database) DisableRule(ctx context.Context, uuid uuid.UUID) error {
 }
 
 func (db *Database) SwitchRule(ctx context.Context, uuidEnable uuid.UUID, uuidDisable uuid.UUID) error {
-	if stmt, ok := db.stmt["switch_rule"]; ok {
+	return db.withRules(ctx, []uuid.UUID{uuidEnable, uuidDisable}, func(tx *sql.Tx) error {
+		return db.switchRule(ctx, tx, uuidEnable, uuidDisable)
+	})
+}
+
+func (db *Database) switchRule(ctx context.Context, tx *sql.Tx, uuidEnable uuid.UUID, uuidDisable uuid.UUID) error {
+	if stmt, ok := db.statement(ctx, tx, "switch_rule"); ok {
 		_, err := stmt.ExecContext(ctx, uuidEnable.String(), uuidDisable.String())
 		return err
 	} else {
@@ -364,8 +494,18 @@ func (db *Database) SwitchRule(ctx context.Context, uuidEnable uuid.UUID, uuidDi
 	}
 }
 
-func (db *Database) DeleteRule(ctx context.Context, uuid uuid.UUID) error {
-	if stmt, ok := db.stmt["delete_rule"]; ok {
+func (db *Database) DeleteRule(ctx context.Context, id uuid.UUID) error {
+	if err := db.withRules(ctx, []uuid.UUID{id}, func(tx *sql.Tx) error {
+		return db.deleteRule(ctx, tx, id)
+	}); err != nil {
+		return err
+	}
+	db.traffic.Delete(id)
+	return nil
+}
+
+func (db *Database) deleteRule(ctx context.Context, tx *sql.Tx, uuid uuid.UUID) error {
+	if stmt, ok := db.statement(ctx, tx, "delete_rule"); ok {
 		_, err := stmt.ExecContext(ctx, uuid.String())
 		return err
 	} else {
@@ -373,68 +513,145 @@ func (db *Database) DeleteRule(ctx context.Context, uuid uuid.UUID) error {
 	}
 }
 
-func (db *Database) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (n4tosrv6.Action, error) {
+func (db *Database) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (database_api.Action, error) {
+	return db.getUplinkAction(ctx, uplinkFTeid, gnbIp, ueIp.String(), serviceIp.String())
+}
+
+// End Marker has no T-PDU: any UE IP Address and Service IP Address are matched
+func (db *Database) GetUplinkEndMarkerAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr) (database_api.Action, error) {
+	return db.getUplinkAction(ctx, uplinkFTeid, gnbIp, nil, nil)
+}
+
+// ueIp and serviceIp are nil to match any address
+func (db *Database) getUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp any, serviceIp any) (database_api.Action, error) {
+	var id uuid.UUID
 	var action_srh []string
-	if stmt, ok := db.stmt["get_uplink_action"]; ok {
-		err := stmt.QueryRowContext(ctx, uplinkFTeid.Teid, uplinkFTeid.Addr.String(), gnbIp.String(), ueIp.String(), serviceIp.String()).Scan(pq.Array(&action_srh))
+	var action_paths []byte
+	if stmt, ok := db.statement(ctx, nil, "get_uplink_action"); ok {
+		err := stmt.QueryRowContext(ctx, uplinkFTeid.Teid, uplinkFTeid.Addr.String(), gnbIp.String(), ueIp, serviceIp).Scan(&id, pq.Array(&action_srh), &action_paths)
+		if errors.Is(err, sql.ErrNoRows) {
+			return database_api.Action{}, database_api.ErrNoMatchingRule
+		}
 		if err != nil {
-			return n4tosrv6.Action{}, err
+			return database_api.Action{}, err
 		}
 		srh, err := n4tosrv6.NewSRH(action_srh)
 		if err != nil {
-			return n4tosrv6.Action{}, err
+			return database_api.Action{}, err
 		}
-		return n4tosrv6.Action{
-			SRH: *srh,
+		paths, err := decodePaths(action_paths)
+		if err != nil {
+			return database_api.Action{}, err
+		}
+		db.touch(id, time.Now())
+		return database_api.Action{
+			Action: n4tosrv6.Action{
+				SRH: *srh,
+			},
+			Paths: paths,
+			Rule:  id,
 		}, err
 	} else {
-		return n4tosrv6.Action{}, fmt.Errorf("Procedure not registered")
+		return database_api.Action{}, fmt.Errorf("Procedure not registered")
 	}
 }
 
-func (db *Database) GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (n4tosrv6.Action, error) {
+func (db *Database) GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (database_api.Action, error) {
+	var id uuid.UUID
 	var action_srh []string
 	var action_source_gtp4 *string
-	if stmt, ok := db.stmt["get_downlink_action"]; ok {
-		err := stmt.QueryRowContext(ctx, ueIp.String()).Scan(pq.Array(&action_srh), &action_source_gtp4)
+	var action_paths []byte
+	if stmt, ok := db.statement(ctx, nil, "get_downlink_action"); ok {
+		err := stmt.QueryRowContext(ctx, ueIp.String()).Scan(&id, pq.Array(&action_srh), &action_source_gtp4, &action_paths)
+		if errors.Is(err, sql.ErrNoRows) {
+			return database_api.Action{}, database_api.ErrNoMatchingRule
+		}
 		if err != nil {
-			return n4tosrv6.Action{}, err
+			return database_api.Action{}, err
 		}
 		srh, err := n4tosrv6.NewSRH(action_srh)
 		if err != nil {
-			return n4tosrv6.Action{}, err
+			return database_api.Action{}, err
 		}
 		if action_source_gtp4 == nil {
-			return n4tosrv6.Action{}, fmt.Errorf("Empty SourceGtp4 for downlink rule")
+			return database_api.Action{}, fmt.Errorf("Empty SourceGtp4 for downlink rule")
 		}
 		source_gtp4, err := netip.ParseAddr(*action_source_gtp4)
 		if err != nil {
-			return n4tosrv6.Action{}, err
+			return database_api.Action{}, err
 		}
-		return n4tosrv6.Action{
-			SRH:        *srh,
-			SourceGtp4: &source_gtp4,
+		paths, err := decodePaths(action_paths)
+		if err != nil {
+			return database_api.Action{}, err
+		}
+		db.touch(id, time.Now())
+		return database_api.Action{
+			Action: n4tosrv6.Action{
+				SRH:        *srh,
+				SourceGtp4: &source_gtp4,
+			},
+			Paths: paths,
+			Rule:  id,
 		}, err
 	} else {
-		return n4tosrv6.Action{}, fmt.Errorf("Procedure not registered")
+		return database_api.Action{}, fmt.Errorf("Procedure not registered")
 	}
 }
 
-func (db *Database) UpdateAction(ctx context.Context, uuidRule uuid.UUID, action n4tosrv6.Action) error {
-	srh := []string{}
-	source_gtp4 := "::"
-	if action.SourceGtp4 != nil {
-		source_gtp4 = action.SourceGtp4.String()
-	} else {
-		return fmt.Errorf("Empty SourceGtp4 for downlink rule")
+func (db *Database) UpdateAction(ctx context.Context, uuidRule uuid.UUID, action database_api.ActionUpdate) error {
+	if err := checkAction(action); err != nil {
+		return err
 	}
+	return db.withRules(ctx, []uuid.UUID{uuidRule}, func(tx *sql.Tx) error {
+		return db.updateAction(ctx, tx, uuidRule, action)
+	})
+}
+
+func (db *Database) updateAction(ctx context.Context, tx *sql.Tx, uuidRule uuid.UUID, action database_api.ActionUpdate) error {
+	if err := checkAction(action); err != nil {
+		return err
+	}
+	paths, err := json.Marshal(action.Paths)
+	if err != nil {
+		return err
+	}
+	srh := []string{}
+	source_gtp4 := action.SourceGtp4.String()
 	for _, ip := range action.SRH {
 		srh = append(srh, ip.String())
 	}
-	if stmt, ok := db.stmt["update_action"]; ok {
-		_, err := stmt.ExecContext(ctx, uuidRule.String(), pq.Array(srh), source_gtp4)
+	if stmt, ok := db.statement(ctx, tx, "update_action"); ok {
+		_, err := stmt.ExecContext(ctx, uuidRule.String(), pq.Array(srh), string(paths), source_gtp4)
 		return err
 	} else {
 		return fmt.Errorf("Procedure not registered")
 	}
 }
+
+func (db *Database) SetPathState(ctx context.Context, uuid uuid.UUID, index int, down bool) error {
+	r, err := db.GetRule(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(r.Paths) {
+		return database_api.ErrPathNotFound
+	}
+	if stmt, ok := db.statement(ctx, nil, "set_path_state"); ok {
+		_, err := stmt.ExecContext(ctx, uuid.String(), index, down)
+		return err
+	} else {
+		return fmt.Errorf("Procedure not registered")
+	}
+}
+
+// Decode paths stored in JSON
+func decodePaths(b []byte) ([]database_api.Path, error) {
+	var paths []database_api.Path
+	if err := json.Unmarshal(b, &paths); err != nil {
+		return nil, fmt.Errorf("Could not decode paths: %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return paths, nil
+}
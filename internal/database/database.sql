@@ -1,46 +1,40 @@
 -- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
 -- Use of this source code is governed by a MIT-style license that can be
 -- SPDX-License-Identifier: MIT
-CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
-
-CREATE TABLE IF NOT EXISTS rule (
-	uuid UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-	type_uplink BOOL NOT NULL,
-	enabled BOOL NOT NULL,
-	action_srh INET ARRAY NOT NULL,
-	action_source_gtp4 INET,
-	match_ue_ip CIDR NOT NULL,
-	match_gnb_ip CIDR ARRAY,
-	match_service_ip CIDR,
-	match_uplink_teid BIGINT,
-	match_uplink_upf INET
-);
 
+-- Tables are created by migrations (see migrations/),
+-- procedures and functions are replaced on each start.
 
 CREATE OR REPLACE PROCEDURE insert_uplink_rule(
-	IN in_enabled BOOL, IN in_ue_ip CIDR,
+	IN in_enabled BOOL, IN in_priority INTEGER, IN in_ue_ip CIDR,
 	IN in_gnb_ip CIDR ARRAY,
 	IN in_uplink_teid BIGINT, IN in_uplink_upf INET,
 	IN in_service_ip CIDR,
-	IN in_srh INET ARRAY,
+	IN in_srh INET ARRAY, IN in_paths JSONB,
+	IN in_expires_at TIMESTAMPTZ, IN in_inactivity_timeout INTEGER,
 	OUT out_uuid UUID
 )
 LANGUAGE plpgsql AS $$
 BEGIN
-	INSERT INTO rule(type_uplink, enabled, match_ue_ip, match_gnb_ip, match_uplink_teid, match_uplink_upf, match_service_ip, action_srh)
-		VALUES(TRUE, in_enabled, in_ue_ip, in_gnb_ip, in_uplink_teid, in_uplink_upf, in_service_ip, in_srh) RETURNING rule.uuid INTO out_uuid;
+	INSERT INTO rule(type_uplink, enabled, priority, match_ue_ip, match_gnb_ip, match_uplink_teid, match_uplink_upf, match_service_ip, action_srh,
+			action_paths, expires_at, inactivity_timeout)
+		VALUES(TRUE, in_enabled, in_priority, in_ue_ip, in_gnb_ip, in_uplink_teid, in_uplink_upf, in_service_ip, in_srh,
+			in_paths, in_expires_at, in_inactivity_timeout)
+		RETURNING rule.uuid INTO out_uuid;
 END;$$;
 
 CREATE OR REPLACE PROCEDURE insert_downlink_rule(
-	IN in_enabled BOOL, IN in_ue_ip CIDR,
-	IN in_srh INET ARRAY,
+	IN in_enabled BOOL, IN in_priority INTEGER, IN in_ue_ip CIDR,
+	IN in_srh INET ARRAY, IN in_paths JSONB,
 	IN in_source_gtp4 INET,
+	IN in_expires_at TIMESTAMPTZ, IN in_inactivity_timeout INTEGER,
 	OUT out_uuid UUID
 )
 LANGUAGE plpgsql AS $$
 BEGIN
-	INSERT INTO rule(type_uplink, enabled, match_ue_ip, action_srh, action_source_gtp4)
-		VALUES(FALSE, in_enabled, in_ue_ip, in_srh, in_source_gtp4) RETURNING rule.uuid INTO out_uuid;
+	INSERT INTO rule(type_uplink, enabled, priority, match_ue_ip, action_srh, action_paths, action_source_gtp4, expires_at, inactivity_timeout)
+		VALUES(FALSE, in_enabled, in_priority, in_ue_ip, in_srh, in_paths, in_source_gtp4, in_expires_at, in_inactivity_timeout)
+		RETURNING rule.uuid INTO out_uuid;
 END;$$;
 
 
@@ -49,7 +43,8 @@ CREATE OR REPLACE PROCEDURE enable_rule(
 )
 LANGUAGE plpgsql AS $$
 BEGIN
-	UPDATE rule SET enabled = true WHERE rule.uuid = in_uuid;
+	-- inactivity is counted from the activation of the rule
+	UPDATE rule SET enabled = true, last_active = now() WHERE rule.uuid = in_uuid AND rule.enabled = false;
 END;$$;
 
 CREATE OR REPLACE PROCEDURE disable_rule(
@@ -66,7 +61,7 @@ CREATE OR REPLACE PROCEDURE switch_rule(
 )
 LANGUAGE plpgsql AS $$
 BEGIN
-	UPDATE rule SET enabled = true WHERE rule.uuid = in_uuid_enable;
+	UPDATE rule SET enabled = true, last_active = now() WHERE rule.uuid = in_uuid_enable AND rule.enabled = false;
 	UPDATE rule SET enabled = false WHERE rule.uuid = in_uuid_disable;
 END;$$;
 
@@ -81,49 +76,137 @@ END;$$;
 CREATE OR REPLACE PROCEDURE update_action(
 	IN in_uuid UUID,
 	IN in_srh INET ARRAY,
+	IN in_paths JSONB,
 	IN in_source_gtp4 INET
 )
 LANGUAGE plpgsql AS $$
 BEGIN
-	UPDATE rule SET action_srh = in_srh WHERE rule.uuid = in_uuid;
-	UPDATE rule SET action_source_gtp4 = in_source_gtp4 WHERE rule.uuid = in_uuid;
+	UPDATE rule SET action_srh = in_srh, action_paths = in_paths, action_source_gtp4 = in_source_gtp4
+		WHERE rule.uuid = in_uuid;
+END;$$;
+
+CREATE OR REPLACE PROCEDURE set_path_state(
+	IN in_uuid UUID, IN in_index INTEGER, IN in_down BOOL
+)
+LANGUAGE plpgsql AS $$
+BEGIN
+	UPDATE rule SET action_paths = jsonb_set(action_paths, ARRAY[in_index::text, 'down'], to_jsonb(in_down))
+		WHERE rule.uuid = in_uuid AND in_index < jsonb_array_length(rule.action_paths);
+END;$$;
+
+-- Activity of rules is recorded by headends, and written periodically
+CREATE OR REPLACE PROCEDURE update_last_active(
+	IN in_uuids UUID ARRAY, IN in_last_active TIMESTAMPTZ ARRAY
+)
+LANGUAGE plpgsql AS $$
+BEGIN
+	UPDATE rule SET last_active = greatest(rule.last_active, activity.last_active)
+		FROM unnest(in_uuids, in_last_active) AS activity(uuid, last_active)
+		WHERE rule.uuid = activity.uuid;
 END;$$;
 
+-- Traffic of rules is counted by headends, and added periodically
+CREATE OR REPLACE PROCEDURE add_rule_counters(
+	IN in_uuids UUID ARRAY, IN in_packets BIGINT ARRAY, IN in_bytes BIGINT ARRAY, IN in_last_hit TIMESTAMPTZ ARRAY
+)
+LANGUAGE plpgsql AS $$
+BEGIN
+	-- rules deleted meanwhile are ignored
+	INSERT INTO rule_counters(uuid, packets, bytes, last_hit)
+		SELECT traffic.uuid, traffic.packets, traffic.bytes, traffic.last_hit
+		FROM unnest(in_uuids, in_packets, in_bytes, in_last_hit) AS traffic(uuid, packets, bytes, last_hit)
+		JOIN rule ON rule.uuid = traffic.uuid
+		ON CONFLICT (uuid) DO UPDATE SET packets = rule_counters.packets + EXCLUDED.packets,
+			bytes = rule_counters.bytes + EXCLUDED.bytes,
+			last_hit = greatest(rule_counters.last_hit, EXCLUDED.last_hit);
+END;$$;
+
+CREATE OR REPLACE PROCEDURE reset_rule_counters(
+	IN in_uuid UUID
+)
+LANGUAGE plpgsql AS $$
+BEGIN
+	DELETE FROM rule_counters WHERE uuid = in_uuid;
+END;$$;
+
+CREATE OR REPLACE FUNCTION get_rule_counters(
+	IN in_uuid UUID
+)
+RETURNS TABLE (
+	t_packets BIGINT,
+	t_bytes BIGINT,
+	t_last_hit TIMESTAMPTZ
+)
+AS $$
+BEGIN
+	RETURN QUERY SELECT packets AS "t_packets", bytes AS "t_bytes", last_hit AS "t_last_hit"
+		FROM rule_counters
+		WHERE (rule_counters.uuid = in_uuid);
+END;$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_all_rule_counters()
+RETURNS TABLE (
+	t_uuid UUID,
+	t_packets BIGINT,
+	t_bytes BIGINT,
+	t_last_hit TIMESTAMPTZ
+)
+AS $$
+BEGIN
+	RETURN QUERY SELECT uuid AS "t_uuid", packets AS "t_packets", bytes AS "t_bytes", last_hit AS "t_last_hit"
+		FROM rule_counters;
+END;$$ LANGUAGE plpgsql;
+
 CREATE OR REPLACE FUNCTION get_uplink_action(
 	IN in_uplink_teid BIGINT, IN in_uplink_upf INET,
 	IN in_gnb_ip INET,
 	IN in_ue_ip INET, IN in_service_ip INET
 )
 RETURNS TABLE (
-	t_action_srh INET ARRAY
+	t_uuid UUID,
+	t_action_srh INET ARRAY,
+	t_action_paths JSONB
 )
 AS $$
 BEGIN
-	RETURN QUERY SELECT rule.action_srh AS "t_action_srh"
+	RETURN QUERY SELECT rule.uuid AS "t_uuid", rule.action_srh AS "t_action_srh", rule.action_paths AS "t_action_paths"
 		FROM rule
 		WHERE (rule.match_uplink_teid = in_uplink_teid
 			AND rule.match_uplink_upf && in_uplink_upf
 			AND in_gnb_ip <<= any (rule.match_gnb_ip)
-			AND rule.match_ue_ip && in_ue_ip
-			AND rule.match_service_ip && in_service_ip
+			-- a /0 prefix matches any address, of any IP version; NULL arguments match any rule (End Marker)
+			AND (in_ue_ip IS NULL OR masklen(rule.match_ue_ip) = 0 OR rule.match_ue_ip >>= in_ue_ip)
+			AND (in_service_ip IS NULL OR rule.match_service_ip IS NULL OR masklen(rule.match_service_ip) = 0
+				OR rule.match_service_ip >>= in_service_ip)
 			AND rule.enabled = TRUE
 			AND rule.type_uplink = TRUE
-		);
+		)
+		-- highest priority, then most specific rule
+		ORDER BY rule.priority DESC, coalesce(masklen(rule.match_service_ip), 0) DESC, masklen(rule.match_ue_ip) DESC,
+			(SELECT max(masklen(gnb)) FROM unnest(rule.match_gnb_ip) AS gnb WHERE in_gnb_ip <<= gnb) DESC,
+			rule.uuid ASC
+		LIMIT 1;
 END;$$ LANGUAGE plpgsql;
 
 CREATE OR REPLACE FUNCTION get_downlink_action(
 	IN in_ue_ip_address INET
 )
 RETURNS TABLE (
+	t_uuid UUID,
 	t_action_srh INET ARRAY,
-	t_action_source_gtp4 INET
+	t_action_source_gtp4 INET,
+	t_action_paths JSONB
 )
 AS $$
 BEGIN
-	RETURN QUERY SELECT rule.action_srh AS "t_action_srh", rule.action_source_gtp4 AS "t_action_source_gtp4"
+	RETURN QUERY SELECT rule.uuid AS "t_uuid", rule.action_srh AS "t_action_srh", rule.action_source_gtp4 AS "t_action_source_gtp4",
+		rule.action_paths AS "t_action_paths"
 		FROM rule
 		WHERE (rule.type_uplink = FALSE AND rule.enabled = TRUE
-			AND match_ue_ip && in_ue_ip_address);
+			AND (masklen(rule.match_ue_ip) = 0 OR rule.match_ue_ip >>= in_ue_ip_address))
+		-- highest priority, then most specific rule
+		ORDER BY rule.priority DESC, masklen(rule.match_ue_ip) DESC, rule.uuid ASC
+		LIMIT 1;
 END;$$ LANGUAGE plpgsql;
 
 CREATE OR REPLACE FUNCTION get_rule(
@@ -132,21 +215,28 @@ CREATE OR REPLACE FUNCTION get_rule(
 RETURNS TABLE (
 	t_type_uplink BOOL,
 	t_enabled BOOL,
+	t_priority INTEGER,
 	t_action_srh INET ARRAY,
 	t_action_source_gtp4 INET,
 	t_match_ue_ip CIDR,
 	t_match_gnb_ip CIDR ARRAY,
 	t_match_uplink_teid BIGINT,
 	t_match_uplink_upf INET,
-	t_match_service_ip CIDR
+	t_match_service_ip CIDR,
+	t_expires_at TIMESTAMPTZ,
+	t_inactivity_timeout INTEGER,
+	t_last_active TIMESTAMPTZ,
+	t_action_paths JSONB
 )
 AS $$
 BEGIN
-	RETURN QUERY SELECT type_uplink AS "t_type_uplink", enabled AS "t_enabled",
+	RETURN QUERY SELECT type_uplink AS "t_type_uplink", enabled AS "t_enabled", priority AS "t_priority",
 		action_srh AS "t_action_srh", action_source_gtp4 AS "t_action_source_gtp4",
 		match_ue_ip AS "t_match_ue_ip", match_gnb_ip AS "t_match_gnb_ip",
 		match_uplink_teid AS "t_match_uplink_teid", match_uplink_upf AS "t_match_uplink_upf",
-		match_service_ip AS "t_match_service_ip"
+		match_service_ip AS "t_match_service_ip",
+		expires_at AS "t_expires_at", inactivity_timeout AS "t_inactivity_timeout", last_active AS "t_last_active",
+		action_paths AS "t_action_paths"
 		FROM rule
 		WHERE (rule.uuid = in_uuid);
 END;$$ LANGUAGE plpgsql;
@@ -156,21 +246,53 @@ RETURNS TABLE (
 	t_uuid UUID,
 	t_type_uplink BOOL,
 	t_enabled BOOL,
+	t_priority INTEGER,
 	t_action_srh INET ARRAY,
 	t_action_source_gtp4 INET,
 	t_match_ue_ip CIDR,
 	t_match_gnb_ip CIDR ARRAY,
 	t_match_uplink_teid BIGINT,
 	t_match_uplink_upf INET,
-	t_match_service_ip CIDR
+	t_match_service_ip CIDR,
+	t_expires_at TIMESTAMPTZ,
+	t_inactivity_timeout INTEGER,
+	t_last_active TIMESTAMPTZ,
+	t_action_paths JSONB
 )
 AS $$
 BEGIN
 	RETURN QUERY SELECT uuid AS "t_uuid", type_uplink AS "t_type_uplink",
-		enabled AS "t_enabled",
+		enabled AS "t_enabled", priority AS "t_priority",
 		action_srh AS "t_action_srh", action_source_gtp4 AS "t_action_source_gtp4",
 		match_ue_ip AS "t_match_ue_ip", match_gnb_ip AS "t_match_gnb_ip",
 		match_uplink_teid AS "t_match_uplink_teid", match_uplink_upf AS "t_match_uplink_upf",
-		match_service_ip AS "t_match_service_ip"
+		match_service_ip AS "t_match_service_ip",
+		expires_at AS "t_expires_at", inactivity_timeout AS "t_inactivity_timeout", last_active AS "t_last_active",
+		action_paths AS "t_action_paths"
 		FROM rule;
 END;$$ LANGUAGE plpgsql;
+
+-- Controller-driven headends keep a cache of lookups,
+-- invalidated when rules are changed
+CREATE OR REPLACE FUNCTION notify_rule_change()
+RETURNS TRIGGER
+AS $$
+BEGIN
+	-- activity of rules does not change lookups
+	IF (TG_OP = 'UPDATE' AND (to_jsonb(OLD) - 'last_active') = (to_jsonb(NEW) - 'last_active')) THEN
+		RETURN NULL;
+	END IF;
+	IF (TG_OP = 'DELETE' OR TG_OP = 'UPDATE') THEN
+		PERFORM pg_notify('rule_change', json_build_object('uuid', OLD.uuid, 'type_uplink', OLD.type_uplink,
+			'uplink_teid', OLD.match_uplink_teid, 'uplink_upf', host(OLD.match_uplink_upf))::text);
+	END IF;
+	IF (TG_OP = 'INSERT' OR TG_OP = 'UPDATE') THEN
+		PERFORM pg_notify('rule_change', json_build_object('uuid', NEW.uuid, 'type_uplink', NEW.type_uplink,
+			'uplink_teid', NEW.match_uplink_teid, 'uplink_upf', host(NEW.match_uplink_upf))::text);
+	END IF;
+	RETURN NULL;
+END;$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS rule_change ON rule;
+CREATE TRIGGER rule_change AFTER INSERT OR UPDATE OR DELETE ON rule
+	FOR EACH ROW EXECUTE FUNCTION notify_rule_change();
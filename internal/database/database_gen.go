@@ -13,15 +13,21 @@ type procedureOrFunction struct {
 }
 
 var procedures = map[string]procedureOrFunction{
-	"insert_uplink_rule":   {is_procedure: true, num_in: 7, num_out: 1},
-	"insert_downlink_rule": {is_procedure: true, num_in: 4, num_out: 1},
-	"enable_rule":          {is_procedure: true, num_in: 1, num_out: 0},
-	"disable_rule":         {is_procedure: true, num_in: 1, num_out: 0},
-	"switch_rule":          {is_procedure: true, num_in: 2, num_out: 0},
-	"delete_rule":          {is_procedure: true, num_in: 1, num_out: 0},
-	"update_action":        {is_procedure: true, num_in: 3, num_out: 0},
-	"get_uplink_action":    {is_procedure: false, num_in: 5, num_out: 0},
-	"get_downlink_action":  {is_procedure: false, num_in: 1, num_out: 0},
-	"get_rule":             {is_procedure: false, num_in: 1, num_out: 0},
-	"get_all_rules":        {is_procedure: false, num_in: 0, num_out: 0},
+	"insert_uplink_rule":    {is_procedure: true, num_in: 11, num_out: 1},
+	"insert_downlink_rule":  {is_procedure: true, num_in: 8, num_out: 1},
+	"enable_rule":           {is_procedure: true, num_in: 1, num_out: 0},
+	"disable_rule":          {is_procedure: true, num_in: 1, num_out: 0},
+	"switch_rule":           {is_procedure: true, num_in: 2, num_out: 0},
+	"delete_rule":           {is_procedure: true, num_in: 1, num_out: 0},
+	"update_action":         {is_procedure: true, num_in: 4, num_out: 0},
+	"set_path_state":        {is_procedure: true, num_in: 3, num_out: 0},
+	"update_last_active":    {is_procedure: true, num_in: 2, num_out: 0},
+	"add_rule_counters":     {is_procedure: true, num_in: 4, num_out: 0},
+	"reset_rule_counters":   {is_procedure: true, num_in: 1, num_out: 0},
+	"get_rule_counters":     {is_procedure: false, num_in: 1, num_out: 0},
+	"get_all_rule_counters": {is_procedure: false, num_in: 0, num_out: 0},
+	"get_uplink_action":     {is_procedure: false, num_in: 5, num_out: 0},
+	"get_downlink_action":   {is_procedure: false, num_in: 1, num_out: 0},
+	"get_rule":              {is_procedure: false, num_in: 1, num_out: 0},
+	"get_all_rules":         {is_procedure: false, num_in: 0, num_out: 0},
 }
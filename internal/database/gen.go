@@ -23,6 +23,7 @@ const (
 	StateCheckProcedure
 	StateCheckFunction
 	StateCheckNbArgs
+	StateCheckReturns
 )
 
 type StateLine int
@@ -74,6 +75,8 @@ func main() {
 	stateParser := StateInit
 	nb_in := 0
 	nb_out := 0
+	entry := ""
+	is_procedure := false
 	for scanner.Scan() {
 		stateLine := StateLineRead
 		line := scanner.Text()
@@ -82,6 +85,7 @@ func main() {
 			case StateInit:
 				nb_in = 0
 				nb_out = 0
+				entry = ""
 				stateParser = StateCheckProcedure
 			case StateCheckProcedure:
 				psuffix, ok := strings.CutPrefix(line, "CREATE OR REPLACE PROCEDURE ")
@@ -91,9 +95,8 @@ func main() {
 				}
 				psplit := strings.Split(psuffix, "(")
 				pname := psplit[0]
-				if _, err = f.WriteString(fmt.Sprintf("\t\"%s\": {is_procedure: true, ", pname)); err != nil {
-					panic(err)
-				}
+				entry = fmt.Sprintf("\t\"%s\": {is_procedure: true, ", pname)
+				is_procedure = true
 				stateParser = StateCheckNbArgs
 			case StateCheckFunction:
 				fsuffix, ok := strings.CutPrefix(line, "CREATE OR REPLACE FUNCTION ")
@@ -104,9 +107,8 @@ func main() {
 				}
 				psplit := strings.Split(fsuffix, "(")
 				pname := psplit[0]
-				if _, err = f.WriteString(fmt.Sprintf("\t\"%s\": {is_procedure: false, ", pname)); err != nil {
-					panic(err)
-				}
+				entry = fmt.Sprintf("\t\"%s\": {is_procedure: false, ", pname)
+				is_procedure = false
 				stateParser = StateCheckNbArgs
 			case StateCheckNbArgs:
 				// we assume argmode is always given
@@ -114,11 +116,25 @@ func main() {
 				nb_in += strings.Count(line, "IN ")
 				stateLine = StateLineEnd
 				if strings.HasSuffix(line, ")") {
-					if _, err = f.WriteString(fmt.Sprintf("num_in: %d, num_out: %d},\n", nb_in, nb_out)); err != nil {
+					entry += fmt.Sprintf("num_in: %d, num_out: %d},\n", nb_in, nb_out)
+					if is_procedure {
+						if _, err = f.WriteString(entry); err != nil {
+							panic(err)
+						}
+						stateParser = StateInit
+					} else {
+						stateParser = StateCheckReturns
+					}
+				}
+			case StateCheckReturns:
+				// trigger functions can only be called as triggers
+				if !strings.HasPrefix(line, "RETURNS TRIGGER") {
+					if _, err = f.WriteString(entry); err != nil {
 						panic(err)
 					}
-					stateParser = StateInit
 				}
+				stateParser = StateInit
+				stateLine = StateLineEnd
 
 			default:
 				panic("Unknown state")
@@ -0,0 +1,204 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Monitor checks the connection to the postgres database periodically,
+// and applies the failure policy to lookups while the database is unreachable.
+// With the fail-open policy, lookups are served from a snapshot of the rules,
+// refreshed on each successful check.
+type Monitor struct {
+	*Database
+	interval time.Duration
+	timeout  time.Duration
+	policy   config.FailurePolicy
+	up       atomic.Bool
+	snapshot atomic.Pointer[Memory] // last known rules, fail-open only
+	events   events_api.Publisher   // may be nil
+
+	mu     sync.Mutex
+	health database_api.Health
+}
+
+// Create a new Monitor of a connected database
+func NewMonitor(db *Database, conf *config.HealthCheck, events events_api.Publisher) (*Monitor, error) {
+	if conf.IntervalOrDefault() <= 0 {
+		return nil, fmt.Errorf("Health check interval must be positive")
+	}
+	if conf.TimeoutOrDefault() <= 0 {
+		return nil, fmt.Errorf("Health check timeout must be positive")
+	}
+	now := time.Now()
+	m := &Monitor{
+		Database: db,
+		interval: conf.IntervalOrDefault(),
+		timeout:  conf.TimeoutOrDefault(),
+		policy:   conf.FailurePolicyOrDefault(),
+		events:   events,
+		health: database_api.Health{
+			State:         database_api.HealthUp,
+			Since:         &now,
+			FailurePolicy: conf.FailurePolicyOrDefault().String(),
+		},
+	}
+	m.up.Store(true)
+	return m, nil
+}
+
+func (m *Monitor) publish(t events_api.EventType, message string) {
+	if m.events != nil {
+		m.events.Publish(t, events_api.AlarmEvent{Alarm: "database-unreachable", Source: "postgres", Message: message})
+	}
+}
+
+// Health of the database
+func (m *Monitor) Health() database_api.Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.health
+	if !m.up.Load() && m.policy == config.FailOpen && m.snapshot.Load() != nil {
+		h.Fallback = true
+	}
+	if s := m.snapshot.Load(); s != nil {
+		h.FallbackRules = s.len()
+	}
+	return h
+}
+
+// Check the database every interval, until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	m.check(ctx)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(ctx)
+		}
+	}
+}
+
+// Check the database, and update its state
+func (m *Monitor) check(ctx context.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	wasUp := m.up.Load()
+	err := m.PingContext(checkCtx)
+	if err == nil && !wasUp {
+		// the database may have been restarted or restored meanwhile
+		if err = m.Reprepare(checkCtx); err != nil {
+			err = fmt.Errorf("Could not prepare statements: %w", err)
+		}
+	}
+	if err == nil && m.policy == config.FailOpen {
+		rules, e := m.GetRules(checkCtx)
+		if e != nil {
+			err = fmt.Errorf("Could not load rules: %w", e)
+		} else {
+			m.snapshot.Store(NewMemoryFrom(rules))
+		}
+	}
+	if ctx.Err() != nil {
+		// exiting
+		return
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.health.LastCheck = &now
+	switch {
+	case err == nil && !wasUp:
+		m.health.State = database_api.HealthUp
+		m.health.Since = &now
+		m.health.Error = ""
+		m.health.Reconnections++
+		m.up.Store(true)
+		logrus.Info("Connection to postgres database is restored.")
+		m.publish(events_api.AlarmCleared, "Connection to postgres database is restored")
+	case err != nil && wasUp:
+		m.health.State = database_api.HealthDown
+		m.health.Since = &now
+		m.health.Error = err.Error()
+		m.up.Store(false)
+		logrus.WithError(err).WithFields(logrus.Fields{"failure-policy": m.policy}).Error("Postgres database is unreachable.")
+		m.publish(events_api.AlarmRaised, err.Error())
+	case err != nil:
+		m.health.Error = err.Error()
+		logrus.WithError(err).Debug("Postgres database is still unreachable.")
+	}
+}
+
+// Lookup in the database, or according to the failure policy if the database is unreachable.
+// Lookups in the database time out like health checks, so workers are not stalled by an outage.
+func (m *Monitor) lookup(ctx context.Context, f func(ctx context.Context, s database_api.RuleStore) (database_api.Action, error)) (database_api.Action, error) {
+	if m.up.Load() {
+		lookupCtx, cancel := context.WithTimeout(ctx, m.timeout)
+		action, err := f(lookupCtx, m.Database)
+		timedOut := lookupCtx.Err() != nil
+		cancel()
+		if err == nil || errors.Is(err, database_api.ErrNoMatchingRule) || ctx.Err() != nil {
+			return action, err
+		}
+		if m.policy == config.FailClosed {
+			if timedOut {
+				return database_api.Action{}, database_api.ErrDatabaseUnavailable
+			}
+			return action, err
+		}
+		// the outage may not be detected yet
+	}
+	if m.policy == config.FailClosed {
+		return database_api.Action{}, database_api.ErrDatabaseUnavailable
+	}
+	snapshot := m.snapshot.Load()
+	if snapshot == nil {
+		return database_api.Action{}, database_api.ErrDatabaseUnavailable
+	}
+	action, err := f(ctx, snapshot)
+	if err == nil {
+		// written to the database once it is reachable again
+		m.touch(action.Rule, time.Now())
+	}
+	return action, err
+}
+
+func (m *Monitor) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (database_api.Action, error) {
+	return m.lookup(ctx, func(ctx context.Context, s database_api.RuleStore) (database_api.Action, error) {
+		return s.GetUplinkAction(ctx, uplinkFTeid, gnbIp, ueIp, serviceIp)
+	})
+}
+
+func (m *Monitor) GetUplinkEndMarkerAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr) (database_api.Action, error) {
+	return m.lookup(ctx, func(ctx context.Context, s database_api.RuleStore) (database_api.Action, error) {
+		return s.GetUplinkEndMarkerAction(ctx, uplinkFTeid, gnbIp)
+	})
+}
+
+func (m *Monitor) GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (database_api.Action, error) {
+	return m.lookup(ctx, func(ctx context.Context, s database_api.RuleStore) (database_api.Action, error) {
+		return s.GetDownlinkAction(ctx, ueIp)
+	})
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestNewMonitor(t *testing.T) {
+	zero := time.Duration(0)
+	negative := -time.Second
+	for _, tt := range []struct {
+		name string
+		conf *config.HealthCheck
+		ok   bool
+	}{
+		{"defaults", nil, true},
+		{"zero interval", &config.HealthCheck{Interval: &zero}, false},
+		{"negative interval", &config.HealthCheck{Interval: &negative}, false},
+		{"zero timeout", &config.HealthCheck{Timeout: &zero}, false},
+		{"negative timeout", &config.HealthCheck{Timeout: &negative}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMonitor(&Database{}, tt.conf, nil); (err == nil) != tt.ok {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+// Behaviour of the postgres database in lookups
+type dbLookup int
+
+const (
+	dbMatch dbLookup = iota
+	dbNoMatch
+	dbError
+	dbHang // until the lookup times out
+)
+
+func TestMonitorLookup(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	errQuery := errors.New("Query failed")
+	ue := netip.MustParseAddr("10.45.0.1")
+	dbRule := uuid.Must(uuid.NewV4())
+	for _, tt := range []struct {
+		name     string
+		policy   config.FailurePolicy
+		up       bool
+		snapshot bool
+		db       dbLookup
+		want     error // nil if the action of the database or of the snapshot is expected
+		fallback bool  // action expected from the snapshot
+	}{
+		{"fail-closed match", config.FailClosed, true, false, dbMatch, nil, false},
+		{"fail-closed no match", config.FailClosed, true, false, dbNoMatch, database_api.ErrNoMatchingRule, false},
+		{"fail-closed error", config.FailClosed, true, false, dbError, errQuery, false},
+		{"fail-closed timeout", config.FailClosed, true, false, dbHang, database_api.ErrDatabaseUnavailable, false},
+		{"fail-closed down", config.FailClosed, false, false, dbMatch, database_api.ErrDatabaseUnavailable, false},
+		{"fail-open match", config.FailOpen, true, true, dbMatch, nil, false},
+		{"fail-open no match", config.FailOpen, true, true, dbNoMatch, database_api.ErrNoMatchingRule, false},
+		{"fail-open error", config.FailOpen, true, true, dbError, nil, true},
+		{"fail-open timeout", config.FailOpen, true, true, dbHang, nil, true},
+		{"fail-open down", config.FailOpen, false, true, dbMatch, nil, true},
+		{"fail-open without snapshot", config.FailOpen, false, false, dbMatch, database_api.ErrDatabaseUnavailable, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMonitor(&Database{}, &config.HealthCheck{Timeout: &timeout, FailurePolicy: tt.policy}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.up.Store(tt.up)
+			var fallback database_api.Action
+			if tt.snapshot {
+				snapshot := NewMemory()
+				insertAll(t, snapshot, []database_api.Rule{downlink(t, "", 0)})
+				m.snapshot.Store(snapshot)
+				if fallback, err = snapshot.GetDownlinkAction(context.Background(), ue); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			action, err := m.lookup(context.Background(), func(ctx context.Context, s database_api.RuleStore) (database_api.Action, error) {
+				if s, ok := s.(*Memory); ok {
+					return s.GetDownlinkAction(ctx, ue)
+				}
+				switch tt.db {
+				case dbNoMatch:
+					return database_api.Action{}, database_api.ErrNoMatchingRule
+				case dbError:
+					return database_api.Action{}, errQuery
+				case dbHang:
+					<-ctx.Done()
+					return database_api.Action{}, ctx.Err()
+				}
+				return database_api.Action{Rule: dbRule}, nil
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			want := dbRule
+			if tt.fallback {
+				want = fallback.Rule
+			}
+			if action.Rule != want {
+				t.Errorf("got action of rule %s, want %s", action.Rule, want)
+			}
+		})
+	}
+}
+
+// Lookups cancelled by the caller are not served from the snapshot
+func TestMonitorLookupCancelled(t *testing.T) {
+	m, err := NewMonitor(&Database{}, &config.HealthCheck{FailurePolicy: config.FailOpen}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.snapshot.Store(NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = m.lookup(ctx, func(ctx context.Context, s database_api.RuleStore) (database_api.Action, error) {
+		if _, ok := s.(*Memory); ok {
+			t.Error("snapshot used")
+		}
+		return database_api.Action{}, ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// Postgres driver whose connections answer pings, and fail queries with queryErr,
+// or rows with rowsErr; queries without error return no rows
+type fakeConnector struct {
+	queryErr error
+	rowsErr  error
+}
+
+func (c fakeConnector) Connect(ctx context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                            { return nil }
+
+type fakeConn fakeConnector
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt(c), nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("Not supported") }
+func (c fakeConn) Ping(ctx context.Context) error            { return nil }
+
+type fakeStmt fakeConnector
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("Not supported")
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.queryErr != nil {
+		return nil, s.queryErr
+	}
+	return fakeRows{err: s.rowsErr}, nil
+}
+
+type fakeRows struct {
+	err error
+}
+
+func (r fakeRows) Columns() []string { return nil }
+func (r fakeRows) Close() error      { return nil }
+func (r fakeRows) Next(dest []driver.Value) error {
+	if r.err != nil {
+		return r.err
+	}
+	return io.EOF
+}
+
+// The snapshot of the rules is kept when the rules cannot be reloaded
+func TestMonitorCheckSnapshot(t *testing.T) {
+	errQuery := errors.New("canceling statement due to statement timeout")
+	for _, tt := range []struct {
+		name string
+		conn fakeConnector
+		up   bool
+	}{
+		{"rules reloaded", fakeConnector{}, true},
+		{"query fails", fakeConnector{queryErr: errQuery}, false},
+		{"rows fail", fakeConnector{rowsErr: errQuery}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := sql.OpenDB(tt.conn)
+			defer sqlDB.Close()
+			db := NewDatabase(sqlDB)
+			for _, name := range []string{"get_all_rules", "get_all_rule_counters"} {
+				stmt, err := sqlDB.Prepare(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.stmt[name] = stmt
+			}
+			m, err := NewMonitor(db, &config.HealthCheck{FailurePolicy: config.FailOpen}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot := NewMemory()
+			insertAll(t, snapshot, []database_api.Rule{downlink(t, "", 0)})
+			m.snapshot.Store(snapshot)
+
+			m.check(context.Background())
+			if m.up.Load() != tt.up {
+				t.Errorf("got database up %v, want %v", m.up.Load(), tt.up)
+			}
+			if kept := m.snapshot.Load() == snapshot; kept == tt.up {
+				t.Errorf("got snapshot kept %v, want %v", kept, !tt.up)
+			}
+			if h := m.Health(); h.FallbackRules != snapshot.len() && !tt.up {
+				t.Errorf("got %d fallback rules, want %d", h.FallbackRules, snapshot.len())
+			}
+		})
+	}
+}
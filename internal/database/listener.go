@@ -0,0 +1,112 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"encoding/json"
+	"net/netip"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Channel notified by the rule_change trigger of database.sql
+const ruleChangeChannel = "rule_change"
+
+// Payload of a rule_change notification
+type ruleChange struct {
+	Uuid       uuid.UUID   `json:"uuid"`
+	TypeUplink bool        `json:"type_uplink"`
+	UplinkTeid *uint32     `json:"uplink_teid"`
+	UplinkUpf  *netip.Addr `json:"uplink_upf"`
+}
+
+// Listener invalidates entries of a Cache when rules are changed in the postgres database.
+// The Cache is active only while the Listener is connected.
+type Listener struct {
+	listener *pq.Listener
+	cache    *Cache
+	closing  chan struct{}
+	done     chan struct{}
+}
+
+// Create a new Listener for the postgres database of conninfo
+func NewListener(conninfo string, cache *Cache) *Listener {
+	l := &Listener{
+		cache:   cache,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	l.listener = pq.NewListener(conninfo, 100*time.Millisecond, 10*time.Second, l.event)
+	return l
+}
+
+// Called by pq on connection events
+func (l *Listener) event(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventDisconnected:
+		// notifications may be lost
+		l.cache.SetActive(false)
+		logrus.WithError(err).Warn("Disconnected from postgres database: lookup cache is disabled until reconnection.")
+	case pq.ListenerEventConnectionAttemptFailed:
+		logrus.WithError(err).Debug("Could not connect to postgres database to listen for rule changes.")
+	}
+}
+
+// Start listening for rule changes
+func (l *Listener) Start() {
+	go l.run()
+}
+
+func (l *Listener) run() {
+	defer close(l.done)
+	// blocks until the connection is established
+	if err := l.listener.Listen(ruleChangeChannel); err != nil {
+		select {
+		case <-l.closing:
+			return
+		default:
+		}
+		logrus.WithError(err).Error("Could not listen for rule changes: lookup cache is disabled.")
+		return
+	}
+	l.cache.SetActive(true)
+	for n := range l.listener.Notify {
+		if n == nil {
+			// reconnected: changes while disconnected are unknown
+			l.cache.SetActive(true)
+			continue
+		}
+		var change ruleChange
+		if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+			logrus.WithError(err).Warn("Malformed rule change notification")
+			l.cache.InvalidateAll()
+			continue
+		}
+		if !change.TypeUplink {
+			l.cache.InvalidateDownlink()
+			continue
+		}
+		if change.UplinkTeid == nil || change.UplinkUpf == nil {
+			l.cache.InvalidateAll()
+			continue
+		}
+		l.cache.InvalidateUplink(jsonapi.Fteid{Teid: *change.UplinkTeid, Addr: *change.UplinkUpf})
+	}
+}
+
+// Stop listening for rule changes. The Cache is deactivated.
+func (l *Listener) Close() error {
+	close(l.closing)
+	err := l.listener.Close()
+	<-l.done
+	l.cache.SetActive(false)
+	return err
+}
@@ -0,0 +1,441 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+)
+
+// Memory is a RuleStore without persistence, for labs and CI.
+// When several rules are matching a packet, the rule with the highest priority,
+// then the most specific one, is used (see morePrecise).
+type Memory struct {
+	mu       sync.RWMutex
+	rules    database_api.RuleMap
+	active   map[uuid.UUID]*atomic.Int64   // last activity of rules (unix nanoseconds), updated by lookups
+	traffic  map[uuid.UUID]*counter        // counters of rules, updated by headends
+	uplink   map[jsonapi.Fteid][]uuid.UUID // index of uplink rules
+	downlink []uuid.UUID                   // downlink rules
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		rules:    make(database_api.RuleMap),
+		active:   make(map[uuid.UUID]*atomic.Int64),
+		traffic:  make(map[uuid.UUID]*counter),
+		uplink:   make(map[jsonapi.Fteid][]uuid.UUID),
+		downlink: make([]uuid.UUID, 0),
+	}
+}
+
+// Create a new Memory containing these rules, e.g. a snapshot of another RuleStore
+func NewMemoryFrom(rules database_api.RuleMap) *Memory {
+	m := NewMemory()
+	for id, r := range rules {
+		m.add(id, r)
+	}
+	return m
+}
+
+// Check the rule could be inserted in the postgres database
+func checkRule(r database_api.Rule) error {
+	if err := validateRule(r); err != nil {
+		return fmt.Errorf("%w: %w", database_api.ErrInvalidRule, err)
+	}
+	return nil
+}
+
+func validateRule(r database_api.Rule) error {
+	if len(r.Action.SRH) == 0 {
+		return fmt.Errorf("SRH should contain at least one segment")
+	}
+	switch r.Type {
+	case "uplink":
+		if r.Match.Header == nil {
+			return fmt.Errorf("Missing GTP header for uplink rule")
+		}
+		if r.UEPrefix != nil && r.Match.Header.InnerIpSrc != nil {
+			return fmt.Errorf("Inner IP source and UE prefix of the uplink rule are mutually exclusive")
+		}
+	case "downlink":
+		if r.Action.SourceGtp4 == nil {
+			return fmt.Errorf("Empty SourceGtp4 for downlink Action")
+		}
+		if r.UEPrefix != nil && r.Match.Payload != nil {
+			return fmt.Errorf("Destination IP of the payload and UE prefix of the downlink rule are mutually exclusive")
+		}
+	default:
+		return fmt.Errorf("Wrong type for the rule")
+	}
+	if err := validatePaths(r.Paths); err != nil {
+		return err
+	}
+	if r.InactivityTimeout > math.MaxInt32 {
+		return fmt.Errorf("Inactivity timeout is too long")
+	}
+	if r.UEPrefix != nil && !r.UEPrefix.IsValid() {
+		return fmt.Errorf("Invalid UE prefix")
+	}
+	ue, hasUE := r.UE()
+	service, hasService := r.Service()
+	if hasUE && hasService && ue.Addr().Is4() != service.Is4() {
+		return fmt.Errorf("UE and Service IP Addresses of the uplink rule must be of the same IP version")
+	}
+	return nil
+}
+
+func (m *Memory) InsertRule(ctx context.Context, r database_api.Rule) (*uuid.UUID, error) {
+	if err := checkRule(r); err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	m.insert(id, r.Normalized())
+	return &id, nil
+}
+
+// Insert a checked rule
+func (m *Memory) insert(id uuid.UUID, r database_api.Rule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(id, r)
+}
+
+// Insert a checked rule; m.mu must be held
+func (m *Memory) add(id uuid.UUID, r database_api.Rule) {
+	r.LastActive = nil
+	r.Counters = nil
+	m.rules[id] = r
+	m.active[id] = &atomic.Int64{}
+	m.active[id].Store(time.Now().UnixNano())
+	m.traffic[id] = &counter{}
+	if r.Type == "uplink" {
+		m.uplink[r.Match.Header.FTeid] = append(m.uplink[r.Match.Header.FTeid], id)
+	} else {
+		m.downlink = append(m.downlink, id)
+	}
+}
+
+func (m *Memory) GetRule(ctx context.Context, id uuid.UUID) (database_api.Rule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.rules[id]
+	if !ok {
+		return database_api.Rule{}, database_api.ErrRuleNotFound
+	}
+	return m.withActivity(id, r), nil
+}
+
+// Rule with its last activity and counters; m.mu must be held
+func (m *Memory) withActivity(id uuid.UUID, r database_api.Rule) database_api.Rule {
+	if a, ok := m.active[id]; ok {
+		t := time.Unix(0, a.Load())
+		r.LastActive = &t
+	}
+	if c, ok := m.traffic[id]; ok {
+		counters := c.load()
+		r.Counters = &counters
+	}
+	return r
+}
+
+// Record activity of a rule
+func (m *Memory) touch(id uuid.UUID, at time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if a, ok := m.active[id]; ok {
+		a.Store(at.UnixNano())
+	}
+}
+
+// Number of rules
+func (m *Memory) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.rules)
+}
+
+func (m *Memory) GetRules(ctx context.Context) (database_api.RuleMap, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := make(database_api.RuleMap, len(m.rules))
+	for id, r := range m.rules {
+		rules[id] = m.withActivity(id, r)
+	}
+	return rules, nil
+}
+
+// Set enabled state of rules
+func (m *Memory) setEnabled(state map[uuid.UUID]bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range state {
+		if _, ok := m.rules[id]; !ok {
+			return database_api.ErrRuleNotFound
+		}
+	}
+	now := time.Now().UnixNano()
+	for id, enabled := range state {
+		m.set(id, enabled, now)
+	}
+	return nil
+}
+
+// Set enabled state of an existing rule; m.mu must be held
+func (m *Memory) set(id uuid.UUID, enabled bool, now int64) {
+	r := m.rules[id]
+	if enabled && !r.Enabled {
+		// inactivity is counted from the activation of the rule
+		m.active[id].Store(now)
+	}
+	r.Enabled = enabled
+	m.rules[id] = r
+}
+
+func (m *Memory) EnableRule(ctx context.Context, id uuid.UUID) error {
+	return m.setEnabled(map[uuid.UUID]bool{id: true})
+}
+
+func (m *Memory) DisableRule(ctx context.Context, id uuid.UUID) error {
+	return m.setEnabled(map[uuid.UUID]bool{id: false})
+}
+
+func (m *Memory) SwitchRule(ctx context.Context, uuidEnable uuid.UUID, uuidDisable uuid.UUID) error {
+	return m.setEnabled(map[uuid.UUID]bool{uuidEnable: true, uuidDisable: false})
+}
+
+func (m *Memory) DeleteRule(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[id]; !ok {
+		return database_api.ErrRuleNotFound
+	}
+	m.remove(id)
+	return nil
+}
+
+// Delete an existing rule; m.mu must be held
+func (m *Memory) remove(id uuid.UUID) {
+	r := m.rules[id]
+	delete(m.rules, id)
+	delete(m.active, id)
+	delete(m.traffic, id)
+	remove := func(l []uuid.UUID) []uuid.UUID {
+		for i, v := range l {
+			if v == id {
+				return append(l[:i:i], l[i+1:]...)
+			}
+		}
+		return l
+	}
+	if r.Type == "uplink" {
+		l := remove(m.uplink[r.Match.Header.FTeid])
+		if len(l) == 0 {
+			delete(m.uplink, r.Match.Header.FTeid)
+		} else {
+			m.uplink[r.Match.Header.FTeid] = l
+		}
+	} else {
+		m.downlink = remove(m.downlink)
+	}
+}
+
+func validatePaths(paths []database_api.Path) error {
+	if len(paths) > database_api.MaxPaths {
+		return fmt.Errorf("A rule can have at most %d paths", database_api.MaxPaths)
+	}
+	for i, p := range paths {
+		if len(p.SRH) == 0 {
+			return fmt.Errorf("SRH of path %d should contain at least one segment", i)
+		}
+		if p.Weight > math.MaxInt32 {
+			return fmt.Errorf("Weight of path %d is too high", i)
+		}
+	}
+	return nil
+}
+
+// Check the action could be updated in the postgres database
+func checkAction(action database_api.ActionUpdate) error {
+	if err := validateAction(action.Action); err != nil {
+		return fmt.Errorf("%w: %w", database_api.ErrInvalidRule, err)
+	}
+	if err := validatePaths(action.Paths); err != nil {
+		return fmt.Errorf("%w: %w", database_api.ErrInvalidRule, err)
+	}
+	return nil
+}
+
+func validateAction(action n4tosrv6.Action) error {
+	if action.SourceGtp4 == nil {
+		return fmt.Errorf("Empty SourceGtp4 for downlink rule")
+	}
+	if len(action.SRH) == 0 {
+		return fmt.Errorf("SRH should contain at least one segment")
+	}
+	return nil
+}
+
+func (m *Memory) UpdateAction(ctx context.Context, uuidRule uuid.UUID, action database_api.ActionUpdate) error {
+	if err := checkAction(action); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rules[uuidRule]
+	if !ok {
+		return database_api.ErrRuleNotFound
+	}
+	r.Action = action.Action
+	r.Paths = action.Paths
+	m.rules[uuidRule] = r
+	return nil
+}
+
+func (m *Memory) SetPathState(ctx context.Context, id uuid.UUID, index int, down bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rules[id]
+	if !ok {
+		return database_api.ErrRuleNotFound
+	}
+	if index < 0 || index >= len(r.Paths) {
+		return database_api.ErrPathNotFound
+	}
+	// paths may be used by actions returned by lookups
+	r.Paths = slices.Clone(r.Paths)
+	r.Paths[index].Down = down
+	m.rules[id] = r
+	return nil
+}
+
+// Specificity of a match: priority of the rule, bits of the service prefix, of the UE prefix, and of the gNB prefix
+type specificity [4]int
+
+// Returns true if a is more specific than b
+func morePrecise(a, b specificity) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// Length of the longest prefix containing addr, or -1
+func longestMatch(prefixes []netip.Prefix, addr netip.Addr) int {
+	best := -1
+	for _, p := range prefixes {
+		if p.Bits() > best && p.Contains(addr) {
+			best = p.Bits()
+		}
+	}
+	return best
+}
+
+func (m *Memory) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (database_api.Action, error) {
+	return m.getUplinkAction(uplinkFTeid, gnbIp, &ueIp, &serviceIp)
+}
+
+// End Marker has no T-PDU: any UE IP Address and Service IP Address are matched
+func (m *Memory) GetUplinkEndMarkerAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr) (database_api.Action, error) {
+	return m.getUplinkAction(uplinkFTeid, gnbIp, nil, nil)
+}
+
+// ueIp and serviceIp are nil to match any address
+func (m *Memory) getUplinkAction(uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp *netip.Addr, serviceIp *netip.Addr) (database_api.Action, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var best *database_api.Rule
+	var bestId uuid.UUID
+	var bestSpec specificity
+	for _, id := range m.uplink[uplinkFTeid] {
+		r := m.rules[id]
+		if !r.Enabled {
+			continue
+		}
+		spec := specificity{int(r.Priority), 0, 0, longestMatch(r.Match.Header.OuterIpSrc, gnbIp)}
+		if spec[3] < 0 {
+			continue
+		}
+		if service, ok := r.Service(); ok {
+			if serviceIp != nil && service != *serviceIp {
+				continue
+			}
+			spec[1] = service.BitLen()
+		}
+		if ue, ok := r.UE(); ok {
+			if ueIp != nil && !ue.Contains(*ueIp) {
+				continue
+			}
+			spec[2] = ue.Bits()
+		}
+		// ties are broken by UUID, for lookups to be deterministic
+		if best == nil || morePrecise(spec, bestSpec) || (spec == bestSpec && id.String() < bestId.String()) {
+			best = &r
+			bestId = id
+			bestSpec = spec
+		}
+	}
+	if best == nil {
+		return database_api.Action{}, database_api.ErrNoMatchingRule
+	}
+	m.active[bestId].Store(time.Now().UnixNano())
+	return database_api.Action{
+		Action: n4tosrv6.Action{
+			SRH: best.Action.SRH,
+		},
+		Paths: best.Paths,
+		Rule:  bestId,
+	}, nil
+}
+
+func (m *Memory) GetDownlinkAction(ctx context.Context, ueIp netip.Addr) (database_api.Action, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var best *database_api.Rule
+	var bestId uuid.UUID
+	var bestSpec specificity
+	for _, id := range m.downlink {
+		r := m.rules[id]
+		if !r.Enabled {
+			continue
+		}
+		spec := specificity{int(r.Priority), 0, 0, 0}
+		if ue, ok := r.UE(); ok {
+			if !ue.Contains(ueIp) {
+				continue
+			}
+			spec[2] = ue.Bits()
+		}
+		if best == nil || morePrecise(spec, bestSpec) || (spec == bestSpec && id.String() < bestId.String()) {
+			best = &r
+			bestId = id
+			bestSpec = spec
+		}
+	}
+	if best == nil {
+		return database_api.Action{}, database_api.ErrNoMatchingRule
+	}
+	m.active[bestId].Store(time.Now().UnixNano())
+	return database_api.Action{Action: best.Action, Paths: best.Paths, Rule: bestId}, nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gofrs/uuid"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+// Insert rules, and return their UUIDs
+func insertAll(t *testing.T, m *Memory, rules []database_api.Rule) []uuid.UUID {
+	t.Helper()
+	ids := make([]uuid.UUID, len(rules))
+	for i, r := range rules {
+		id, err := m.InsertRule(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = *id
+	}
+	return ids
+}
+
+func TestUplinkPrecedence(t *testing.T) {
+	gnb := netip.MustParseAddr("10.0.1.1")
+	ue := netip.MustParseAddr("10.45.0.1")
+	service := netip.MustParseAddr("10.1.0.1")
+	for _, tt := range []struct {
+		name  string
+		rules []database_api.Rule
+		want  int // index of the rule used, or -1
+	}{
+		{"no rule", nil, -1},
+		{"gNB not matching", []database_api.Rule{apitest.Uplink{GNB: "10.0.2.0/24"}.Rule(t)}, -1},
+		{"UE not matching", []database_api.Rule{apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.46.0.0/16"}.Rule(t)}, -1},
+		{"service not matching", []database_api.Rule{apitest.Uplink{GNB: "10.0.1.0/24", Service: "10.1.0.2"}.Rule(t)}, -1},
+		{"longest gNB prefix", []database_api.Rule{
+			apitest.Uplink{GNB: "10.0.0.0/16"}.Rule(t),
+			apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+		}, 1},
+		{"UE prefix before gNB prefix", []database_api.Rule{
+			apitest.Uplink{GNB: "10.0.1.1/32"}.Rule(t),
+			apitest.Uplink{GNB: "10.0.0.0/16", UE: "10.45.0.0/16"}.Rule(t),
+		}, 1},
+		{"longest UE prefix", []database_api.Rule{
+			apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.0/24"}.Rule(t),
+			apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.0/16"}.Rule(t),
+		}, 0},
+		{"service before UE prefix", []database_api.Rule{
+			apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.1/32"}.Rule(t),
+			apitest.Uplink{GNB: "10.0.1.0/24", Service: "10.1.0.1"}.Rule(t),
+		}, 1},
+		{"priority before specificity", []database_api.Rule{
+			apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.1/32", Service: "10.1.0.1"}.Rule(t),
+			apitest.Uplink{GNB: "0.0.0.0/0", Priority: 1}.Rule(t),
+		}, 1},
+		{"negative priority", []database_api.Rule{
+			apitest.Uplink{GNB: "10.0.1.0/24", Priority: -1, Service: "10.1.0.1"}.Rule(t),
+			apitest.Uplink{GNB: "0.0.0.0/0"}.Rule(t),
+		}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemory()
+			ids := insertAll(t, m, tt.rules)
+			action, err := m.GetUplinkAction(context.Background(), apitest.Fteid, gnb, ue, service)
+			if tt.want < 0 {
+				if !errors.Is(err, database_api.ErrNoMatchingRule) {
+					t.Errorf("got error %v, want %v", err, database_api.ErrNoMatchingRule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action.Rule != ids[tt.want] {
+				t.Errorf("got rule %s, want rule %d (%s)", action.Rule, tt.want, ids[tt.want])
+			}
+		})
+	}
+}
+
+// Rules with the same match and priority are ordered by UUID
+func TestUplinkPrecedenceTies(t *testing.T) {
+	m := NewMemory()
+	ids := insertAll(t, m, []database_api.Rule{
+		apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+		apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+		apitest.Uplink{GNB: "10.0.1.0/24"}.Rule(t),
+	})
+	want := ids[0]
+	for _, id := range ids[1:] {
+		if id.String() < want.String() {
+			want = id
+		}
+	}
+	for i := 0; i < 10; i++ {
+		action, err := m.GetUplinkAction(context.Background(), apitest.Fteid, netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.45.0.1"), netip.MustParseAddr("10.1.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action.Rule != want {
+			t.Fatalf("got rule %s, want %s", action.Rule, want)
+		}
+	}
+}
+
+// End Markers match rules of any UE and service
+func TestUplinkEndMarker(t *testing.T) {
+	m := NewMemory()
+	ids := insertAll(t, m, []database_api.Rule{
+		apitest.Uplink{GNB: "10.0.1.0/24", UE: "10.45.0.0/16", Service: "10.1.0.1"}.Rule(t),
+	})
+	action, err := m.GetUplinkEndMarkerAction(context.Background(), apitest.Fteid, netip.MustParseAddr("10.0.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.Rule != ids[0] {
+		t.Errorf("got rule %s, want %s", action.Rule, ids[0])
+	}
+}
+
+func downlink(t *testing.T, ue string, priority int32) database_api.Rule {
+	t.Helper()
+	srh, err := n4tosrv6.NewSRH([]string{"fc00:1::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := netip.MustParseAddr("10.0.0.100")
+	r := database_api.Rule{
+		Rule: n4tosrv6.Rule{
+			Enabled: true,
+			Type:    "downlink",
+			Action:  n4tosrv6.Action{SRH: *srh, SourceGtp4: &src},
+		},
+		Priority: priority,
+	}
+	if ue != "" {
+		p := netip.MustParsePrefix(ue)
+		r.UEPrefix = &p
+	}
+	return r
+}
+
+func TestDownlinkUEPrefixes(t *testing.T) {
+	rules := []database_api.Rule{
+		downlink(t, "", 0),
+		downlink(t, "10.45.0.0/16", 0),
+		downlink(t, "10.45.0.1/32", 0),
+		downlink(t, "2001:db8:1::/64", 0),
+	}
+	for _, tt := range []struct {
+		ue   string
+		want int
+	}{
+		{"10.45.0.1", 2},
+		{"10.45.0.2", 1},
+		{"10.46.0.1", 0},
+		{"2001:db8:1::1", 3},
+		{"2001:db8:2::1", 0},
+	} {
+		t.Run(tt.ue, func(t *testing.T) {
+			m := NewMemory()
+			ids := insertAll(t, m, rules)
+			action, err := m.GetDownlinkAction(context.Background(), netip.MustParseAddr(tt.ue))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action.Rule != ids[tt.want] {
+				t.Errorf("got rule %s, want rule %d (%s)", action.Rule, tt.want, ids[tt.want])
+			}
+		})
+	}
+}
+
+// Updates replace the paths of the rule with the action
+func TestUpdateActionPaths(t *testing.T) {
+	ue := netip.MustParseAddr("10.45.0.1")
+	src := netip.MustParseAddr("10.0.0.100")
+	action := func(paths ...string) database_api.ActionUpdate {
+		a := database_api.ActionUpdate{Action: n4tosrv6.Action{SRH: apitest.SRH(t, "fc00:9::1"), SourceGtp4: &src}}
+		for _, p := range paths {
+			a.Paths = append(a.Paths, database_api.Path{SRH: apitest.SRH(t, p)})
+		}
+		return a
+	}
+	update := func(m *Memory, id uuid.UUID, a database_api.ActionUpdate) error {
+		return m.UpdateAction(context.Background(), id, a)
+	}
+	batch := func(m *Memory, id uuid.UUID, a database_api.ActionUpdate) error {
+		_, err := m.ApplyBatch(context.Background(), []database_api.BatchOperation{{Op: database_api.BatchUpdate, Uuid: &id, Action: &a}})
+		return err
+	}
+	for _, tt := range []struct {
+		name   string
+		paths  []string // paths of the rule
+		action database_api.ActionUpdate
+		want   []string // segment lists used
+	}{
+		{"paths removed", []string{"fc00:1::1", "fc00:2::1"}, action(), []string{"fc00:9::1"}},
+		{"paths replaced", []string{"fc00:1::1", "fc00:2::1"}, action("fc00:3::1"), []string{"fc00:3::1"}},
+		{"paths added", nil, action("fc00:3::1", "fc00:4::1"), []string{"fc00:3::1", "fc00:4::1"}},
+	} {
+		for name, apply := range map[string]func(*Memory, uuid.UUID, database_api.ActionUpdate) error{"update": update, "batch": batch} {
+			t.Run(tt.name+" "+name, func(t *testing.T) {
+				r := downlink(t, "", 0)
+				for _, p := range tt.paths {
+					r.Paths = append(r.Paths, database_api.Path{SRH: apitest.SRH(t, p)})
+				}
+				m := NewMemory()
+				ids := insertAll(t, m, []database_api.Rule{r})
+				if err := apply(m, ids[0], tt.action); err != nil {
+					t.Fatal(err)
+				}
+				a, err := m.GetDownlinkAction(context.Background(), ue)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for _, srh := range a.SRHsUp() {
+					got = append(got, srh[0].String())
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("got segment lists %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateActionInvalid(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.100")
+	m := NewMemory()
+	ids := insertAll(t, m, []database_api.Rule{downlink(t, "", 0)})
+	for _, tt := range []struct {
+		name   string
+		action database_api.ActionUpdate
+	}{
+		{"empty SRH", database_api.ActionUpdate{Action: n4tosrv6.Action{SourceGtp4: &src}}},
+		{"empty path", database_api.ActionUpdate{Action: n4tosrv6.Action{SRH: apitest.SRH(t, "fc00:9::1"), SourceGtp4: &src}, Paths: []database_api.Path{{}}}},
+		{"too many paths", database_api.ActionUpdate{Action: n4tosrv6.Action{SRH: apitest.SRH(t, "fc00:9::1"), SourceGtp4: &src}, Paths: make([]database_api.Path, database_api.MaxPaths+1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.UpdateAction(context.Background(), ids[0], tt.action); !errors.Is(err, database_api.ErrInvalidRule) {
+				t.Errorf("got error %v, want %v", err, database_api.ErrInvalidRule)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Migrations are named NNNN_description.sql, and are applied in order.
+// An applied migration must never be modified: changes of the schema are done in a new migration.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);`
+
+// Prevents concurrent migrations by several instances
+const migrationsLockKey = "nextmn-srv6-migrations"
+
+// A schema migration
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil if not applied
+	sql       string
+}
+
+// Embedded migrations, sorted by version
+func Migrations() ([]Migration, error) {
+	return readMigrations(migrationsFS, "migrations")
+}
+
+// Migrations of the directory dir of fsys, sorted by version
+func readMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(files))
+	for _, f := range files {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(f.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("Malformed migration name %s", f.Name())
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("Malformed migration version %s", f.Name())
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			sql:     string(b),
+		})
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("Duplicate migration version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Latest version of the schema known by this binary
+func LatestSchemaVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Applied versions, and the time they were applied
+func appliedVersions(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Migrations, with the time they were applied
+func (db *Database) MigrationStatus(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, schemaVersionTable); err != nil {
+		return nil, fmt.Errorf("Could not create schema_version table: %s", err)
+	}
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read schema version: %s", err)
+	}
+	for i, m := range migrations {
+		if at, ok := applied[m.Version]; ok {
+			migrations[i].AppliedAt = &at
+		}
+	}
+	return migrations, nil
+}
+
+// Apply pending migrations, in a single transaction. Returns applied migrations.
+func (db *Database) Migrate(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", migrationsLockKey); err != nil {
+		return nil, fmt.Errorf("Could not lock database for migrations: %s", err)
+	}
+	if _, err := tx.ExecContext(ctx, schemaVersionTable); err != nil {
+		return nil, fmt.Errorf("Could not create schema_version table: %s", err)
+	}
+	applied, err := appliedVersions(ctx, tx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read schema version: %s", err)
+	}
+	for version := range applied {
+		if version > latest {
+			return nil, fmt.Errorf("Database schema version %d is newer than the latest version supported (%d)", version, latest)
+		}
+	}
+	done := make([]Migration, 0)
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+			return nil, fmt.Errorf("Could not apply migration %04d_%s: %s", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_version(version, name) VALUES($1, $2)", m.Version, m.Name); err != nil {
+			return nil, fmt.Errorf("Could not update schema version: %s", err)
+		}
+		logrus.WithFields(logrus.Fields{"version": m.Version, "name": m.Name}).Info("Applied database migration")
+		done = append(done, m)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return done, nil
+}
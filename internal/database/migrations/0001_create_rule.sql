@@ -0,0 +1,19 @@
+-- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+-- Use of this source code is governed by a MIT-style license that can be
+-- SPDX-License-Identifier: MIT
+
+-- Deployments created before schema versioning already have this table
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS rule (
+	uuid UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+	type_uplink BOOL NOT NULL,
+	enabled BOOL NOT NULL,
+	action_srh INET ARRAY NOT NULL,
+	action_source_gtp4 INET,
+	match_ue_ip CIDR NOT NULL,
+	match_gnb_ip CIDR ARRAY,
+	match_service_ip CIDR,
+	match_uplink_teid BIGINT,
+	match_uplink_upf INET
+);
@@ -0,0 +1,12 @@
+-- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+-- Use of this source code is governed by a MIT-style license that can be
+-- SPDX-License-Identifier: MIT
+
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+
+-- Arguments and results of these procedures and functions have changed:
+-- they are recreated by database.sql
+DROP PROCEDURE IF EXISTS insert_uplink_rule;
+DROP PROCEDURE IF EXISTS insert_downlink_rule;
+DROP FUNCTION IF EXISTS get_rule;
+DROP FUNCTION IF EXISTS get_all_rules;
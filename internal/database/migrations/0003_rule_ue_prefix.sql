@@ -0,0 +1,6 @@
+-- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+-- Use of this source code is governed by a MIT-style license that can be
+-- SPDX-License-Identifier: MIT
+
+-- Rules can match IPv4 and IPv6 UE prefixes: lookups of the prefixes containing an address use this index
+CREATE INDEX IF NOT EXISTS rule_match_ue_ip ON rule USING gist (match_ue_ip inet_ops);
@@ -0,0 +1,11 @@
+-- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+-- Use of this source code is governed by a MIT-style license that can be
+-- SPDX-License-Identifier: MIT
+
+-- Counters are kept out of the rule table: their updates do not notify changes of rules
+CREATE TABLE IF NOT EXISTS rule_counters (
+	uuid UUID PRIMARY KEY REFERENCES rule (uuid) ON DELETE CASCADE,
+	packets BIGINT NOT NULL DEFAULT 0,
+	bytes BIGINT NOT NULL DEFAULT 0,
+	last_hit TIMESTAMPTZ
+);
@@ -0,0 +1,15 @@
+-- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+-- Use of this source code is governed by a MIT-style license that can be
+-- SPDX-License-Identifier: MIT
+
+-- Weighted segment lists of the rule, in JSON: [{"srh": ["fc00::1"], "weight": 1, "down": false}]
+ALTER TABLE rule ADD COLUMN IF NOT EXISTS action_paths JSONB NOT NULL DEFAULT '[]';
+
+-- Arguments and results of these procedures and functions have changed:
+-- they are recreated by database.sql
+DROP PROCEDURE IF EXISTS insert_uplink_rule;
+DROP PROCEDURE IF EXISTS insert_downlink_rule;
+DROP FUNCTION IF EXISTS get_uplink_action;
+DROP FUNCTION IF EXISTS get_downlink_action;
+DROP FUNCTION IF EXISTS get_rule;
+DROP FUNCTION IF EXISTS get_all_rules;
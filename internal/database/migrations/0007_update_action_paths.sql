@@ -0,0 +1,7 @@
+-- Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+-- Use of this source code is governed by a MIT-style license that can be
+-- SPDX-License-Identifier: MIT
+
+-- Paths of the rule are replaced with its action:
+-- update_action is recreated by database.sql with a new argument
+DROP PROCEDURE IF EXISTS update_action;
@@ -0,0 +1,86 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadMigrations(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		files []string
+		want  []string // version_name of migrations, in order
+		err   string   // beginning of the error
+	}{
+		{"empty", nil, []string{}, ""},
+		{"sorted by version", []string{"0010_c.sql", "0002_b.sql", "0001_a.sql"}, []string{"1_a", "2_b", "10_c"}, ""},
+		{"not padded", []string{"10_c.sql", "9_b.sql"}, []string{"9_b", "10_c"}, ""},
+		{"underscore in name", []string{"0001_rule_priority.sql"}, []string{"1_rule_priority"}, ""},
+		{"duplicate version", []string{"0001_a.sql", "0002_b.sql", "02_c.sql"}, nil, "Duplicate migration version 2"},
+		{"no name", []string{"0001.sql"}, nil, "Malformed migration name"},
+		{"no version", []string{"a_b.sql"}, nil, "Malformed migration version"},
+		{"version zero", []string{"0000_a.sql"}, nil, "Malformed migration version"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, f := range tt.files {
+				fsys["migrations/"+f] = &fstest.MapFile{Data: []byte("-- " + f)}
+			}
+			if len(tt.files) == 0 {
+				fsys["migrations"] = &fstest.MapFile{Mode: fs.ModeDir}
+			}
+			migrations, err := readMigrations(fsys, "migrations")
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, m := range migrations {
+				got = append(got, strconv.Itoa(m.Version)+"_"+m.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got migrations %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Embedded migrations have consecutive versions, and are not empty
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migration")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("got version %d for migration %d (%s), want %d", m.Version, i, m.Name, i+1)
+		}
+		if strings.TrimSpace(m.sql) == "" {
+			t.Errorf("migration %d (%s) is empty", m.Version, m.Name)
+		}
+	}
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != migrations[len(migrations)-1].Version {
+		t.Errorf("got latest version %d, want %d", latest, migrations[len(migrations)-1].Version)
+	}
+}
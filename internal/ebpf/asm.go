@@ -0,0 +1,269 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cilium/ebpf/asm"
+)
+
+// Return codes of TC programs
+const (
+	tcActUnspec = -1 // not handled: next program, or kernel stack
+	tcActOK     = 0  // translated packet is handed to the kernel stack
+	tcActShot   = 2  // drop
+)
+
+// Offsets in struct __sk_buff
+const (
+	skbGSOSize = 176
+)
+
+// Modes of bpf_skb_adjust_room
+const (
+	bpfAdjRoomNet = 0
+)
+
+// Headers lengths
+const (
+	ethHdrLen  = 14
+	ipv4HdrLen = 20
+	ipv6HdrLen = 40
+	udpHdrLen  = 8
+	gtpuHdrLen = 8
+)
+
+// Value which, stored as a Half in host byte order, is in network byte order
+func hostBE16(v uint16) int32 {
+	return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v)))
+}
+
+// Value which, stored as a Word in host byte order, is in network byte order
+func hostBE32(v uint32) int32 {
+	return int32(binary.NativeEndian.Uint32(binary.BigEndian.AppendUint32(nil, v)))
+}
+
+// Instructions of a program being generated
+type builder struct {
+	insns   asm.Instructions
+	pending string // label of the next instruction
+	labels  int
+}
+
+// Append instructions
+func (b *builder) add(insns ...asm.Instruction) {
+	for _, ins := range insns {
+		if b.pending != "" {
+			ins = ins.WithSymbol(b.pending)
+			b.pending = ""
+		}
+		b.insns = append(b.insns, ins)
+	}
+}
+
+// Create a new unique label
+func (b *builder) newLabel(name string) string {
+	b.labels++
+	return fmt.Sprintf("%s_%d", name, b.labels)
+}
+
+// Set label of the next instruction
+func (b *builder) mark(label string) {
+	if b.pending != "" {
+		// two labels on the same instruction: insert a nop
+		b.add(asm.Ja.Label(label))
+	}
+	b.pending = label
+}
+
+// Copy n bytes of the packet, starting at off, to the stack.
+// Jumps to fail if the packet is too short.
+func (b *builder) loadBytes(off int32, stack int16, n int32, fail string) {
+	b.add(asm.Mov.Imm(asm.R2, off))
+	b.loadBytesReg(stack, n, fail)
+}
+
+// Same as loadBytes, with the offset in R2
+func (b *builder) loadBytesReg(stack int16, n int32, fail string) {
+	b.add(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, int32(stack)),
+		asm.Mov.Imm(asm.R4, n),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, fail),
+	)
+}
+
+// Copy n bytes from the stack to the packet, starting at off.
+func (b *builder) storeBytes(off int32, stack int16, n int32, fail string) {
+	b.add(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, off),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, int32(stack)),
+		asm.Mov.Imm(asm.R4, n),
+		asm.Mov.Imm(asm.R5, 0),
+		asm.FnSkbStoreBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, fail),
+	)
+}
+
+// Compute the checksum of the IPv4 header on the stack
+func (b *builder) ipv4Checksum(stack int16) {
+	b.add(
+		asm.Mov.Imm(asm.R1, 0),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, int32(stack)),
+		asm.Mov.Imm(asm.R4, ipv4HdrLen),
+		asm.Mov.Imm(asm.R5, 0),
+		asm.FnCsumDiff.Call(),
+		// fold into 16 bits
+		asm.Mov.Reg32(asm.R0, asm.R0),
+		asm.Mov.Reg(asm.R1, asm.R0),
+		asm.RSh.Imm(asm.R1, 16),
+		asm.And.Imm(asm.R0, 0xFFFF),
+		asm.Add.Reg(asm.R0, asm.R1),
+		asm.Mov.Reg(asm.R1, asm.R0),
+		asm.RSh.Imm(asm.R1, 16),
+		asm.Add.Reg(asm.R0, asm.R1),
+		asm.Xor.Imm(asm.R0, 0xFFFF),
+		asm.StoreMem(asm.RFP, stack+10, asm.R0, asm.Half),
+	)
+}
+
+// Change the protocol of the packet, and the Ethernet type accordingly.
+// stack is a scratch space of 2 bytes.
+func (b *builder) changeProto(ethType uint16, stack int16, fail string) {
+	b.add(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, hostBE16(ethType)),
+		asm.Mov.Imm(asm.R3, 0),
+		asm.FnSkbChangeProto.Call(),
+		asm.JNE.Imm(asm.R0, 0, fail),
+		asm.StoreImm(asm.RFP, stack, int64(hostBE16(ethType)), asm.Half),
+	)
+	b.storeBytes(12, stack, 2, fail)
+}
+
+// Add (or remove, if negative) R2 bytes after the network header
+func (b *builder) adjustRoom(fail string) {
+	skip := b.newLabel("adjust_room_skip")
+	b.add(
+		asm.JEq.Imm(asm.R2, 0, skip),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R3, bpfAdjRoomNet),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.FnSkbAdjustRoom.Call(),
+		asm.JNE.Imm(asm.R0, 0, fail),
+	)
+	b.mark(skip)
+}
+
+// Extract the w bits field at bit offset off (from the left) of
+// the 128 bits address hi:lo (in host byte order) into dst.
+// off is a register, w is lower than 64.
+// t1 and t2 are clobbered.
+func (b *builder) extract128(dst, off asm.Register, w int32, hi, lo, t1, t2 asm.Register) {
+	inLo := b.newLabel("extract_lo")
+	straddle := b.newLabel("extract_straddle")
+	end := b.newLabel("extract_end")
+	b.add(
+		asm.JGE.Imm(off, 64, inLo),
+		asm.JGT.Imm(off, 64-w, straddle),
+		// field is in hi
+		asm.Mov.Reg(dst, hi),
+		asm.LSh.Reg(dst, off),
+		asm.RSh.Imm(dst, 64-w),
+		asm.Ja.Label(end),
+	)
+	b.mark(inLo)
+	b.add(
+		asm.Mov.Reg(t1, off),
+		asm.Sub.Imm(t1, 64),
+		asm.Mov.Reg(dst, lo),
+		asm.LSh.Reg(dst, t1),
+		asm.RSh.Imm(dst, 64-w),
+		asm.Ja.Label(end),
+	)
+	b.mark(straddle)
+	b.add(
+		// upper part of the field is at the end of hi
+		asm.Mov.Reg(dst, hi),
+		asm.LSh.Reg(dst, off),
+		asm.RSh.Imm(dst, 64-w),
+		// lower part of the field is at the beginning of lo
+		asm.Mov.Imm(t1, 128-w),
+		asm.Sub.Reg(t1, off),
+		asm.Mov.Reg(t2, lo),
+		asm.RSh.Reg(t2, t1),
+		asm.Or.Reg(dst, t2),
+	)
+	b.mark(end)
+}
+
+// Insert the w bits field src at bit offset off (from the left) of
+// the 128 bits address hi:lo (in host byte order).
+// off is a register, w is lower than 64, and bits of hi:lo at this position must be zero.
+// t1 and t2 are clobbered.
+func (b *builder) insert128(src, off asm.Register, w int32, hi, lo, t1, t2 asm.Register) {
+	inLo := b.newLabel("insert_lo")
+	straddle := b.newLabel("insert_straddle")
+	end := b.newLabel("insert_end")
+	b.add(
+		asm.JGE.Imm(off, 64, inLo),
+		asm.JGT.Imm(off, 64-w, straddle),
+		// field is in hi
+		asm.Mov.Imm(t1, 64-w),
+		asm.Sub.Reg(t1, off),
+		asm.Mov.Reg(t2, src),
+		asm.LSh.Reg(t2, t1),
+		asm.Or.Reg(hi, t2),
+		asm.Ja.Label(end),
+	)
+	b.mark(inLo)
+	b.add(
+		asm.Mov.Imm(t1, 128-w),
+		asm.Sub.Reg(t1, off),
+		asm.Mov.Reg(t2, src),
+		asm.LSh.Reg(t2, t1),
+		asm.Or.Reg(lo, t2),
+		asm.Ja.Label(end),
+	)
+	b.mark(straddle)
+	b.add(
+		// upper part of the field goes at the end of hi
+		asm.Mov.Reg(t1, off),
+		asm.Add.Imm(t1, w-64),
+		asm.Mov.Reg(t2, src),
+		asm.RSh.Reg(t2, t1),
+		asm.Or.Reg(hi, t2),
+		// lower part of the field goes at the beginning of lo
+		asm.Mov.Imm(t1, 128-w),
+		asm.Sub.Reg(t1, off),
+		asm.Mov.Reg(t2, src),
+		asm.LSh.Reg(t2, t1),
+		asm.Or.Reg(lo, t2),
+	)
+	b.mark(end)
+}
+
+// Common exits of programs
+func (b *builder) exits(pass, drop string) {
+	b.mark(pass)
+	b.add(
+		asm.Mov.Imm(asm.R0, tcActUnspec),
+		asm.Return(),
+	)
+	b.mark(drop)
+	b.add(
+		asm.Mov.Imm(asm.R0, tcActShot),
+		asm.Return(),
+	)
+}
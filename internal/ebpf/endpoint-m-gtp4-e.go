@@ -0,0 +1,242 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/nextmn/srv6/internal/constants"
+
+	"github.com/cilium/ebpf/asm"
+)
+
+// Stack of the End.M.GTP4.E program
+const (
+	eStackEthType  = -8
+	eStackIPv6     = -48  // IPv6 header (40 bytes)
+	eStackSRH      = -56  // first 8 bytes of the SRH
+	eStackOut      = -104 // new IPv4/UDP/GTP-U headers (44 bytes)
+	eStackInnerLen = -112
+)
+
+// Length of the IPv4/UDP/GTP-U headers pushed by End.M.GTP4.E
+// (GTP-U header with a PDU Session Container)
+const eOutLen = ipv4HdrLen + udpHdrLen + gtpuHdrLen + 4 + 4
+
+// End.M.GTP4.E running at TC ingress.
+// G-PDUs are translated in the kernel; other packets
+// (e.g. End Markers) are left to the kernel stack.
+type EndpointMGTP4E struct {
+	*TCProgram
+}
+
+// Create a new End.M.GTP4.E program for this prefix (the SID is prefix + IPv4 DA + Args.Mob.Session)
+func NewEndpointMGTP4E(prefix netip.Prefix, ttl uint8) (*EndpointMGTP4E, error) {
+	insns, err := endpointMGTP4EInstructions(prefix, ttl)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newTCProgram("end_m_gtp4_e", insns)
+	if err != nil {
+		return nil, err
+	}
+	return &EndpointMGTP4E{TCProgram: p}, nil
+}
+
+func endpointMGTP4EInstructions(prefix netip.Prefix, ttl uint8) (asm.Instructions, error) {
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return nil, fmt.Errorf("Prefix of End.M.GTP4.E must be an IPv6 prefix")
+	}
+	// IPv4 DA (32 bits) and Args.Mob.Session (40 bits) follow the prefix
+	bits := prefix.Bits()
+	if bits > 128-32-40 {
+		return nil, fmt.Errorf("Prefix of End.M.GTP4.E is too long (maximum is /56)")
+	}
+	addr := prefix.Masked().Addr().As16()
+	prefixHi := binary.BigEndian.Uint64(addr[:8])
+	var maskHi uint64
+	if bits > 0 {
+		maskHi = ^uint64(0) << (64 - bits)
+	}
+
+	b := &builder{}
+	pass := "pass"
+	drop := "drop"
+	inner := "inner"
+
+	b.add(asm.Mov.Reg(asm.R6, asm.R1))
+	// GSO packets are left to the kernel
+	b.add(
+		asm.LoadMem(asm.R0, asm.R6, skbGSOSize, asm.Word),
+		asm.JNE.Imm(asm.R0, 0, pass),
+	)
+	// Ethernet
+	b.loadBytes(12, eStackEthType, 2, pass)
+	b.add(
+		asm.LoadMem(asm.R0, asm.RFP, eStackEthType, asm.Half),
+		asm.JNE.Imm(asm.R0, hostBE16(0x86DD), pass),
+	)
+	// IPv6 DA must be in prefix
+	b.loadBytes(ethHdrLen, eStackIPv6, ipv6HdrLen, pass)
+	b.add(
+		asm.LoadMem(asm.R7, asm.RFP, eStackIPv6+24, asm.DWord),
+		asm.HostTo(asm.BE, asm.R7, asm.DWord),
+		asm.LoadMem(asm.R8, asm.RFP, eStackIPv6+32, asm.DWord),
+		asm.HostTo(asm.BE, asm.R8, asm.DWord),
+	)
+	if bits > 0 {
+		b.add(
+			asm.Mov.Reg(asm.R1, asm.R7),
+			asm.LoadImm(asm.R2, int64(maskHi), asm.DWord),
+			asm.And.Reg(asm.R1, asm.R2),
+			asm.LoadImm(asm.R2, int64(prefixHi), asm.DWord),
+			asm.JNE.Reg(asm.R1, asm.R2, pass),
+		)
+	}
+
+	// RFC 9433 section 6.6. End.M.GTP4.E
+	// SRH is optional: R9 is its length
+	b.add(
+		asm.Mov.Imm(asm.R9, 0),
+		asm.LoadMem(asm.R1, asm.RFP, eStackIPv6+6, asm.Byte),
+		asm.JEq.Imm(asm.R1, 4, inner),
+		asm.JNE.Imm(asm.R1, 43, pass),
+	)
+	b.loadBytes(ethHdrLen+ipv6HdrLen, eStackSRH, 8, pass)
+	b.add(
+		// Routing Type: SRH
+		asm.LoadMem(asm.R1, asm.RFP, eStackSRH+2, asm.Byte),
+		asm.JNE.Imm(asm.R1, 4, pass),
+		// S02. If (Segments Left != 0) discard the packet
+		asm.LoadMem(asm.R1, asm.RFP, eStackSRH+3, asm.Byte),
+		asm.JNE.Imm(asm.R1, 0, drop),
+		// No Next Header (End Marker) is left to the kernel
+		asm.LoadMem(asm.R1, asm.RFP, eStackSRH, asm.Byte),
+		asm.JNE.Imm(asm.R1, 4, pass),
+		asm.LoadMem(asm.R9, asm.RFP, eStackSRH+1, asm.Byte),
+		asm.LSh.Imm(asm.R9, 3),
+		asm.Add.Imm(asm.R9, 8),
+	)
+	b.mark(inner)
+	b.add(
+		asm.LoadMem(asm.R1, asm.RFP, eStackIPv6+4, asm.Half),
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+		asm.Sub.Reg(asm.R1, asm.R9),
+		asm.JSLE.Imm(asm.R1, 0, pass),
+		asm.JGT.Imm(asm.R1, 0xFFFF-eOutLen, pass),
+		asm.StoreMem(asm.RFP, eStackInnerLen, asm.R1, asm.DWord),
+	)
+
+	// S03. Push a new IPv4 header with a UDP/GTP-U header
+	for i := int16(0); i < eOutLen; i += 4 {
+		b.add(asm.StoreImm(asm.RFP, eStackOut+i, 0, asm.Word))
+	}
+	b.add(
+		// IPv4
+		asm.StoreImm(asm.RFP, eStackOut, 0x45, asm.Byte),
+		asm.StoreImm(asm.RFP, eStackOut+6, int64(hostBE16(0x4000)), asm.Half), // Don't Fragment
+		asm.StoreImm(asm.RFP, eStackOut+8, int64(ttl), asm.Byte),
+		asm.StoreImm(asm.RFP, eStackOut+9, 17, asm.Byte),
+		// UDP
+		asm.StoreImm(asm.RFP, eStackOut+22, int64(hostBE16(constants.GTPU_PORT_INT)), asm.Half),
+		// GTP-U: version 1, PT, E
+		asm.StoreImm(asm.RFP, eStackOut+28, 0x34, asm.Byte),
+		asm.StoreImm(asm.RFP, eStackOut+29, constants.GTPU_MESSAGE_TYPE_GPDU, asm.Byte),
+		// PDU Session Container (DL PDU Session Information)
+		asm.StoreImm(asm.RFP, eStackOut+39, 0x85, asm.Byte),
+		asm.StoreImm(asm.RFP, eStackOut+40, 1, asm.Byte),
+	)
+	// lengths
+	for _, f := range []struct {
+		off int16
+		add int32
+	}{
+		{off: 2, add: eOutLen},                         // IPv4 Total Length
+		{off: 24, add: udpHdrLen + gtpuHdrLen + 4 + 4}, // UDP Length
+		{off: 30, add: 4 + 4},                          // GTP-U Message Length
+	} {
+		b.add(
+			asm.LoadMem(asm.R1, asm.RFP, eStackInnerLen, asm.DWord),
+			asm.Add.Imm(asm.R1, f.add),
+			asm.HostTo(asm.BE, asm.R1, asm.Half),
+			asm.StoreMem(asm.RFP, eStackOut+f.off, asm.R1, asm.Half),
+		)
+	}
+
+	// S01. Store the IPv6 DA and SA in buffer memory
+	// S04. Set the outer IPv4 SA and DA (from buffer memory)
+	b.add(asm.Mov.Imm(asm.R1, int32(bits)))
+	b.extract128(asm.R2, asm.R1, 32, asm.R7, asm.R8, asm.R3, asm.R4)
+	b.add(
+		asm.HostTo(asm.BE, asm.R2, asm.Word),
+		asm.StoreMem(asm.RFP, eStackOut+16, asm.R2, asm.Word),
+		asm.Mov.Imm(asm.R1, int32(bits+32)),
+	)
+	b.extract128(asm.R2, asm.R1, 40, asm.R7, asm.R8, asm.R3, asm.R4)
+	b.add(
+		// S06. Set the GTP-U TEID (from buffer memory)
+		asm.Mov.Reg(asm.R3, asm.R2),
+		asm.HostTo(asm.BE, asm.R3, asm.Word),
+		asm.StoreMem(asm.RFP, eStackOut+32, asm.R3, asm.Word),
+		// QFI is copied into the DSCP field
+		asm.Mov.Reg(asm.R3, asm.R2),
+		asm.RSh.Imm(asm.R3, 34),
+		asm.And.Imm(asm.R3, 0x3F),
+		asm.Mov.Reg(asm.R4, asm.R3),
+		asm.LSh.Imm(asm.R4, 2),
+		asm.StoreMem(asm.RFP, eStackOut+1, asm.R4, asm.Byte),
+		// PDU Session Container: RQI and QFI
+		asm.Mov.Reg(asm.R4, asm.R2),
+		asm.RSh.Imm(asm.R4, 33),
+		asm.And.Imm(asm.R4, 1),
+		asm.LSh.Imm(asm.R4, 6),
+		asm.Or.Reg(asm.R4, asm.R3),
+		asm.StoreMem(asm.RFP, eStackOut+42, asm.R4, asm.Byte),
+	)
+	// IPv6 SA: IPv4 SA and UDP Source Port, prefix length is in the last byte
+	b.add(
+		asm.LoadMem(asm.R7, asm.RFP, eStackIPv6+8, asm.DWord),
+		asm.HostTo(asm.BE, asm.R7, asm.DWord),
+		asm.LoadMem(asm.R8, asm.RFP, eStackIPv6+16, asm.DWord),
+		asm.HostTo(asm.BE, asm.R8, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.And.Imm(asm.R1, 0x7F),
+		asm.JEq.Imm(asm.R1, 0, pass),
+		asm.JGT.Imm(asm.R1, 128-32-16-7, pass),
+		asm.Mov.Reg(asm.R5, asm.R1),
+	)
+	b.extract128(asm.R2, asm.R1, 32, asm.R7, asm.R8, asm.R3, asm.R4)
+	b.add(
+		asm.HostTo(asm.BE, asm.R2, asm.Word),
+		asm.StoreMem(asm.RFP, eStackOut+12, asm.R2, asm.Word),
+		asm.Add.Imm(asm.R5, 32),
+	)
+	b.extract128(asm.R2, asm.R5, 16, asm.R7, asm.R8, asm.R3, asm.R4)
+	b.add(
+		asm.HostTo(asm.BE, asm.R2, asm.Half),
+		asm.StoreMem(asm.RFP, eStackOut+20, asm.R2, asm.Half),
+	)
+	b.ipv4Checksum(eStackOut)
+
+	// S02. Pop the IPv6 header and all its extension headers
+	b.changeProto(0x0800, eStackEthType, drop)
+	b.add(
+		asm.Mov.Imm(asm.R2, eOutLen-ipv4HdrLen),
+		asm.Sub.Reg(asm.R2, asm.R9),
+	)
+	b.adjustRoom(drop)
+	b.storeBytes(ethHdrLen, eStackOut, eOutLen, drop)
+
+	// S07. Submit the packet to the egress IPv4 FIB lookup
+	b.add(
+		asm.Mov.Imm(asm.R0, tcActOK),
+		asm.Return(),
+	)
+	b.exits(pass, drop)
+	return b.insns, nil
+}
@@ -0,0 +1,456 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/constants"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/nextmn/rfc9433/encoding"
+
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+
+	cilium_ebpf "github.com/cilium/ebpf"
+)
+
+// Stack of the H.M.GTP4.D program
+const (
+	dStackEthType  = -8
+	dStackIPv4     = -32  // IPv4 header (20 bytes)
+	dStackUDP      = -48  // UDP header followed by the GTP-U header (16 bytes)
+	dStackGTPOpt   = -56  // GTP-U optional fields and PDU Session Container (8 bytes)
+	dStackInner    = -80  // inner IPv4 header (20 bytes)
+	dStackArgs     = -88  // first byte of Args.Mob.Session (QFI, R, U)
+	dStackInnerLen = -96  // length of the T-PDU
+	dStackKey      = -128 // key of the rules map (24 bytes)
+	dStackIPv6     = -176 // new IPv6 header (40 bytes)
+	dStackSeg0     = -192 // Segment List[0] (16 bytes)
+)
+
+// H.M.GTP4.D running at TC ingress.
+// G-PDUs matching a rule are translated in the kernel; other packets
+// (e.g. Echo Requests, End Markers, unknown TEIDs) are left to the kernel stack.
+type HeadendGTP4 struct {
+	*TCProgram
+	rules    *cilium_ebpf.Map
+	withCtrl bool
+	prefix   netip.Prefix
+
+	mu      sync.Mutex
+	entries map[any]action // content of the rules map
+}
+
+// Create a new H.M.GTP4.D program using a static policy
+func NewHeadendGTP4(prefix netip.Prefix, srcPrefix netip.Prefix, hopLimit uint8) (*HeadendGTP4, error) {
+	return newHeadendGTP4(prefix, srcPrefix, hopLimit, false)
+}
+
+// Create a new H.M.GTP4.D program using rules of the controller
+func NewHeadendGTP4WithCtrl(prefix netip.Prefix, srcPrefix netip.Prefix, hopLimit uint8) (*HeadendGTP4, error) {
+	return newHeadendGTP4(prefix, srcPrefix, hopLimit, true)
+}
+
+func newHeadendGTP4(prefix netip.Prefix, srcPrefix netip.Prefix, hopLimit uint8, withCtrl bool) (*HeadendGTP4, error) {
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("Prefix of H.M.GTP4.D must be an IPv4 prefix")
+	}
+	if !srcPrefix.Addr().Is6() || srcPrefix.Bits() < 1 || srcPrefix.Bits() > 128-32-16-7 {
+		return nil, fmt.Errorf("Source address prefix of H.M.GTP4.D must be an IPv6 prefix of length between 1 and 73")
+	}
+	keySize := uint32(binary.Size(policyKey{}))
+	name := "hmgtp4d_policy"
+	if withCtrl {
+		keySize = uint32(binary.Size(ruleKey{}))
+		name = "hmgtp4d_rules"
+	}
+	rules, err := cilium_ebpf.NewMap(&cilium_ebpf.MapSpec{
+		Name:       name,
+		Type:       cilium_ebpf.LPMTrie,
+		KeySize:    keySize,
+		ValueSize:  uint32(binary.Size(action{})),
+		MaxEntries: MaxRules,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create eBPF map: %w", err)
+	}
+	insns, err := headendGTP4Instructions(prefix, srcPrefix, hopLimit, withCtrl, rules.FD())
+	if err != nil {
+		rules.Close()
+		return nil, err
+	}
+	p, err := newTCProgram("h_m_gtp4_d", insns)
+	if err != nil {
+		rules.Close()
+		return nil, err
+	}
+	return &HeadendGTP4{
+		TCProgram: p,
+		rules:     rules,
+		withCtrl:  withCtrl,
+		prefix:    prefix,
+		entries:   make(map[any]action),
+	}, nil
+}
+
+// Detach and unload the program, and its map
+func (h *HeadendGTP4) Close() error {
+	if err := h.TCProgram.Close(); err != nil {
+		return err
+	}
+	return h.rules.Close()
+}
+
+// Load a static policy into the rules map
+func (h *HeadendGTP4) SetPolicy(policy []config.Policy) error {
+	if h.withCtrl {
+		return fmt.Errorf("This headend uses rules of the controller")
+	}
+	entries, err := policyEntries(policy)
+	if err != nil {
+		return err
+	}
+	return h.update(entries)
+}
+
+// Synchronize the rules map with rules of the controller
+func (h *HeadendGTP4) SyncRules(rules database_api.RuleMap) error {
+	if !h.withCtrl {
+		return fmt.Errorf("This headend uses a static policy")
+	}
+	return h.update(ruleEntries(h.prefix, rules))
+}
+
+// Update the rules map: only differences are written
+func (h *HeadendGTP4) update(entries map[any]action) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k := range h.entries {
+		if _, ok := entries[k]; !ok {
+			if err := h.rules.Delete(k); err != nil {
+				return err
+			}
+			delete(h.entries, k)
+		}
+	}
+	for k, v := range entries {
+		if old, ok := h.entries[k]; ok && old == v {
+			continue
+		}
+		if err := h.rules.Put(k, v); err != nil {
+			return err
+		}
+		h.entries[k] = v
+	}
+	return nil
+}
+
+func headendGTP4Instructions(prefix netip.Prefix, srcPrefix netip.Prefix, hopLimit uint8, withCtrl bool, rulesFD int) (asm.Instructions, error) {
+	prefix4 := prefix.Masked().Addr().As4()
+	var mask uint32
+	if prefix.Bits() > 0 {
+		mask = ^uint32(0) << (32 - prefix.Bits())
+	}
+	// IPv6 SA template: prefix and its length
+	src, err := encoding.NewMGTP4IPv6Src(srcPrefix, [4]byte{}, 0).Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{}
+	pass := "pass"
+	drop := "drop"
+	inner := "inner"
+	found := "found"
+	nextHop := "next_hop"
+	translate := "translate"
+
+	b.add(asm.Mov.Reg(asm.R6, asm.R1))
+	// GSO packets are left to the kernel
+	b.add(
+		asm.LoadMem(asm.R0, asm.R6, skbGSOSize, asm.Word),
+		asm.JNE.Imm(asm.R0, 0, pass),
+	)
+	// Ethernet
+	b.loadBytes(12, dStackEthType, 2, pass)
+	b.add(
+		asm.LoadMem(asm.R0, asm.RFP, dStackEthType, asm.Half),
+		asm.JNE.Imm(asm.R0, hostBE16(0x0800), pass),
+	)
+	// IPv4 without options nor fragmentation, with DA in prefix
+	b.loadBytes(ethHdrLen, dStackIPv4, ipv4HdrLen, pass)
+	b.add(
+		asm.LoadMem(asm.R1, asm.RFP, dStackIPv4, asm.Byte),
+		asm.JNE.Imm(asm.R1, 0x45, pass),
+		asm.LoadMem(asm.R1, asm.RFP, dStackIPv4+9, asm.Byte),
+		asm.JNE.Imm(asm.R1, 17, pass),
+		asm.LoadMem(asm.R1, asm.RFP, dStackIPv4+6, asm.Half),
+		asm.And.Imm(asm.R1, hostBE16(0x3FFF)),
+		asm.JNE.Imm(asm.R1, 0, pass),
+		asm.LoadMem(asm.R1, asm.RFP, dStackIPv4+16, asm.Word),
+		asm.HostTo(asm.BE, asm.R1, asm.Word),
+		asm.And.Imm32(asm.R1, int32(mask)),
+		asm.JNE.Imm32(asm.R1, int32(binary.BigEndian.Uint32(prefix4[:])), pass),
+	)
+
+	// RFC 9433 section 6.7. H.M.GTP4.D
+	// S01. IF !(Payload == UDP/GTP-U) THEN Drop the packet
+	// (non GTP-U packets are left to the kernel)
+	b.loadBytes(ethHdrLen+ipv4HdrLen, dStackUDP, udpHdrLen+gtpuHdrLen, pass)
+	b.add(
+		asm.LoadMem(asm.R1, asm.RFP, dStackUDP+2, asm.Half),
+		asm.JNE.Imm(asm.R1, hostBE16(constants.GTPU_PORT_INT), pass),
+		// version 1, PT
+		asm.LoadMem(asm.R1, asm.RFP, dStackUDP+8, asm.Byte),
+		asm.Mov.Reg(asm.R2, asm.R1),
+		asm.And.Imm(asm.R2, 0xF0),
+		asm.JNE.Imm(asm.R2, 0x30, pass),
+		asm.LoadMem(asm.R2, asm.RFP, dStackUDP+9, asm.Byte),
+		asm.JNE.Imm(asm.R2, constants.GTPU_MESSAGE_TYPE_GPDU, pass),
+		// R8 is the length of the GTP-U header
+		asm.Mov.Imm(asm.R8, gtpuHdrLen),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.StoreMem(asm.RFP, dStackArgs, asm.R2, asm.DWord),
+		asm.And.Imm(asm.R1, 0x07),
+		asm.JEq.Imm(asm.R1, 0, inner),
+	)
+	b.loadBytes(ethHdrLen+ipv4HdrLen+udpHdrLen+gtpuHdrLen, dStackGTPOpt, 8, pass)
+	b.add(
+		asm.Mov.Imm(asm.R8, gtpuHdrLen+4),
+		asm.LoadMem(asm.R1, asm.RFP, dStackUDP+8, asm.Byte),
+		asm.And.Imm(asm.R1, 0x04),
+		asm.JEq.Imm(asm.R1, 0, inner),
+		// only a single PDU Session Container is supported
+		asm.LoadMem(asm.R1, asm.RFP, dStackGTPOpt+3, asm.Byte),
+		asm.JEq.Imm(asm.R1, 0, inner),
+		asm.JNE.Imm(asm.R1, 0x85, pass),
+		asm.LoadMem(asm.R1, asm.RFP, dStackGTPOpt+4, asm.Byte),
+		asm.JNE.Imm(asm.R1, 1, pass),
+		asm.LoadMem(asm.R1, asm.RFP, dStackGTPOpt+7, asm.Byte),
+		asm.JNE.Imm(asm.R1, 0, pass),
+		asm.Mov.Imm(asm.R8, gtpuHdrLen+4+4),
+		// PDU Type == DL PDU Session Information
+		asm.LoadMem(asm.R1, asm.RFP, dStackGTPOpt+5, asm.Byte),
+		asm.RSh.Imm(asm.R1, 4),
+		asm.JNE.Imm(asm.R1, 0, inner),
+		// QFI and RQI
+		asm.LoadMem(asm.R1, asm.RFP, dStackGTPOpt+6, asm.Byte),
+		asm.Mov.Reg(asm.R2, asm.R1),
+		asm.And.Imm(asm.R2, 0x3F),
+		asm.LSh.Imm(asm.R2, 2),
+		asm.RSh.Imm(asm.R1, 6),
+		asm.And.Imm(asm.R1, 1),
+		asm.LSh.Imm(asm.R1, 1),
+		asm.Or.Reg(asm.R2, asm.R1),
+		asm.StoreMem(asm.RFP, dStackArgs, asm.R2, asm.DWord),
+	)
+	// S02. Pop the outer IPv4 header and UDP/GTP-U headers
+	// (T-PDU must be IPv4)
+	b.mark(inner)
+	b.add(
+		asm.Mov.Imm(asm.R2, ethHdrLen+ipv4HdrLen+udpHdrLen),
+		asm.Add.Reg(asm.R2, asm.R8),
+	)
+	b.loadBytesReg(dStackInner, ipv4HdrLen, pass)
+	b.add(
+		asm.LoadMem(asm.R1, asm.RFP, dStackInner, asm.Byte),
+		asm.RSh.Imm(asm.R1, 4),
+		asm.JNE.Imm(asm.R1, 4, pass),
+		asm.LoadMem(asm.R1, asm.RFP, dStackIPv4+2, asm.Half),
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+		asm.Sub.Imm(asm.R1, ipv4HdrLen+udpHdrLen),
+		asm.Sub.Reg(asm.R1, asm.R8),
+		asm.JSLE.Imm(asm.R1, 0, pass),
+		asm.StoreMem(asm.RFP, dStackInnerLen, asm.R1, asm.DWord),
+	)
+
+	// Find the rule matching this packet
+	lookup := func() {
+		b.add(
+			asm.LoadMapPtr(asm.R1, rulesFD),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, dStackKey),
+			asm.FnMapLookupElem.Call(),
+			asm.JNE.Imm(asm.R0, 0, found),
+		)
+	}
+	if withCtrl {
+		// TEID, UPF, UE, Service, gNB
+		b.add(
+			asm.StoreImm(asm.RFP, dStackKey, ruleKeyBits, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackUDP+12, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+4, asm.R1, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackIPv4+16, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+8, asm.R1, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackInner+12, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+12, asm.R1, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackInner+16, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+16, asm.R1, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackIPv4+12, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+20, asm.R1, asm.Word),
+		)
+		lookup()
+		// rules without UE IP Address
+		b.add(asm.StoreImm(asm.RFP, dStackKey+12, 0, asm.Word))
+		lookup()
+		// rules without Service IP Address
+		b.add(
+			asm.LoadMem(asm.R1, asm.RFP, dStackInner+12, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+12, asm.R1, asm.Word),
+			asm.StoreImm(asm.RFP, dStackKey+16, 0, asm.Word),
+		)
+		lookup()
+		// rules without UE IP Address nor Service IP Address
+		b.add(asm.StoreImm(asm.RFP, dStackKey+12, 0, asm.Word))
+		lookup()
+	} else {
+		// TEID, inner IPv4 SA
+		b.add(
+			asm.StoreImm(asm.RFP, dStackKey, policyKeyBits, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackUDP+12, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+4, asm.R1, asm.Word),
+			asm.LoadMem(asm.R1, asm.RFP, dStackInner+12, asm.Word),
+			asm.StoreMem(asm.RFP, dStackKey+8, asm.R1, asm.Word),
+		)
+		lookup()
+	}
+	// no rule: let the kernel handle the packet
+	b.add(asm.Ja.Label(pass))
+
+	// R7 is the action, R9 the length of its SRH
+	b.mark(found)
+	b.add(
+		asm.Mov.Reg(asm.R7, asm.R0),
+		asm.LoadMem(asm.R9, asm.R7, actionOffSRHLen, asm.Half),
+		asm.JLT.Imm(asm.R9, 8+16, pass),
+		asm.JGT.Imm(asm.R9, srhMaxLen, pass),
+	)
+
+	// S05. Encapsulate the packet into a new IPv6 header
+	if withCtrl {
+		b.add(asm.StoreImm(asm.RFP, dStackIPv6, int64(hostBE32(0x60000000)), asm.Word))
+	} else {
+		// QFI is copied into the Traffic Class
+		b.add(
+			asm.LoadMem(asm.R1, asm.RFP, dStackArgs, asm.DWord),
+			asm.And.Imm(asm.R1, 0xFC),
+			asm.LSh.Imm(asm.R1, 20),
+			asm.Or.Imm(asm.R1, 0x60000000),
+			asm.HostTo(asm.BE, asm.R1, asm.Word),
+			asm.StoreMem(asm.RFP, dStackIPv6, asm.R1, asm.Word),
+		)
+	}
+	b.add(
+		asm.LoadMem(asm.R1, asm.RFP, dStackInnerLen, asm.DWord),
+		asm.Add.Reg(asm.R1, asm.R9),
+		asm.JGT.Imm(asm.R1, 0xFFFF, pass),
+		asm.HostTo(asm.BE, asm.R1, asm.Half),
+		asm.StoreMem(asm.RFP, dStackIPv6+4, asm.R1, asm.Half),
+		asm.StoreImm(asm.RFP, dStackIPv6+6, 43, asm.Byte),
+		asm.StoreImm(asm.RFP, dStackIPv6+7, int64(hopLimit), asm.Byte),
+	)
+	// S04. Copy IPv4 SA (and UDP Source Port) to form IPv6 SA B'
+	b.add(
+		asm.LoadImm(asm.R3, int64(binary.BigEndian.Uint64(src[:8])), asm.DWord),
+		asm.LoadImm(asm.R4, int64(binary.BigEndian.Uint64(src[8:])), asm.DWord),
+		asm.LoadMem(asm.R2, asm.RFP, dStackIPv4+12, asm.Word),
+		asm.HostTo(asm.BE, asm.R2, asm.Word),
+		asm.LSh.Imm(asm.R2, 16),
+		asm.LoadMem(asm.R5, asm.RFP, dStackUDP, asm.Half),
+		asm.HostTo(asm.BE, asm.R5, asm.Half),
+		asm.Or.Reg(asm.R2, asm.R5),
+		asm.Mov.Imm(asm.R1, int32(srcPrefix.Bits())),
+	)
+	b.insert128(asm.R2, asm.R1, 32+16, asm.R3, asm.R4, asm.R0, asm.R5)
+	b.add(
+		asm.HostTo(asm.BE, asm.R3, asm.DWord),
+		asm.StoreMem(asm.RFP, dStackIPv6+8, asm.R3, asm.DWord),
+		asm.HostTo(asm.BE, asm.R4, asm.DWord),
+		asm.StoreMem(asm.RFP, dStackIPv6+16, asm.R4, asm.DWord),
+	)
+	if !withCtrl {
+		// S03. Copy IPv4 DA and TEID to form SID B (Segment List[0])
+		b.add(
+			asm.LoadMem(asm.R3, asm.R7, actionOffSRH+8, asm.DWord),
+			asm.HostTo(asm.BE, asm.R3, asm.DWord),
+			asm.LoadMem(asm.R4, asm.R7, actionOffSRH+16, asm.DWord),
+			asm.HostTo(asm.BE, asm.R4, asm.DWord),
+			asm.LoadMem(asm.R1, asm.R7, actionOffDstBits, asm.Byte),
+			asm.JGT.Imm(asm.R1, 128-32-40, pass),
+			asm.LoadMem(asm.R2, asm.RFP, dStackIPv4+16, asm.Word),
+			asm.HostTo(asm.BE, asm.R2, asm.Word),
+		)
+		b.insert128(asm.R2, asm.R1, 32, asm.R3, asm.R4, asm.R0, asm.R5)
+		b.add(
+			asm.Add.Imm(asm.R1, 32),
+			asm.LoadMem(asm.R2, asm.RFP, dStackArgs, asm.DWord),
+			asm.LSh.Imm(asm.R2, 32),
+			asm.LoadMem(asm.R5, asm.RFP, dStackUDP+12, asm.Word),
+			asm.HostTo(asm.BE, asm.R5, asm.Word),
+			asm.Or.Reg(asm.R2, asm.R5),
+		)
+		b.insert128(asm.R2, asm.R1, 40, asm.R3, asm.R4, asm.R0, asm.R5)
+		b.add(
+			asm.HostTo(asm.BE, asm.R3, asm.DWord),
+			asm.StoreMem(asm.RFP, dStackSeg0, asm.R3, asm.DWord),
+			asm.HostTo(asm.BE, asm.R4, asm.DWord),
+			asm.StoreMem(asm.RFP, dStackSeg0+8, asm.R4, asm.DWord),
+			// S06. Set the IPv6 DA = B (when there is no other segment)
+			asm.LoadMem(asm.R1, asm.R7, actionOffFlags, asm.Byte),
+			asm.And.Imm(asm.R1, actionFlagDstSeg0),
+			asm.JEq.Imm(asm.R1, 0, nextHop),
+			asm.StoreMem(asm.RFP, dStackIPv6+24, asm.R3, asm.DWord),
+			asm.StoreMem(asm.RFP, dStackIPv6+32, asm.R4, asm.DWord),
+			asm.Ja.Label(translate),
+		)
+	}
+	b.mark(nextHop)
+	b.add(
+		asm.LoadMem(asm.R1, asm.R7, actionOffNextHop, asm.DWord),
+		asm.StoreMem(asm.RFP, dStackIPv6+24, asm.R1, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R7, actionOffNextHop+8, asm.DWord),
+		asm.StoreMem(asm.RFP, dStackIPv6+32, asm.R1, asm.DWord),
+	)
+
+	b.mark(translate)
+	b.changeProto(0x86DD, dStackEthType, drop)
+	b.add(
+		asm.Mov.Reg(asm.R2, asm.R9),
+		asm.Sub.Imm(asm.R2, udpHdrLen),
+		asm.Sub.Reg(asm.R2, asm.R8),
+	)
+	b.adjustRoom(drop)
+	b.storeBytes(ethHdrLen, dStackIPv6, ipv6HdrLen, drop)
+	// SRH
+	b.add(
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.Mov.Imm(asm.R2, ethHdrLen+ipv6HdrLen),
+		asm.Mov.Reg(asm.R3, asm.R7),
+		asm.Add.Imm(asm.R3, actionOffSRH),
+		asm.Mov.Reg(asm.R4, asm.R9),
+		asm.Mov.Imm(asm.R5, 0),
+		asm.FnSkbStoreBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, drop),
+	)
+	if !withCtrl {
+		b.storeBytes(ethHdrLen+ipv6HdrLen+8, dStackSeg0, 16, drop)
+	}
+
+	// S07. Forward along the shortest path to B
+	b.add(
+		asm.Mov.Imm(asm.R0, tcActOK),
+		asm.Return(),
+	)
+	b.exits(pass, drop)
+	return b.insns, nil
+}
@@ -0,0 +1,337 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/rfc9433/encoding"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of entries in a rules map
+const MaxRules = 65536
+
+// Maximum number of segments in the SRH pushed by H.M.GTP4.D
+const MaxSegments = 8
+
+// Maximum length of the SRH pushed by H.M.GTP4.D
+const srhMaxLen = 8 + 16*MaxSegments
+
+// Value of the rules map: SRH to push
+type action struct {
+	SRHLen  uint16 // in bytes
+	Flags   uint8
+	DstBits uint8 // length of the prefix of Segment List[0] (static policy)
+	_       uint32
+	NextHop [16]byte // IPv6 DA
+	SRH     [srhMaxLen]byte
+}
+
+// Offsets in action
+const (
+	actionOffSRHLen  = 0
+	actionOffFlags   = 2
+	actionOffDstBits = 3
+	actionOffNextHop = 8
+	actionOffSRH     = 24
+)
+
+// Flags of action
+const (
+	actionFlagDstSeg0 = 1 // IPv6 DA is Segment List[0] (static policy)
+)
+
+// Key of the rules map for a static policy
+type policyKey struct {
+	PrefixLen uint32
+	Teid      [4]byte
+	InnerSrc  [4]byte
+}
+
+// Length of the key used for lookup
+const policyKeyBits = 64
+
+// Key of the rules map for rules of the controller
+type ruleKey struct {
+	PrefixLen uint32
+	Teid      [4]byte
+	Upf       [4]byte
+	UE        [4]byte // 0.0.0.0 if any
+	Service   [4]byte // 0.0.0.0 if any
+	Gnb       [4]byte
+}
+
+// Length of the key used for lookup
+const ruleKeyBits = 160
+
+// Create an action from the Segment List of the SRH
+func newAction(segments []net.IP) (action, error) {
+	a := action{}
+	if len(segments) < 1 || len(segments) > MaxSegments {
+		return a, fmt.Errorf("SRH must contain between 1 and %d segments", MaxSegments)
+	}
+	a.SRHLen = uint16(8 + 16*len(segments))
+	a.SRH[0] = 4                        // Next Header: IPv4
+	a.SRH[1] = uint8(2 * len(segments)) // Hdr Ext Len
+	a.SRH[2] = 4                        // Routing Type: SRH
+	a.SRH[3] = uint8(len(segments) - 1) // Segments Left
+	a.SRH[4] = uint8(len(segments) - 1) // Last Entry
+	for i, s := range segments {
+		ip := s.To16()
+		if ip == nil || s.To4() != nil {
+			return a, fmt.Errorf("Segment %s is not an IPv6 address", s)
+		}
+		copy(a.SRH[8+16*i:], ip)
+	}
+	copy(a.NextHop[:], a.SRH[8+16*(len(segments)-1):])
+	return a, nil
+}
+
+// Create the action of a BSID of the static policy
+func newPolicyAction(bsid *config.Bsid) (action, error) {
+	if bsid.BsidPrefix == nil {
+		return action{}, fmt.Errorf("BSID prefix is not set")
+	}
+	dstPrefix, err := netip.ParsePrefix(*bsid.BsidPrefix)
+	if err != nil {
+		return action{}, err
+	}
+	if !dstPrefix.Addr().Is6() || dstPrefix.Bits() > 128-32-40 {
+		return action{}, fmt.Errorf("BSID prefix must be an IPv6 prefix of length lower than 56")
+	}
+	// Segment List[0] is completed by the program
+	seg0, err := encoding.NewMGTP4IPv6Dst(dstPrefix, [4]byte{}, encoding.NewArgsMobSession(0, false, false, 0)).Marshal()
+	if err != nil {
+		return action{}, err
+	}
+	a, err := newAction(append([]net.IP{seg0}, bsid.ReverseSegmentsList()...))
+	if err != nil {
+		return a, err
+	}
+	a.DstBits = uint8(dstPrefix.Bits())
+	if len(bsid.SegmentsList) == 0 {
+		a.Flags |= actionFlagDstSeg0
+	}
+	return a, nil
+}
+
+// Entries of the rules map for a static policy.
+// Policies are evaluated in order by the NextMN provider, whereas
+// the rules map returns the longest match: policies shadowed by a previous one
+// are not added to the map.
+func policyEntries(policy []config.Policy) (map[any]action, error) {
+	entries := make(map[any]action)
+	// TEID -> prefixes of inner IPv4 SA of previous policies
+	previous := make(map[uint32][]netip.Prefix)
+	for _, p := range policy {
+		a, err := newPolicyAction(&p.Bsid)
+		if err != nil {
+			return nil, err
+		}
+		if p.Match == nil {
+			// catch-all policy: next policies are never used
+			entries[policyKey{PrefixLen: 0}] = a
+			break
+		}
+		if p.Match.Teid == nil {
+			// never matched by the NextMN provider
+			continue
+		}
+		innerSrc := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if p.Match.InnerHeaderIPv4SrcPrefix != nil {
+			innerSrc, err = netip.ParsePrefix(*p.Match.InnerHeaderIPv4SrcPrefix)
+			if err != nil {
+				return nil, fmt.Errorf("Malformed matching criteria (inner Header IPv4 Prefix): %s", err)
+			}
+			if !innerSrc.Addr().Is4() {
+				return nil, fmt.Errorf("Malformed matching criteria (inner Header IPv4 Prefix): not an IPv4 prefix")
+			}
+			innerSrc = innerSrc.Masked()
+		}
+		if slices.ContainsFunc(previous[*p.Match.Teid], func(prev netip.Prefix) bool {
+			return prev.Bits() <= innerSrc.Bits() && prev.Contains(innerSrc.Addr())
+		}) {
+			continue
+		}
+		previous[*p.Match.Teid] = append(previous[*p.Match.Teid], innerSrc)
+		key := policyKey{
+			PrefixLen: uint32(32 + innerSrc.Bits()),
+			InnerSrc:  innerSrc.Addr().As4(),
+		}
+		binary.BigEndian.PutUint32(key.Teid[:], *p.Match.Teid)
+		entries[key] = a
+	}
+	return entries, nil
+}
+
+// An uplink rule of the controller, loaded into the rules map
+type ctrlRule struct {
+	id       string
+	priority int32
+	ue       [4]byte // 0.0.0.0 if any
+	service  [4]byte // 0.0.0.0 if any
+	gnb      []netip.Prefix
+	action   action
+}
+
+// Specificity of a rule for packets of a gNB prefix (see database_api.Rule),
+// ok is false if the rule does not match these packets
+func (r *ctrlRule) specificity(gnb netip.Prefix) (spec [4]int, ok bool) {
+	spec[0] = int(r.priority)
+	if r.service != [4]byte{} {
+		spec[1] = 32
+	}
+	if r.ue != [4]byte{} {
+		spec[2] = 32
+	}
+	spec[3] = -1
+	for _, p := range r.gnb {
+		if p.Bits() <= gnb.Bits() && p.Contains(gnb.Addr()) && p.Bits() > spec[3] {
+			spec[3] = p.Bits()
+		}
+	}
+	return spec, spec[3] >= 0
+}
+
+// Returns true if the rule matches packets of this UE IP Address and Service IP Address
+func (r *ctrlRule) covers(ue [4]byte, service [4]byte) bool {
+	return (r.ue == [4]byte{} || r.ue == ue) && (r.service == [4]byte{} || r.service == service)
+}
+
+// Entries of the rules map for uplink rules of the controller handled by this headend.
+//
+// The program looks up (UE, Service), (any, Service), (UE, any), then (any, any), and each lookup
+// returns the longest gNB prefix. For the result to be the rule with the highest priority,
+// then the most specific rule, each entry contains the best rule matching all packets of the entry:
+// entries of a key contain rules of more generic keys (e.g. (any, any) rules are added to (UE, Service) keys).
+func ruleEntries(prefix netip.Prefix, rules database_api.RuleMap) map[any]action {
+	entries := make(map[any]action)
+	// rules by F-TEID
+	byFTeid := make(map[jsonapi.Fteid][]*ctrlRule)
+	unsupported := make(map[jsonapi.Fteid]struct{})
+	for id, r := range rules {
+		if !r.Enabled || r.Type != "uplink" || r.Match.Header == nil {
+			continue
+		}
+		upf := r.Match.Header.FTeid.Addr
+		if !upf.Is4() || !prefix.Contains(upf) {
+			// handled by another headend
+			continue
+		}
+		ue, hasUE := r.UE()
+		service, hasService := r.Service()
+		if (hasUE && !ue.Addr().Is4()) || (hasService && !service.Is4()) {
+			// IPv6 T-PDUs are left to the kernel
+			continue
+		}
+		if hasUE && !ue.IsSingleIP() {
+			// keys of the map contain a single UE IP Address: packets of this F-TEID are left to the kernel
+			logrus.WithFields(logrus.Fields{"uuid": id, "ue-prefix": ue}).Warning("UE prefixes are not supported by the eBPF headend: rules of this F-TEID are not loaded into eBPF map")
+			unsupported[r.Match.Header.FTeid] = struct{}{}
+			continue
+		}
+		if len(r.Paths) > 0 {
+			// paths are selected for each flow: packets of this F-TEID are left to the kernel
+			logrus.WithFields(logrus.Fields{"uuid": id}).Warning("Rules with several paths are not supported by the eBPF headend: rules of this F-TEID are not loaded into eBPF map")
+			unsupported[r.Match.Header.FTeid] = struct{}{}
+			continue
+		}
+		a, err := newAction(r.Action.SRH.AsSlice())
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{"uuid": id}).Warning("Rule not loaded into eBPF map")
+			continue
+		}
+		cr := &ctrlRule{
+			id:       id.String(),
+			priority: r.Priority,
+			action:   a,
+		}
+		if hasUE {
+			cr.ue = ue.Addr().As4()
+		}
+		if hasService {
+			cr.service = service.As4()
+		}
+		for _, gnb := range r.Match.Header.OuterIpSrc {
+			if gnb.Addr().Is4() {
+				cr.gnb = append(cr.gnb, gnb.Masked())
+			}
+		}
+		byFTeid[r.Match.Header.FTeid] = append(byFTeid[r.Match.Header.FTeid], cr)
+	}
+	for fteid := range unsupported {
+		delete(byFTeid, fteid)
+	}
+	for fteid, group := range byFTeid {
+		// keys used by at least one rule
+		type matchKey struct{ ue, service [4]byte }
+		keys := make(map[matchKey]struct{})
+		ueOnly := make([][4]byte, 0)
+		serviceOnly := make([][4]byte, 0)
+		for _, r := range group {
+			keys[matchKey{ue: r.ue, service: r.service}] = struct{}{}
+			if r.service == [4]byte{} && r.ue != [4]byte{} {
+				ueOnly = append(ueOnly, r.ue)
+			}
+			if r.ue == [4]byte{} && r.service != [4]byte{} {
+				serviceOnly = append(serviceOnly, r.service)
+			}
+		}
+		// (any, Service) keys do not contain (UE, any) rules:
+		// a packet matching both is looked up with a (UE, Service) key
+		for _, ue := range ueOnly {
+			for _, service := range serviceOnly {
+				keys[matchKey{ue: ue, service: service}] = struct{}{}
+			}
+		}
+		for k := range keys {
+			covering := make([]*ctrlRule, 0, len(group))
+			gnbs := make(map[netip.Prefix]struct{})
+			for _, r := range group {
+				if r.covers(k.ue, k.service) {
+					covering = append(covering, r)
+					for _, p := range r.gnb {
+						gnbs[p] = struct{}{}
+					}
+				}
+			}
+			for gnb := range gnbs {
+				// packets of this entry are matched by rules with a gNB prefix containing it
+				var best *ctrlRule
+				var bestSpec [4]int
+				for _, r := range covering {
+					spec, ok := r.specificity(gnb)
+					if !ok {
+						continue
+					}
+					if best == nil || slices.Compare(spec[:], bestSpec[:]) > 0 || (spec == bestSpec && r.id < best.id) {
+						best = r
+						bestSpec = spec
+					}
+				}
+				key := ruleKey{
+					PrefixLen: uint32(128 + gnb.Bits()),
+					Upf:       fteid.Addr.As4(),
+					UE:        k.ue,
+					Service:   k.service,
+					Gnb:       gnb.Addr().As4(),
+				}
+				binary.BigEndian.PutUint32(key.Teid[:], fteid.Teid)
+				entries[key] = best.action
+			}
+		}
+	}
+	return entries
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package ebpf
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+
+	cilium_ebpf "github.com/cilium/ebpf"
+)
+
+// A program attached at TC ingress of an interface (requires TCX, Linux 6.6)
+type TCProgram struct {
+	prog *cilium_ebpf.Program
+	link link.Link
+}
+
+// Load a new TC program
+func newTCProgram(name string, insns asm.Instructions) (*TCProgram, error) {
+	prog, err := cilium_ebpf.NewProgram(&cilium_ebpf.ProgramSpec{
+		Name:         name,
+		Type:         cilium_ebpf.SchedCLS,
+		Instructions: insns,
+		License:      "MIT",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not load eBPF program %s: %w", name, err)
+	}
+	return &TCProgram{
+		prog: prog,
+	}, nil
+}
+
+// Attach the program at TC ingress of the interface
+func (p *TCProgram) Attach(iface string) error {
+	if p.link != nil {
+		return fmt.Errorf("eBPF program is already attached")
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	l, err := link.AttachTCX(link.TCXOptions{
+		Interface: ifi.Index,
+		Program:   p.prog,
+		Attach:    cilium_ebpf.AttachTCXIngress,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not attach eBPF program to %s: %w", iface, err)
+	}
+	p.link = l
+	return nil
+}
+
+// Detach and unload the program
+func (p *TCProgram) Close() error {
+	if p.link != nil {
+		if err := p.link.Close(); err != nil {
+			return err
+		}
+		p.link = nil
+	}
+	return p.prog.Close()
+}
+
+// Program, to run it with BPF_PROG_TEST_RUN
+func (p *TCProgram) Program() *cilium_ebpf.Program {
+	return p.prog
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package events_api
+
+import (
+	"time"
+
+	database_api "github.com/nextmn/srv6/internal/database/api"
+
+	"github.com/gofrs/uuid"
+)
+
+type EventType string
+
+const (
+	RuleCreated  EventType = "rule.created"
+	RuleUpdated  EventType = "rule.updated" // action or paths of the rule
+	RuleEnabled  EventType = "rule.enabled"
+	RuleDisabled EventType = "rule.disabled"
+	RuleDeleted  EventType = "rule.deleted"
+	RuleExpired  EventType = "rule.expired"
+	TaskState    EventType = "task.state"
+	AlarmRaised  EventType = "alarm.raised"
+	AlarmCleared EventType = "alarm.cleared"
+
+	// Sent to a subscriber when events following its last event ID are no longer available:
+	// the state must be fetched again (e.g. GET /rules)
+	StreamReset EventType = "stream.reset"
+)
+
+type Event struct {
+	Id   string    `json:"id"` // ordered within a run of the program
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// Data of rule events
+type RuleEvent struct {
+	Uuid   uuid.UUID                 `json:"uuid"`
+	Rule   *database_api.Rule        `json:"rule,omitempty"`   // created and updated rules
+	Reason database_api.ExpiryReason `json:"reason,omitempty"` // expired rules
+	Action string                    `json:"action,omitempty"` // expired rules: disabled or deleted
+	Source string                    `json:"source"`           // api, expiry, or gtpu-path-management
+}
+
+// Data of task events
+type TaskEvent struct {
+	Task  string `json:"task"`
+	State string `json:"state"` // running, init-failed, stopped, or exit-failed
+	Error string `json:"error,omitempty"`
+}
+
+// Data of alarm events
+type AlarmEvent struct {
+	Alarm   string `json:"alarm"`  // e.g. gtpu-path-failure
+	Source  string `json:"source"` // e.g. address of a GTP-U peer
+	Message string `json:"message,omitempty"`
+}
+
+type Publisher interface {
+	Publish(t EventType, data any)
+}
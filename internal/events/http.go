@@ -0,0 +1,85 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package events
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Delay between two comments sent on idle streams, so proxies keep the connection open
+const keepAliveInterval = 15 * time.Second
+
+// Stream events with Server-Sent Events.
+// Streams resume after the Last-Event-ID header (or the last-event-id query parameter),
+// and can be filtered by prefixes of event types (e.g. types=rule,alarm).
+func (h *Hub) GetEvents(c *gin.Context) {
+	lastId := c.GetHeader("Last-Event-ID")
+	if lastId == "" {
+		lastId = c.Query("last-event-id")
+	}
+	var prefixes []string
+	if types := c.Query("types"); types != "" {
+		prefixes = strings.Split(types, ",")
+	}
+	s := h.Subscribe(lastId)
+	defer s.Close()
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // disable buffering of nginx
+	c.Status(http.StatusOK)
+	send := func(ev events_api.Event) {
+		if ev.Type != events_api.StreamReset && !hasPrefix(string(ev.Type), prefixes) {
+			return
+		}
+		c.Render(-1, sse.Event{Id: ev.Id, Event: string(ev.Type), Data: ev})
+	}
+	if s.Reset != nil {
+		send(*s.Reset)
+	}
+	for _, ev := range s.Missed {
+		send(ev)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case ev, ok := <-s.C:
+			if !ok {
+				return
+			}
+			send(ev)
+			c.Writer.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+func hasPrefix(t string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(t, strings.TrimSpace(p)) {
+			return true
+		}
+	}
+	return false
+}
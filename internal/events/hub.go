@@ -0,0 +1,149 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	events_api "github.com/nextmn/srv6/internal/events/api"
+)
+
+// Number of past events kept to resume subscriptions
+const DefaultHistory = 1024
+
+// Events waiting to be sent to a subscriber; slower subscribers are disconnected
+const subscriberBuffer = 256
+
+// Hub dispatches events to subscribers, and keeps the last events
+// so subscribers can resume after their last event ID.
+type Hub struct {
+	mu          sync.Mutex
+	epoch       int64 // start of the Hub: IDs of events of previous runs are not resumed
+	seq         uint64
+	history     []entry // oldest first
+	maxHistory  int
+	subscribers map[*Subscription]struct{}
+}
+
+// Event of the history
+type entry struct {
+	seq uint64
+	ev  events_api.Event
+}
+
+// Create a new Hub keeping maxHistory events
+func NewHub(maxHistory int) *Hub {
+	return &Hub{
+		epoch:       time.Now().UnixNano(),
+		history:     make([]entry, 0, maxHistory),
+		maxHistory:  maxHistory,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *Hub) id(seq uint64) string {
+	return fmt.Sprintf("%d-%d", h.epoch, seq)
+}
+
+// Sequence number of an event ID of this Hub
+func (h *Hub) parseId(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != strconv.FormatInt(h.epoch, 10) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// Publish an event; does nothing on a nil Hub
+func (h *Hub) Publish(t events_api.EventType, data any) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	ev := events_api.Event{Id: h.id(h.seq), Type: t, Time: time.Now(), Data: data}
+	if h.maxHistory > 0 {
+		if len(h.history) == h.maxHistory {
+			copy(h.history, h.history[1:])
+			h.history = h.history[:len(h.history)-1]
+		}
+		h.history = append(h.history, entry{seq: h.seq, ev: ev})
+	}
+	for s := range h.subscribers {
+		select {
+		case s.ch <- ev:
+		default:
+			// the subscriber can resume from its last event
+			delete(h.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+// Subscription to the events of a Hub
+type Subscription struct {
+	C      <-chan events_api.Event // closed when the subscriber is disconnected
+	Missed []events_api.Event      // events following the last event ID of the subscriber
+	Reset  *events_api.Event       // not nil when events following the last event ID are not available
+	ch     chan events_api.Event
+	hub    *Hub
+}
+
+// Subscribe to events following lastId (all future events if empty)
+func (h *Hub) Subscribe(lastId string) *Subscription {
+	ch := make(chan events_api.Event, subscriberBuffer)
+	s := &Subscription{C: ch, ch: ch, hub: h}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = struct{}{}
+	if lastId == "" {
+		return s
+	}
+	seq, ok := h.parseId(lastId)
+	oldest := h.seq + 1
+	if len(h.history) > 0 {
+		oldest = h.history[0].seq
+	}
+	if !ok || seq > h.seq || seq+1 < oldest {
+		s.Reset = &events_api.Event{
+			Id:   h.id(h.seq),
+			Type: events_api.StreamReset,
+			Time: time.Now(),
+			Data: map[string]string{"last-event-id": lastId},
+		}
+		return s
+	}
+	for _, e := range h.history[seq+1-oldest:] {
+		s.Missed = append(s.Missed, e.ev)
+	}
+	return s
+}
+
+// Stop receiving events
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subscribers[s]; ok {
+		delete(s.hub.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// Disconnect all subscribers, e.g. on shutdown of the http server
+func (h *Hub) Disconnect() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		close(s.ch)
+	}
+}
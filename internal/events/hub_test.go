@@ -0,0 +1,151 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package events
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hub keeping 3 events, after 5 events were published
+func testHub() *Hub {
+	h := NewHub(3)
+	for i := 0; i < 5; i++ {
+		h.Publish(events_api.RuleCreated, i)
+	}
+	return h
+}
+
+func TestSubscribe(t *testing.T) {
+	h := testHub()
+	for _, tt := range []struct {
+		name   string
+		lastId string
+		missed []any // data of missed events
+		reset  bool
+	}{
+		{"new subscriber", "", nil, false},
+		{"up to date", h.id(5), nil, false},
+		{"last event evicted", h.id(2), []any{2, 3, 4}, false},
+		{"last event kept", h.id(3), []any{3, 4}, false},
+		{"missing events", h.id(1), nil, true},
+		{"future event", h.id(6), nil, true},
+		{"previous run", "1-4", nil, true},
+		{"malformed ID", "last", nil, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := h.Subscribe(tt.lastId)
+			defer s.Close()
+			if got := s.Reset != nil; got != tt.reset {
+				t.Fatalf("got reset %v, want %v", got, tt.reset)
+			}
+			if tt.reset && s.Reset.Type != events_api.StreamReset {
+				t.Errorf("got reset of type %s, want %s", s.Reset.Type, events_api.StreamReset)
+			}
+			if len(s.Missed) != len(tt.missed) {
+				t.Fatalf("got %d missed events, want %d", len(s.Missed), len(tt.missed))
+			}
+			for i, ev := range s.Missed {
+				if ev.Data != tt.missed[i] {
+					t.Errorf("missed event %d: got data %v, want %v", i, ev.Data, tt.missed[i])
+				}
+			}
+		})
+	}
+}
+
+// Resuming from the last event received loses no event
+func TestSubscribeResume(t *testing.T) {
+	h := NewHub(DefaultHistory)
+	s := h.Subscribe("")
+	h.Publish(events_api.RuleCreated, 0)
+	last := <-s.C
+	s.Close()
+	h.Publish(events_api.RuleEnabled, 1)
+	h.Publish(events_api.RuleDisabled, 2)
+
+	s = h.Subscribe(last.Id)
+	defer s.Close()
+	h.Publish(events_api.RuleDeleted, 3)
+	got := append([]events_api.Event{}, s.Missed...)
+	got = append(got, <-s.C)
+	for i, ev := range got {
+		if ev.Data != i+1 {
+			t.Errorf("event %d: got data %v, want %d", i, ev.Data, i+1)
+		}
+	}
+}
+
+// Slow subscribers are disconnected instead of blocking publishers
+func TestSubscriberOverflow(t *testing.T) {
+	h := NewHub(0)
+	s := h.Subscribe("")
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.Publish(events_api.RuleCreated, i)
+	}
+	n := 0
+	for range s.C {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("got %d events before disconnection, want %d", n, subscriberBuffer)
+	}
+	s.Close()
+}
+
+func TestGetEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := testHub()
+	h.Publish(events_api.AlarmRaised, 5)
+	r := gin.New()
+	r.GET("/events", h.GetEvents)
+	for _, tt := range []struct {
+		name   string
+		target string
+		header string
+		want   []string // lines expected in the stream
+		absent []string // lines not expected in the stream
+	}{
+		{"header", "/events", h.id(5), []string{"id:" + h.id(6), "event:alarm.raised"}, []string{"id:" + h.id(5)}},
+		{"query", "/events?last-event-id=" + h.id(4), "", []string{"id:" + h.id(5), "id:" + h.id(6)}, []string{"id:" + h.id(4)}},
+		{"filtered types", "/events?types=rule&last-event-id=" + h.id(4), "", []string{"id:" + h.id(5)}, []string{"id:" + h.id(6)}},
+		{"reset", "/events?types=rule", h.id(1), []string{"event:stream.reset", "id:" + h.id(6)}, []string{"event:rule.created"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// the stream is closed once past events are sent
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil).WithContext(ctx)
+			if tt.header != "" {
+				req.Header.Set("Last-Event-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+				t.Errorf("got Content-Type %q", ct)
+			}
+			lines := strings.Split(w.Body.String(), "\n")
+			for _, l := range tt.want {
+				if !slices.Contains(lines, l) {
+					t.Errorf("%q missing from stream:\n%s", l, w.Body)
+				}
+			}
+			for _, l := range tt.absent {
+				if slices.Contains(lines, l) {
+					t.Errorf("%q unexpected in stream:\n%s", l, w.Body)
+				}
+			}
+		})
+	}
+}
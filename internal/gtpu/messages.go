@@ -0,0 +1,136 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package gtpu
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/nextmn/srv6/internal/constants"
+
+	gopacket_gtp "github.com/nextmn/gopacket-gtp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Serialize a GTP-U message over IPv4/UDP
+func serializeGTP4Message(src netip.Addr, dst netip.Addr, srcPort layers.UDPPort, dstPort layers.UDPPort, ttl uint8, gtpu *gopacket_gtp.GTPv1U, payload []byte) ([]byte, error) {
+	ipv4 := layers.IPv4{
+		// IPv4
+		Version: 4,
+		// Next Header: UDP
+		Protocol: layers.IPProtocolUDP,
+		// Fragmentation is inefficient and should be avoided (TS 129.281 section 4.2.2)
+		// It is recommended to set the default inner MTU size instead.
+		Flags: layers.IPv4DontFragment,
+		SrcIP: src.AsSlice(),
+		DstIP: dst.AsSlice(),
+		// TTL from tun config
+		TTL: ttl,
+		// other fields are initialized at zero
+		// cheksum, and length are computed at serialization
+	}
+	udp := layers.UDP{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		// cheksum, and length are computed at serialization
+	}
+	// required for checksum
+	udp.SetNetworkLayerForChecksum(&ipv4)
+
+	// Unfortunately, gopacket is not able to compute length at serialization for GTP…
+	// When one of the S, PN or E flags is set, the 4 optional octets are part of the length.
+	gtpu.MessageLength = uint16(len(payload))
+	if gtpu.SequenceNumberFlag || gtpu.NPDUFlag || len(gtpu.GTPExtensionHeaders) > 0 {
+		gtpu.MessageLength += 4
+	}
+	for _, e := range gtpu.GTPExtensionHeaders {
+		gtpu.MessageLength += uint16(len(e.Content) + 2) // Type + Length = 2 bytes
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf,
+		gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+		&ipv4,
+		&udp,
+		gtpu,
+		gopacket.Payload(payload),
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Create a GTP-U Echo Response in reply to an Echo Request
+func NewGTP4EchoResponse(src netip.Addr, dst netip.Addr, dstPort layers.UDPPort, ttl uint8, sequenceNumber uint16) ([]byte, error) {
+	gtpu := gopacket_gtp.GTPv1U{
+		Version:      1,
+		ProtocolType: 1,
+		// TS 129.281 section 5.1:
+		// > For the Echo Request, Echo Response, Error Indication and Supported Extension Headers
+		// > Notification messages, the S flag shall be set to '1'.
+		SequenceNumberFlag: true,
+		SequenceNumber:     sequenceNumber,
+		MessageType:        constants.GTPU_MESSAGE_TYPE_ECHO_RESPONSE,
+		TEID:               0,
+	}
+	// TS 129.281 section 8.2: the Restart Counter of the Recovery IE shall be set to zero
+	// by the sender, and shall be ignored by the receiver.
+	return serializeGTP4Message(src, dst, constants.GTPU_PORT_INT, dstPort, ttl, &gtpu, []byte{constants.GTPU_IE_RECOVERY, 0})
+}
+
+// Create a GTP-U Echo Request
+func NewGTP4EchoRequest(src netip.Addr, dst netip.Addr, ttl uint8, sequenceNumber uint16) ([]byte, error) {
+	gtpu := gopacket_gtp.GTPv1U{
+		Version:            1,
+		ProtocolType:       1,
+		SequenceNumberFlag: true,
+		SequenceNumber:     sequenceNumber,
+		MessageType:        constants.GTPU_MESSAGE_TYPE_ECHO_REQUEST,
+		TEID:               0,
+	}
+	return serializeGTP4Message(src, dst, constants.GTPU_PORT_INT, constants.GTPU_PORT_INT, ttl, &gtpu, []byte{})
+}
+
+// Create a GTP-U Error Indication (TS 129.281 section 7.3.1)
+// src is the address the erroneous G-PDU was sent to, and teid its TEID.
+func NewGTP4ErrorIndication(src netip.Addr, dst netip.Addr, ttl uint8, teid uint32) ([]byte, error) {
+	gtpu := gopacket_gtp.GTPv1U{
+		Version:            1,
+		ProtocolType:       1,
+		SequenceNumberFlag: true,
+		SequenceNumber:     0,
+		MessageType:        constants.GTPU_MESSAGE_TYPE_ERROR_INDICATION,
+		TEID:               0,
+	}
+	// Tunnel Endpoint Identifier Data I (type 16, TV)
+	// + GTP-U Peer Address (type 133, TLV)
+	ies := make([]byte, 0, 5+3+4)
+	ies = append(ies, constants.GTPU_IE_TEID_DATA_I)
+	ies = binary.BigEndian.AppendUint32(ies, teid)
+	ies = append(ies, constants.GTPU_IE_GTPU_PEER_ADDRESS)
+	ies = binary.BigEndian.AppendUint16(ies, 4)
+	ies = append(ies, src.AsSlice()...)
+	// The Error Indication is always sent to the GTP-U port, even if the G-PDU
+	// was received from another UDP source port
+	return serializeGTP4Message(src, dst, constants.GTPU_PORT_INT, constants.GTPU_PORT_INT, ttl, &gtpu, ies)
+}
+
+// Create a GTP-U End Marker for the given TEID
+func NewGTP4EndMarker(src netip.Addr, dst netip.Addr, srcPort layers.UDPPort, ttl uint8, teid uint32) ([]byte, error) {
+	gtpu := gopacket_gtp.GTPv1U{
+		Version:      1,
+		ProtocolType: 1,
+		MessageType:  constants.GTPU_MESSAGE_TYPE_END_MARKER,
+		TEID:         teid,
+	}
+	// End Marker is sent with the same source port than G-PDUs of this tunnel
+	return serializeGTP4Message(src, dst, srcPort, constants.GTPU_PORT_INT, ttl, &gtpu, []byte{})
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package gtpu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/nextmn/srv6/internal/constants"
+)
+
+// Ones' complement sum of b, folded
+func sum16(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return sum
+}
+
+func TestGTP4Messages(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.1.1")
+	errorIndication, err := NewGTP4ErrorIndication(src, dst, 32, 0x01020304)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endMarker, err := NewGTP4EndMarker(src, dst, 40000, 32, 0x01020304)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		pkt     []byte
+		srcPort uint16
+		flags   uint8 // version 1, protocol type GTP, and S flag
+		msgType uint8
+		teid    uint32
+		ies     []byte // after the optional fields, if any
+	}{
+		{
+			name:    "Error Indication",
+			pkt:     errorIndication,
+			srcPort: constants.GTPU_PORT_INT,
+			flags:   0x32,
+			msgType: constants.GTPU_MESSAGE_TYPE_ERROR_INDICATION,
+			teid:    0,
+			ies: []byte{
+				constants.GTPU_IE_TEID_DATA_I, 0x01, 0x02, 0x03, 0x04,
+				constants.GTPU_IE_GTPU_PEER_ADDRESS, 0, 4, 10, 0, 0, 1,
+			},
+		},
+		{
+			name:    "End Marker",
+			pkt:     endMarker,
+			srcPort: 40000,
+			flags:   0x30,
+			msgType: constants.GTPU_MESSAGE_TYPE_END_MARKER,
+			teid:    0x01020304,
+			ies:     []byte{},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := tt.pkt
+			if len(pkt) < 36 {
+				t.Fatalf("packet too short: % x", pkt)
+			}
+			// IPv4
+			if int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+				t.Errorf("wrong IPv4 total length")
+			}
+			if pkt[6]&0x40 == 0 {
+				t.Errorf("DF flag not set")
+			}
+			if pkt[8] != 32 || pkt[9] != 17 {
+				t.Errorf("got TTL %d and protocol %d, want 32 and 17", pkt[8], pkt[9])
+			}
+			if !bytes.Equal(pkt[12:16], src.AsSlice()) || !bytes.Equal(pkt[16:20], dst.AsSlice()) {
+				t.Errorf("wrong IPv4 addresses")
+			}
+			if sum16(0, pkt[:20]) != 0xFFFF {
+				t.Errorf("wrong IPv4 header checksum")
+			}
+			// UDP
+			udp := pkt[20:]
+			if got := binary.BigEndian.Uint16(udp[0:2]); got != tt.srcPort {
+				t.Errorf("got source port %d, want %d", got, tt.srcPort)
+			}
+			if got := binary.BigEndian.Uint16(udp[2:4]); got != constants.GTPU_PORT_INT {
+				t.Errorf("got destination port %d, want %d", got, constants.GTPU_PORT_INT)
+			}
+			pseudo := sum16(17+uint32(len(udp)), pkt[12:20])
+			if sum16(pseudo, udp) != 0xFFFF {
+				t.Errorf("wrong UDP checksum")
+			}
+			// GTP-U
+			gtp := udp[8:]
+			if gtp[0] != tt.flags || gtp[1] != tt.msgType {
+				t.Errorf("got flags %#x and message type %d, want %#x and %d", gtp[0], gtp[1], tt.flags, tt.msgType)
+			}
+			if got := int(binary.BigEndian.Uint16(gtp[2:4])); got != len(gtp)-8 {
+				t.Errorf("got message length %d, want %d", got, len(gtp)-8)
+			}
+			if got := binary.BigEndian.Uint32(gtp[4:8]); got != tt.teid {
+				t.Errorf("got TEID %#x, want %#x", got, tt.teid)
+			}
+			ies := gtp[8:]
+			if tt.flags&0x07 != 0 {
+				// sequence number, N-PDU number, and next extension header type
+				if !bytes.Equal(ies[:4], []byte{0, 0, 0, 0}) {
+					t.Errorf("got optional fields % x, want zeros", ies[:4])
+				}
+				ies = ies[4:]
+			}
+			if !bytes.Equal(ies, tt.ies) {
+				t.Errorf("got IEs % x, want % x", ies, tt.ies)
+			}
+		})
+	}
+}
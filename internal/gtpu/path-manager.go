@@ -0,0 +1,533 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package gtpu
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/constants"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	events_api "github.com/nextmn/srv6/internal/events/api"
+
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type PeerState int
+
+const (
+	PeerStateUnknown PeerState = iota // no Echo Response received yet
+	PeerStateUp
+	PeerStateDown
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerStateUnknown:
+		return "unknown"
+	case PeerStateUp:
+		return "up"
+	case PeerStateDown:
+		return "down"
+	default:
+		return "Unknown"
+	}
+}
+
+func (s PeerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Status of a GTP-U peer, as reported by the REST API
+type PeerStatus struct {
+	Address             netip.Addr `json:"address"`
+	Source              netip.Addr `json:"source"`
+	State               PeerState  `json:"state"`
+	Static              bool       `json:"static"`                    // false when learned from rules
+	ConsecutiveFailures int        `json:"consecutive-failures"`      // Echo Requests without response
+	RestartCounter      *uint8     `json:"restart-counter,omitempty"` // from the Recovery IE
+	Restarts            int        `json:"restarts"`                  // restarts detected using the Recovery IE
+	LastEchoResponse    *time.Time `json:"last-echo-response,omitempty"`
+	AffectedRules       int        `json:"affected-rules"` // rules disabled or switched because of this peer
+}
+
+// Rules modified on path failure
+type affectedRule struct {
+	disabled uuid.UUID
+	enabled  *uuid.UUID // backup rule, if any
+}
+
+type peer struct {
+	PeerStatus
+	outstanding bool   // an Echo Request is waiting for a response
+	seq         uint16 // sequence number of the outstanding Echo Request
+	sentAt      time.Time
+	nextProbe   time.Time
+	affected    []affectedRule
+}
+
+type transition struct {
+	address netip.Addr
+	up      bool
+}
+
+// Sender writes packets to the dataplane, for a range of GTP4 headend addresses
+type Sender struct {
+	Prefix netip.Prefix
+	TTL    uint8
+	Write  func(packet []byte) (int, error)
+}
+
+// PathManager sends Echo Requests to GTP-U peers (TS 29.281 section 7.2.1),
+// and disables or switches rules using a peer on path failure
+type PathManager struct {
+	mu             sync.Mutex
+	interval       time.Duration
+	timeout        time.Duration
+	retries        int
+	onFailure      config.PathFailureAction
+	learnFromRules bool
+	senders        []Sender
+	rules          database_api.Rules       // used to learn peers
+	writer         database_api.RulesWriter // used to change rules on path failure
+	peers          map[netip.Addr]*peer
+	pending        map[uint16]netip.Addr
+	seq            uint16
+	transitions    chan transition
+	events         events_api.Publisher // may be nil
+}
+
+func NewPathManager(conf *config.GTPUPathManagement, defaultSource *netip.Addr, senders []Sender, rules database_api.Rules, writer database_api.RulesWriter, events events_api.Publisher) (*PathManager, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("Missing GTP-U path management configuration")
+	}
+	if conf.OnFailure != config.PathFailureNone && writer == nil {
+		return nil, fmt.Errorf("Action on path failure requires a database and the REST API")
+	}
+	if conf.LearnFromRules && rules == nil {
+		return nil, fmt.Errorf("Learning peers from rules requires a database")
+	}
+	pm := &PathManager{
+		interval:       conf.IntervalOrDefault(),
+		timeout:        conf.TimeoutOrDefault(),
+		retries:        conf.RetriesOrDefault(),
+		onFailure:      conf.OnFailure,
+		learnFromRules: conf.LearnFromRules,
+		senders:        senders,
+		rules:          rules,
+		writer:         writer,
+		peers:          make(map[netip.Addr]*peer),
+		pending:        make(map[uint16]netip.Addr),
+		transitions:    make(chan transition, 64),
+		events:         events,
+	}
+	if pm.interval <= 0 || pm.timeout <= 0 {
+		return nil, fmt.Errorf("Interval and timeout must be positive")
+	}
+	if pm.retries < 0 {
+		return nil, fmt.Errorf("Retries must not be negative")
+	}
+	for _, p := range conf.Peers {
+		src := defaultSource
+		if p.Source != nil {
+			src = p.Source
+		}
+		if src == nil {
+			return nil, fmt.Errorf("Missing source address for GTP-U peer %s", p.Address)
+		}
+		pm.peers[p.Address] = &peer{
+			PeerStatus: PeerStatus{
+				Address: p.Address,
+				Source:  *src,
+				State:   PeerStateUnknown,
+				Static:  true,
+			},
+		}
+	}
+	return pm, nil
+}
+
+// Run the path manager until ctx is done
+func (pm *PathManager) Run(ctx context.Context) {
+	if pm.learnFromRules {
+		pm.refreshPeers(ctx)
+	}
+	// the database may be slow: it must not delay Echo Requests
+	go pm.runRules(ctx)
+	tick := pm.timeout
+	if pm.interval < tick {
+		tick = pm.interval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	pm.probe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pm.probe()
+		}
+	}
+}
+
+// Learn peers from rules, and change rules on path state changes, until ctx is done
+func (pm *PathManager) runRules(ctx context.Context) {
+	refresh := time.NewTicker(pm.interval)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			if pm.learnFromRules {
+				pm.refreshPeers(ctx)
+			}
+		case t := <-pm.transitions:
+			if t.up {
+				pm.restoreRules(ctx, t.address)
+			} else {
+				pm.applyFailureAction(ctx, t.address)
+			}
+		}
+	}
+}
+
+// Peers returns the status of each GTP-U peer
+func (pm *PathManager) Peers() []PeerStatus {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	peers := make([]PeerStatus, 0, len(pm.peers))
+	for _, p := range pm.peers {
+		s := p.PeerStatus
+		s.AffectedRules = len(p.affected)
+		peers = append(peers, s)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address.Less(peers[j].Address)
+	})
+	return peers
+}
+
+// HandleEchoResponse must be called when an Echo Response is received from a peer.
+// The payload contains the Information Elements of the Echo Response.
+func (pm *PathManager) HandleEchoResponse(address netip.Addr, seq uint16, payload []byte) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if a, ok := pm.pending[seq]; !ok || a != address {
+		logrus.WithFields(logrus.Fields{"peer": address, "seq": seq}).Debug("Unexpected GTP-U Echo Response")
+		return
+	}
+	delete(pm.pending, seq)
+	p, ok := pm.peers[address]
+	if !ok || !p.outstanding || p.seq != seq {
+		return
+	}
+	now := time.Now()
+	p.outstanding = false
+	p.ConsecutiveFailures = 0
+	p.LastEchoResponse = &now
+	p.nextProbe = p.sentAt.Add(pm.interval)
+
+	// TS 29.281 section 8.2: the restart counter shall be ignored by the receiver,
+	// but a change is still worth reporting
+	if len(payload) >= 2 && payload[0] == constants.GTPU_IE_RECOVERY {
+		counter := payload[1]
+		if p.RestartCounter != nil && *p.RestartCounter != counter {
+			p.Restarts++
+			logrus.WithFields(logrus.Fields{"peer": address}).Warn("GTP-U peer restarted")
+		}
+		p.RestartCounter = &counter
+	}
+
+	if p.State != PeerStateUp {
+		logrus.WithFields(logrus.Fields{"peer": address}).Info("GTP-U path is up")
+		if p.State == PeerStateDown {
+			pm.publish(events_api.AlarmCleared, events_api.AlarmEvent{Alarm: "gtpu-path-failure", Source: address.String(), Message: "GTP-U path is up"})
+			pm.notify(transition{address: address, up: true})
+		}
+		p.State = PeerStateUp
+	}
+}
+
+// Send Echo Requests, and detect timeouts
+func (pm *PathManager) probe() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	now := time.Now()
+	for _, p := range pm.peers {
+		if p.outstanding {
+			if now.Sub(p.sentAt) < pm.timeout {
+				continue
+			}
+			// T3-RESPONSE expired
+			delete(pm.pending, p.seq)
+			p.outstanding = false
+			p.ConsecutiveFailures++
+			if p.ConsecutiveFailures > pm.retries {
+				if p.State != PeerStateDown {
+					logrus.WithFields(logrus.Fields{"peer": p.Address, "requests": p.ConsecutiveFailures}).Warn("GTP-U path failure")
+					p.State = PeerStateDown
+					pm.publish(events_api.AlarmRaised, events_api.AlarmEvent{Alarm: "gtpu-path-failure", Source: p.Address.String(), Message: "No Echo Response from GTP-U peer"})
+					pm.notify(transition{address: p.Address, up: false})
+				}
+				// continue probing to detect recovery
+				p.nextProbe = p.sentAt.Add(pm.interval)
+			} else {
+				// retransmission
+				p.nextProbe = now
+			}
+		}
+		if now.Before(p.nextProbe) {
+			continue
+		}
+		pm.send(p, now)
+	}
+}
+
+// Send an Echo Request to the peer; pm.mu must be held
+func (pm *PathManager) send(p *peer, now time.Time) {
+	var sender *Sender
+	for i := range pm.senders {
+		if pm.senders[i].Prefix.Contains(p.Source) {
+			sender = &pm.senders[i]
+			break
+		}
+	}
+	if sender == nil {
+		logrus.WithFields(logrus.Fields{"peer": p.Address, "source": p.Source}).Debug("No GTP4 headend with this source address")
+		p.nextProbe = now.Add(pm.interval)
+		return
+	}
+	pm.seq++
+	seq := pm.seq
+	pkt, err := NewGTP4EchoRequest(p.Source, p.Address, sender.TTL, seq)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"peer": p.Address}).Error("Could not create GTP-U Echo Request")
+		p.nextProbe = now.Add(pm.interval)
+		return
+	}
+	// the request is considered sent even if the write fails, so failures are detected
+	if _, err := sender.Write(pkt); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"peer": p.Address}).Debug("Could not send GTP-U Echo Request")
+	}
+	p.outstanding = true
+	p.seq = seq
+	p.sentAt = now
+	pm.pending[seq] = p.Address
+}
+
+// Non-blocking notification of a state change; pm.mu must be held
+func (pm *PathManager) notify(t transition) {
+	if pm.onFailure == config.PathFailureNone {
+		return
+	}
+	select {
+	case pm.transitions <- t:
+	default:
+		logrus.WithFields(logrus.Fields{"peer": t.address}).Error("GTP-U path state change dropped")
+	}
+}
+
+// Learn peers from the outer IP source of uplink rules
+func (pm *PathManager) refreshPeers(ctx context.Context) {
+	rules, err := pm.rules.GetRules(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Could not learn GTP-U peers from rules")
+		return
+	}
+	learned := make(map[netip.Addr]netip.Addr)
+	for _, r := range rules {
+		if r.Type != "uplink" || r.Match.Header == nil {
+			continue
+		}
+		for _, prefix := range r.Match.Header.OuterIpSrc {
+			if prefix.IsSingleIP() && prefix.Addr().Is4() {
+				learned[prefix.Addr()] = r.Match.Header.FTeid.Addr
+			}
+		}
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for addr, src := range learned {
+		if _, ok := pm.peers[addr]; ok {
+			continue
+		}
+		pm.peers[addr] = &peer{
+			PeerStatus: PeerStatus{
+				Address: addr,
+				Source:  src,
+				State:   PeerStateUnknown,
+			},
+		}
+	}
+	for addr, p := range pm.peers {
+		if _, ok := learned[addr]; ok || p.Static {
+			continue
+		}
+		if p.outstanding {
+			delete(pm.pending, p.seq)
+		}
+		delete(pm.peers, addr)
+	}
+}
+
+// Returns true if the rule is bound to this gNB
+func usesPeer(r n4tosrv6.Rule, address netip.Addr) bool {
+	if r.Type != "uplink" || r.Match.Header == nil {
+		return false
+	}
+	for _, prefix := range r.Match.Header.OuterIpSrc {
+		if prefix.IsSingleIP() && prefix.Addr() == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if r2 can replace r1
+func isBackup(r1 database_api.Rule, r2 database_api.Rule) bool {
+	if r2.Enabled || r2.Type != r1.Type || r1.Match.Header == nil || r2.Match.Header == nil {
+		return false
+	}
+	if r1.Match.Header.FTeid != r2.Match.Header.FTeid {
+		return false
+	}
+	ue1, ok1 := r1.UE()
+	ue2, ok2 := r2.UE()
+	if ok1 != ok2 || ue1 != ue2 {
+		return false
+	}
+	s1, ok1 := r1.Service()
+	s2, ok2 := r2.Service()
+	return ok1 == ok2 && s1 == s2
+}
+
+func (pm *PathManager) applyFailureAction(ctx context.Context, address netip.Addr) {
+	affected := []affectedRule{}
+	if err := pm.writer.UpdateRules(ctx, func(rules database_api.RuleMap, apply database_api.ApplyFunc) {
+		for id, r := range rules {
+			if !r.Enabled || !usesPeer(r.Rule, address) {
+				continue
+			}
+			if pm.onFailure == config.PathFailureSwitchRules {
+				switched := false
+				for id2, r2 := range rules {
+					if !isBackup(r, r2) || usesPeer(r2.Rule, address) {
+						continue
+					}
+					if err := apply(
+						database_api.BatchOperation{Op: database_api.BatchEnable, Uuid: &id2},
+						database_api.BatchOperation{Op: database_api.BatchDisable, Uuid: &id},
+					); err != nil {
+						logrus.WithError(err).WithFields(logrus.Fields{"peer": address, "rule": id, "backup": id2}).Error("Could not switch rule")
+						break
+					}
+					pm.publishRule(events_api.RuleDisabled, id)
+					pm.publishRule(events_api.RuleEnabled, id2)
+					// the backup cannot replace other rules
+					r2.Enabled = true
+					rules[id2] = r2
+					affected = append(affected, affectedRule{disabled: id, enabled: &id2})
+					switched = true
+					break
+				}
+				if switched {
+					continue
+				}
+			}
+			if err := apply(database_api.BatchOperation{Op: database_api.BatchDisable, Uuid: &id}); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{"peer": address, "rule": id}).Error("Could not disable rule")
+				continue
+			}
+			pm.publishRule(events_api.RuleDisabled, id)
+			affected = append(affected, affectedRule{disabled: id})
+		}
+	}); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"peer": address}).Error("Could not get rules on GTP-U path failure")
+		return
+	}
+	logrus.WithFields(logrus.Fields{"peer": address, "rules": len(affected), "action": pm.onFailure}).Info("Rules updated on GTP-U path failure")
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if p, ok := pm.peers[address]; ok {
+		p.affected = append(p.affected, affected...)
+	}
+}
+
+// Returns true if rules are still in the state left by the failure action
+func (a affectedRule) unchanged(rules database_api.RuleMap) bool {
+	if r, ok := rules[a.disabled]; !ok || r.Enabled {
+		return false
+	}
+	if a.enabled == nil {
+		return true
+	}
+	r, ok := rules[*a.enabled]
+	return ok && r.Enabled
+}
+
+func (pm *PathManager) restoreRules(ctx context.Context, address netip.Addr) {
+	pm.mu.Lock()
+	p, ok := pm.peers[address]
+	if !ok {
+		pm.mu.Unlock()
+		return
+	}
+	affected := p.affected
+	p.affected = nil
+	pm.mu.Unlock()
+	restored := 0
+	if err := pm.writer.UpdateRules(ctx, func(rules database_api.RuleMap, apply database_api.ApplyFunc) {
+		for _, a := range affected {
+			if !a.unchanged(rules) {
+				// changed by the API or by the expiry of rules meanwhile
+				logrus.WithFields(logrus.Fields{"peer": address, "rule": a.disabled}).Info("Rule changed since GTP-U path failure: not restored")
+				continue
+			}
+			ops := []database_api.BatchOperation{{Op: database_api.BatchEnable, Uuid: &a.disabled}}
+			if a.enabled != nil {
+				ops = append(ops, database_api.BatchOperation{Op: database_api.BatchDisable, Uuid: a.enabled})
+			}
+			if err := apply(ops...); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{"peer": address, "rule": a.disabled}).Error("Could not restore rule")
+				continue
+			}
+			if a.enabled != nil {
+				pm.publishRule(events_api.RuleDisabled, *a.enabled)
+			}
+			pm.publishRule(events_api.RuleEnabled, a.disabled)
+			restored++
+		}
+	}); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"peer": address}).Error("Could not get rules on GTP-U path recovery")
+		pm.mu.Lock()
+		defer pm.mu.Unlock()
+		if p, ok := pm.peers[address]; ok {
+			p.affected = append(p.affected, affected...)
+		}
+		return
+	}
+	logrus.WithFields(logrus.Fields{"peer": address, "rules": restored}).Info("Rules restored on GTP-U path recovery")
+}
+
+func (pm *PathManager) publish(t events_api.EventType, data any) {
+	if pm.events != nil {
+		pm.events.Publish(t, data)
+	}
+}
+
+func (pm *PathManager) publishRule(t events_api.EventType, id uuid.UUID) {
+	pm.publish(t, events_api.RuleEvent{Uuid: id, Source: "gtpu-path-management"})
+}
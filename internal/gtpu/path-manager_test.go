@@ -0,0 +1,225 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package gtpu
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/ctrl"
+	"github.com/nextmn/srv6/internal/database"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestIsBackup(t *testing.T) {
+	rule := apitest.Uplink{GNB: "10.0.1.1"}.Rule(t)
+	for _, tt := range []struct {
+		name   string
+		backup database_api.Rule
+		want   bool
+	}{
+		{"other gNB", apitest.Uplink{GNB: "10.0.1.2", Disabled: true}.Rule(t), true},
+		{"enabled", apitest.Uplink{GNB: "10.0.1.2"}.Rule(t), false},
+		{"other TEID", apitest.Uplink{GNB: "10.0.1.2", TEID: 2, Disabled: true}.Rule(t), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBackup(rule, tt.backup); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A backup replaces a single rule: other rules of the failed peer are disabled
+func TestSwitchRulesBackupUsedOnce(t *testing.T) {
+	ctx := context.Background()
+	gnb := netip.MustParseAddr("10.0.1.1")
+	store := database.NewMemory()
+	insert := func(r database_api.Rule) uuid.UUID {
+		id, err := store.InsertRule(ctx, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *id
+	}
+	failed := []uuid.UUID{
+		insert(apitest.Uplink{GNB: "10.0.1.1"}.Rule(t)),
+		insert(apitest.Uplink{GNB: "10.0.1.1", Priority: 1}.Rule(t)),
+	}
+	backup := insert(apitest.Uplink{GNB: "10.0.1.2", Disabled: true}.Rule(t))
+
+	pm := &PathManager{
+		onFailure: config.PathFailureSwitchRules,
+		rules:     store,
+		writer:    ctrl.NewRulesRegistry(store, config.RulesOverlapWarn, nil),
+		peers:     map[netip.Addr]*peer{gnb: {PeerStatus: PeerStatus{Address: gnb}}},
+	}
+	pm.applyFailureAction(ctx, gnb)
+
+	switched := 0
+	for _, a := range pm.peers[gnb].affected {
+		if a.enabled != nil {
+			switched++
+			if *a.enabled != backup {
+				t.Errorf("rule %s switched to %s, want %s", a.disabled, *a.enabled, backup)
+			}
+		}
+	}
+	if switched != 1 || len(pm.peers[gnb].affected) != 2 {
+		t.Fatalf("got %d affected rules (%d switched), want 2 (1 switched)", len(pm.peers[gnb].affected), switched)
+	}
+	rules, err := store.GetRules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[failed[0]].Enabled || rules[failed[1]].Enabled || !rules[backup].Enabled {
+		t.Error("failed rules must be disabled, and the backup enabled")
+	}
+
+	pm.restoreRules(ctx, gnb)
+	rules, err = store.GetRules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules[failed[0]].Enabled || !rules[failed[1]].Enabled || rules[backup].Enabled {
+		t.Error("failed rules must be enabled again, and the backup disabled")
+	}
+}
+
+// Rules changed while the path is down are left as they are on recovery
+func TestRestoreRulesChanged(t *testing.T) {
+	ctx := context.Background()
+	gnb := netip.MustParseAddr("10.0.1.1")
+	for _, tt := range []struct {
+		name          string
+		change        func(store *database.Memory, failed uuid.UUID, backup uuid.UUID) error
+		failedEnabled bool
+		backupEnabled bool
+	}{
+		{"unchanged", func(*database.Memory, uuid.UUID, uuid.UUID) error { return nil }, true, false},
+		{"rule enabled", func(s *database.Memory, failed uuid.UUID, _ uuid.UUID) error { return s.EnableRule(ctx, failed) }, true, true},
+		{"backup disabled", func(s *database.Memory, _ uuid.UUID, backup uuid.UUID) error { return s.DisableRule(ctx, backup) }, false, false},
+		{"rule deleted", func(s *database.Memory, failed uuid.UUID, _ uuid.UUID) error { return s.DeleteRule(ctx, failed) }, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := database.NewMemory()
+			failed, err := store.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.1"}.Rule(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			backup, err := store.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.2", Disabled: true}.Rule(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pm := &PathManager{
+				onFailure: config.PathFailureSwitchRules,
+				writer:    ctrl.NewRulesRegistry(store, config.RulesOverlapWarn, nil),
+				peers:     map[netip.Addr]*peer{gnb: {PeerStatus: PeerStatus{Address: gnb}}},
+			}
+			pm.applyFailureAction(ctx, gnb)
+			if err := tt.change(store, *failed, *backup); err != nil {
+				t.Fatal(err)
+			}
+			pm.restoreRules(ctx, gnb)
+			rules, err := store.GetRules(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rules[*failed].Enabled != tt.failedEnabled || rules[*backup].Enabled != tt.backupEnabled {
+				t.Errorf("got rule enabled: %v, backup enabled: %v, want %v and %v",
+					rules[*failed].Enabled, rules[*backup].Enabled, tt.failedEnabled, tt.backupEnabled)
+			}
+		})
+	}
+}
+
+// A backup ambiguous with an enabled rule is not used when overlaps are rejected
+func TestSwitchRulesOverlapRejected(t *testing.T) {
+	ctx := context.Background()
+	gnb := netip.MustParseAddr("10.0.1.1")
+	store := database.NewMemory()
+	failed, err := store.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.1"}.Rule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := store.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.2", Disabled: true}.Rule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.InsertRule(ctx, apitest.Uplink{GNB: "10.0.1.2"}.Rule(t)); err != nil {
+		t.Fatal(err)
+	}
+	pm := &PathManager{
+		onFailure: config.PathFailureSwitchRules,
+		writer:    ctrl.NewRulesRegistry(store, config.RulesOverlapReject, nil),
+		peers:     map[netip.Addr]*peer{gnb: {PeerStatus: PeerStatus{Address: gnb}}},
+	}
+	pm.applyFailureAction(ctx, gnb)
+	rules, err := store.GetRules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[*failed].Enabled || rules[*backup].Enabled {
+		t.Error("failed rule must be disabled, and the backup left disabled")
+	}
+	if a := pm.peers[gnb].affected; len(a) != 1 || a[0].enabled != nil {
+		t.Errorf("got affected rules %v, want the failed rule disabled without backup", a)
+	}
+}
+
+// Writer blocked until its context is done
+type blockedWriter struct{}
+
+func (blockedWriter) UpdateRules(ctx context.Context, update func(rules database_api.RuleMap, apply database_api.ApplyFunc)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Echo Requests are sent while rules are changed
+func TestRunNotBlockedByRules(t *testing.T) {
+	interval := 10 * time.Millisecond
+	gnb := netip.MustParseAddr("10.0.1.1")
+	src := netip.MustParseAddr("10.0.0.100")
+	sent := make(chan struct{}, 16)
+	sender := Sender{
+		Prefix: netip.MustParsePrefix("10.0.0.0/24"),
+		TTL:    64,
+		Write: func(packet []byte) (int, error) {
+			select {
+			case sent <- struct{}{}:
+			default:
+			}
+			return len(packet), nil
+		},
+	}
+	pm, err := NewPathManager(&config.GTPUPathManagement{
+		Interval:  &interval,
+		Timeout:   &interval,
+		OnFailure: config.PathFailureDisableRules,
+		Peers:     []config.GTPUPeer{{Address: gnb}},
+	}, &src, []Sender{sender}, nil, blockedWriter{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.transitions <- transition{address: gnb, up: false}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pm.Run(ctx)
+	timeout := time.After(time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sent:
+		case <-timeout:
+			t.Fatalf("got %d Echo Requests, want 3", i)
+		}
+	}
+}
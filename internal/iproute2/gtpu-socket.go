@@ -0,0 +1,280 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package iproute2
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/nextmn/srv6/internal/constants"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// Length of the IPv4 and UDP headers rebuilt in front of received GTP-U payloads
+const gtpuSocketHdrLen = 20 + 8
+
+// Maximum size of a packet read (jumbo frames)
+const gtpuSocketMTU = 9000
+
+// GTPUSocket receives GTP-U payloads on UDP port 2152, and sends SRv6 packets
+// with a raw IPv6 socket. It can be used instead of a TunIface by H.M.GTP4.D:
+// packets read are rebuilt as IPv4 packets, and IPv4 packets written are sent
+// from the UDP socket.
+type GTPUSocket struct {
+	name     string
+	prefix   netip.Prefix // addresses of the headend
+	nbQueues int
+	queues   []*net.UDPConn // one socket per queue (SO_REUSEPORT)
+	raw      int            // raw IPv6 socket, -1 when closed
+}
+
+// Create a new GTPUSocket with nbQueues queues for this prefix
+func NewGTPUSocket(name string, prefix netip.Prefix, nbQueues int) *GTPUSocket {
+	if nbQueues < 1 {
+		nbQueues = 1
+	}
+	return &GTPUSocket{
+		name:     name,
+		prefix:   prefix,
+		nbQueues: nbQueues,
+		queues:   nil,
+		raw:      -1,
+	}
+}
+
+// Open the sockets
+func (s *GTPUSocket) Open(ctx context.Context) error {
+	if !s.prefix.Addr().Is4() {
+		return fmt.Errorf("Prefix of socket %s must be an IPv4 prefix", s.name)
+	}
+	// a single address is bound directly, otherwise the destination address is checked on reception
+	laddr := netip.AddrPortFrom(netip.IPv4Unspecified(), constants.GTPU_PORT_INT)
+	if s.prefix.IsSingleIP() {
+		laddr = netip.AddrPortFrom(s.prefix.Addr(), constants.GTPU_PORT_INT)
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var opErr error
+			if err := c.Control(func(fd uintptr) {
+				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return opErr
+		},
+	}
+	queues := make([]*net.UDPConn, 0, s.nbQueues)
+	closeAll := func() {
+		for _, q := range queues {
+			q.Close()
+		}
+	}
+	for i := 0; i < s.nbQueues; i++ {
+		c, err := lc.ListenPacket(ctx, "udp4", laddr.String())
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("Could not open socket %s: %w", s.name, err)
+		}
+		conn := c.(*net.UDPConn)
+		queues = append(queues, conn)
+		// destination address of received packets
+		if err := ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst, true); err != nil {
+			closeAll()
+			return fmt.Errorf("Could not open socket %s: %w", s.name, err)
+		}
+	}
+	// IPPROTO_RAW implies the IPv6 header is provided
+	raw, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_RAW)
+	if err != nil {
+		closeAll()
+		return fmt.Errorf("Could not open raw IPv6 socket for %s: %w", s.name, err)
+	}
+	s.queues = queues
+	s.raw = raw
+	return nil
+}
+
+// Close the sockets
+func (s *GTPUSocket) Close() error {
+	var ret error
+	for _, q := range s.queues {
+		if err := q.Close(); err != nil {
+			ret = err
+		}
+	}
+	s.queues = nil
+	if s.raw >= 0 {
+		if err := unix.Close(s.raw); err != nil {
+			ret = err
+		}
+		s.raw = -1
+	}
+	return ret
+}
+
+// Name of the GTPUSocket
+func (s *GTPUSocket) Name() string {
+	return s.name
+}
+
+// Maximum size of a packet read
+func (s *GTPUSocket) MTU() (int64, error) {
+	return gtpuSocketMTU, nil
+}
+
+// Default IPv6 Hop Limit
+func (s *GTPUSocket) IPv6HopLimit() (uint8, error) {
+	return IPv6HopLimit("default")
+}
+
+// IPv4 default TTL
+func (s *GTPUSocket) IPv4TTL() (uint8, error) {
+	return IPv4DefaultTTL()
+}
+
+// Number of queues of the GTPUSocket
+func (s *GTPUSocket) Queues() int {
+	return len(s.queues)
+}
+
+// Offloads are never enabled on a GTPUSocket
+func (s *GTPUSocket) Offload() bool {
+	return false
+}
+
+// Offloads are never enabled on a GTPUSocket
+func (s *GTPUSocket) OffloadUDP() bool {
+	return false
+}
+
+// Read a packet from the first queue
+func (s *GTPUSocket) Read(b []byte) (int, error) {
+	return s.ReadQueue(0, b)
+}
+
+// Write a packet to the first queue
+func (s *GTPUSocket) Write(b []byte) (int, error) {
+	return s.WriteQueue(0, b)
+}
+
+// Read a GTP-U payload from a queue, and rebuild its IPv4 and UDP headers.
+// Packets with a destination address outside of the prefix, or truncated, are skipped.
+func (s *GTPUSocket) ReadQueue(queue int, b []byte) (int, error) {
+	if queue < 0 || queue >= len(s.queues) {
+		return 0, fmt.Errorf("Queue %d does not exist on socket %s", queue, s.name)
+	}
+	if len(b) <= gtpuSocketHdrLen {
+		return 0, fmt.Errorf("Buffer is too short")
+	}
+	oob := ipv4.NewControlMessage(ipv4.FlagDst)
+	for {
+		n, oobn, flags, src, err := s.queues[queue].ReadMsgUDPAddrPort(b[gtpuSocketHdrLen:], oob)
+		if err != nil {
+			return 0, err
+		}
+		if flags&unix.MSG_TRUNC != 0 {
+			continue
+		}
+		var cm ipv4.ControlMessage
+		if err := cm.Parse(oob[:oobn]); err != nil || cm.Dst == nil {
+			continue
+		}
+		dst, ok := netip.AddrFromSlice(cm.Dst.To4())
+		if !ok || !s.prefix.Contains(dst) {
+			continue
+		}
+		srcAddr := src.Addr().Unmap()
+		if !srcAddr.Is4() {
+			continue
+		}
+		// IPv4
+		hdr := b[:gtpuSocketHdrLen]
+		clear(hdr)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(gtpuSocketHdrLen+n))
+		hdr[8] = 64 // TTL
+		hdr[9] = unix.IPPROTO_UDP
+		a4 := srcAddr.As4()
+		copy(hdr[12:16], a4[:])
+		a4 = dst.As4()
+		copy(hdr[16:20], a4[:])
+		binary.BigEndian.PutUint16(hdr[10:12], ipv4HeaderChecksum(hdr[:20]))
+		// UDP (without checksum)
+		binary.BigEndian.PutUint16(hdr[20:22], src.Port())
+		binary.BigEndian.PutUint16(hdr[22:24], constants.GTPU_PORT_INT)
+		binary.BigEndian.PutUint16(hdr[24:26], uint16(8+n))
+		return gtpuSocketHdrLen + n, nil
+	}
+}
+
+// Write a packet to a queue.
+// IPv6 packets are sent with the raw socket, and UDP payloads of IPv4 packets
+// (e.g. GTP Echo Responses) are sent from the UDP socket.
+func (s *GTPUSocket) WriteQueue(queue int, b []byte) (int, error) {
+	if queue < 0 || queue >= len(s.queues) {
+		return 0, fmt.Errorf("Queue %d does not exist on socket %s", queue, s.name)
+	}
+	if len(b) < 1 {
+		return 0, fmt.Errorf("Packet is empty")
+	}
+	switch b[0] >> 4 {
+	case 6:
+		if len(b) < 40 {
+			return 0, fmt.Errorf("Packet is too short")
+		}
+		sa := &unix.SockaddrInet6{Addr: [16]byte(b[24:40])}
+		if err := unix.Sendto(s.raw, b, 0, sa); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case 4:
+		ihl := int(b[0]&0x0F) * 4
+		if ihl < 20 || len(b) < ihl+8 {
+			return 0, fmt.Errorf("Packet is too short")
+		}
+		if b[9] != unix.IPPROTO_UDP {
+			return 0, fmt.Errorf("Only UDP can be sent from socket %s", s.name)
+		}
+		dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[16:20])), binary.BigEndian.Uint16(b[ihl+2:ihl+4]))
+		cm := ipv4.ControlMessage{Src: net.IP(b[12:16])}
+		if _, _, err := s.queues[queue].WriteMsgUDPAddrPort(b[ihl+8:], cm.Marshal(), dst); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	default:
+		return 0, fmt.Errorf("Unknown IP version")
+	}
+}
+
+// Read a packet, possibly a GSO super-packet, from a queue of the socket.
+// Offloads are not supported by GTPUSocket.
+func (s *GTPUSocket) ReadQueueVnet(queue int, hdr *VirtioNetHdr, b []byte) (int, error) {
+	return 0, fmt.Errorf("Offloads are not supported on socket %s", s.name)
+}
+
+// Write a packet, possibly a GSO super-packet, to a queue of the socket.
+// Offloads are not supported by GTPUSocket.
+func (s *GTPUSocket) WriteQueueVnet(queue int, hdr *VirtioNetHdr, b []byte) (int, error) {
+	return 0, fmt.Errorf("Offloads are not supported on socket %s", s.name)
+}
+
+// Checksum of an IPv4 header
+func ipv4HeaderChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i : i+2]))
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
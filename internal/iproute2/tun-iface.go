@@ -7,6 +7,7 @@ package iproute2
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -16,15 +17,22 @@ import (
 
 // TunIface
 type TunIface struct {
-	name  string
-	iface *water.Interface
+	name     string
+	nbQueues int
+	offload  bool                 // IFF_VNET_HDR with TSO/USO
+	queues   []io.ReadWriteCloser // one file descriptor per queue
 }
 
-// Create a new TunIface
-func NewTunIface(name string) *TunIface {
+// Create a new TunIface with nbQueues queues
+func NewTunIface(name string, nbQueues int, offload bool) *TunIface {
+	if nbQueues < 1 {
+		nbQueues = 1
+	}
 	return &TunIface{
-		name:  name,
-		iface: nil,
+		name:     name,
+		nbQueues: nbQueues,
+		offload:  offload,
+		queues:   nil,
 	}
 }
 
@@ -37,15 +45,30 @@ func (t *TunIface) CreateAndUp() error {
 			MultiQueue: true,
 		},
 	}
-	iface, err := water.New(config)
-	if err != nil {
-		return fmt.Errorf("Unable to allocate TUN interface: %s", err)
-	}
-	t.iface = iface
+	queues := make([]io.ReadWriteCloser, 0, t.nbQueues)
+	// each call on the same interface name attaches a new queue
+	for i := 0; i < t.nbQueues; i++ {
+		var iface io.ReadWriteCloser
+		var err error
+		if t.offload {
+			// water does not support IFF_VNET_HDR
+			iface, err = openVnetQueue(t.name)
+		} else {
+			iface, err = water.New(config)
+		}
+		if err != nil {
+			for _, q := range queues {
+				q.Close()
+			}
+			return fmt.Errorf("Unable to allocate TUN interface (queue %d): %s", i, err)
+		}
+		queues = append(queues, iface)
+	}
+	t.queues = queues
 	if err := t.DropIcmpRedirect(); err != nil {
 		return err
 	}
-	if err := runIP("link", "set", "dev", t.iface.Name(), "up"); err != nil {
+	if err := runIP("link", "set", "dev", t.name, "up"); err != nil {
 		return err
 	}
 	return nil
@@ -53,11 +76,14 @@ func (t *TunIface) CreateAndUp() error {
 
 // Stop TunIface related goroutines and delete the interface
 func (t *TunIface) Delete() error {
-	if t.iface == nil {
+	if len(t.queues) == 0 {
 		return nil
 	}
-	if err := runIP("link", "del", t.iface.Name()); err != nil {
-		return fmt.Errorf("Unable to delete interface %s: %s", t.iface.Name(), err)
+	if err := runIP("link", "del", t.name); err != nil {
+		return fmt.Errorf("Unable to delete interface %s: %s", t.name, err)
+	}
+	for _, q := range t.queues {
+		q.Close()
 	}
 	if err := t.CancelDropIcmpRedirect(); err != nil {
 		return err
@@ -67,10 +93,10 @@ func (t *TunIface) Delete() error {
 
 // MTU of the TunIface
 func (t *TunIface) MTU() (int64, error) {
-	if strings.Contains(t.iface.Name(), "/") || strings.Contains(t.iface.Name(), ".") {
+	if strings.Contains(t.name, "/") || strings.Contains(t.name, ".") {
 		return 0, fmt.Errorf("interface name contains illegal character")
 	}
-	filename := fmt.Sprintf("/sys/class/net/%s/mtu", t.iface.Name())
+	filename := fmt.Sprintf("/sys/class/net/%s/mtu", t.name)
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return 0, err
@@ -80,59 +106,38 @@ func (t *TunIface) MTU() (int64, error) {
 
 // IPv6 Hop Limit of the TunIface
 func (t *TunIface) IPv6HopLimit() (uint8, error) {
-	if strings.Contains(t.iface.Name(), "/") || strings.Contains(t.iface.Name(), ".") {
-		return 0, fmt.Errorf("interface name contains illegal character")
-	}
-	filename := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/hop_limit", t.iface.Name())
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return 0, err
-	}
-	ret, err := strconv.ParseUint(strings.TrimRight(string(content), "\n"), 10, 8)
-	if err != nil {
-		return 0, err
-	}
-	return uint8(ret), nil
+	return IPv6HopLimit(t.name)
 }
 
 // IPv4 default TTL
 func (t *TunIface) IPv4TTL() (uint8, error) {
-	filename := "/proc/sys/net/ipv4/ip_default_ttl"
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return 0, err
-	}
-	ret, err := strconv.ParseUint(strings.TrimRight(string(content), "\n"), 10, 8)
-	if err != nil {
-		return 0, err
-	}
-	return uint8(ret), nil
+	return IPv4DefaultTTL()
 }
 
 // Drop ICMP/ICMPv6 redirects on the interface
 func (t *TunIface) DropIcmpRedirect() error {
-	if t.iface == nil {
+	if len(t.queues) == 0 {
 		return nil
 	}
-	if err := runIPTables("-A", "OUTPUT", "-o", t.iface.Name(), "-p", "icmp", "--icmp-type", "redirect", "-j", "DROP"); err != nil {
-		return fmt.Errorf("Unable to drop icmp redirect on interface %s: %s", t.iface.Name(), err)
+	if err := runIPTables("-A", "OUTPUT", "-o", t.name, "-p", "icmp", "--icmp-type", "redirect", "-j", "DROP"); err != nil {
+		return fmt.Errorf("Unable to drop icmp redirect on interface %s: %s", t.name, err)
 	}
-	if err := runIP6Tables("-A", "OUTPUT", "-o", t.iface.Name(), "-p", "icmpv6", "--icmpv6-type", "redirect", "-j", "DROP"); err != nil {
-		return fmt.Errorf("Unable to drop icmpv6 redirect on interface %s: %s", t.iface.Name(), err)
+	if err := runIP6Tables("-A", "OUTPUT", "-o", t.name, "-p", "icmpv6", "--icmpv6-type", "redirect", "-j", "DROP"); err != nil {
+		return fmt.Errorf("Unable to drop icmpv6 redirect on interface %s: %s", t.name, err)
 	}
 	return nil
 }
 
 // Cancel Drop ICMP/ICMPv6 redirects on the interface
 func (t *TunIface) CancelDropIcmpRedirect() error {
-	if t.iface == nil {
+	if len(t.queues) == 0 {
 		return nil
 	}
-	if err := runIP6Tables("-D", "OUTPUT", "-o", t.iface.Name(), "-p", "icmpv6", "--icmpv6-type", "redirect", "-j", "DROP"); err != nil {
-		return fmt.Errorf("Unable to drop icmpv6 redirect on interface %s: %s", t.iface.Name(), err)
+	if err := runIP6Tables("-D", "OUTPUT", "-o", t.name, "-p", "icmpv6", "--icmpv6-type", "redirect", "-j", "DROP"); err != nil {
+		return fmt.Errorf("Unable to drop icmpv6 redirect on interface %s: %s", t.name, err)
 	}
-	if err := runIPTables("-D", "OUTPUT", "-o", t.iface.Name(), "-p", "icmp", "--icmp-type", "redirect", "-j", "DROP"); err != nil {
-		return fmt.Errorf("Unable to drop icmp redirect on interface %s: %s", t.iface.Name(), err)
+	if err := runIPTables("-D", "OUTPUT", "-o", t.name, "-p", "icmp", "--icmp-type", "redirect", "-j", "DROP"); err != nil {
+		return fmt.Errorf("Unable to drop icmp redirect on interface %s: %s", t.name, err)
 	}
 	return nil
 }
@@ -142,12 +147,77 @@ func (t *TunIface) Name() string {
 	return t.name
 }
 
-// Read a packet from the water interface
+// Number of queues of the TunIface
+func (t *TunIface) Queues() int {
+	return len(t.queues)
+}
+
+// Offloads are enabled: packets read may be GSO super-packets
+func (t *TunIface) Offload() bool {
+	return t.offload
+}
+
+// UDP segmentation offload is enabled on each queue: UDP super-packets can be written
+func (t *TunIface) OffloadUDP() bool {
+	if !t.offload || len(t.queues) == 0 {
+		return false
+	}
+	for _, q := range t.queues {
+		if vq, ok := q.(*vnetQueue); !ok || !vq.uso {
+			return false
+		}
+	}
+	return true
+}
+
+// Read a packet from the first queue of the water interface
 func (t *TunIface) Read(b []byte) (int, error) {
-	return t.iface.Read(b)
+	return t.ReadQueue(0, b)
 }
 
-// Write a packet to the water interface
+// Write a packet to the first queue of the water interface
 func (t *TunIface) Write(b []byte) (int, error) {
-	return t.iface.Write(b)
+	return t.WriteQueue(0, b)
+}
+
+// Read a packet from a queue of the water interface
+func (t *TunIface) ReadQueue(queue int, b []byte) (int, error) {
+	if queue < 0 || queue >= len(t.queues) {
+		return 0, fmt.Errorf("Queue %d does not exist on interface %s", queue, t.name)
+	}
+	return t.queues[queue].Read(b)
+}
+
+// Write a packet to a queue of the water interface
+func (t *TunIface) WriteQueue(queue int, b []byte) (int, error) {
+	if queue < 0 || queue >= len(t.queues) {
+		return 0, fmt.Errorf("Queue %d does not exist on interface %s", queue, t.name)
+	}
+	return t.queues[queue].Write(b)
+}
+
+// Read a packet, possibly a GSO super-packet, from a queue of the interface.
+// Offloads must be enabled.
+func (t *TunIface) ReadQueueVnet(queue int, hdr *VirtioNetHdr, b []byte) (int, error) {
+	if queue < 0 || queue >= len(t.queues) {
+		return 0, fmt.Errorf("Queue %d does not exist on interface %s", queue, t.name)
+	}
+	q, ok := t.queues[queue].(*vnetQueue)
+	if !ok {
+		return 0, fmt.Errorf("Offloads are not enabled on interface %s", t.name)
+	}
+	return q.ReadVnet(hdr, b)
+}
+
+// Write a packet, possibly a GSO super-packet, to a queue of the interface.
+// Offloads must be enabled.
+func (t *TunIface) WriteQueueVnet(queue int, hdr *VirtioNetHdr, b []byte) (int, error) {
+	if queue < 0 || queue >= len(t.queues) {
+		return 0, fmt.Errorf("Queue %d does not exist on interface %s", queue, t.name)
+	}
+	q, ok := t.queues[queue].(*vnetQueue)
+	if !ok {
+		return 0, fmt.Errorf("Offloads are not enabled on interface %s", t.name)
+	}
+	return q.WriteVnet(hdr, b)
 }
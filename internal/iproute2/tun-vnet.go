@@ -0,0 +1,196 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package iproute2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Length of struct virtio_net_hdr
+const VirtioNetHdrLen = 10
+
+// GSO types (include/uapi/linux/virtio_net.h)
+const (
+	VirtioNetHdrGSONone  = 0
+	VirtioNetHdrGSOTCPv4 = 1
+	VirtioNetHdrGSOUDP   = 3 // UFO, not negotiated
+	VirtioNetHdrGSOTCPv6 = 4
+	VirtioNetHdrGSOUDPL4 = 5
+	VirtioNetHdrGSOECN   = 0x80
+)
+
+// Flags
+const (
+	VirtioNetHdrFNeedsCsum = 1 // checksum must be completed: sum from CsumStart, stored at CsumStart+CsumOffset
+)
+
+// struct virtio_net_hdr, prepended to each packet when IFF_VNET_HDR is set
+type VirtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// Decode a virtio_net_hdr (legacy virtio uses native endianness)
+func (h *VirtioNetHdr) decode(b []byte) {
+	h.Flags = b[0]
+	h.GSOType = b[1]
+	h.HdrLen = binary.NativeEndian.Uint16(b[2:4])
+	h.GSOSize = binary.NativeEndian.Uint16(b[4:6])
+	h.CsumStart = binary.NativeEndian.Uint16(b[6:8])
+	h.CsumOffset = binary.NativeEndian.Uint16(b[8:10])
+}
+
+// Encode a virtio_net_hdr
+func (h *VirtioNetHdr) encode(b []byte) {
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	binary.NativeEndian.PutUint16(b[2:4], h.HdrLen)
+	binary.NativeEndian.PutUint16(b[4:6], h.GSOSize)
+	binary.NativeEndian.PutUint16(b[6:8], h.CsumStart)
+	binary.NativeEndian.PutUint16(b[8:10], h.CsumOffset)
+}
+
+// Header of complete packets written to the interface
+var emptyVirtioNetHdr = make([]byte, VirtioNetHdrLen)
+
+// A queue of a TUN interface opened with IFF_VNET_HDR
+type vnetQueue struct {
+	file   *os.File
+	rc     syscall.RawConn
+	closed atomic.Bool
+	uso    bool // UDP super-packets are accepted by the kernel
+}
+
+// Errors of the raw connection are not converted to os.ErrClosed, unlike those of os.File
+func (q *vnetQueue) wrapErr(err error) error {
+	if q.closed.Load() {
+		return os.ErrClosed
+	}
+	return err
+}
+
+// Open a new queue of the TUN interface with offloads enabled
+func openVnetQueue(name string) (*vnetQueue, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE | unix.IFF_VNET_HDR)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("TUNSETIFF: %s", err)
+	}
+	// USO requires Linux 6.2
+	offloads := unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+	uso := true
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offloads|unix.TUN_F_USO4|unix.TUN_F_USO6); err != nil {
+		uso = false
+		if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offloads); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("TUNSETOFFLOAD: %s", err)
+		}
+	}
+	// non-blocking mode to use the runtime poller
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &vnetQueue{
+		file: file,
+		rc:   rc,
+		uso:  uso,
+	}, nil
+}
+
+// Read a packet and its virtio_net_hdr
+func (q *vnetQueue) ReadVnet(hdr *VirtioNetHdr, b []byte) (int, error) {
+	var h [VirtioNetHdrLen]byte
+	var n int
+	var errno error
+	err := q.rc.Read(func(fd uintptr) bool {
+		n, errno = unix.Readv(int(fd), [][]byte{h[:], b})
+		return !errors.Is(errno, unix.EAGAIN)
+	})
+	if err != nil {
+		return 0, q.wrapErr(err)
+	}
+	if errno != nil {
+		return 0, errno
+	}
+	if n < VirtioNetHdrLen {
+		return 0, fmt.Errorf("Packet too short for virtio_net_hdr")
+	}
+	hdr.decode(h[:])
+	return n - VirtioNetHdrLen, nil
+}
+
+// Read a packet, dropping its virtio_net_hdr
+func (q *vnetQueue) Read(b []byte) (int, error) {
+	var hdr VirtioNetHdr
+	n, err := q.ReadVnet(&hdr, b)
+	if err != nil {
+		return 0, err
+	}
+	if hdr.GSOType != VirtioNetHdrGSONone {
+		return 0, fmt.Errorf("Unexpected GSO packet")
+	}
+	return n, nil
+}
+
+// Write a single packet, with an empty virtio_net_hdr
+func (q *vnetQueue) Write(b []byte) (int, error) {
+	return q.writev(emptyVirtioNetHdr, b)
+}
+
+// Write a packet, possibly a GSO super-packet segmented by the kernel, and its virtio_net_hdr
+func (q *vnetQueue) WriteVnet(hdr *VirtioNetHdr, b []byte) (int, error) {
+	var h [VirtioNetHdrLen]byte
+	hdr.encode(h[:])
+	return q.writev(h[:], b)
+}
+
+func (q *vnetQueue) writev(h []byte, b []byte) (int, error) {
+	var n int
+	var errno error
+	err := q.rc.Write(func(fd uintptr) bool {
+		n, errno = unix.Writev(int(fd), [][]byte{h, b})
+		return !errors.Is(errno, unix.EAGAIN)
+	})
+	if err != nil {
+		return 0, q.wrapErr(err)
+	}
+	if errno != nil {
+		return 0, errno
+	}
+	return n - VirtioNetHdrLen, nil
+}
+
+func (q *vnetQueue) Close() error {
+	q.closed.Store(true)
+	return q.file.Close()
+}
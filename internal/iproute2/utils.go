@@ -7,9 +7,12 @@ package iproute2
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/netip"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
 // Run ip command
@@ -51,3 +54,29 @@ func runIP6Tables(args ...string) error {
 func IPSrSetSourceAddress(address netip.Addr) error {
 	return runIP("sr", "tunsrc", "set", address.String())
 }
+
+// Read a sysctl containing an uint8
+func readSysctlUint8(filename string) (uint8, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	ret, err := strconv.ParseUint(strings.TrimRight(string(content), "\n"), 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	return uint8(ret), nil
+}
+
+// IPv6 Hop Limit of an interface
+func IPv6HopLimit(iface string) (uint8, error) {
+	if strings.Contains(iface, "/") || strings.Contains(iface, ".") {
+		return 0, fmt.Errorf("interface name contains illegal character")
+	}
+	return readSysctlUint8(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/hop_limit", iface))
+}
+
+// IPv4 default TTL
+func IPv4DefaultTTL() (uint8, error) {
+	return readSysctlUint8("/proc/sys/net/ipv4/ip_default_ttl")
+}
@@ -0,0 +1,23 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"github.com/nextmn/srv6/internal/iproute2"
+)
+
+// Packets are read from and written to an Iface
+// (iproute2.TunIface, or iproute2.GTPUSocket)
+type Iface interface {
+	MTU() (int64, error)
+	Queues() int
+	Offload() bool
+	OffloadUDP() bool
+	ReadQueue(queue int, b []byte) (int, error)
+	WriteQueue(queue int, b []byte) (int, error)
+	ReadQueueVnet(queue int, hdr *iproute2.VirtioNetHdr, b []byte) (int, error)
+	WriteQueueVnet(queue int, hdr *iproute2.VirtioNetHdr, b []byte) (int, error)
+}
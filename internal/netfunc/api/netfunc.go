@@ -7,10 +7,9 @@ package netfunc
 
 import (
 	"context"
-
-	"github.com/nextmn/srv6/internal/iproute2"
 )
 
 type NetFunc interface {
-	Run(ctx context.Context, tunIface *iproute2.TunIface) error
+	Run(ctx context.Context, iface Iface) error
+	Stats() Stats
 }
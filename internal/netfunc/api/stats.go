@@ -0,0 +1,18 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+// Counters of a NetFunc
+type Stats struct {
+	TunQueues    int    `json:"tun-queues"`
+	Workers      int    `json:"workers"`
+	QueueSize    int    `json:"queue-size"`    // per worker
+	QueueDepth   int    `json:"queue-depth"`   // packets currently waiting in queues
+	Received     uint64 `json:"received"`      // packets read from the interface
+	Sent         uint64 `json:"sent"`          // packets written to the interface
+	QueueDropped uint64 `json:"queue-dropped"` // packets dropped because the queue of the worker was full
+	Dropped      uint64 `json:"dropped"`       // packets dropped by the handler
+}
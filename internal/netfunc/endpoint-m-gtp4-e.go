@@ -14,10 +14,10 @@ import (
 	"github.com/google/gopacket/layers"
 
 	gopacket_gtp "github.com/nextmn/gopacket-gtp"
-	gopacket_srv6 "github.com/nextmn/gopacket-srv6"
 	"github.com/nextmn/rfc9433/encoding"
 
 	"github.com/nextmn/srv6/internal/constants"
+	"github.com/nextmn/srv6/internal/gtpu"
 )
 
 type EndpointMGTP4E struct {
@@ -32,12 +32,12 @@ func NewEndpointMGTP4E(prefix netip.Prefix, ttl uint8, hopLimit uint8) *Endpoint
 
 // Get IPv6 Destination Address Fields from Packet
 func (e EndpointMGTP4E) ipv6DAFields(p *Packet) (*encoding.MGTP4IPv6Dst, error) {
-	layerIPv6 := p.Layer(layers.LayerTypeIPv6)
-	if layerIPv6 == nil {
-		return nil, fmt.Errorf("Malformed IPv6 packet")
+	layerIPv6, err := p.IPv6()
+	if err != nil {
+		return nil, err
 	}
 	// get destination address
-	dstSlice := layerIPv6.(*layers.IPv6).NetworkFlow().Dst().Raw()
+	dstSlice := layerIPv6.DstIP
 	prefix := e.Prefix().Bits()
 	if prefix < 0 {
 		return nil, fmt.Errorf("Wrong prefix")
@@ -51,12 +51,12 @@ func (e EndpointMGTP4E) ipv6DAFields(p *Packet) (*encoding.MGTP4IPv6Dst, error)
 
 // Get IPv6 Source Address Fields from Packet
 func (e EndpointMGTP4E) ipv6SAFields(p *Packet) (*encoding.MGTP4IPv6Src, error) {
-	layerIPv6 := p.Layer(layers.LayerTypeIPv6)
-	if layerIPv6 == nil {
-		return nil, fmt.Errorf("Malformed IPv6 packet")
+	layerIPv6, err := p.IPv6()
+	if err != nil {
+		return nil, err
 	}
-	// get destination address
-	srcSlice := layerIPv6.(*layers.IPv6).NetworkFlow().Src().Raw()
+	// get source address
+	srcSlice := layerIPv6.SrcIP
 	if src, err := encoding.ParseMGTP4IPv6SrcNextMN([16]byte(srcSlice)); err != nil {
 		return nil, err
 	} else {
@@ -65,9 +65,8 @@ func (e EndpointMGTP4E) ipv6SAFields(p *Packet) (*encoding.MGTP4IPv6Src, error)
 }
 
 // Handle a packet
-func (e EndpointMGTP4E) Handle(ctx context.Context, packet []byte) ([]byte, error) {
-	pqt, err := NewIPv6Packet(packet)
-	if err != nil {
+func (e EndpointMGTP4E) Handle(ctx context.Context, pqt *Packet) ([]byte, error) {
+	if err := pqt.DecodeIPv6(); err != nil {
 		return nil, err
 	}
 	if _, err := e.CheckDAInPrefixRange(pqt); err != nil {
@@ -75,8 +74,7 @@ func (e EndpointMGTP4E) Handle(ctx context.Context, packet []byte) ([]byte, erro
 	}
 
 	// SRH is optionnal (unless the endpoint is configured to accept only packet with HMAC TLV)
-	if layerSRH := pqt.Layer(gopacket_srv6.LayerTypeIPv6Routing); layerSRH != nil {
-		srh := layerSRH.(*gopacket_srv6.IPv6Routing)
+	if srh := pqt.SRH(); srh != nil {
 		// RFC 9433 section 6.6. End.M.GTP4.E
 		// S01. When an SRH is processed {
 		// S02.   If (Segments Left != 0) {
@@ -105,6 +103,11 @@ func (e EndpointMGTP4E) Handle(ctx context.Context, packet []byte) ([]byte, erro
 		return nil, err
 	}
 
+	// An SRv6 packet with No Next Header is translated back into an End Marker
+	if pqt.IPv6NoNextHeader() {
+		return gtpu.NewGTP4EndMarker(ipv6SA.IPv4(), ipv6DA.IPv4(), layers.UDPPort(ipv6SA.UDPPortNumber()), e.TTL(), ipv6DA.PDUSessionID())
+	}
+
 	// S02. Pop the IPv6 header and all its extension headers
 	payload, err := pqt.PopIPv6Headers()
 	if err != nil {
@@ -209,25 +212,9 @@ func (e EndpointMGTP4E) Handle(ctx context.Context, packet []byte) ([]byte, erro
 		//   - N-PDU Number: ignored
 		//   - Next Extension Header Type (at end of the packet: no next header)
 		// - total size of gtp extension headers
-		MessageLength: uint16(len(payload.LayerContents()) + 4 + gtpExtensionHeadersLen),
-	}
-	// create buffer for the packet
-	buf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buf,
-		gopacket.SerializeOptions{
-			FixLengths:       true,
-			ComputeChecksums: true,
-		},
-		&ipv4,
-		&udp,
-		&gtpu,
-		gopacket.Payload(payload.LayerContents()),
-		gopacket.Payload(payload.LayerPayload()),
-	); err != nil {
-		return nil, err
-	} else {
-		// S07. Submit the packet to the egress IPv4 FIB lookup for
-		//      transmission to the new destination
-		return buf.Bytes(), nil
+		MessageLength: uint16(len(payload) + 4 + gtpExtensionHeadersLen),
 	}
+	// S07. Submit the packet to the egress IPv4 FIB lookup for
+	//      transmission to the new destination
+	return pqt.Serialize(&ipv4, &udp, &gtpu, gopacket.Payload(payload))
 }
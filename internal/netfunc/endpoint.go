@@ -14,7 +14,7 @@ import (
 	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
 )
 
-func NewEndpoint(ec *config.Endpoint, ttl uint8, hopLimit uint8) (netfunc_api.NetFunc, error) {
+func NewEndpoint(ec *config.Endpoint, ttl uint8, hopLimit uint8, dataplane *config.Dataplane) (netfunc_api.NetFunc, error) {
 	p, err := netip.ParsePrefix(ec.Prefix)
 	if err != nil {
 		return nil, err
@@ -22,7 +22,7 @@ func NewEndpoint(ec *config.Endpoint, ttl uint8, hopLimit uint8) (netfunc_api.Ne
 	switch ec.Behavior {
 	case iana.End_M_GTP4_E:
 
-		return NewNetFunc(NewEndpointMGTP4E(p, ttl, hopLimit)), nil
+		return NewNetFunc(NewEndpointMGTP4E(p, ttl, hopLimit), dataplane), nil
 	default:
 		return nil, fmt.Errorf("Unsupported endpoint behavior (%s) with this provider (%s)", ec.Behavior, ec.Provider)
 	}
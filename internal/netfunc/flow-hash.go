@@ -0,0 +1,75 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"encoding/binary"
+
+	"github.com/nextmn/srv6/internal/constants"
+)
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// FNV-1a, without allocation
+func fnvAdd(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// Hash of the flow of a packet, used to dispatch packets to workers.
+// Packets of a same flow are processed by the same worker, so they are not reordered.
+//   - IPv4: addresses, protocol, UDP/TCP ports, and TEID for GTP-U
+//   - IPv4 fragments: addresses, protocol and identification, so all fragments of a datagram share a worker
+//   - IPv6: addresses, flow label, and UDP/TCP ports when they follow the IPv6 header
+//     (with SRv6, the TEID is part of the destination address)
+func flowHash(packet []byte) uint32 {
+	h := uint32(fnvOffset32)
+	if len(packet) < 1 {
+		return h
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return h
+		}
+		ihl := int(packet[0]&0x0F) * 4
+		proto := packet[9]
+		h = fnvAdd(h, packet[12:20])
+		h = fnvAdd(h, packet[9:10])
+		// only the first fragment contains the transport header:
+		// fragments (More Fragments flag or non-zero offset) are hashed by identification
+		if binary.BigEndian.Uint16(packet[6:8])&0x3FFF != 0 {
+			return fnvAdd(h, packet[4:6])
+		}
+		if (proto != 6 && proto != 17) || len(packet) < ihl+4 {
+			return h
+		}
+		h = fnvAdd(h, packet[ihl:ihl+4])
+		if proto == 17 && len(packet) >= ihl+16 && binary.BigEndian.Uint16(packet[ihl+2:ihl+4]) == constants.GTPU_PORT_INT {
+			// UDP header (8 bytes), then TEID at offset 4 of GTP-U header
+			h = fnvAdd(h, packet[ihl+12:ihl+16])
+		}
+	case 6:
+		if len(packet) < 40 {
+			return h
+		}
+		h = fnvAdd(h, packet[8:40])
+		h ^= binary.BigEndian.Uint32(packet[0:4]) & 0x000FFFFF
+		h *= fnvPrime32
+		// ports are not searched after extension headers: fragments have a Fragment Header,
+		// so all fragments of a packet are hashed alike
+		if proto := packet[6]; (proto == 6 || proto == 17) && len(packet) >= 44 {
+			h = fnvAdd(h, packet[40:44])
+		}
+	}
+	return h
+}
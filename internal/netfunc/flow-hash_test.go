@@ -0,0 +1,105 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// IPv4 / UDP (/ GTP-U) header
+func ipv4UDP(src string, dst string, srcPort uint16, dstPort uint16, teid uint32) []byte {
+	b := make([]byte, 20+8+8)
+	b[0] = 0x45
+	b[8] = 64
+	b[9] = 17
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(b[20:22], srcPort)
+	binary.BigEndian.PutUint16(b[22:24], dstPort)
+	b[28] = 0x30
+	b[29] = 0xFF
+	binary.BigEndian.PutUint32(b[32:36], teid)
+	return b
+}
+
+// Fragment of an IPv4 datagram: the transport header is only in the first one
+func ipv4Fragment(first []byte, id uint16, offset uint16, more bool) []byte {
+	b := make([]byte, 36)
+	copy(b, first)
+	binary.BigEndian.PutUint16(b[4:6], id)
+	flags := offset / 8
+	if more {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(b[6:8], flags)
+	if offset != 0 {
+		// payload of later fragments is not a transport header
+		for i := 20; i < len(b); i++ {
+			b[i] = byte(i)
+		}
+	}
+	return b
+}
+
+func ipv6Packet(src string, dst string, flowLabel uint32) []byte {
+	b := make([]byte, 40)
+	binary.BigEndian.PutUint32(b[0:4], 6<<28|flowLabel)
+	b[6] = byte(layers.IPProtocolIPv6Routing)
+	copy(b[8:24], net.ParseIP(src))
+	copy(b[24:40], net.ParseIP(dst))
+	return b
+}
+
+// IPv6 packet followed by a transport header with these ports
+func ipv6Transport(proto layers.IPProtocol, srcPort uint16, dstPort uint16) []byte {
+	b := append(ipv6Packet("fc00::1", "fc00:1::1", 0), make([]byte, 8)...)
+	b[6] = byte(proto)
+	binary.BigEndian.PutUint16(b[40:42], srcPort)
+	binary.BigEndian.PutUint16(b[42:44], dstPort)
+	return b
+}
+
+func TestFlowHash(t *testing.T) {
+	gtpu := ipv4UDP("10.0.0.1", "10.0.0.2", 2152, 2152, 1)
+	for _, tt := range []struct {
+		name string
+		a    []byte
+		b    []byte
+		same bool
+	}{
+		{"same GTP-U tunnel", gtpu, ipv4UDP("10.0.0.1", "10.0.0.2", 2152, 2152, 1), true},
+		{"other TEID", gtpu, ipv4UDP("10.0.0.1", "10.0.0.2", 2152, 2152, 2), false},
+		{"other source port", ipv4UDP("10.0.0.1", "10.0.0.2", 1000, 53, 0), ipv4UDP("10.0.0.1", "10.0.0.2", 1001, 53, 0), false},
+		{"other source address", gtpu, ipv4UDP("10.0.0.3", "10.0.0.2", 2152, 2152, 1), false},
+		{"first and last fragments", ipv4Fragment(gtpu, 42, 0, true), ipv4Fragment(gtpu, 42, 16, false), true},
+		{"first and middle fragments", ipv4Fragment(gtpu, 42, 0, true), ipv4Fragment(gtpu, 42, 8, true), true},
+		{"fragments of other datagrams", ipv4Fragment(gtpu, 42, 16, false), ipv4Fragment(gtpu, 43, 16, false), false},
+		{"same IPv6 flow", ipv6Packet("fc00::1", "fc00:1::1", 7), ipv6Packet("fc00::1", "fc00:1::1", 7), true},
+		{"other IPv6 flow label", ipv6Packet("fc00::1", "fc00:1::1", 7), ipv6Packet("fc00::1", "fc00:1::1", 8), false},
+		{"other IPv6 destination", ipv6Packet("fc00::1", "fc00:1::1", 7), ipv6Packet("fc00::1", "fc00:1::2", 7), false},
+		{"same IPv6 TCP ports", ipv6Transport(layers.IPProtocolTCP, 1000, 443), ipv6Transport(layers.IPProtocolTCP, 1000, 443), true},
+		{"other IPv6 TCP source port", ipv6Transport(layers.IPProtocolTCP, 1000, 443), ipv6Transport(layers.IPProtocolTCP, 1001, 443), false},
+		{"other IPv6 UDP destination port", ipv6Transport(layers.IPProtocolUDP, 1000, 53), ipv6Transport(layers.IPProtocolUDP, 1000, 54), false},
+		{"IPv6 fragments", ipv6Transport(layers.IPProtocolIPv6Fragment, 1000, 443), ipv6Transport(layers.IPProtocolIPv6Fragment, 1001, 443), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := flowHash(tt.a) == flowHash(tt.b); same != tt.same {
+				t.Errorf("got same hash %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestFlowHashTruncated(t *testing.T) {
+	for _, p := range [][]byte{nil, {0x45}, {0x60, 0, 0, 0}, make([]byte, 21), ipv6Transport(layers.IPProtocolTCP, 1, 2)[:42]} {
+		// must not panic
+		flowHash(p)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/nextmn/srv6/internal/iproute2"
+)
+
+// Maximum number of segments of a written UDP super-packet (UDP_MAX_SEGMENTS is 64 on older kernels)
+const maxUDPSegments = 64
+
+// Length of the IP and UDP headers of a packet that can be coalesced, or 0.
+// IPv4 options, fragments, and IPv6 extension headers are not coalesced.
+func udpHeaderLen(pkt []byte) int {
+	if len(pkt) < 1 {
+		return 0
+	}
+	var ipLen int
+	switch pkt[0] >> 4 {
+	case 4:
+		ipLen = 20
+		if len(pkt) < ipLen+8 || pkt[0]&0x0F != 5 || pkt[9] != 17 || int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			return 0
+		}
+		// MF flag, or fragment offset
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3FFF != 0 {
+			return 0
+		}
+	case 6:
+		ipLen = 40
+		if len(pkt) < ipLen+8 || pkt[6] != 17 || int(binary.BigEndian.Uint16(pkt[4:6])) != len(pkt)-ipLen {
+			return 0
+		}
+	default:
+		return 0
+	}
+	if int(binary.BigEndian.Uint16(pkt[ipLen+4:ipLen+6])) != len(pkt)-ipLen {
+		return 0
+	}
+	return ipLen + 8
+}
+
+// Coalesces UDP packets written to a TUN interface into USO super-packets (e.g. GTP-U of M.GTP4.E):
+// consecutive packets of a flow with the same size are written with a single system call,
+// and segmented by the kernel.
+type udpCoalescer struct {
+	write     func(b []byte) (int, error)
+	writeVnet func(hdr *iproute2.VirtioNetHdr, b []byte) (int, error)
+	written   func(packets int) // called after each successful write
+
+	buf      []byte // super-packet
+	n        int    // length of the super-packet
+	segments int
+	hdrLen   int // length of IP and UDP headers
+	gsoSize  int // length of the UDP payload of segments
+	last     int // length of the UDP payload of the last segment
+}
+
+func newUDPCoalescer(write func(b []byte) (int, error), writeVnet func(hdr *iproute2.VirtioNetHdr, b []byte) (int, error), written func(packets int)) *udpCoalescer {
+	return &udpCoalescer{
+		write:     write,
+		writeVnet: writeVnet,
+		written:   written,
+		buf:       make([]byte, maxSuperPacketSize),
+	}
+}
+
+// Returns true if pkt can be appended to the super-packet:
+// headers are the same, except lengths, checksums, and IPv4 identification
+func (c *udpCoalescer) canAppend(pkt []byte, hdrLen int) bool {
+	if c.segments == 0 || hdrLen != c.hdrLen || c.segments >= maxUDPSegments {
+		return false
+	}
+	size := len(pkt) - hdrLen
+	// only the last segment may be shorter
+	if size == 0 || size > c.gsoSize || c.last != c.gsoSize || c.n+size > len(c.buf) {
+		return false
+	}
+	head := c.buf[:hdrLen]
+	if pkt[0]>>4 == 4 {
+		if !bytes.Equal(pkt[0:2], head[0:2]) || !bytes.Equal(pkt[6:10], head[6:10]) || !bytes.Equal(pkt[12:24], head[12:24]) {
+			return false
+		}
+		// identifications are incremented by the kernel, and only matter for fragmentation
+		df := pkt[6]&0x40 != 0
+		id := binary.BigEndian.Uint16(pkt[4:6])
+		return df || id == binary.BigEndian.Uint16(head[4:6])+uint16(c.segments)
+	}
+	return bytes.Equal(pkt[0:4], head[0:4]) && bytes.Equal(pkt[6:44], head[6:44])
+}
+
+// Write a packet, or append it to the super-packet.
+// Packets that cannot be coalesced are written once the super-packet is written, to keep their order.
+func (c *udpCoalescer) push(pkt []byte) {
+	hdrLen := udpHeaderLen(pkt)
+	if c.canAppend(pkt, hdrLen) {
+		c.n += copy(c.buf[c.n:], pkt[hdrLen:])
+		c.segments++
+		c.last = len(pkt) - hdrLen
+		return
+	}
+	c.flush()
+	if hdrLen == 0 || len(pkt) > len(c.buf) {
+		if _, err := c.write(pkt); err == nil {
+			c.written(1)
+		}
+		return
+	}
+	c.n = copy(c.buf, pkt)
+	c.segments = 1
+	c.hdrLen = hdrLen
+	c.gsoSize = len(pkt) - hdrLen
+	c.last = c.gsoSize
+}
+
+// Write the super-packet
+func (c *udpCoalescer) flush() {
+	segments := c.segments
+	pkt := c.buf[:c.n]
+	c.segments = 0
+	c.n = 0
+	switch segments {
+	case 0:
+		return
+	case 1:
+		// written unchanged
+		if _, err := c.write(pkt); err == nil {
+			c.written(1)
+		}
+		return
+	}
+	ipLen := c.hdrLen - 8
+	proto := uint8(17)
+	if pkt[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:12], ^csumFold(csumAdd(0, pkt[:ipLen])))
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-ipLen))
+	}
+	l4Len := len(pkt) - ipLen
+	binary.BigEndian.PutUint16(pkt[ipLen+4:ipLen+6], uint16(l4Len))
+	// the kernel completes the checksum of each segment from the sum of the pseudo-header
+	binary.BigEndian.PutUint16(pkt[ipLen+6:ipLen+8], csumFold(pseudoHeaderSum(pkt, proto, l4Len)))
+	hdr := iproute2.VirtioNetHdr{
+		Flags:      iproute2.VirtioNetHdrFNeedsCsum,
+		GSOType:    iproute2.VirtioNetHdrGSOUDPL4,
+		HdrLen:     uint16(c.hdrLen),
+		GSOSize:    uint16(c.gsoSize),
+		CsumStart:  uint16(ipLen),
+		CsumOffset: 6,
+	}
+	if _, err := c.writeVnet(&hdr, pkt); err == nil {
+		c.written(segments)
+	}
+}
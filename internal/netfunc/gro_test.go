@@ -0,0 +1,145 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/nextmn/srv6/internal/iproute2"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type groPacket struct {
+	ipv6    bool
+	id      uint16
+	df      bool
+	srcPort uint16
+	size    int // UDP payload
+	proto   layers.IPProtocol
+}
+
+func (p groPacket) bytes(t testing.TB) []byte {
+	t.Helper()
+	proto := p.proto
+	if proto == 0 {
+		proto = layers.IPProtocolUDP
+	}
+	var ip gopacket.NetworkLayer
+	if p.ipv6 {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: net.ParseIP("fc00::1"), DstIP: net.ParseIP("fc00::2")}
+	} else {
+		ipv4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: p.id, Protocol: proto, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4()}
+		if p.df {
+			ipv4.Flags = layers.IPv4DontFragment
+		}
+		ip = ipv4
+	}
+	payload := gsoPayload(p.size)
+	if proto == layers.IPProtocolTCP {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(p.srcPort), DstPort: 443, DataOffset: 5, ACK: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serialize(t, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(payload))
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(p.srcPort), DstPort: 2152}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serialize(t, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(payload))
+}
+
+// Packets of a flow with consecutive identifications
+func groFlow(n int, size int) []groPacket {
+	pkts := make([]groPacket, n)
+	for i := range pkts {
+		pkts[i] = groPacket{id: uint16(i), df: true, srcPort: 2152, size: size}
+	}
+	return pkts
+}
+
+func TestUDPCoalescer(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		packets  []groPacket
+		segments []int // segments of each write, 0 for packets written unchanged
+	}{
+		{"single packet", groFlow(1, 1000), []int{0}},
+		{"same flow", groFlow(3, 1000), []int{3}},
+		{"IPv6", []groPacket{{ipv6: true, srcPort: 2152, size: 1000}, {ipv6: true, srcPort: 2152, size: 1000}}, []int{2}},
+		{"shorter last packet", append(groFlow(2, 1000), groPacket{id: 2, df: true, srcPort: 2152, size: 500}), []int{3}},
+		{"larger packet", append(groFlow(2, 500), groPacket{id: 2, df: true, srcPort: 2152, size: 1000}), []int{2, 0}},
+		{"after a shorter packet", []groPacket{{df: true, srcPort: 2152, size: 1000}, {id: 1, df: true, srcPort: 2152, size: 500}, {id: 2, df: true, srcPort: 2152, size: 500}}, []int{2, 0}},
+		{"other flow", []groPacket{{df: true, srcPort: 2152, size: 1000}, {id: 1, df: true, srcPort: 2153, size: 1000}}, []int{0, 0}},
+		{"other IP version", []groPacket{{df: true, srcPort: 2152, size: 1000}, {ipv6: true, srcPort: 2152, size: 1000}}, []int{0, 0}},
+		{"not UDP", []groPacket{{df: true, srcPort: 2152, size: 1000}, {id: 1, df: true, srcPort: 2152, size: 1000, proto: layers.IPProtocolTCP}, {id: 2, df: true, srcPort: 2152, size: 1000}}, []int{0, 0, 0}},
+		{"consecutive identifications", []groPacket{{id: 0xFFFF, srcPort: 2152, size: 1000}, {id: 0, srcPort: 2152, size: 1000}}, []int{2}},
+		{"other identification without DF", []groPacket{{id: 1, srcPort: 2152, size: 1000}, {id: 3, srcPort: 2152, size: 1000}}, []int{0, 0}},
+		{"segments limit", groFlow(maxUDPSegments+1, 100), []int{maxUDPSegments, 0}},
+		{"size limit", groFlow(70, 1400), []int{46, 24}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var writes [][]byte
+			var hdrs []*iproute2.VirtioNetHdr
+			sent := 0
+			c := newUDPCoalescer(
+				func(b []byte) (int, error) {
+					writes = append(writes, bytes.Clone(b))
+					hdrs = append(hdrs, nil)
+					return len(b), nil
+				},
+				func(hdr *iproute2.VirtioNetHdr, b []byte) (int, error) {
+					writes = append(writes, bytes.Clone(b))
+					h := *hdr
+					hdrs = append(hdrs, &h)
+					return len(b), nil
+				},
+				func(packets int) { sent += packets },
+			)
+			want := make([][]byte, len(tt.packets))
+			for i, p := range tt.packets {
+				want[i] = p.bytes(t)
+				c.push(want[i])
+			}
+			c.flush()
+			if len(writes) != len(tt.segments) {
+				t.Fatalf("got %d writes, want %d", len(writes), len(tt.segments))
+			}
+			if sent != len(tt.packets) {
+				t.Errorf("got %d packets sent, want %d", sent, len(tt.packets))
+			}
+			// segments produced by the kernel are the packets pushed
+			var got [][]byte
+			for i, w := range writes {
+				if hdrs[i] == nil {
+					if tt.segments[i] != 0 {
+						t.Fatalf("write %d: got a single packet, want %d segments", i, tt.segments[i])
+					}
+					got = append(got, w)
+					continue
+				}
+				n := 0
+				if err := segmentVnet(hdrs[i], w, func() []byte { return make([]byte, len(w)) }, func(seg []byte) {
+					got = append(got, bytes.Clone(seg))
+					n++
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if n != tt.segments[i] {
+					t.Errorf("write %d: got %d segments, want %d", i, n, tt.segments[i])
+				}
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d packets, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Errorf("packet %d: got % x, want % x", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nextmn/srv6/internal/iproute2"
+)
+
+// Add bytes to a ones' complement sum
+func csumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// Fold a ones' complement sum into 16 bits
+func csumFold(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return uint16(sum)
+}
+
+// Sum of the pseudo-header for TCP/UDP checksums
+func pseudoHeaderSum(ip []byte, proto uint8, length int) uint32 {
+	var sum uint32
+	if ip[0]>>4 == 4 {
+		sum = csumAdd(0, ip[12:20])
+	} else {
+		sum = csumAdd(0, ip[8:40])
+	}
+	sum += uint32(proto)
+	sum += uint32(length>>16) + uint32(length&0xFFFF)
+	return sum
+}
+
+// Segment a packet read with a virtio_net_hdr.
+// GSO super-packets are split into segments of at most GSOSize bytes of payload,
+// and partial checksums are completed.
+// Each segment is written into a buffer returned by get, and passed to put.
+func segmentVnet(hdr *iproute2.VirtioNetHdr, pkt []byte, get func() []byte, put func(seg []byte)) error {
+	if len(pkt) < 1 {
+		return fmt.Errorf("Empty packet")
+	}
+	gsoType := hdr.GSOType &^ iproute2.VirtioNetHdrGSOECN
+	if gsoType == iproute2.VirtioNetHdrGSONone {
+		if hdr.Flags&iproute2.VirtioNetHdrFNeedsCsum != 0 {
+			// the checksum field already contains the sum of the pseudo-header
+			start := int(hdr.CsumStart)
+			field := start + int(hdr.CsumOffset)
+			if field+2 > len(pkt) {
+				return fmt.Errorf("Malformed virtio_net_hdr")
+			}
+			binary.BigEndian.PutUint16(pkt[field:], ^csumFold(csumAdd(0, pkt[start:])))
+		}
+		buf := get()
+		if len(pkt) > len(buf) {
+			return fmt.Errorf("Packet larger than MTU")
+		}
+		put(buf[:copy(buf, pkt)])
+		return nil
+	}
+
+	var proto uint8
+	l4 := int(hdr.CsumStart)
+	var l4HdrLen int
+	switch gsoType {
+	case iproute2.VirtioNetHdrGSOTCPv4, iproute2.VirtioNetHdrGSOTCPv6:
+		proto = 6
+		if l4+20 > len(pkt) {
+			return fmt.Errorf("Malformed TCP super-packet")
+		}
+		l4HdrLen = int(pkt[l4+12]>>4) * 4
+	case iproute2.VirtioNetHdrGSOUDPL4:
+		proto = 17
+		l4HdrLen = 8
+	default:
+		return fmt.Errorf("Unsupported GSO type: %d", hdr.GSOType)
+	}
+	hdrLen := l4 + l4HdrLen
+	gsoSize := int(hdr.GSOSize)
+	if hdrLen > len(pkt) || gsoSize == 0 {
+		return fmt.Errorf("Malformed GSO super-packet")
+	}
+	isIPv4 := pkt[0]>>4 == 4
+	payload := pkt[hdrLen:]
+	var ipID uint16
+	if isIPv4 {
+		ipID = binary.BigEndian.Uint16(pkt[4:6])
+	}
+	var tcpSeq uint32
+	var tcpFlags uint8
+	if proto == 6 {
+		tcpSeq = binary.BigEndian.Uint32(pkt[l4+4 : l4+8])
+		tcpFlags = pkt[l4+13]
+	}
+
+	for i, off := 0, 0; off < len(payload); i, off = i+1, off+gsoSize {
+		end := min(off+gsoSize, len(payload))
+		buf := get()
+		segLen := hdrLen + end - off
+		if segLen > len(buf) {
+			return fmt.Errorf("Segment larger than MTU")
+		}
+		seg := buf[:segLen]
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		// network header
+		if isIPv4 {
+			binary.BigEndian.PutUint16(seg[2:4], uint16(segLen))
+			binary.BigEndian.PutUint16(seg[4:6], ipID+uint16(i))
+			ihl := int(seg[0]&0x0F) * 4
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:12], ^csumFold(csumAdd(0, seg[:ihl])))
+		} else {
+			binary.BigEndian.PutUint16(seg[4:6], uint16(segLen-40))
+		}
+
+		// transport header
+		l4Len := segLen - l4
+		var csumField int
+		if proto == 6 {
+			binary.BigEndian.PutUint32(seg[l4+4:l4+8], tcpSeq+uint32(off))
+			flags := tcpFlags
+			if end != len(payload) {
+				flags &^= 0x09 // FIN, PSH: last segment only
+			}
+			if i != 0 {
+				flags &^= 0x80 // CWR: first segment only
+			}
+			seg[l4+13] = flags
+			csumField = l4 + 16
+		} else {
+			binary.BigEndian.PutUint16(seg[l4+4:l4+6], uint16(l4Len))
+			csumField = l4 + 6
+		}
+		seg[csumField], seg[csumField+1] = 0, 0
+		csum := ^csumFold(csumAdd(pseudoHeaderSum(seg, proto, l4Len), seg[l4:]))
+		if proto == 17 && csum == 0 {
+			csum = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(seg[csumField:], csum)
+		put(seg)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/nextmn/srv6/internal/iproute2"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Payload whose bytes depend on their offset, so misplaced bytes are detected
+func gsoPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// IP header followed by a transport header and payload
+func gsoPacket(t testing.TB, ipv6 bool, l4 gopacket.SerializableLayer, payload []byte) []byte {
+	t.Helper()
+	var ip gopacket.NetworkLayer
+	proto := layers.IPProtocolTCP
+	if _, ok := l4.(*layers.UDP); ok {
+		proto = layers.IPProtocolUDP
+	}
+	if ipv6 {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: net.ParseIP("fc00::1"), DstIP: net.ParseIP("fc00::2")}
+	} else {
+		ip = &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 0xFFFE, Protocol: proto, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4()}
+	}
+	switch l := l4.(type) {
+	case *layers.TCP:
+		l.SetNetworkLayerForChecksum(ip)
+	case *layers.UDP:
+		l.SetNetworkLayerForChecksum(ip)
+	}
+	return serialize(t, ip.(gopacket.SerializableLayer), l4, gopacket.Payload(payload))
+}
+
+// Ones' complement sum of a valid checksum
+func checksumOK(sum uint32) bool {
+	return csumFold(sum) == 0xFFFF
+}
+
+func TestSegmentVnet(t *testing.T) {
+	payload := gsoPayload(2500)
+	tcp := func() *layers.TCP {
+		return &layers.TCP{SrcPort: 1000, DstPort: 443, Seq: 0xFFFFFF00, DataOffset: 5, ACK: true, PSH: true, FIN: true, CWR: true, Window: 100}
+	}
+	udp := &layers.UDP{SrcPort: 1000, DstPort: 53}
+	for _, tt := range []struct {
+		name     string
+		ipv6     bool
+		l4       gopacket.SerializableLayer
+		l4HdrLen int
+		gsoType  uint8
+		gsoSize  uint16
+		segments int
+	}{
+		{"TCPv4", false, tcp(), 20, iproute2.VirtioNetHdrGSOTCPv4, 1000, 3},
+		{"TCPv4 with ECN", false, tcp(), 20, iproute2.VirtioNetHdrGSOTCPv4 | iproute2.VirtioNetHdrGSOECN, 1000, 3},
+		{"TCPv6", true, tcp(), 20, iproute2.VirtioNetHdrGSOTCPv6, 1200, 3},
+		{"UDP_L4", false, udp, 8, iproute2.VirtioNetHdrGSOUDPL4, 1000, 3},
+		{"UDP_L4 over IPv6", true, udp, 8, iproute2.VirtioNetHdrGSOUDPL4, 2500, 1},
+		{"NEEDS_CSUM only", false, udp, 8, iproute2.VirtioNetHdrGSONone, 0, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := gsoPacket(t, tt.ipv6, tt.l4, payload)
+			l4 := 20
+			proto := uint8(layers.IPProtocolTCP)
+			csumOffset := 16
+			if tt.ipv6 {
+				l4 = 40
+			}
+			if tt.l4HdrLen == 8 {
+				proto = uint8(layers.IPProtocolUDP)
+				csumOffset = 6
+			}
+			// the kernel leaves the sum of the pseudo-header in the checksum field
+			binary.BigEndian.PutUint16(pkt[l4+csumOffset:], csumFold(pseudoHeaderSum(pkt, proto, len(pkt)-l4)))
+			hdr := &iproute2.VirtioNetHdr{
+				Flags:      iproute2.VirtioNetHdrFNeedsCsum,
+				GSOType:    tt.gsoType,
+				HdrLen:     uint16(l4 + tt.l4HdrLen),
+				GSOSize:    tt.gsoSize,
+				CsumStart:  uint16(l4),
+				CsumOffset: uint16(csumOffset),
+			}
+			segs := [][]byte{}
+			if err := segmentVnet(hdr, pkt, func() []byte { return make([]byte, len(pkt)) }, func(seg []byte) {
+				segs = append(segs, bytes.Clone(seg))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != tt.segments {
+				t.Fatalf("got %d segments, want %d", len(segs), tt.segments)
+			}
+			gsoSize := int(tt.gsoSize)
+			if gsoSize == 0 {
+				gsoSize = len(payload)
+			}
+			hdrLen := l4 + tt.l4HdrLen
+			for i, seg := range segs {
+				start := i * gsoSize
+				end := min(start+gsoSize, len(payload))
+				if len(seg) != hdrLen+end-start || !bytes.Equal(seg[hdrLen:], payload[start:end]) {
+					t.Errorf("segment %d: wrong payload", i)
+				}
+				if tt.ipv6 {
+					if got := binary.BigEndian.Uint16(seg[4:6]); int(got) != len(seg)-40 {
+						t.Errorf("segment %d: got payload length %d, want %d", i, got, len(seg)-40)
+					}
+				} else {
+					if got := binary.BigEndian.Uint16(seg[2:4]); int(got) != len(seg) {
+						t.Errorf("segment %d: got total length %d, want %d", i, got, len(seg))
+					}
+					if got, want := binary.BigEndian.Uint16(seg[4:6]), uint16(0xFFFE+i); got != want {
+						t.Errorf("segment %d: got IPv4 ID %#x, want %#x", i, got, want)
+					}
+					if !checksumOK(csumAdd(0, seg[:20])) {
+						t.Errorf("segment %d: wrong IPv4 header checksum", i)
+					}
+				}
+				if !checksumOK(csumAdd(pseudoHeaderSum(seg, proto, len(seg)-l4), seg[l4:])) {
+					t.Errorf("segment %d: wrong L4 checksum", i)
+				}
+				if proto == uint8(layers.IPProtocolUDP) {
+					if got := binary.BigEndian.Uint16(seg[l4+4 : l4+6]); int(got) != len(seg)-l4 {
+						t.Errorf("segment %d: got UDP length %d, want %d", i, got, len(seg)-l4)
+					}
+					continue
+				}
+				if got, want := binary.BigEndian.Uint32(seg[l4+4:l4+8]), uint32(0xFFFFFF00)+uint32(start); got != want {
+					t.Errorf("segment %d: got TCP sequence number %#x, want %#x", i, got, want)
+				}
+				want := uint8(0x10) // ACK
+				if i == 0 {
+					want |= 0x80 // CWR
+				}
+				if i == len(segs)-1 {
+					want |= 0x09 // FIN, PSH
+				}
+				if got := seg[l4+13]; got != want {
+					t.Errorf("segment %d: got TCP flags %#x, want %#x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentVnetMalformed(t *testing.T) {
+	pkt := gsoPacket(t, false, &layers.UDP{SrcPort: 1000, DstPort: 53}, gsoPayload(100))
+	get := func() []byte { return make([]byte, 1500) }
+	put := func([]byte) {}
+	for _, tt := range []struct {
+		name string
+		hdr  iproute2.VirtioNetHdr
+		pkt  []byte
+	}{
+		{"empty packet", iproute2.VirtioNetHdr{}, nil},
+		{"checksum after the packet", iproute2.VirtioNetHdr{Flags: iproute2.VirtioNetHdrFNeedsCsum, CsumStart: 124, CsumOffset: 6}, pkt},
+		{"unsupported GSO type", iproute2.VirtioNetHdr{GSOType: iproute2.VirtioNetHdrGSOUDP, GSOSize: 50, CsumStart: 20}, pkt},
+		{"zero GSO size", iproute2.VirtioNetHdr{GSOType: iproute2.VirtioNetHdrGSOUDPL4, CsumStart: 20}, pkt},
+		{"truncated TCP header", iproute2.VirtioNetHdr{GSOType: iproute2.VirtioNetHdrGSOTCPv4, GSOSize: 50, CsumStart: 120}, pkt},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := segmentVnet(&tt.hdr, tt.pkt, get, put); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
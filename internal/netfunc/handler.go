@@ -8,5 +8,7 @@ package netfunc
 import "context"
 
 type Handler interface {
-	Handle(ctx context.Context, packet []byte) ([]byte, error)
+	// Handle a packet previously loaded with pqt.Reset.
+	// The returned slice may be backed by the buffer of pqt.
+	Handle(ctx context.Context, pqt *Packet) ([]byte, error)
 }
@@ -14,7 +14,7 @@ import (
 	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
 )
 
-func NewHeadendWithCtrl(he *config.Headend, ttl uint8, hopLimit uint8, setup_registry app_api.Registry) (netfunc_api.NetFunc, error) {
+func NewHeadendWithCtrl(he *config.Headend, ttl uint8, hopLimit uint8, dataplane *config.Dataplane, setup_registry app_api.Registry) (netfunc_api.NetFunc, error) {
 	p, err := netip.ParsePrefix(he.To)
 	if err != nil {
 		return nil, err
@@ -29,7 +29,7 @@ func NewHeadendWithCtrl(he *config.Headend, ttl uint8, hopLimit uint8, setup_reg
 		if err != nil {
 			return nil, err
 		}
-		return NewNetFunc(NewHeadendEncapsWithCtrl(p, srcAddressPrefix, ttl, hopLimit, db)), nil
+		return NewNetFunc(NewHeadendEncapsWithCtrl(p, srcAddressPrefix, ttl, hopLimit, db), dataplane), nil
 	case config.H_M_GTP4_D:
 		db, ok := setup_registry.DB()
 		if !ok {
@@ -40,11 +40,13 @@ func NewHeadendWithCtrl(he *config.Headend, ttl uint8, hopLimit uint8, setup_reg
 			return nil, err
 		}
 
-		g, err := NewHeadendGTP4WithCtrl(p, srcAddressPrefix, ttl, hopLimit, db)
+		// path manager is optional
+		pm, _ := setup_registry.PathManager()
+		g, err := NewHeadendGTP4WithCtrl(p, srcAddressPrefix, ttl, hopLimit, db, pm)
 		if err != nil {
 			return nil, err
 		}
-		return NewNetFunc(g), nil
+		return NewNetFunc(g, dataplane), nil
 	default:
 		return nil, fmt.Errorf("Unsupported headend behavior (%s) with this provider (%s)", he.Behavior, he.Provider)
 	}
@@ -13,7 +13,6 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 
-	gopacket_srv6 "github.com/nextmn/gopacket-srv6"
 	"github.com/nextmn/rfc9433/encoding"
 	db_api "github.com/nextmn/srv6/internal/database/api"
 )
@@ -33,11 +32,21 @@ func NewHeadendEncapsWithCtrl(prefix netip.Prefix, srcPrefix netip.Prefix, ttl u
 }
 
 // Handle a packet
-func (h HeadendEncapsWithCtrl) Handle(ctx context.Context, packet []byte) ([]byte, error) {
-	pqt, err := NewIPv4Packet(packet)
+func (h HeadendEncapsWithCtrl) Handle(ctx context.Context, pqt *Packet) ([]byte, error) {
+	// IPv4 or IPv6 PDU Session
+	layerType, err := networkLayerType(pqt.Data())
 	if err != nil {
 		return nil, err
 	}
+	nextHeader := layers.IPProtocolIPv4
+	if layerType == layers.LayerTypeIPv6 {
+		nextHeader = layers.IPProtocolIPv6
+		if err := pqt.DecodeIPv6(); err != nil {
+			return nil, err
+		}
+	} else if err := pqt.DecodeIPv4(); err != nil {
+		return nil, err
+	}
 	if _, err := h.CheckDAInPrefixRange(pqt); err != nil {
 		return nil, err
 	}
@@ -55,7 +64,7 @@ func (h HeadendEncapsWithCtrl) Handle(ctx context.Context, packet []byte) ([]byt
 		return nil, fmt.Errorf("Error during serialization of IPv6 SA: %w", err)
 	}
 
-	segs := action.SRH.AsSlice()
+	segs := action.SRHForFlow(uint64(flowHash(pqt.Data()))).AsSlice()
 	ipheader := &layers.IPv6{
 		SrcIP: src,
 		// S06. Set the IPv6 DA = B
@@ -67,33 +76,14 @@ func (h HeadendEncapsWithCtrl) Handle(ctx context.Context, packet []byte) ([]byt
 		TrafficClass: 0, // FIXME: put this in Action
 	}
 
-	srh := &gopacket_srv6.IPv6Routing{
-		RoutingType: 4,
-		// the first item on segments list is the next endpoint
-		SegmentsLeft:     uint8(len(segs) - 1), // pointer to next segment
-		SourceRoutingIPs: segs,
-		Tag:              0, // not used
-		Flags:            0, // no flag defined
-		GopacketIpv6ExtensionBase: gopacket_srv6.GopacketIpv6ExtensionBase{
-			NextHeader: layers.IPProtocolIPv4,
-		},
-	}
+	srh := NewSRH(segs, nextHeader)
 
 	// Encapsulate the packet into a new IPv6 header
-	buf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buf,
-		gopacket.SerializeOptions{
-			FixLengths:       true,
-			ComputeChecksums: true,
-		},
-		ipheader,
-		srh,
-		gopacket.Payload(pqt.Packet.Layers()[0].LayerContents()),
-		gopacket.Payload(pqt.Packet.Layers()[0].LayerPayload()),
-	); err != nil {
+	// Forward along the shortest path to B
+	pkt, err := pqt.Serialize(ipheader, srh, gopacket.Payload(pqt.Data()))
+	if err != nil {
 		return nil, err
-	} else {
-		// Forward along the shortest path to B
-		return buf.Bytes(), nil
 	}
+	h.db.CountTraffic(action.Rule, len(pqt.Data()))
+	return pkt, nil
 }
@@ -7,16 +7,16 @@ package netfunc
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/netip"
 
 	"github.com/nextmn/srv6/internal/constants"
 	db_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/gtpu"
 
-	gopacket_gtp "github.com/nextmn/gopacket-gtp"
-	gopacket_srv6 "github.com/nextmn/gopacket-srv6"
 	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
 	"github.com/nextmn/rfc9433/encoding"
 
 	"github.com/google/gopacket"
@@ -25,22 +25,23 @@ import (
 
 type HeadendGTP4WithCtrl struct {
 	BaseHandler
-	db        db_api.Uplink
-	srcPrefix netip.Prefix
+	db          db_api.Uplink
+	srcPrefix   netip.Prefix
+	pathManager *gtpu.PathManager // nil when GTP-U path management is disabled
 }
 
-func NewHeadendGTP4WithCtrl(prefix netip.Prefix, srcPrefix netip.Prefix, ttl uint8, hopLimit uint8, db db_api.Uplink) (*HeadendGTP4WithCtrl, error) {
+func NewHeadendGTP4WithCtrl(prefix netip.Prefix, srcPrefix netip.Prefix, ttl uint8, hopLimit uint8, db db_api.Uplink, pathManager *gtpu.PathManager) (*HeadendGTP4WithCtrl, error) {
 	return &HeadendGTP4WithCtrl{
 		BaseHandler: NewBaseHandler(prefix, ttl, hopLimit),
 		db:          db,
 		srcPrefix:   srcPrefix,
+		pathManager: pathManager,
 	}, nil
 }
 
 // Handle a packet
-func (h HeadendGTP4WithCtrl) Handle(ctx context.Context, packet []byte) ([]byte, error) {
-	pqt, err := NewIPv4Packet(packet)
-	if err != nil {
+func (h HeadendGTP4WithCtrl) Handle(ctx context.Context, pqt *Packet) ([]byte, error) {
+	if err := pqt.DecodeIPv4(); err != nil {
 		return nil, err
 	}
 	dest_addr, err := h.CheckDAInPrefixRange(pqt)
@@ -55,105 +56,100 @@ func (h HeadendGTP4WithCtrl) Handle(ctx context.Context, packet []byte) ([]byte,
 	// RFC 9433 section 6.7. H.M.GTP4.D
 
 	// S01. IF !(Payload == UDP/GTP-U) THEN Drop the packet
-	// S02. Pop the outer IPv4 header and UDP/GTP-U headers
-	payload, err := pqt.PopGTP4Headers()
+	gtpuHeader, err := pqt.GTP4Header()
 	if err != nil {
 		return nil, err
 	}
 	// S03. Copy IPv4 DA and TEID to form SID B
-	layerGTPU := pqt.Layer(layers.LayerTypeGTPv1U)
-	if layerGTPU == nil {
-		return nil, fmt.Errorf("Could not parse GTPU layer")
-	}
-	gtpu := layerGTPU.(*layers.GTPv1U)
-	teid := gtpu.TEID
+	teid := gtpuHeader.TEID
 
-	// handle echo request
-	if gtpu.MessageType == constants.GTPU_MESSAGE_TYPE_ECHO_REQUEST {
-		if !gtpu.SequenceNumberFlag {
+	switch gtpuHeader.MessageType {
+	case constants.GTPU_MESSAGE_TYPE_ECHO_REQUEST:
+		// handle echo request
+		if !gtpuHeader.SequenceNumberFlag {
 			return nil, fmt.Errorf("No sequence number flag in GTP Echo Request")
 		}
-		ipv4resp := layers.IPv4{
-			// IPv4
-			Version: 4,
-			// Next Header: UDP
-			Protocol: layers.IPProtocolUDP,
-			// Fragmentation is inefficient and should be avoided (TS 129.281 section 4.2.2)
-			// It is recommended to set the default inner MTU size instead.
-			Flags: layers.IPv4DontFragment,
-			// Destination IP from buffer
-			SrcIP: dest_addr.AsSlice(),
-			// Source IP from buffer
-			DstIP: gnb_ip.AsSlice(),
-			// TTL from tun config
-			TTL: h.TTL(),
-			// other fields are initialized at zero
-			// cheksum, and length are computed at serialization
+		udp, err := pqt.UDP()
+		if err != nil {
+			return nil, err
+		}
+		return gtpu.NewGTP4EchoResponse(dest_addr, gnb_ip, udp.SrcPort, h.TTL(), gtpuHeader.SequenceNumber)
+	case constants.GTPU_MESSAGE_TYPE_ECHO_RESPONSE:
+		// response to an Echo Request sent by the path manager
+		if h.pathManager == nil {
+			return nil, fmt.Errorf("Unexpected GTP Echo Response: path management is disabled")
+		}
+		if !gtpuHeader.SequenceNumberFlag {
+			return nil, fmt.Errorf("No sequence number flag in GTP Echo Response")
+		}
+		h.pathManager.HandleEchoResponse(gnb_ip, gtpuHeader.SequenceNumber, gtpuHeader.LayerPayload())
+		return nil, nil
+	case constants.GTPU_MESSAGE_TYPE_END_MARKER:
+		// End Marker has no T-PDU: it is translated into an SRv6 packet with No Next Header,
+		// following the same path than G-PDUs of this tunnel
+		action, err := h.db.GetUplinkEndMarkerAction(ctx, jsonapi.Fteid{Teid: teid, Addr: dest_addr}, gnb_ip)
+		if err != nil {
+			return nil, err
 		}
-		udpresp := layers.UDP{
-			// Source Port
-			SrcPort: constants.GTPU_PORT_INT,
-			DstPort: pqt.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort,
-			// cheksum, and length are computed at serialization
+		// with several paths, flows of the tunnel may use any path up:
+		// an End Marker is sent on each of them
+		srhs := action.SRHsUp()
+		for _, srh := range srhs[:len(srhs)-1] {
+			pkt, err := h.encapsulate(pqt, srh, nil, layers.IPProtocolNoNextHeader)
+			if err != nil {
+				return nil, err
+			}
+			pqt.AddExtra(pkt)
 		}
-		// required for checksum
-		udpresp.SetNetworkLayerForChecksum(&ipv4resp)
-		gtpresp := gopacket_gtp.GTPv1U{
-			Version:            1,
-			ProtocolType:       1,
-			SequenceNumberFlag: true,
-			SequenceNumber:     gtpu.SequenceNumber,
-			// message type: G-PDU
-			MessageType:   constants.GTPU_MESSAGE_TYPE_ECHO_RESPONSE,
-			TEID:          0,
-			MessageLength: uint16(6), // recovery IE + seqNum + N-PDU Number (ignored) + next ext header type
+		return h.encapsulate(pqt, srhs[len(srhs)-1], nil, layers.IPProtocolNoNextHeader)
+	case constants.GTPU_MESSAGE_TYPE_GPDU:
+		// S02. Pop the outer IPv4 header and UDP/GTP-U headers
+		payload, err := pqt.PopGTP4Headers()
+		if err != nil {
+			return nil, err
 		}
-		payloadresp := []byte{14, 0} // empty recovery IE
-		buf := gopacket.NewSerializeBuffer()
-		if err := gopacket.SerializeLayers(buf,
-			gopacket.SerializeOptions{
-				FixLengths:       true,
-				ComputeChecksums: true,
-			},
-			&ipv4resp,
-			&udpresp,
-			&gtpresp,
-			gopacket.Payload(payloadresp),
-		); err != nil {
+		// Get Inner Header Addresses (IPv4 or IPv6 PDU Session)
+		innerHeaderSrc, innerHeaderDst, nextHeader, err := pqt.InnerAddrs()
+		if err != nil {
 			return nil, err
-		} else {
-			return buf.Bytes(), nil
 		}
 
+		action, err := h.db.GetUplinkAction(ctx, jsonapi.Fteid{Teid: teid, Addr: dest_addr}, gnb_ip, innerHeaderSrc, innerHeaderDst)
+		if errors.Is(err, db_api.ErrNoMatchingRule) {
+			// Let the gNB release the bearer
+			return gtpu.NewGTP4ErrorIndication(dest_addr, gnb_ip, h.TTL(), teid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkt, err := h.encapsulate(pqt, action.SRHForFlow(uint64(flowHash(payload))), payload, nextHeader)
+		if err != nil {
+			return nil, err
+		}
+		h.db.CountTraffic(action.Rule, len(payload))
+		return pkt, nil
+	default:
+		return nil, fmt.Errorf("Unsupported GTP-U message type: %d", gtpuHeader.MessageType)
 	}
+}
 
-	if gtpu.MessageType != constants.GTPU_MESSAGE_TYPE_GPDU {
-		return nil, fmt.Errorf("GTP packet is not a G-PDU")
-	}
-	// Check payload is IPv4
-	inner, ok := payload.(*layers.IPv4)
-	if !ok {
-		return nil, fmt.Errorf("Payload is not IPv4")
-	}
-	if inner.Version != 4 {
-		return nil, fmt.Errorf("Payload is IPv%d instead of IPv4", inner.Version)
+// Encapsulate the payload into a new IPv6 header with the SRH of the path.
+// When payload is nil, nextHeader is No Next Header.
+func (h HeadendGTP4WithCtrl) encapsulate(pqt *Packet, path n4tosrv6.SRH, payload []byte, nextHeader layers.IPProtocol) ([]byte, error) {
+	// S04. Copy IPv4 SA to form IPv6 SA B'
+	ipv4, err := pqt.IPv4()
+	if err != nil {
+		return nil, err
 	}
-	// Get Inner IPv4 Header Addresses
-	innerHeaderSrcIPv4 := netip.AddrFrom4([4]byte{inner.SrcIP[0], inner.SrcIP[1], inner.SrcIP[2], inner.SrcIP[3]})
-	innerHeaderDstIPv4 := netip.AddrFrom4([4]byte{inner.DstIP[0], inner.DstIP[1], inner.DstIP[2], inner.DstIP[3]})
-
-	action, err := h.db.GetUplinkAction(ctx, jsonapi.Fteid{Teid: teid, Addr: dest_addr}, gnb_ip, innerHeaderSrcIPv4, innerHeaderDstIPv4)
+	udp, err := pqt.UDP()
 	if err != nil {
 		return nil, err
 	}
-	// S04. Copy IPv4 SA to form IPv6 SA B'
-	ipv4SA := pqt.NetworkLayer().NetworkFlow().Src().Raw()
-	udpSP := pqt.TransportLayer().TransportFlow().Src().Raw()
 
-	ipv6SA := encoding.NewMGTP4IPv6Src(h.srcPrefix, [4]byte(ipv4SA), binary.BigEndian.Uint16(udpSP))
+	ipv6SA := encoding.NewMGTP4IPv6Src(h.srcPrefix, [4]byte(ipv4.SrcIP.To4()), uint16(udp.SrcPort))
 
 	src, err := ipv6SA.Marshal()
-	segs := action.SRH.AsSlice()
+	segs := path.AsSlice()
 	if err != nil {
 		return nil, fmt.Errorf("Error during serialization of IPv6 SA: %w", err)
 	}
@@ -168,33 +164,12 @@ func (h HeadendGTP4WithCtrl) Handle(ctx context.Context, packet []byte) ([]byte,
 		//TrafficClass: qfi << 2,
 		TrafficClass: 0, // FIXME
 	}
-	srh := &gopacket_srv6.IPv6Routing{
-		RoutingType: 4,
-		// the first item on segments list is the next endpoint
-		SegmentsLeft:     uint8(len(segs) - 1), // pointer to next segment
-		SourceRoutingIPs: segs,
-		Tag:              0, // not used
-		Flags:            0, // no flag defined
-		GopacketIpv6ExtensionBase: gopacket_srv6.GopacketIpv6ExtensionBase{
-			NextHeader: layers.IPProtocolIPv4,
-		},
-	}
+	srh := NewSRH(segs, nextHeader)
 
 	// S05. Encapsulate the packet into a new IPv6 header
-	buf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buf,
-		gopacket.SerializeOptions{
-			FixLengths:       true,
-			ComputeChecksums: true,
-		},
-		ipheader,
-		srh,
-		gopacket.Payload(payload.LayerContents()),
-		gopacket.Payload(payload.LayerPayload()),
-	); err != nil {
-		return nil, err
-	} else {
-		// S07. Forward along the shortest path to B
-		return buf.Bytes(), nil
+	// S07. Forward along the shortest path to B
+	if payload == nil {
+		return pqt.Serialize(ipheader, srh)
 	}
+	return pqt.Serialize(ipheader, srh, gopacket.Payload(payload))
 }
@@ -0,0 +1,93 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	db_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/database/api/apitest"
+	"github.com/nextmn/srv6/internal/gtpu"
+
+	"github.com/gofrs/uuid"
+	"github.com/google/gopacket/layers"
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
+)
+
+// Uplink store answering every lookup with the same action
+type fakeUplink struct {
+	action db_api.Action
+}
+
+func (f fakeUplink) CountTraffic(id uuid.UUID, size int) {}
+
+func (f fakeUplink) GetUplinkAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr, ueIp netip.Addr, serviceIp netip.Addr) (db_api.Action, error) {
+	return f.action, nil
+}
+
+func (f fakeUplink) GetUplinkEndMarkerAction(ctx context.Context, uplinkFTeid jsonapi.Fteid, gnbIp netip.Addr) (db_api.Action, error) {
+	return f.action, nil
+}
+
+func TestHeadendGTP4EndMarker(t *testing.T) {
+	path := func(segment string, down bool) db_api.Path {
+		return db_api.Path{SRH: apitest.SRH(t, segment), Down: down}
+	}
+	for _, tt := range []struct {
+		name  string
+		paths []db_api.Path
+		want  []string // destination of each End Marker
+	}{
+		{"no path", nil, []string{"fc00:9::1"}},
+		{"single path", []db_api.Path{path("fc00:1::1", false)}, []string{"fc00:1::1"}},
+		{"all paths up", []db_api.Path{path("fc00:1::1", false), path("fc00:2::1", false), path("fc00:3::1", false)}, []string{"fc00:1::1", "fc00:2::1", "fc00:3::1"}},
+		{"path down", []db_api.Path{path("fc00:1::1", false), path("fc00:2::1", true), path("fc00:3::1", false)}, []string{"fc00:1::1", "fc00:3::1"}},
+		{"all paths down", []db_api.Path{path("fc00:1::1", true), path("fc00:2::1", true)}, []string{"fc00:9::1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			action := db_api.Action{Action: n4tosrv6.Action{SRH: apitest.SRH(t, "fc00:9::1")}, Paths: tt.paths}
+			h, err := NewHeadendGTP4WithCtrl(netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fc00:4::/48"), 64, 64, fakeUplink{action: action}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			endMarker, err := gtpu.NewGTP4EndMarker(netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.0.0.100"), 2152, 64, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pqt := NewPacket()
+			pqt.Reset(endMarker)
+			out, err := h.Handle(context.Background(), pqt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// extra packets are copies: out is still valid
+			packets := append(append([][]byte{}, pqt.Extra()...), out)
+			if len(packets) != len(tt.want) {
+				t.Fatalf("got %d End Markers, want %d", len(packets), len(tt.want))
+			}
+			for i, pkt := range packets {
+				p := NewPacket()
+				p.Reset(pkt)
+				if err := p.DecodeIPv6(); err != nil {
+					t.Fatal(err)
+				}
+				ipv6, err := p.IPv6()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dst := ipv6.DstIP.String(); dst != tt.want[i] {
+					t.Errorf("End Marker %d: got destination %s, want %s", i, dst, tt.want[i])
+				}
+				if srh := p.SRH(); srh == nil || srh.NextHeader != layers.IPProtocolNoNextHeader {
+					t.Errorf("End Marker %d: SRH without No Next Header", i)
+				}
+			}
+		})
+	}
+}
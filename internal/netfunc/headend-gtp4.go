@@ -7,40 +7,42 @@ package netfunc
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 
 	"github.com/nextmn/srv6/internal/config"
 	"github.com/nextmn/srv6/internal/constants"
+	"github.com/nextmn/srv6/internal/gtpu"
 
-	gopacket_gtp "github.com/nextmn/gopacket-gtp"
-	gopacket_srv6 "github.com/nextmn/gopacket-srv6"
 	"github.com/nextmn/rfc9433/encoding"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+var errNoPolicy = errors.New("Could not found policy matching criteria")
+
 type HeadendGTP4 struct {
 	policy []config.Policy
 	BaseHandler
 	sourceAddressPrefix netip.Prefix
+	pathManager         *gtpu.PathManager // nil when GTP-U path management is disabled
 }
 
-func NewHeadendGTP4(prefix netip.Prefix, sourceAddressPrefix netip.Prefix, policy []config.Policy, ttl uint8, hopLimit uint8) *HeadendGTP4 {
+func NewHeadendGTP4(prefix netip.Prefix, sourceAddressPrefix netip.Prefix, policy []config.Policy, ttl uint8, hopLimit uint8, pathManager *gtpu.PathManager) *HeadendGTP4 {
 	return &HeadendGTP4{
 		sourceAddressPrefix: sourceAddressPrefix,
 		policy:              policy,
 		BaseHandler:         NewBaseHandler(prefix, ttl, hopLimit),
+		pathManager:         pathManager,
 	}
 }
 
 // Handle a packet
-func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error) {
-	pqt, err := NewIPv4Packet(packet)
-	if err != nil {
+func (h HeadendGTP4) Handle(ctx context.Context, pqt *Packet) ([]byte, error) {
+	if err := pqt.DecodeIPv4(); err != nil {
 		return nil, err
 	}
 	dest_addr, err := h.CheckDAInPrefixRange(pqt)
@@ -55,91 +57,62 @@ func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error)
 	// RFC 9433 section 6.7. H.M.GTP4.D
 
 	// S01. IF !(Payload == UDP/GTP-U) THEN Drop the packet
-	// S02. Pop the outer IPv4 header and UDP/GTP-U headers
-	payload, err := pqt.PopGTP4Headers()
+	gtpuHeader, err := pqt.GTP4Header()
 	if err != nil {
 		return nil, err
 	}
 	// S03. Copy IPv4 DA and TEID to form SID B
-	layerGTPU := pqt.Layer(layers.LayerTypeGTPv1U)
-	if layerGTPU == nil {
-		return nil, fmt.Errorf("Could not parse GTPU layer")
-	}
-	gtpu := layerGTPU.(*layers.GTPv1U)
-	teid := gtpu.TEID
+	teid := gtpuHeader.TEID
 
-	// handle echo request
-	if gtpu.MessageType == constants.GTPU_MESSAGE_TYPE_ECHO_REQUEST {
-		if !gtpu.SequenceNumberFlag {
+	switch gtpuHeader.MessageType {
+	case constants.GTPU_MESSAGE_TYPE_ECHO_REQUEST:
+		// handle echo request
+		if !gtpuHeader.SequenceNumberFlag {
 			return nil, fmt.Errorf("No sequence number flag in GTP Echo Request")
 		}
-		ipv4resp := layers.IPv4{
-			// IPv4
-			Version: 4,
-			// Next Header: UDP
-			Protocol: layers.IPProtocolUDP,
-			// Fragmentation is inefficient and should be avoided (TS 129.281 section 4.2.2)
-			// It is recommended to set the default inner MTU size instead.
-			Flags: layers.IPv4DontFragment,
-			// Destination IP from buffer
-			SrcIP: dest_addr.AsSlice(),
-			// Source IP from buffer
-			DstIP: gnb_ip.AsSlice(),
-			// TTL from tun config
-			TTL: h.TTL(),
-			// other fields are initialized at zero
-			// cheksum, and length are computed at serialization
+		udp, err := pqt.UDP()
+		if err != nil {
+			return nil, err
 		}
-		udpresp := layers.UDP{
-			// Source Port
-			SrcPort: constants.GTPU_PORT_INT,
-			DstPort: pqt.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort,
-			// cheksum, and length are computed at serialization
+		return gtpu.NewGTP4EchoResponse(dest_addr, gnb_ip, udp.SrcPort, h.TTL(), gtpuHeader.SequenceNumber)
+	case constants.GTPU_MESSAGE_TYPE_ECHO_RESPONSE:
+		// response to an Echo Request sent by the path manager
+		if h.pathManager == nil {
+			return nil, fmt.Errorf("Unexpected GTP Echo Response: path management is disabled")
 		}
-		// required for checksum
-		udpresp.SetNetworkLayerForChecksum(&ipv4resp)
-		gtpresp := gopacket_gtp.GTPv1U{
-			Version:            1,
-			ProtocolType:       1,
-			SequenceNumberFlag: true,
-			SequenceNumber:     gtpu.SequenceNumber,
-			// message type: G-PDU
-			MessageType:   constants.GTPU_MESSAGE_TYPE_ECHO_RESPONSE,
-			TEID:          0,
-			MessageLength: uint16(6), // recovery IE + seqNum + N-PDU Number (ignored) + next ext header type
+		if !gtpuHeader.SequenceNumberFlag {
+			return nil, fmt.Errorf("No sequence number flag in GTP Echo Response")
 		}
-		payloadresp := []byte{14, 0} // empty recovery IE
-		buf := gopacket.NewSerializeBuffer()
-		if err := gopacket.SerializeLayers(buf,
-			gopacket.SerializeOptions{
-				FixLengths:       true,
-				ComputeChecksums: true,
-			},
-			&ipv4resp,
-			&udpresp,
-			&gtpresp,
-			gopacket.Payload(payloadresp),
-		); err != nil {
+		h.pathManager.HandleEchoResponse(gnb_ip, gtpuHeader.SequenceNumber, gtpuHeader.LayerPayload())
+		return nil, nil
+	case constants.GTPU_MESSAGE_TYPE_END_MARKER:
+		// End Marker has no T-PDU: it is translated into an SRv6 packet with No Next Header,
+		// following the same path than G-PDUs of this tunnel
+		bsid, err := h.findBsid(pqt, teid, nil)
+		if err != nil {
 			return nil, err
-		} else {
-			return buf.Bytes(), nil
 		}
-
+		return h.encapsulate(pqt, encoding.NewArgsMobSession(0, false, false, teid), bsid, nil)
+	case constants.GTPU_MESSAGE_TYPE_GPDU:
+	default:
+		return nil, fmt.Errorf("Unsupported GTP-U message type: %d", gtpuHeader.MessageType)
 	}
 
-	if gtpu.MessageType != constants.GTPU_MESSAGE_TYPE_GPDU {
-		return nil, fmt.Errorf("GTP packet is not a G-PDU")
+	// S02. Pop the outer IPv4 header and UDP/GTP-U headers
+	payload, err := pqt.PopGTP4Headers()
+	if err != nil {
+		return nil, err
 	}
 
 	// TODO: create a dedicated parser for GTPU extension Headers
 	// TODO: create a dedicated parser for PDU Session Container
 	var qfi uint8 = 0
 	var reflectiveQosIndication = false
-	if gtpu.ExtensionHeaderFlag && len(gtpu.GTPExtensionHeaders) > 0 {
+	if gtpuHeader.ExtensionHeaderFlag && len(gtpuHeader.GTPExtensionHeaders) > 0 {
 		// TS 129.281, Fig. 5.2.1-3:
 		// > For a GTP-PDU with several Extension Headers, the PDU Session
 		// > Container should be the first Extension Header.
-		firstExt := gtpu.GTPExtensionHeaders[0]
+		firstExt := gtpuHeader.GTPExtensionHeaders[0]
 		if firstExt.Type == 0x85 { // PDU Session Container
 			b := firstExt.Content
 			if (b[0] & 0xF0 >> 4) == 0 { // PDU Type == DL PDU Session Information
@@ -151,20 +124,29 @@ func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error)
 			}
 		}
 	}
-	ipv4DA := pqt.NetworkLayer().NetworkFlow().Dst().Raw()
 	argsMobSession := encoding.NewArgsMobSession(qfi, reflectiveQosIndication, false, teid)
 
+	bsid, err := h.findBsid(pqt, teid, payload)
+	if errors.Is(err, errNoPolicy) {
+		// Let the gNB release the bearer
+		return gtpu.NewGTP4ErrorIndication(dest_addr, gnb_ip, h.TTL(), teid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.encapsulate(pqt, argsMobSession, bsid, payload)
+}
+
+// Find a policy matching criteria.
+// When payload is nil (End Marker), only the TEID is checked.
+func (h HeadendGTP4) findBsid(pqt *Packet, teid uint32, payload []byte) (*config.Bsid, error) {
 	var innerHeaderIPv4 netip.Addr
 	isInnerHeaderIPv4 := false
 
-	var bsid *config.Bsid
-
-	// find a policy matching criteria
 	for _, p := range h.policy {
 		// catch-all policy (should be last policy in list)
 		if p.Match == nil {
-			bsid = &p.Bsid
-			break
+			return &p.Bsid, nil
 		}
 
 		// otherwise, teid is mandatory
@@ -173,16 +155,13 @@ func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error)
 				// teid doesn't match
 				continue
 			}
-			if p.Match.InnerHeaderIPv4SrcPrefix != nil {
+			if p.Match.InnerHeaderIPv4SrcPrefix != nil && payload != nil {
 				// teid matches, and we need to check the prefix
 				if !isInnerHeaderIPv4 {
 					// init innerHeaderIPv4
-					inner, ok := payload.(*layers.IPv4)
-					if !ok {
-						return nil, fmt.Errorf("Payload is not IPv4")
-					}
-					if inner.Version != 4 {
-						return nil, fmt.Errorf("Payload is IPv%d instead of IPv4", inner.Version)
+					inner, err := pqt.InnerIPv4()
+					if err != nil {
+						return nil, err
 					}
 					innerHeaderIPv4 = netip.AddrFrom4([4]byte{inner.SrcIP[0], inner.SrcIP[1], inner.SrcIP[2], inner.SrcIP[3]})
 					isInnerHeaderIPv4 = true
@@ -193,21 +172,30 @@ func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error)
 				}
 				if prefix.Contains(innerHeaderIPv4) {
 					// prefix matches
-					bsid = &p.Bsid
-					break
+					return &p.Bsid, nil
 				}
 				// prefix doesn't match: continue
 			} else {
 				// teid matches, and no prefix to check
-				bsid = &p.Bsid
-				break
+				return &p.Bsid, nil
 			}
 		}
 	}
-	if bsid == nil {
-		return nil, fmt.Errorf("Could not found policy matching criteria")
-	}
+	return nil, errNoPolicy
+}
 
+// Encapsulate the payload into a new IPv6 header with a SRH.
+// When payload is nil, No Next Header is used.
+func (h HeadendGTP4) encapsulate(pqt *Packet, argsMobSession *encoding.ArgsMobSession, bsid *config.Bsid, payload []byte) ([]byte, error) {
+	ipv4, err := pqt.IPv4()
+	if err != nil {
+		return nil, err
+	}
+	udp, err := pqt.UDP()
+	if err != nil {
+		return nil, err
+	}
+	ipv4DA := ipv4.DstIP.To4()
 	if bsid.BsidPrefix == nil {
 		return nil, fmt.Errorf("Error with policy found")
 	}
@@ -218,14 +206,10 @@ func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error)
 	ipv6DA := encoding.NewMGTP4IPv6Dst(dstPrefix, [4]byte(ipv4DA), argsMobSession)
 
 	// S04. Copy IPv4 SA to form IPv6 SA B'
-	ipv4SA := pqt.NetworkLayer().NetworkFlow().Src().Raw()
-	udpSP := pqt.TransportLayer().TransportFlow().Src().Raw()
+	ipv4SA := ipv4.SrcIP.To4()
 
 	srcPrefix := h.sourceAddressPrefix
-	ipv6SA := encoding.NewMGTP4IPv6Src(srcPrefix, [4]byte(ipv4SA), binary.BigEndian.Uint16(udpSP))
-	if err != nil {
-		return nil, fmt.Errorf("Error during creation of IPv6 SA: %s", err)
-	}
+	ipv6SA := encoding.NewMGTP4IPv6Src(srcPrefix, [4]byte(ipv4SA), uint16(udp.SrcPort))
 
 	src, err := ipv6SA.Marshal()
 	if err != nil {
@@ -249,36 +233,19 @@ func (h HeadendGTP4) Handle(ctx context.Context, packet []byte) ([]byte, error)
 		NextHeader: layers.IPProtocolIPv6Routing, // IPv6-Route
 		HopLimit:   h.HopLimit(),
 		// TODO: Generate a FlowLabel with hash(IPv6SA + IPv6DA + policy)
-		TrafficClass: qfi << 2,
+		TrafficClass: argsMobSession.QFI() << 2,
 	}
-	segList := append([]net.IP{seg0}, bsid.ReverseSegmentsList()...)
-	srh := &gopacket_srv6.IPv6Routing{
-		RoutingType: 4,
-		// the first item on segments list is the next endpoint
-		SegmentsLeft:     uint8(len(segList) - 1), // pointer to next segment
-		SourceRoutingIPs: segList,
-		Tag:              0, // not used
-		Flags:            0, // no flag defined
-		GopacketIpv6ExtensionBase: gopacket_srv6.GopacketIpv6ExtensionBase{
-			NextHeader: layers.IPProtocolIPv4,
-		},
+	nextHeader := layers.IPProtocolIPv4
+	if payload == nil {
+		nextHeader = layers.IPProtocolNoNextHeader
 	}
+	segList := append([]net.IP{seg0}, bsid.ReverseSegmentsList()...)
+	srh := NewSRH(segList, nextHeader)
 
 	// S05. Encapsulate the packet into a new IPv6 header
-	buf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buf,
-		gopacket.SerializeOptions{
-			FixLengths:       true,
-			ComputeChecksums: true,
-		},
-		ipheader,
-		srh,
-		gopacket.Payload(payload.LayerContents()),
-		gopacket.Payload(payload.LayerPayload()),
-	); err != nil {
-		return nil, err
-	} else {
-		// S07. Forward along the shortest path to B
-		return buf.Bytes(), nil
+	// S07. Forward along the shortest path to B
+	if payload == nil {
+		return pqt.Serialize(ipheader, srh)
 	}
+	return pqt.Serialize(ipheader, srh, gopacket.Payload(payload))
 }
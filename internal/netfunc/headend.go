@@ -9,11 +9,12 @@ import (
 	"fmt"
 	"net/netip"
 
+	app_api "github.com/nextmn/srv6/internal/app/api"
 	"github.com/nextmn/srv6/internal/config"
 	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
 )
 
-func NewHeadend(he *config.Headend, ttl uint8, hopLimit uint8) (netfunc_api.NetFunc, error) {
+func NewHeadend(he *config.Headend, ttl uint8, hopLimit uint8, dataplane *config.Dataplane, setup_registry app_api.Registry) (netfunc_api.NetFunc, error) {
 	p, err := netip.ParsePrefix(he.To)
 	if err != nil {
 		return nil, err
@@ -32,7 +33,9 @@ func NewHeadend(he *config.Headend, ttl uint8, hopLimit uint8) (netfunc_api.NetF
 			return nil, err
 		}
 
-		return NewNetFunc(NewHeadendGTP4(p, srcAddressPrefix, policy, ttl, hopLimit)), nil
+		// path manager is optional
+		pm, _ := setup_registry.PathManager()
+		return NewNetFunc(NewHeadendGTP4(p, srcAddressPrefix, policy, ttl, hopLimit, pm), dataplane), nil
 	default:
 		return nil, fmt.Errorf("Unsupported headend behavior (%s) with this provider (%s)", he.Behavior, he.Provider)
 	}
@@ -7,7 +7,16 @@ package netfunc
 
 import (
 	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/nextmn/srv6/internal/config"
 	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
 
 	"github.com/nextmn/srv6/internal/iproute2"
@@ -15,40 +24,257 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Maximum size of a GSO super-packet
+const maxSuperPacketSize = 65535
+
+// Packets handled by a worker before writing its coalesced packets
+const maxBatchSize = 64
+
+// Delays between reads after transient errors
+const (
+	minReadBackoff = 1 * time.Millisecond
+	maxReadBackoff = 1 * time.Second
+)
+
+// A packet read from the TUN interface, waiting for a worker
+type job struct {
+	buf *[]byte
+	n   int
+}
+
 type NetFunc struct {
-	handler netfunc_api.Handler
+	handler   Handler
+	workers   int
+	queueSize int
+	queues    []chan job
+	buffers   sync.Pool
+
+	tunQueues atomic.Int64
+
+	// counters
+	received     atomic.Uint64
+	sent         atomic.Uint64
+	queueDropped atomic.Uint64
+	dropped      atomic.Uint64
 }
 
-func NewNetFunc(handler netfunc_api.Handler) *NetFunc {
+func NewNetFunc(handler Handler, dataplane *config.Dataplane) *NetFunc {
+	workers := dataplane.WorkersOrDefault()
+	queueSize := dataplane.QueueSizeOrDefault()
+	queues := make([]chan job, workers)
+	for i := range queues {
+		queues[i] = make(chan job, queueSize)
+	}
 	return &NetFunc{
-		handler: handler,
+		handler:   handler,
+		workers:   workers,
+		queueSize: queueSize,
+		queues:    queues,
 	}
 }
 
 // Run the NetFunc goroutine
-func (n *NetFunc) Run(ctx context.Context, tunIface *iproute2.TunIface) error {
+func (n *NetFunc) Run(ctx context.Context, tunIface netfunc_api.Iface) error {
 	// Get MTU
 	mtu, err := tunIface.MTU()
 	if err != nil {
 		return err
 	}
+	n.buffers.New = func() any {
+		b := make([]byte, mtu)
+		return &b
+	}
+	n.tunQueues.Store(int64(tunIface.Queues()))
+	for i, q := range n.queues {
+		// spread writes across queues of the TUN interface
+		go n.worker(ctx, tunIface, i%tunIface.Queues(), q)
+	}
+	reader := n.reader
+	if tunIface.Offload() {
+		reader = n.vnetReader
+	}
+	// one reader per queue of the TUN interface
+	for i := 1; i < tunIface.Queues(); i++ {
+		go reader(ctx, tunIface, i)
+	}
+	reader(ctx, tunIface, 0)
+	return nil
+}
+
+// Send a packet to a worker
+func (n *NetFunc) dispatch(buf *[]byte, nb int) {
+	n.received.Add(1)
+	// packets of a same flow are sent to the same worker to avoid reordering
+	q := n.queues[flowHash((*buf)[:nb])%uint32(n.workers)]
+	select {
+	case q <- job{buf: buf, n: nb}:
+	default:
+		n.queueDropped.Add(1)
+		n.buffers.Put(buf)
+	}
+}
+
+// Handle an error of a reader. Returns true if the reader must stop:
+// the queue has been closed (e.g. the interface has been deleted), or ctx is done.
+// After other errors, the reader waits for backoff, doubled on each consecutive error.
+func readFailed(ctx context.Context, err error, tunQueue int, backoff *time.Duration) bool {
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, syscall.EBADF) {
+		logrus.WithError(err).WithFields(logrus.Fields{"queue": tunQueue}).Debug("Queue closed, reader stopped")
+		return true
+	}
+	*backoff = min(max(2**backoff, minReadBackoff), maxReadBackoff)
+	logrus.WithError(err).WithFields(logrus.Fields{"queue": tunQueue, "backoff": *backoff}).Debug("Could not read packet")
+	t := time.NewTimer(*backoff)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Read packets from a queue of the TUN interface, and dispatch them to workers
+func (n *NetFunc) reader(ctx context.Context, tunIface netfunc_api.Iface, tunQueue int) {
+	var backoff time.Duration
 	// Read packets while no stop signal
 	for {
 		select {
 		case <-ctx.Done():
 			// Stop signal received
-			return nil
+			return
 		default:
-			packet := make([]byte, mtu)
-			if nb, err := tunIface.Read(packet); err == nil {
-				go func(ctx context.Context, iface *iproute2.TunIface) {
-					if out, err := n.handler.Handle(ctx, packet[:nb]); err == nil {
-						iface.Write(out)
-					} else {
-						logrus.WithError(err).Debug("Packet dropped")
-					}
-				}(ctx, tunIface)
+			buf := n.buffers.Get().(*[]byte)
+			nb, err := tunIface.ReadQueue(tunQueue, *buf)
+			if err != nil {
+				n.buffers.Put(buf)
+				if readFailed(ctx, err, tunQueue, &backoff) {
+					return
+				}
+				continue
 			}
+			backoff = 0
+			n.dispatch(buf, nb)
 		}
 	}
 }
+
+// Read packets from a queue of a TUN interface with offloads enabled.
+// Super-packets are segmented before being dispatched to workers, so
+// handlers (and writes) only see packets smaller than the MTU.
+func (n *NetFunc) vnetReader(ctx context.Context, tunIface netfunc_api.Iface, tunQueue int) {
+	superPacket := make([]byte, maxSuperPacketSize)
+	var hdr iproute2.VirtioNetHdr
+	var cur *[]byte
+	get := func() []byte {
+		cur = n.buffers.Get().(*[]byte)
+		return *cur
+	}
+	put := func(seg []byte) {
+		n.dispatch(cur, len(seg))
+		cur = nil
+	}
+	var backoff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			// Stop signal received
+			return
+		default:
+			nb, err := tunIface.ReadQueueVnet(tunQueue, &hdr, superPacket)
+			if err != nil {
+				if readFailed(ctx, err, tunQueue, &backoff) {
+					return
+				}
+				continue
+			}
+			backoff = 0
+			if err := segmentVnet(&hdr, superPacket[:nb], get, put); err != nil {
+				n.dropped.Add(1)
+				logrus.WithError(err).Debug("Packet dropped")
+			}
+			if cur != nil {
+				// segmentation failed after get
+				n.buffers.Put(cur)
+				cur = nil
+			}
+		}
+	}
+}
+
+// Process packets of a queue.
+// With UDP segmentation offload, packets already waiting in the queue are handled
+// before writing, and UDP packets of a same flow are written as a single super-packet.
+func (n *NetFunc) worker(ctx context.Context, iface netfunc_api.Iface, tunQueue int, q chan job) {
+	// decoding layers and serialization buffer are reused for each packet of this worker
+	pqt := NewPacket()
+	write := func(b []byte) {
+		if _, err := iface.WriteQueue(tunQueue, b); err == nil {
+			n.sent.Add(1)
+		}
+	}
+	flush := func() {}
+	if iface.OffloadUDP() {
+		c := newUDPCoalescer(
+			func(b []byte) (int, error) { return iface.WriteQueue(tunQueue, b) },
+			func(hdr *iproute2.VirtioNetHdr, b []byte) (int, error) { return iface.WriteQueueVnet(tunQueue, hdr, b) },
+			func(packets int) { n.sent.Add(uint64(packets)) },
+		)
+		write, flush = c.push, c.flush
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-q:
+			n.handle(ctx, pqt, j, write)
+		batch:
+			for i := 1; i < maxBatchSize; i++ {
+				select {
+				case j := <-q:
+					n.handle(ctx, pqt, j, write)
+				default:
+					break batch
+				}
+			}
+			flush()
+		}
+	}
+}
+
+// Handle a packet, and write its output
+func (n *NetFunc) handle(ctx context.Context, pqt *Packet, j job, write func(b []byte)) {
+	defer n.buffers.Put(j.buf)
+	pqt.Reset((*j.buf)[:j.n])
+	out, err := n.handler.Handle(ctx, pqt)
+	if err != nil {
+		n.dropped.Add(1)
+		logrus.WithError(err).Debug("Packet dropped")
+		return
+	}
+	if len(out) > 0 {
+		// some packets are consumed without reply
+		write(out)
+	}
+	for _, extra := range pqt.Extra() {
+		write(extra)
+	}
+}
+
+// Counters of the NetFunc
+func (n *NetFunc) Stats() netfunc_api.Stats {
+	depth := 0
+	for _, q := range n.queues {
+		depth += len(q)
+	}
+	return netfunc_api.Stats{
+		TunQueues:    int(n.tunQueues.Load()),
+		Workers:      n.workers,
+		QueueSize:    n.queueSize,
+		QueueDepth:   depth,
+		Received:     n.received.Load(),
+		Sent:         n.sent.Load(),
+		QueueDropped: n.queueDropped.Load(),
+		Dropped:      n.dropped.Load(),
+	}
+}
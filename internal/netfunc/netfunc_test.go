@@ -0,0 +1,144 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/iproute2"
+)
+
+func TestReadFailed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		stop bool
+	}{
+		{"closed file", &os.PathError{Op: "read", Path: "/dev/net/tun", Err: os.ErrClosed}, true},
+		{"closed socket", &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}, true},
+		{"EOF", io.EOF, true},
+		{"bad file descriptor", fmt.Errorf("read: %w", syscall.EBADF), true},
+		{"transient", syscall.ENOBUFS, false},
+		{"other", errors.New("Packet too short for virtio_net_hdr"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var backoff time.Duration
+			if stop := readFailed(context.Background(), tt.err, 0, &backoff); stop != tt.stop {
+				t.Errorf("got stop=%v, want %v", stop, tt.stop)
+			}
+		})
+	}
+}
+
+func TestReadFailedBackoff(t *testing.T) {
+	var backoff time.Duration
+	want := minReadBackoff
+	for i := 0; i < 3; i++ {
+		readFailed(context.Background(), syscall.ENOBUFS, 0, &backoff)
+		if backoff != want {
+			t.Fatalf("error %d: got backoff %s, want %s", i, backoff, want)
+		}
+		want *= 2
+	}
+	backoff = maxReadBackoff
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !readFailed(ctx, syscall.ENOBUFS, 0, &backoff) {
+		t.Error("reader not stopped when ctx is done")
+	}
+	if backoff != maxReadBackoff {
+		t.Errorf("got backoff %s, want %s", backoff, maxReadBackoff)
+	}
+}
+
+// Handler returning packets unchanged
+type echoHandler struct{}
+
+func (echoHandler) Handle(ctx context.Context, pqt *Packet) ([]byte, error) {
+	return pqt.data, nil
+}
+
+// Iface recording writes
+type fakeIface struct {
+	offloadUDP bool
+	mu         sync.Mutex
+	writes     int
+	vnetWrites int
+}
+
+func (f *fakeIface) MTU() (int64, error) { return 1500, nil }
+func (f *fakeIface) Queues() int         { return 1 }
+func (f *fakeIface) Offload() bool       { return f.offloadUDP }
+func (f *fakeIface) OffloadUDP() bool    { return f.offloadUDP }
+func (f *fakeIface) ReadQueue(queue int, b []byte) (int, error) {
+	return 0, os.ErrClosed
+}
+func (f *fakeIface) ReadQueueVnet(queue int, hdr *iproute2.VirtioNetHdr, b []byte) (int, error) {
+	return 0, os.ErrClosed
+}
+func (f *fakeIface) WriteQueue(queue int, b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes++
+	return len(b), nil
+}
+func (f *fakeIface) WriteQueueVnet(queue int, hdr *iproute2.VirtioNetHdr, b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.vnetWrites++
+	return len(b), nil
+}
+
+// Packets waiting in the queue of a worker are coalesced with USO
+func TestWorkerBatch(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		offloadUDP bool
+		writes     int
+		vnetWrites int
+	}{
+		{"without USO", false, 3, 0},
+		{"with USO", true, 0, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			workers := 1
+			n := NewNetFunc(echoHandler{}, &config.Dataplane{Workers: &workers})
+			n.buffers.New = func() any {
+				b := make([]byte, 1500)
+				return &b
+			}
+			for _, p := range groFlow(3, 1000) {
+				buf := n.buffers.Get().(*[]byte)
+				n.dispatch(buf, copy(*buf, p.bytes(t)))
+			}
+			iface := &fakeIface{offloadUDP: tt.offloadUDP}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go n.worker(ctx, iface, 0, n.queues[0])
+			deadline := time.Now().Add(time.Second)
+			for n.Stats().Sent < 3 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			iface.mu.Lock()
+			defer iface.mu.Unlock()
+			if n.Stats().Sent != 3 || iface.writes != tt.writes || iface.vnetWrites != tt.vnetWrites {
+				t.Errorf("got %d packets sent with %d writes and %d super-packets, want 3 with %d and %d",
+					n.Stats().Sent, iface.writes, iface.vnetWrites, tt.writes, tt.vnetWrites)
+			}
+		})
+	}
+}
@@ -7,66 +7,191 @@ package netfunc
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"net/netip"
 
 	"github.com/nextmn/srv6/internal/constants"
 	db_api "github.com/nextmn/srv6/internal/database/api"
 
-	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
-
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// Packet being handled by a worker.
+// Layers and buffers are preallocated and reused for each packet:
+// a Packet must not be shared between goroutines, and slices
+// returned by its methods are only valid until the next packet.
 type Packet struct {
-	gopacket.Packet
+	data           []byte
 	firstLayerType gopacket.LayerType
+	decoded        []gopacket.LayerType
+
+	// IPv4 / UDP / GTP-U
+	parser4 *gopacket.DecodingLayerParser
+	ipv4    layers.IPv4
+	udp     layers.UDP
+	gtpu    gtpuHeader
+
+	// IPv6 / SRH
+	parser6 *gopacket.DecodingLayerParser
+	ipv6    layers.IPv6
+	srh     SRH
+
+	// T-PDU of a GTP-U packet, decoded on demand
+	inner        layers.IPv4
+	innerDecoded bool
+
+	buf gopacket.SerializeBuffer
+
+	// packets to send after the packet returned by the handler
+	extra [][]byte
+}
+
+// Create a new Packet, to be reused by a single worker
+func NewPacket() *Packet {
+	p := &Packet{
+		decoded: make([]gopacket.LayerType, 0, 4),
+		buf:     zeroingBuffer{gopacket.NewSerializeBuffer()},
+	}
+	p.parser4 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &p.ipv4, &p.udp, &p.gtpu)
+	p.parser4.IgnoreUnsupported = true
+	p.parser6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &p.ipv6, &p.srh)
+	p.parser6.IgnoreUnsupported = true
+	return p
+}
+
+// Set the raw packet to be decoded
+func (p *Packet) Reset(data []byte) {
+	p.data = data
+	p.firstLayerType = gopacket.LayerTypeZero
+	p.decoded = p.decoded[:0]
+	p.innerDecoded = false
+	p.extra = p.extra[:0]
+}
+
+// Send a copy of out after the packet returned by the handler,
+// for handlers producing several packets (e.g. End Markers on each path)
+func (p *Packet) AddExtra(out []byte) {
+	p.extra = append(p.extra, append([]byte(nil), out...))
+}
+
+// Packets added with AddExtra since the last Reset
+func (p *Packet) Extra() [][]byte {
+	return p.extra
+}
+
+// Raw packet
+func (p *Packet) Data() []byte {
+	return p.data
 }
 
 // (network) LayerType for this packet (LayerTypeIPv4 or LayerTypeIPv6)
-func networkLayerType(packet []byte) (*gopacket.LayerType, error) {
+func networkLayerType(packet []byte) (gopacket.LayerType, error) {
+	if len(packet) == 0 {
+		return gopacket.LayerTypeZero, fmt.Errorf("Malformed packet")
+	}
 	version := (packet[0] >> 4) & 0x0F
 	switch version {
 	case 4:
-		return &layers.LayerTypeIPv4, nil
+		return layers.LayerTypeIPv4, nil
 	case 6:
-		return &layers.LayerTypeIPv6, nil
+		return layers.LayerTypeIPv6, nil
 	default:
-		return nil, fmt.Errorf("Malformed packet")
+		return gopacket.LayerTypeZero, fmt.Errorf("Malformed packet")
+	}
+}
 
+// Decode the packet as IPv6 (with optional SRH)
+func (p *Packet) DecodeIPv6() error {
+	if layerType, err := networkLayerType(p.data); err != nil {
+		return err
+	} else if layerType != layers.LayerTypeIPv6 {
+		return fmt.Errorf("This handler can only receive IPv6 packets")
+	}
+	if err := p.parser6.DecodeLayers(p.data, &p.decoded); err != nil {
+		return err
 	}
+	p.firstLayerType = layers.LayerTypeIPv6
+	return nil
 }
 
-func NewIPv6Packet(packet []byte) (*Packet, error) {
-	if layerType, err := networkLayerType(packet); err != nil {
-		return nil, err
-	} else if *layerType != layers.LayerTypeIPv6 {
-		return nil, fmt.Errorf("This handler can only receive IPv6 packets")
+// Decode the packet as IPv4 (with optional UDP/GTP-U)
+func (p *Packet) DecodeIPv4() error {
+	if layerType, err := networkLayerType(p.data); err != nil {
+		return err
+	} else if layerType != layers.LayerTypeIPv4 {
+		return fmt.Errorf("This handler can only receive IPv4 packets")
 	}
-	return &Packet{
-		Packet:         gopacket.NewPacket(packet, layers.LayerTypeIPv6, gopacket.Default),
-		firstLayerType: layers.LayerTypeIPv6,
-	}, nil
+	// GTP-U extension headers are appended by DecodeFromBytes
+	p.gtpu.GTPExtensionHeaders = p.gtpu.GTPExtensionHeaders[:0]
+	if err := p.parser4.DecodeLayers(p.data, &p.decoded); err != nil {
+		return err
+	}
+	p.firstLayerType = layers.LayerTypeIPv4
+	return nil
 }
 
-func NewIPv4Packet(packet []byte) (*Packet, error) {
-	if layerType, err := networkLayerType(packet); err != nil {
-		return nil, err
-	} else if *layerType != layers.LayerTypeIPv4 {
-		return nil, fmt.Errorf("This handler can only receive IPv4 packets")
+// Returns true if a layer of this type has been decoded
+func (p *Packet) hasLayer(t gopacket.LayerType) bool {
+	for _, d := range p.decoded {
+		if d == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Outer IPv4 header
+func (p *Packet) IPv4() (*layers.IPv4, error) {
+	if p.firstLayerType != layers.LayerTypeIPv4 {
+		return nil, fmt.Errorf("Not an IPv4 packet")
+	}
+	return &p.ipv4, nil
+}
+
+// Outer IPv6 header
+func (p *Packet) IPv6() (*layers.IPv6, error) {
+	if p.firstLayerType != layers.LayerTypeIPv6 {
+		return nil, fmt.Errorf("Not an IPv6 packet")
+	}
+	return &p.ipv6, nil
+}
+
+// UDP header following the outer IPv4 header
+func (p *Packet) UDP() (*layers.UDP, error) {
+	if p.firstLayerType != layers.LayerTypeIPv4 || !p.hasLayer(layers.LayerTypeUDP) {
+		return nil, fmt.Errorf("No UDP layer")
+	}
+	return &p.udp, nil
+}
+
+// Segment Routing Header, or nil if the packet has no SRH
+func (p *Packet) SRH() *SRH {
+	if p.firstLayerType != layers.LayerTypeIPv6 || !p.hasLayer(p.srh.LayerType()) {
+		return nil
+	}
+	return &p.srh
+}
+
+// Source and destination addresses of the first network layer
+func (p *Packet) addrs() (src []byte, dst []byte, err error) {
+	switch p.firstLayerType {
+	case layers.LayerTypeIPv4:
+		return p.ipv4.SrcIP, p.ipv4.DstIP, nil
+	case layers.LayerTypeIPv6:
+		return p.ipv6.SrcIP, p.ipv6.DstIP, nil
+	default:
+		return nil, nil, fmt.Errorf("Packet not decoded")
 	}
-	return &Packet{
-		Packet:         gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default),
-		firstLayerType: layers.LayerTypeIPv4,
-	}, nil
 }
 
 // Return the packet IP destination address (first network layer) if it is in the prefix range
 func (p *Packet) CheckDAInPrefixRange(prefix netip.Prefix) (netip.Addr, error) {
 	// get destination address
-	dstSlice := p.NetworkLayer().NetworkFlow().Dst().Raw()
+	_, dstSlice, err := p.addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
 	dst, ok := netip.AddrFromSlice(dstSlice)
 	if !ok {
 		return netip.Addr{}, fmt.Errorf("Malformed packet")
@@ -79,8 +204,11 @@ func (p *Packet) CheckDAInPrefixRange(prefix netip.Prefix) (netip.Addr, error) {
 }
 
 func (p *Packet) GetSrcAddr() (netip.Addr, error) {
-	// get destination address
-	srcSlice := p.NetworkLayer().NetworkFlow().Src().Raw()
+	// get source address
+	srcSlice, _, err := p.addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
 	src, ok := netip.AddrFromSlice(srcSlice)
 	if !ok {
 		return netip.Addr{}, fmt.Errorf("Malformed packet")
@@ -89,41 +217,158 @@ func (p *Packet) GetSrcAddr() (netip.Addr, error) {
 }
 
 // Returns the DownlinkAction related to this packet
-func (p *Packet) DownlinkAction(ctx context.Context, db db_api.Downlink) (n4tosrv6.Action, error) {
-	dstSlice := p.NetworkLayer().NetworkFlow().Dst().Raw()
+func (p *Packet) DownlinkAction(ctx context.Context, db db_api.Downlink) (db_api.Action, error) {
+	_, dstSlice, err := p.addrs()
+	if err != nil {
+		return db_api.Action{}, err
+	}
 	dst, ok := netip.AddrFromSlice(dstSlice)
 	if !ok {
-		return n4tosrv6.Action{}, fmt.Errorf("Malformed packet")
+		return db_api.Action{}, fmt.Errorf("Malformed packet")
 	}
 	return db.GetDownlinkAction(ctx, dst)
 }
 
-// Returns the first gopacket.Layer after IPv6 header / extension headers
-func (p *Packet) PopIPv6Headers() (gopacket.Layer, error) {
+// Next header of the last IPv6 header / extension header
+func (p *Packet) ipv6NextHeader() (layers.IPProtocol, []byte, error) {
 	if p.firstLayerType != layers.LayerTypeIPv6 {
-		return nil, fmt.Errorf("Not an IPv6 packet")
+		return 0, nil, fmt.Errorf("Not an IPv6 packet")
 	}
-	for _, l := range p.Layers()[1:] { // first layer is IPv6 header, we skip it
-		if !layers.LayerClassIPv6Extension.Contains(l.LayerType()) {
-			return l, nil
-		}
+	if srh := p.SRH(); srh != nil {
+		return srh.NextHeader, srh.LayerPayload(), nil
+	}
+	return p.ipv6.NextHeader, p.ipv6.LayerPayload(), nil
+}
+
+// Returns what follows the IPv6 header / extension headers
+func (p *Packet) PopIPv6Headers() ([]byte, error) {
+	nh, payload, err := p.ipv6NextHeader()
+	if err != nil {
+		return nil, err
+	}
+	if layers.LayerClassIPv6Extension.Contains(nh.LayerType()) {
+		return nil, fmt.Errorf("Unsupported IPv6 extension header: %s", nh)
+	}
+	if nh == layers.IPProtocolNoNextHeader || len(payload) == 0 {
+		return nil, fmt.Errorf("Nothing else than IPv6 Headers in the packet")
 	}
-	return nil, fmt.Errorf("Nothing else than IPv6 Headers in the packet")
+	return payload, nil
 }
 
-// Returns the first gopacket.Layer after IPv4/UDP/GTPU headers
-func (p *Packet) PopGTP4Headers() (gopacket.Layer, error) {
+// Returns true if the last IPv6 header / extension header has No Next Header (59)
+func (p *Packet) IPv6NoNextHeader() bool {
+	nh, _, err := p.ipv6NextHeader()
+	return err == nil && nh == layers.IPProtocolNoNextHeader
+}
+
+// Returns the GTP-U header of an IPv4/UDP/GTPU packet
+func (p *Packet) GTP4Header() (*layers.GTPv1U, error) {
 	if p.firstLayerType != layers.LayerTypeIPv4 {
 		return nil, fmt.Errorf("Not an IPv4 packet")
 	}
-	if len(p.Layers()) < 4 {
-		return nil, fmt.Errorf("Not a GTP4 packet: not enough layers")
-	}
-	if p.Layers()[1].LayerType() != layers.LayerTypeUDP {
+	if !p.hasLayer(layers.LayerTypeUDP) {
 		return nil, fmt.Errorf("No UDP layer")
 	}
-	if binary.BigEndian.Uint16(p.TransportLayer().TransportFlow().Dst().Raw()) != constants.GTPU_PORT_INT {
+	if p.udp.DstPort != constants.GTPU_PORT_INT {
 		return nil, fmt.Errorf("No GTP-U layer")
 	}
-	return p.Layers()[3], nil
+	if !p.hasLayer(layers.LayerTypeGTPv1U) {
+		return nil, fmt.Errorf("Could not parse GTPU layer")
+	}
+	return &p.gtpu.GTPv1U, nil
+}
+
+// Returns the T-PDU following IPv4/UDP/GTPU headers
+func (p *Packet) PopGTP4Headers() ([]byte, error) {
+	if _, err := p.GTP4Header(); err != nil {
+		return nil, err
+	}
+	if len(p.gtpu.LayerPayload()) == 0 {
+		return nil, fmt.Errorf("Not a GTP4 packet: no T-PDU")
+	}
+	return p.gtpu.LayerPayload(), nil
+}
+
+// Returns the IPv4 header of the T-PDU
+func (p *Packet) InnerIPv4() (*layers.IPv4, error) {
+	if p.innerDecoded {
+		return &p.inner, nil
+	}
+	payload, err := p.PopGTP4Headers()
+	if err != nil {
+		return nil, err
+	}
+	if version := payload[0] >> 4; version != 4 {
+		return nil, fmt.Errorf("Payload is IPv%d instead of IPv4", version)
+	}
+	if err := p.inner.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, fmt.Errorf("Payload is not IPv4: %w", err)
+	}
+	p.innerDecoded = true
+	return &p.inner, nil
+}
+
+// Returns the source and destination addresses of the T-PDU (IPv4 or IPv6),
+// and the Next Header to be used to encapsulate it
+func (p *Packet) InnerAddrs() (src netip.Addr, dst netip.Addr, nh layers.IPProtocol, err error) {
+	payload, err := p.PopGTP4Headers()
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, 0, err
+	}
+	switch version := payload[0] >> 4; version {
+	case 4:
+		inner, err := p.InnerIPv4()
+		if err != nil {
+			return netip.Addr{}, netip.Addr{}, 0, err
+		}
+		return netip.AddrFrom4([4]byte(inner.SrcIP.To4())), netip.AddrFrom4([4]byte(inner.DstIP.To4())), layers.IPProtocolIPv4, nil
+	case 6:
+		// addresses are at a fixed offset of the IPv6 header
+		if len(payload) < 40 {
+			return netip.Addr{}, netip.Addr{}, 0, fmt.Errorf("Payload is not IPv6: too short")
+		}
+		return netip.AddrFrom16([16]byte(payload[8:24])), netip.AddrFrom16([16]byte(payload[24:40])), layers.IPProtocolIPv6, nil
+	default:
+		return netip.Addr{}, netip.Addr{}, 0, fmt.Errorf("Payload is IPv%d instead of IPv4 or IPv6", version)
+	}
+}
+
+// Serialize layers into the buffer of this Packet.
+// The returned slice is only valid until the next call.
+func (p *Packet) Serialize(l ...gopacket.SerializableLayer) ([]byte, error) {
+	if err := gopacket.SerializeLayers(p.buf,
+		gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+		l...,
+	); err != nil {
+		return nil, err
+	}
+	return p.buf.Bytes(), nil
+}
+
+// GTP-U header, decoding stops after it:
+// the T-PDU must not overwrite outer layers
+type gtpuHeader struct {
+	layers.GTPv1U
+}
+
+func (g *gtpuHeader) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+// SerializeBuffer clearing prepended bytes:
+// some layers do not write every byte of their header
+type zeroingBuffer struct {
+	gopacket.SerializeBuffer
+}
+
+func (b zeroingBuffer) PrependBytes(num int) ([]byte, error) {
+	bytes, err := b.SerializeBuffer.PrependBytes(num)
+	if err != nil {
+		return nil, err
+	}
+	clear(bytes)
+	return bytes, nil
 }
@@ -0,0 +1,212 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testSegments = []net.IP{
+		net.ParseIP("fc00:3::1"),
+		net.ParseIP("fc00:2::1"),
+		net.ParseIP("fc00:1::1"),
+	}
+	testPayload = make([]byte, 1200)
+)
+
+func serialize(t testing.TB, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// IPv4 / UDP / GTP-U / IPv4 / payload
+func gtp4Packet(t testing.TB) []byte {
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("10.0.0.1").To4(),
+		DstIP:    net.ParseIP("10.0.0.2").To4(),
+	}
+	udp := &layers.UDP{SrcPort: 2152, DstPort: 2152}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	gtpu := &layers.GTPv1U{Version: 1, ProtocolType: 1, MessageType: 255, TEID: 0x1234}
+	inner := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("10.45.0.1").To4(),
+		DstIP:    net.ParseIP("10.1.0.1").To4(),
+	}
+	return serialize(t, ipv4, udp, gtpu, inner, gopacket.Payload(testPayload))
+}
+
+// IPv6 / SRH / payload
+func srv6Packet(t testing.TB) []byte {
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Routing,
+		SrcIP:      net.ParseIP("fc00:4::1"),
+		DstIP:      testSegments[len(testSegments)-1],
+	}
+	return serialize(t, ipv6, NewSRH(testSegments, layers.IPProtocolIPv4), gopacket.Payload(testPayload))
+}
+
+func TestSRHRoundTrip(t *testing.T) {
+	p := NewPacket()
+	p.Reset(srv6Packet(t))
+	if err := p.DecodeIPv6(); err != nil {
+		t.Fatal(err)
+	}
+	srh := p.SRH()
+	if srh == nil {
+		t.Fatal("SRH not decoded")
+	}
+	if srh.NextHeader != layers.IPProtocolIPv4 || srh.SegmentsLeft != 2 || srh.LastEntry != 2 {
+		t.Errorf("unexpected SRH header: next header %s, segments left %d, last entry %d", srh.NextHeader, srh.SegmentsLeft, srh.LastEntry)
+	}
+	if len(srh.SourceRoutingIPs) != len(testSegments) {
+		t.Fatalf("got %d segments, want %d", len(srh.SourceRoutingIPs), len(testSegments))
+	}
+	for i, seg := range testSegments {
+		if !srh.SourceRoutingIPs[i].Equal(seg) {
+			t.Errorf("segment %d: got %s, want %s", i, srh.SourceRoutingIPs[i], seg)
+		}
+	}
+	payload, err := p.PopIPv6Headers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != len(testPayload) {
+		t.Errorf("got a payload of %d bytes, want %d", len(payload), len(testPayload))
+	}
+}
+
+func TestDecodeGTP4(t *testing.T) {
+	p := NewPacket()
+	p.Reset(gtp4Packet(t))
+	if err := p.DecodeIPv4(); err != nil {
+		t.Fatal(err)
+	}
+	gtpu, err := p.GTP4Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gtpu.TEID != 0x1234 {
+		t.Errorf("got TEID %#x, want 0x1234", gtpu.TEID)
+	}
+	src, dst, nh, err := p.InnerAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != "10.45.0.1" || dst.String() != "10.1.0.1" || nh != layers.IPProtocolIPv4 {
+		t.Errorf("unexpected inner packet: %s -> %s (%s)", src, dst, nh)
+	}
+}
+
+func BenchmarkDecodeGTP4(b *testing.B) {
+	data := gtp4Packet(b)
+	p := NewPacket()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Reset(data)
+		if err := p.DecodeIPv4(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := p.InnerIPv4(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeGTP4NewPacket(b *testing.B) {
+	data := gtp4Packet(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		if packet.Layer(layers.LayerTypeGTPv1U) == nil {
+			b.Fatal("GTP-U layer not decoded")
+		}
+	}
+}
+
+func BenchmarkDecodeSRv6(b *testing.B) {
+	data := srv6Packet(b)
+	p := NewPacket()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Reset(data)
+		if err := p.DecodeIPv6(); err != nil {
+			b.Fatal(err)
+		}
+		if p.SRH() == nil {
+			b.Fatal("SRH not decoded")
+		}
+	}
+}
+
+func BenchmarkDecodeSRv6NewPacket(b *testing.B) {
+	data := srv6Packet(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+		if packet.NetworkLayer() == nil {
+			b.Fatal("IPv6 layer not decoded")
+		}
+	}
+}
+
+func BenchmarkSerializeSRv6(b *testing.B) {
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Routing,
+		SrcIP:      net.ParseIP("fc00:4::1"),
+		DstIP:      testSegments[len(testSegments)-1],
+	}
+	srh := NewSRH(testSegments, layers.IPProtocolIPv4)
+	p := NewPacket()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Serialize(ipv6, srh, gopacket.Payload(testPayload)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerializeSRv6NewBuffer(b *testing.B) {
+	ipv6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Routing,
+		SrcIP:      net.ParseIP("fc00:4::1"),
+		DstIP:      testSegments[len(testSegments)-1],
+	}
+	srh := NewSRH(testSegments, layers.IPProtocolIPv4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ipv6, srh, gopacket.Payload(testPayload)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
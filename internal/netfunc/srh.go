@@ -0,0 +1,80 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package netfunc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	gopacket_srv6 "github.com/nextmn/gopacket-srv6"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Segment Routing Header (RFC 8754), usable with a gopacket.DecodingLayerParser
+type SRH struct {
+	gopacket_srv6.IPv6Routing
+}
+
+func NewSRH(segments []net.IP, nextHeader layers.IPProtocol) *SRH {
+	return &SRH{
+		IPv6Routing: gopacket_srv6.IPv6Routing{
+			RoutingType: 4,
+			// the first item on segments list is the next endpoint
+			SegmentsLeft:     uint8(len(segments) - 1), // pointer to next segment
+			SourceRoutingIPs: segments,
+			Tag:              0, // not used
+			Flags:            0, // no flag defined
+			GopacketIpv6ExtensionBase: gopacket_srv6.GopacketIpv6ExtensionBase{
+				NextHeader: nextHeader,
+			},
+		},
+	}
+}
+
+func (s *SRH) CanDecode() gopacket.LayerClass {
+	return gopacket_srv6.LayerTypeIPv6Routing
+}
+
+// Decoding stops after the SRH: the inner packet must not overwrite outer layers
+func (s *SRH) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+// Decode the SRH, reusing the segment list of the previous packet
+func (s *SRH) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return fmt.Errorf("IPv6Routing: data too short")
+	}
+	s.NextHeader = layers.IPProtocol(data[0])
+	s.HeaderLength = data[1]
+	s.ActualLength = int(s.HeaderLength)*8 + 8
+	if len(data) < s.ActualLength {
+		df.SetTruncated()
+		return fmt.Errorf("IPv6Routing: length %d less than specified length %d", len(data), s.ActualLength)
+	}
+	s.Contents = data[:s.ActualLength]
+	s.Payload = data[s.ActualLength:]
+	s.RoutingType = data[2]
+	s.SegmentsLeft = data[3]
+	if s.RoutingType != 4 {
+		return fmt.Errorf("IPv6Routing: RoutingType %d not supported", s.RoutingType)
+	}
+	s.LastEntry = data[4]
+	s.Flags = data[5]
+	s.Tag = binary.BigEndian.Uint16(data[6:8])
+	if s.ActualLength-8 < (1+int(s.LastEntry))*16 {
+		return fmt.Errorf("IPv6Routing: data too short")
+	}
+	s.SourceRoutingIPs = s.SourceRoutingIPs[:0]
+	for j := 0; j <= int(s.LastEntry); j++ {
+		s.SourceRoutingIPs = append(s.SourceRoutingIPs, net.IP(data[8+j*16:8+j*16+16]))
+	}
+	return nil
+}
@@ -10,4 +10,6 @@ import "context"
 type Registry interface {
 	Register(task Task)
 	Run(ctx context.Context) error
+	Start(group string, tasks ...Task) error
+	Stop(group string) error
 }
@@ -13,14 +13,14 @@ import (
 	"net/http"
 
 	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/constants"
 	"github.com/nextmn/srv6/internal/ctrl"
 
 	"github.com/nextmn/json-api/jsonapi"
 	"github.com/nextmn/json-api/jsonapi/n4tosrv6"
 )
 
-const UserAgent = "go-github-nextmn-srv6"
-
 // ControllerRegistry registers and unregisters into controller
 type ControllerRegistryTask struct {
 	WithName
@@ -28,10 +28,11 @@ type ControllerRegistryTask struct {
 	ControllerRegistry *ctrl.ControllerRegistry
 	SetupRegistry      app_api.Registry
 	httpClient         http.Client
+	clientConf         *config.ControllerClient
 }
 
 // Create a new ControllerRegistry
-func NewControllerRegistryTask(name string, remoteControlURI jsonapi.ControlURI, backbone n4tosrv6.BackboneIP, locator n4tosrv6.Locator, localControlURI jsonapi.ControlURI, setup_registry app_api.Registry) *ControllerRegistryTask {
+func NewControllerRegistryTask(name string, remoteControlURI jsonapi.ControlURI, backbone n4tosrv6.BackboneIP, locator n4tosrv6.Locator, localControlURI jsonapi.ControlURI, clientConf *config.ControllerClient, setup_registry app_api.Registry) *ControllerRegistryTask {
 	return &ControllerRegistryTask{
 		WithName:  NewName(name),
 		WithState: NewState(),
@@ -44,11 +45,18 @@ func NewControllerRegistryTask(name string, remoteControlURI jsonapi.ControlURI,
 		},
 		SetupRegistry: setup_registry,
 		httpClient:    http.Client{},
+		clientConf:    clientConf,
 	}
 }
 
 // Init
 func (t *ControllerRegistryTask) RunInit(ctx context.Context) error {
+	credentials, err := ctrl.NewControllerCredentials(t.clientConf)
+	if err != nil {
+		return err
+	}
+	t.ControllerRegistry.Credentials = credentials
+	t.httpClient = credentials.Client(0)
 	if t.SetupRegistry != nil {
 		t.SetupRegistry.RegisterControllerRegistry(t.ControllerRegistry)
 	} else {
@@ -68,8 +76,9 @@ func (t *ControllerRegistryTask) RunInit(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	req.Header.Add("User-Agent", UserAgent)
+	req.Header.Add("User-Agent", constants.USER_AGENT)
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	t.ControllerRegistry.Credentials.Authorize(req)
 	resp, err := t.httpClient.Do(req)
 	if err != nil {
 		return err
@@ -107,7 +116,8 @@ func (t *ControllerRegistryTask) RunExit() error {
 	if err != nil {
 		return err
 	}
-	req.Header.Add("User-Agent", UserAgent)
+	req.Header.Add("User-Agent", constants.USER_AGENT)
+	t.ControllerRegistry.Credentials.Authorize(req)
 	resp, err := t.httpClient.Do(req)
 	if err != nil {
 		return err
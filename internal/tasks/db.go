@@ -7,15 +7,16 @@ package tasks
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"os"
-	"path"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
 	"github.com/nextmn/srv6/internal/database"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	events_api "github.com/nextmn/srv6/internal/events/api"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,21 +24,24 @@ import (
 type DBTask struct {
 	WithName
 	WithState
-	db             *database.Database
-	user           string
-	port           string
-	password       string
-	host           string
-	dbname         string
-	unixSocketPath string
-	registry       app_api.Registry
+	conf     *config.Database
+	db       database_api.RuleStore
+	postgres *database.Database
+	bolt     *database.Bolt
+	monitor  *database.Monitor
+	listener *database.Listener
+	conninfo string
+	cancel   context.CancelFunc // stops background tasks: writing activity and counters of rules, health checks
+	done     sync.WaitGroup     // done when background tasks are stopped, and activity and counters of rules written for the last time
+	registry app_api.Registry
 }
 
 // Create a new DBTask
-func NewDBTask(name string, registry app_api.Registry) *DBTask {
+func NewDBTask(name string, conf *config.Database, registry app_api.Registry) *DBTask {
 	return &DBTask{
 		WithName:  NewName(name),
 		WithState: NewState(),
+		conf:      conf,
 		registry:  registry,
 	}
 }
@@ -45,70 +49,78 @@ func NewDBTask(name string, registry app_api.Registry) *DBTask {
 // Init
 func (db *DBTask) RunInit(ctx context.Context) error {
 	db.state = true
-	// Getting config from environment
-	host, ok := os.LookupEnv("POSTGRES_HOST")
-	if !ok {
-		return fmt.Errorf("No host provided for postgres")
-	}
-	db.host = host
-	port, ok := os.LookupEnv("POSTGRES_PORT")
-	db.port = port
-	if !ok {
-		db.port = "5432"
-	}
-	user, ok := os.LookupEnv("POSTGRES_USER")
-	db.user = user
-	if !ok {
-		user_file, ok := os.LookupEnv("POSTGRES_USER_FILE")
-		if !ok {
-			db.user = "postgres"
-		} else {
-			b, err := os.ReadFile(user_file)
-			if err != nil {
-				return fmt.Errorf("Could not read file %s to get postgres user", user_file)
-			}
-			db.user = string(b)
+	background, cancel := context.WithCancel(ctx)
+	db.cancel = cancel
+	switch db.conf.BackendOrDefault() {
+	case config.DatabasePostgres:
+		if err := db.initPostgres(ctx); err != nil {
+			return err
 		}
-	}
-	dbname, ok := os.LookupEnv("POSTGRES_DB")
-	db.dbname = dbname
-	if !ok {
-		db.dbname = db.user
-	}
-
-	var psqlconn string
-	unixSocket, ok := os.LookupEnv("POSTGRES_UNIX_SOCKET_PATH")
-	if !ok {
-		password, ok := os.LookupEnv("POSTGRES_PASSWORD")
-		db.password = password
-		if !ok {
-			password_file, ok := os.LookupEnv("POSTGRES_PASSWORD_FILE")
-			if !ok {
-				return fmt.Errorf("No password provided for postgres")
-			}
-			b, err := os.ReadFile(password_file)
-			if err != nil {
-				return fmt.Errorf("Could not read file %s to get postgres password", password_file)
-			}
-			db.password = string(b)
+		var healthCheck *config.HealthCheck
+		if db.conf != nil {
+			healthCheck = db.conf.HealthCheck
+		}
+		var events events_api.Publisher
+		if db.registry != nil {
+			events = db.registry.Events()
 		}
-		// Create a conn for this database
-		psqlconn = fmt.Sprintf("host='%s' port='%s' user='%s' password='%s' dbname='%s' sslmode='disable'", db.host, db.port, db.user, db.password, db.dbname)
-	} else {
-		db.unixSocketPath = path.Clean(unixSocket)
-		if db.unixSocketPath != "/" {
-			db.unixSocketPath += "/"
+		monitor, err := database.NewMonitor(db.postgres, healthCheck, events)
+		if err != nil {
+			db.postgres.Exit()
+			db.postgres.Close()
+			db.postgres = nil
+			return err
 		}
-		psqlconn = fmt.Sprintf("postgres:///%s?host=%s&user=%s", db.dbname, db.unixSocketPath, db.user)
+		db.monitor = monitor
+		db.db = db.monitor
+		db.runBackground(background, db.postgres.RunFlush)
+		db.runBackground(background, db.monitor.Run)
+		if size := db.conf.CacheSizeOrDefault(); size > 0 {
+			cache := database.NewCache(db.monitor, size)
+			db.listener = database.NewListener(db.conninfo, cache)
+			db.listener.Start()
+			db.db = cache
+		}
+	case config.DatabaseMemory:
+		logrus.Info("Using in-memory database: rules will be lost on exit.")
+		db.db = database.NewMemory()
+	case config.DatabaseBolt:
+		bolt, err := database.OpenBolt(db.conf.PathOrDefault())
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"path": db.conf.PathOrDefault()}).Info("Using embedded database.")
+		db.bolt = bolt
+		db.db = bolt
+		db.runBackground(background, bolt.RunFlush)
+	default:
+		return fmt.Errorf("Unsupported database backend")
+	}
+	if db.registry != nil {
+		db.registry.RegisterDB(db.db)
 	}
+	return nil
+}
+
+// Run in background until RunExit
+func (db *DBTask) runBackground(ctx context.Context, run func(ctx context.Context)) {
+	db.done.Add(1)
+	go func() {
+		defer db.done.Done()
+		run(ctx)
+	}()
+}
 
-	postgres, err := sql.Open("postgres", psqlconn)
+// Connect to the postgres database
+func (db *DBTask) initPostgres(ctx context.Context) error {
+	postgres, conninfo, err := database.OpenPostgres(db.conf)
 	if err != nil {
-		return fmt.Errorf("Error while openning postgres database: %s", err)
+		return err
 	}
+	db.conninfo = conninfo
 
 	maxAttempts := 16
-	ok = false
+	ok := false
 	for errcnt := 0; (errcnt < maxAttempts) && !ok; errcnt++ {
 		wait, cancel := context.WithTimeout(ctx, 100*(1<<errcnt*time.Millisecond)) // Exponential backoff
 		defer cancel()
@@ -136,15 +148,10 @@ func (db *DBTask) RunInit(ctx context.Context) error {
 		return fmt.Errorf("Could not connect to postgres database after %d attempts: %s", maxAttempts, err)
 	}
 
-	db.db = database.NewDatabase(postgres)
-	if err := db.db.Init(ctx); err != nil {
+	db.postgres = database.NewDatabase(postgres)
+	if err := db.postgres.Init(ctx); err != nil {
 		return err
 	}
-
-	if db.registry != nil {
-		db.registry.RegisterDB(db.db)
-	}
-
 	return nil
 }
 
@@ -157,7 +164,26 @@ func (db *DBTask) RunExit() error {
 	if db.db == nil {
 		return fmt.Errorf("No database")
 	}
-	db.db.Exit()
-	db.db.Close()
+	db.db = nil
+	if db.cancel != nil {
+		db.cancel()
+		db.done.Wait()
+		db.cancel = nil
+	}
+	db.monitor = nil
+	if db.listener != nil {
+		db.listener.Close()
+		db.listener = nil
+	}
+	if db.postgres != nil {
+		db.postgres.Exit()
+		db.postgres.Close()
+		db.postgres = nil
+	}
+	if db.bolt != nil {
+		err := db.bolt.Close()
+		db.bolt = nil
+		return err
+	}
 	return nil
 }
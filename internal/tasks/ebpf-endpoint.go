@@ -0,0 +1,76 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/ebpf"
+	"github.com/nextmn/srv6/internal/iana"
+	"github.com/nextmn/srv6/internal/iproute2"
+)
+
+// TaskEBPFEndpoint attaches an endpoint program at TC ingress
+type TaskEBPFEndpoint struct {
+	WithName
+	WithState
+	endpoint *config.Endpoint
+	prog     *ebpf.EndpointMGTP4E
+}
+
+// Create a new TaskEBPFEndpoint
+func NewTaskEBPFEndpoint(name string, endpoint *config.Endpoint) *TaskEBPFEndpoint {
+	return &TaskEBPFEndpoint{
+		WithName:  NewName(name),
+		WithState: NewState(),
+		endpoint:  endpoint,
+		prog:      nil,
+	}
+}
+
+// Init
+func (t *TaskEBPFEndpoint) RunInit(ctx context.Context) error {
+	if t.endpoint.Iface == nil {
+		return fmt.Errorf("Missing interface for eBPF endpoint %s", t.endpoint.Prefix)
+	}
+	if t.endpoint.Behavior != iana.End_M_GTP4_E {
+		return fmt.Errorf("Unsupported endpoint behavior (%s) with this provider (%s)", t.endpoint.Behavior, t.endpoint.Provider)
+	}
+	p, err := netip.ParsePrefix(t.endpoint.Prefix)
+	if err != nil {
+		return err
+	}
+	ttl, err := iproute2.IPv4DefaultTTL()
+	if err != nil {
+		return err
+	}
+	prog, err := ebpf.NewEndpointMGTP4E(p, ttl)
+	if err != nil {
+		return err
+	}
+	if err := prog.Attach(*t.endpoint.Iface); err != nil {
+		prog.Close()
+		return err
+	}
+	t.prog = prog
+	t.state = true
+	return nil
+}
+
+// Exit
+func (t *TaskEBPFEndpoint) RunExit() error {
+	if t.prog != nil {
+		if err := t.prog.Close(); err != nil {
+			return err
+		}
+		t.prog = nil
+	}
+	t.state = false
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/ebpf"
+	"github.com/nextmn/srv6/internal/iproute2"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Interval between two synchronizations of the rules map with the database
+const ebpfRulesSyncInterval = 1 * time.Second
+
+// TaskEBPFHeadend attaches a headend program at TC ingress.
+// Rules are taken from the policy of the headend, or from the database when no policy is set.
+type TaskEBPFHeadend struct {
+	WithName
+	WithState
+	headend  *config.Headend
+	registry app_api.Registry
+	prog     *ebpf.HeadendGTP4
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when synchronization is stopped
+}
+
+// Create a new TaskEBPFHeadend
+func NewTaskEBPFHeadend(name string, headend *config.Headend, registry app_api.Registry) *TaskEBPFHeadend {
+	return &TaskEBPFHeadend{
+		WithName:  NewName(name),
+		WithState: NewState(),
+		headend:   headend,
+		registry:  registry,
+		prog:      nil,
+		cancel:    nil,
+		done:      nil,
+	}
+}
+
+// Init
+func (t *TaskEBPFHeadend) RunInit(ctx context.Context) error {
+	if t.headend.Iface == nil {
+		return fmt.Errorf("Missing interface for eBPF headend %s", t.headend.Name)
+	}
+	if t.headend.Behavior != config.H_M_GTP4_D {
+		return fmt.Errorf("Unsupported headend behavior (%s) with this provider (%s)", t.headend.Behavior, t.headend.Provider)
+	}
+	if t.headend.SourceAddressPrefix == nil {
+		return fmt.Errorf("Missing source-address-prefix")
+	}
+	p, err := netip.ParsePrefix(t.headend.To)
+	if err != nil {
+		return err
+	}
+	srcAddressPrefix, err := netip.ParsePrefix(*t.headend.SourceAddressPrefix)
+	if err != nil {
+		return err
+	}
+	hopLimit, err := iproute2.IPv6HopLimit(*t.headend.Iface)
+	if err != nil {
+		return err
+	}
+	var db database_api.Rules
+	if t.headend.Policy != nil {
+		t.prog, err = ebpf.NewHeadendGTP4(p, srcAddressPrefix, hopLimit)
+		if err != nil {
+			return err
+		}
+		if err := t.prog.SetPolicy(*t.headend.Policy); err != nil {
+			t.prog.Close()
+			t.prog = nil
+			return err
+		}
+	} else {
+		if t.registry == nil {
+			return fmt.Errorf("Registry is nil")
+		}
+		d, ok := t.registry.DB()
+		if !ok {
+			return fmt.Errorf("No database in registry")
+		}
+		db = d
+		t.prog, err = ebpf.NewHeadendGTP4WithCtrl(p, srcAddressPrefix, hopLimit)
+		if err != nil {
+			return err
+		}
+		// the map is filled before the program is attached
+		t.syncRules(ctx, db)
+	}
+	if err := t.prog.Attach(*t.headend.Iface); err != nil {
+		t.prog.Close()
+		t.prog = nil
+		return err
+	}
+	if db != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		t.cancel = cancel
+		t.done = make(chan struct{})
+		go t.runSync(ctx, db)
+	}
+	t.state = true
+	return nil
+}
+
+// Synchronize periodically the rules map with the database
+func (t *TaskEBPFHeadend) runSync(ctx context.Context, db database_api.Rules) {
+	defer close(t.done)
+	ticker := time.NewTicker(ebpfRulesSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.syncRules(ctx, db)
+		}
+	}
+}
+
+func (t *TaskEBPFHeadend) syncRules(ctx context.Context, db database_api.Rules) {
+	rules, err := db.GetRules(ctx)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"headend": t.headend.Name}).Error("Could not get rules from database")
+		return
+	}
+	if err := t.prog.SyncRules(rules); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"headend": t.headend.Name}).Error("Could not update eBPF rules map")
+	}
+}
+
+// Exit
+func (t *TaskEBPFHeadend) RunExit() error {
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+		<-t.done
+	}
+	if t.prog != nil {
+		if err := t.prog.Close(); err != nil {
+			return err
+		}
+		t.prog = nil
+	}
+	t.state = false
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
+	database_api "github.com/nextmn/srv6/internal/database/api"
+	"github.com/nextmn/srv6/internal/gtpu"
+)
+
+// TaskGTPUPathManagement sends GTP-U Echo Requests to gNBs
+type TaskGTPUPathManagement struct {
+	WithName
+	WithState
+	conf          *config.GTPUPathManagement
+	defaultSource *netip.Addr
+	headends      map[string]string // iface (or socket) name -> headend prefix
+	registry      app_api.Registry
+	cancel        context.CancelFunc
+}
+
+// Create a new TaskGTPUPathManagement
+func NewTaskGTPUPathManagement(name string, conf *config.GTPUPathManagement, defaultSource *netip.Addr, headends map[string]string, registry app_api.Registry) *TaskGTPUPathManagement {
+	return &TaskGTPUPathManagement{
+		WithName:      NewName(name),
+		WithState:     NewState(),
+		conf:          conf,
+		defaultSource: defaultSource,
+		headends:      headends,
+		registry:      registry,
+		cancel:        nil,
+	}
+}
+
+// Init
+func (t *TaskGTPUPathManagement) RunInit(ctx context.Context) error {
+	if t.registry == nil {
+		return fmt.Errorf("Registry is nil")
+	}
+	senders := make([]gtpu.Sender, 0, len(t.headends))
+	for iface_name, to := range t.headends {
+		prefix, err := netip.ParsePrefix(to)
+		if err != nil {
+			return err
+		}
+		var sender gtpu.Sender
+		if tunIface, ok := t.registry.TunIface(iface_name); ok {
+			ttl, err := tunIface.IPv4TTL()
+			if err != nil {
+				return err
+			}
+			sender = gtpu.Sender{Prefix: prefix, TTL: ttl, Write: tunIface.Write}
+		} else if socket, ok := t.registry.GTPUSocket(iface_name); ok {
+			ttl, err := socket.IPv4TTL()
+			if err != nil {
+				return err
+			}
+			sender = gtpu.Sender{Prefix: prefix, TTL: ttl, Write: socket.Write}
+		} else {
+			return fmt.Errorf("Interface %s is not in registry", iface_name)
+		}
+		senders = append(senders, sender)
+	}
+	var rules database_api.Rules
+	if db, ok := t.registry.DB(); ok {
+		rules = db
+	}
+	var writer database_api.RulesWriter
+	if w, ok := t.registry.RulesWriter(); ok {
+		writer = w
+	}
+	pm, err := gtpu.NewPathManager(t.conf, t.defaultSource, senders, rules, writer, t.registry.Events())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	go pm.Run(ctx)
+	t.registry.RegisterPathManager(pm)
+	t.state = true
+	return nil
+}
+
+// Exit
+func (t *TaskGTPUPathManagement) RunExit() error {
+	t.state = false
+	t.registry.DeletePathManager()
+	if t.cancel != nil {
+		t.cancel()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"net/netip"
+
+	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/iproute2"
+)
+
+// TaskGTPUSocket
+type TaskGTPUSocket struct {
+	WithName
+	WithState
+	socket_name string
+	to          string
+	queues      int
+	socket      *iproute2.GTPUSocket
+	registry    app_api.Registry
+}
+
+// Create a new Task for GTPUSocket
+func NewTaskGTPUSocket(name string, socket_name string, to string, queues int, registry app_api.Registry) *TaskGTPUSocket {
+	return &TaskGTPUSocket{
+		WithName:    NewName(name),
+		WithState:   NewState(),
+		socket_name: socket_name,
+		to:          to,
+		queues:      queues,
+		socket:      nil,
+		registry:    registry,
+	}
+}
+
+// Open the socket
+func (t *TaskGTPUSocket) RunInit(ctx context.Context) error {
+	prefix, err := netip.ParsePrefix(t.to)
+	if err != nil {
+		return err
+	}
+	socket := iproute2.NewGTPUSocket(t.socket_name, prefix, t.queues)
+	if err := socket.Open(ctx); err != nil {
+		return err
+	}
+	t.socket = socket
+	if t.registry != nil {
+		if err := t.registry.RegisterGTPUSocket(t.socket); err != nil {
+			return err
+		}
+	}
+	t.state = true
+	return nil
+}
+
+// Close the socket
+func (t *TaskGTPUSocket) RunExit() error {
+	if t.registry != nil {
+		t.registry.DeleteGTPUSocket(t.socket_name)
+	}
+	if t.socket != nil {
+		if err := t.socket.Close(); err != nil {
+			return err
+		}
+		t.socket = nil
+	}
+	t.state = false
+	return nil
+}
@@ -7,19 +7,22 @@ package tasks
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
-	"net/netip"
 	"time"
 
 	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
 	ctrl_api "github.com/nextmn/srv6/internal/ctrl/api"
+	database_api "github.com/nextmn/srv6/internal/database/api"
 	"github.com/sirupsen/logrus"
 
 	"github.com/nextmn/srv6/internal/ctrl"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nextmn/json-api/jsonapi"
 )
 
 // HttpServerTask starts an http server
@@ -27,18 +30,18 @@ type HttpServerTask struct {
 	WithName
 	WithState
 	srv               *http.Server
-	httpAddr          netip.AddrPort
+	control           config.Control
 	rulesRegistryHTTP ctrl_api.RulesRegistryHTTP
 	setupRegistry     app_api.Registry
 }
 
 // Create a new HttpServerTask
-func NewHttpServerTask(name string, httpAddr netip.AddrPort, setupRegistry app_api.Registry) *HttpServerTask {
+func NewHttpServerTask(name string, control config.Control, setupRegistry app_api.Registry) *HttpServerTask {
 	return &HttpServerTask{
 		WithName:          NewName(name),
 		WithState:         NewState(),
 		srv:               nil,
-		httpAddr:          httpAddr,
+		control:           control,
 		rulesRegistryHTTP: nil,
 		setupRegistry:     setupRegistry,
 	}
@@ -53,33 +56,120 @@ func (t *HttpServerTask) RunInit(ctx context.Context) error {
 	if !ok {
 		return fmt.Errorf("DB is not in Registry")
 	}
-	rr := ctrl.NewRulesRegistry(db)
+	hub := t.setupRegistry.Events()
+	rr := ctrl.NewRulesRegistry(db, t.control.RulesOverlap, hub)
 	t.rulesRegistryHTTP = rr
+	// tasks changing rules share the write lock and the overlap check of the API
+	t.setupRegistry.RegisterRulesWriter(rr)
+	var tlsConf *tls.Config
+	if t.control.TLS != nil {
+		c, err := ctrl.ServerTLSConfig(t.control.TLS)
+		if err != nil {
+			return err
+		}
+		tlsConf = c
+	}
 	// TODO:  gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
-	r.GET("/status", func(c *gin.Context) {
+	// status and API document are not authenticated: they are used by health checks and liveness probes
+	public := r.Group("/", ctrl.ValidateRequests())
+	api := r.Group("/")
+	if t.control.Auth != nil {
+		if len(t.control.Auth.ClientCertificates) > 0 && (t.control.TLS == nil || t.control.TLS.ClientCA == nil) {
+			return fmt.Errorf("Authentication with client certificates requires control.tls.client-ca")
+		}
+		auth, err := ctrl.NewAuthenticator(t.control.Auth)
+		if err != nil {
+			return err
+		}
+		api.Use(auth.Authorize())
+	} else {
+		logrus.WithFields(logrus.Fields{"bind-addr": t.control.BindAddr}).Warning("Control API is not authenticated")
+	}
+	api.Use(ctrl.ValidateRequests())
+	public.GET("/openapi.json", ctrl.OpenAPI)
+	public.GET("/status", func(c *gin.Context) {
 		c.Header("Cache-Control", "no-cache")
-		c.JSON(http.StatusOK, gin.H{"ready": true})
+		health := database_api.Health{State: database_api.HealthUp}
+		if m, ok := db.(database_api.MonitoredRuleStore); ok {
+			health = m.Health()
+		}
+		status := http.StatusOK
+		if !health.Ready() {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"ready": health.Ready(), "database": health})
 	})
-	r.POST("/rules", t.rulesRegistryHTTP.PostRule)
-	r.GET("/rules/:uuid", t.rulesRegistryHTTP.GetRule)
-	r.GET("/rules", t.rulesRegistryHTTP.GetRules)
-	r.PATCH("/rules/:uuid/enable", t.rulesRegistryHTTP.EnableRule)
-	r.PATCH("/rules/:uuid/disable", t.rulesRegistryHTTP.DisableRule)
-	r.PATCH("/rules/switch/:enable_uuid/:disable_uuid", t.rulesRegistryHTTP.SwitchRule)
-	r.DELETE("/rules/:uuid", t.rulesRegistryHTTP.DeleteRule)
-	r.PATCH("/rules/:uuid/update-action", t.rulesRegistryHTTP.UpdateAction)
+	api.POST("/rules", t.rulesRegistryHTTP.PostRule)
+	api.GET("/rules/:uuid", t.rulesRegistryHTTP.GetRule)
+	api.GET("/rules", t.rulesRegistryHTTP.GetRules)
+	api.GET("/rules/overlaps", t.rulesRegistryHTTP.GetOverlaps)
+	api.PATCH("/rules/:uuid/enable", t.rulesRegistryHTTP.EnableRule)
+	api.PATCH("/rules/:uuid/disable", t.rulesRegistryHTTP.DisableRule)
+	api.PATCH("/rules/switch/:enable_uuid/:disable_uuid", t.rulesRegistryHTTP.SwitchRule)
+	api.DELETE("/rules/:uuid", t.rulesRegistryHTTP.DeleteRule)
+	api.PATCH("/rules/:uuid/update-action", t.rulesRegistryHTTP.UpdateAction)
+	api.POST("/rules/batch", t.rulesRegistryHTTP.BatchRules)
+	api.PATCH("/rules/:uuid/reset-counters", t.rulesRegistryHTTP.ResetCounters)
+	api.PATCH("/rules/:uuid/paths/:index/down", t.rulesRegistryHTTP.SetPathDown)
+	api.PATCH("/rules/:uuid/paths/:index/up", t.rulesRegistryHTTP.SetPathUp)
+	api.GET("/events", hub.GetEvents)
+	if m, ok := t.setupRegistry.DataplaneManager(); ok {
+		var dr ctrl_api.DataplaneRegistryHTTP = ctrl.NewDataplaneRegistry(m)
+		// prefixes of endpoints are escaped in paths (e.g. fd00:1::%2F64)
+		r.UseRawPath = true
+		api.GET("/endpoints", dr.GetEndpoints)
+		api.POST("/endpoints", dr.PostEndpoint)
+		api.GET("/endpoints/:prefix", dr.GetEndpoint)
+		api.DELETE("/endpoints/:prefix", dr.DeleteEndpoint)
+		api.GET("/headends", dr.GetHeadends)
+		api.POST("/headends", dr.PostHeadend)
+		api.GET("/headends/:name", dr.GetHeadend)
+		api.DELETE("/headends/:name", dr.DeleteHeadend)
+	}
+	api.GET("/gtpu/peers", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+		// path manager is started after the http server
+		pm, ok := t.setupRegistry.PathManager()
+		if !ok {
+			c.JSON(http.StatusNotFound, jsonapi.MessageWithError{Message: "GTP-U path management is disabled", Error: fmt.Errorf("no path manager")})
+			return
+		}
+		c.JSON(http.StatusOK, pm.Peers())
+	})
+	api.GET("/dataplane/stats", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+		c.JSON(http.StatusOK, t.setupRegistry.NetFuncStats())
+	})
+	api.GET("/database/cache/stats", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+		cache, ok := db.(database_api.CachedRuleStore)
+		if !ok {
+			c.JSON(http.StatusNotFound, jsonapi.MessageWithError{Message: "Lookup cache is disabled", Error: fmt.Errorf("no cache")})
+			return
+		}
+		c.JSON(http.StatusOK, cache.CacheStats())
+	})
+	ctrl.CheckRoutes(r.Routes())
 	t.srv = &http.Server{
-		Addr:    t.httpAddr.String(),
-		Handler: r,
+		Addr:      t.control.BindAddr.String(),
+		Handler:   r,
+		TLSConfig: tlsConf,
 	}
+	// event streams are not closed by clients
+	t.srv.RegisterOnShutdown(hub.Disconnect)
 
 	l, err := net.Listen("tcp", t.srv.Addr)
 	if err != nil {
 		return err
 	}
 	go func(ln net.Listener) {
-		if err := t.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		serve := t.srv.Serve
+		if tlsConf != nil {
+			// certificates are loaded by TLSConfig
+			serve = func(ln net.Listener) error { return t.srv.ServeTLS(ln, "", "") }
+		}
+		if err := serve(ln); err != nil && err != http.ErrServerClosed {
 			logrus.WithError(err).Error("HTTP Server error")
 		}
 	}(l)
@@ -90,6 +180,7 @@ func (t *HttpServerTask) RunInit(ctx context.Context) error {
 // Exit
 func (t *HttpServerTask) RunExit() error {
 	t.state = false
+	t.setupRegistry.DeleteRulesWriter()
 	ctx, cancel := context.WithTimeout(context.TODO(), 1*time.Second) // context.Background() is already Done()
 	defer cancel()
 	if err := t.srv.Shutdown(ctx); err != nil {
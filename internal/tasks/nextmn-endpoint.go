@@ -25,10 +25,11 @@ type TaskNextMNEndpoint struct {
 	table      iproute2.Table
 	registry   app_api.Registry
 	iface_name string
+	dataplane  *config.Dataplane
 }
 
 // Create a new TaskNextMNEndpoint
-func NewTaskNextMNEndpoint(name string, endpoint *config.Endpoint, table_name string, iface_name string, registry app_api.Registry) *TaskNextMNEndpoint {
+func NewTaskNextMNEndpoint(name string, endpoint *config.Endpoint, table_name string, iface_name string, dataplane *config.Dataplane, registry app_api.Registry) *TaskNextMNEndpoint {
 	return &TaskNextMNEndpoint{
 		WithName:   NewName(name),
 		WithState:  NewState(),
@@ -36,6 +37,7 @@ func NewTaskNextMNEndpoint(name string, endpoint *config.Endpoint, table_name st
 		table:      iproute2.NewTable(table_name, constants.RT_PROTO_NEXTMN),
 		iface_name: iface_name,
 		registry:   registry,
+		dataplane:  dataplane,
 	}
 }
 
@@ -55,12 +57,13 @@ func (t *TaskNextMNEndpoint) RunInit(ctx context.Context) error {
 		return err
 	}
 	var n netfunc_api.NetFunc
-	if ep, err := netfunc.NewEndpoint(t.endpoint, ttl, hopLimit); err != nil {
+	if ep, err := netfunc.NewEndpoint(t.endpoint, ttl, hopLimit, t.dataplane); err != nil {
 		return err
 	} else {
 		n = ep
 	}
 	go n.Run(ctx, tunIface)
+	t.registry.RegisterNetFunc(t.iface_name, n)
 	// Add route to endpoint
 	if err := t.table.AddRoute6Tun(t.endpoint.Prefix, t.iface_name); err != nil {
 		return err
@@ -71,6 +74,7 @@ func (t *TaskNextMNEndpoint) RunInit(ctx context.Context) error {
 
 // Exit
 func (t *TaskNextMNEndpoint) RunExit() error {
+	t.registry.DeleteNetFunc(t.iface_name)
 	// Remove route to endpoint
 	if err := t.table.DelRoute6Tun(t.endpoint.Prefix, t.iface_name); err != nil {
 		return err
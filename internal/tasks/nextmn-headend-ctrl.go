@@ -8,6 +8,7 @@ package tasks
 import (
 	"context"
 	"fmt"
+	"net/netip"
 
 	app_api "github.com/nextmn/srv6/internal/app/api"
 	"github.com/nextmn/srv6/internal/config"
@@ -25,10 +26,11 @@ type TaskNextMNHeadendWithCtrl struct {
 	table      iproute2.Table
 	registry   app_api.Registry
 	iface_name string
+	dataplane  *config.Dataplane
 }
 
 // Create a new TaskNextMNHeadend
-func NewTaskNextMNHeadendWithCtrl(name string, headend *config.Headend, table_name string, iface_name string, registry app_api.Registry) *TaskNextMNHeadendWithCtrl {
+func NewTaskNextMNHeadendWithCtrl(name string, headend *config.Headend, table_name string, iface_name string, dataplane *config.Dataplane, registry app_api.Registry) *TaskNextMNHeadendWithCtrl {
 	return &TaskNextMNHeadendWithCtrl{
 		WithName:   NewName(name),
 		WithState:  NewState(),
@@ -36,6 +38,7 @@ func NewTaskNextMNHeadendWithCtrl(name string, headend *config.Headend, table_na
 		table:      iproute2.NewTable(table_name, constants.RT_PROTO_NEXTMN),
 		iface_name: iface_name,
 		registry:   registry,
+		dataplane:  dataplane,
 	}
 }
 
@@ -55,14 +58,23 @@ func (t *TaskNextMNHeadendWithCtrl) RunInit(ctx context.Context) error {
 		return err
 	}
 	var n netfunc_api.NetFunc
-	if ep, err := netfunc.NewHeadendWithCtrl(t.headend, ttl, hopLimit, t.registry); err != nil {
+	if ep, err := netfunc.NewHeadendWithCtrl(t.headend, ttl, hopLimit, t.dataplane, t.registry); err != nil {
 		return err
 	} else {
 		n = ep
 	}
 	go n.Run(ctx, tunIface)
+	t.registry.RegisterNetFunc(t.iface_name, n)
 	// Add route to headend
-	if err := t.table.AddRoute4Tun(t.headend.To, t.iface_name); err != nil {
+	if t.ipv6() {
+		// IPv6 PDU Sessions (downlink): the table is not looked up by the IPv4 rule of the headends
+		if err := t.table.AddRule6(t.headend.To); err != nil {
+			return err
+		}
+		if err := t.table.AddRoute6Tun(t.headend.To, t.iface_name); err != nil {
+			return err
+		}
+	} else if err := t.table.AddRoute4Tun(t.headend.To, t.iface_name); err != nil {
 		return err
 	}
 	t.state = true
@@ -71,10 +83,24 @@ func (t *TaskNextMNHeadendWithCtrl) RunInit(ctx context.Context) error {
 
 // Exit
 func (t *TaskNextMNHeadendWithCtrl) RunExit() error {
+	t.registry.DeleteNetFunc(t.iface_name)
 	// Remove route to endpoint
-	if err := t.table.DelRoute4Tun(t.headend.To, t.iface_name); err != nil {
+	if t.ipv6() {
+		if err := t.table.DelRoute6Tun(t.headend.To, t.iface_name); err != nil {
+			return err
+		}
+		if err := t.table.DelRule6(t.headend.To); err != nil {
+			return err
+		}
+	} else if err := t.table.DelRoute4Tun(t.headend.To, t.iface_name); err != nil {
 		return err
 	}
 	t.state = false
 	return nil
 }
+
+// Returns true if the headend handles an IPv6 prefix
+func (t *TaskNextMNHeadendWithCtrl) ipv6() bool {
+	p, err := netip.ParsePrefix(t.headend.To)
+	return err == nil && p.Addr().Is6()
+}
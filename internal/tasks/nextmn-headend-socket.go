@@ -0,0 +1,82 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+
+	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/netfunc"
+	netfunc_api "github.com/nextmn/srv6/internal/netfunc/api"
+)
+
+// TaskNextMNHeadendSocket creates a new H.M.GTP4.D headend receiving packets from a GTPUSocket.
+// No route nor ip rule is required.
+type TaskNextMNHeadendSocket struct {
+	WithName
+	WithState
+	headend     *config.Headend
+	registry    app_api.Registry
+	socket_name string
+	dataplane   *config.Dataplane
+}
+
+// Create a new TaskNextMNHeadendSocket
+func NewTaskNextMNHeadendSocket(name string, headend *config.Headend, socket_name string, dataplane *config.Dataplane, registry app_api.Registry) *TaskNextMNHeadendSocket {
+	return &TaskNextMNHeadendSocket{
+		WithName:    NewName(name),
+		WithState:   NewState(),
+		headend:     headend,
+		socket_name: socket_name,
+		registry:    registry,
+		dataplane:   dataplane,
+	}
+}
+
+// Init
+func (t *TaskNextMNHeadendSocket) RunInit(ctx context.Context) error {
+	if t.headend.Behavior != config.H_M_GTP4_D {
+		return fmt.Errorf("Ingress %s is only supported by %s headends", config.IngressUDPSocket, config.H_M_GTP4_D)
+	}
+	// Create and start headend
+	socket, ok := t.registry.GTPUSocket(t.socket_name)
+	if !ok {
+		return fmt.Errorf("Socket %s is not in registry", t.socket_name)
+	}
+	ttl, err := socket.IPv4TTL()
+	if err != nil {
+		return err
+	}
+	hopLimit, err := socket.IPv6HopLimit()
+	if err != nil {
+		return err
+	}
+	var n netfunc_api.NetFunc
+	switch t.headend.Provider {
+	case config.ProviderNextMN:
+		n, err = netfunc.NewHeadend(t.headend, ttl, hopLimit, t.dataplane, t.registry)
+	case config.ProviderNextMNWithController:
+		n, err = netfunc.NewHeadendWithCtrl(t.headend, ttl, hopLimit, t.dataplane, t.registry)
+	default:
+		err = fmt.Errorf("Ingress %s is not supported with this provider (%s)", config.IngressUDPSocket, t.headend.Provider)
+	}
+	if err != nil {
+		return err
+	}
+	go n.Run(ctx, socket)
+	t.registry.RegisterNetFunc(t.socket_name, n)
+	t.state = true
+	return nil
+}
+
+// Exit
+func (t *TaskNextMNHeadendSocket) RunExit() error {
+	t.registry.DeleteNetFunc(t.socket_name)
+	t.state = false
+	return nil
+}
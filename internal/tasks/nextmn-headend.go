@@ -25,10 +25,11 @@ type TaskNextMNHeadend struct {
 	table      iproute2.Table
 	registry   app_api.Registry
 	iface_name string
+	dataplane  *config.Dataplane
 }
 
 // Create a new TaskNextMNHeadend
-func NewTaskNextMNHeadend(name string, headend *config.Headend, table_name string, iface_name string, registry app_api.Registry) *TaskNextMNHeadend {
+func NewTaskNextMNHeadend(name string, headend *config.Headend, table_name string, iface_name string, dataplane *config.Dataplane, registry app_api.Registry) *TaskNextMNHeadend {
 	return &TaskNextMNHeadend{
 		WithName:   NewName(name),
 		WithState:  NewState(),
@@ -36,6 +37,7 @@ func NewTaskNextMNHeadend(name string, headend *config.Headend, table_name strin
 		table:      iproute2.NewTable(table_name, constants.RT_PROTO_NEXTMN),
 		iface_name: iface_name,
 		registry:   registry,
+		dataplane:  dataplane,
 	}
 }
 
@@ -55,12 +57,13 @@ func (t *TaskNextMNHeadend) RunInit(ctx context.Context) error {
 		return err
 	}
 	var n netfunc_api.NetFunc
-	if ep, err := netfunc.NewHeadend(t.headend, ttl, hopLimit); err != nil {
+	if ep, err := netfunc.NewHeadend(t.headend, ttl, hopLimit, t.dataplane, t.registry); err != nil {
 		return err
 	} else {
 		n = ep
 	}
 	go n.Run(ctx, tunIface)
+	t.registry.RegisterNetFunc(t.iface_name, n)
 	// Add route to headend
 	if err := t.table.AddRoute4Tun(t.headend.To, t.iface_name); err != nil {
 		return err
@@ -71,6 +74,7 @@ func (t *TaskNextMNHeadend) RunInit(ctx context.Context) error {
 
 // Exit
 func (t *TaskNextMNHeadend) RunExit() error {
+	t.registry.DeleteNetFunc(t.iface_name)
 	// Remove route to endpoint
 	if err := t.table.DelRoute4Tun(t.headend.To, t.iface_name); err != nil {
 		return err
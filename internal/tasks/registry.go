@@ -9,7 +9,9 @@ import (
 	"context"
 	"fmt"
 	"slices"
+	"sync"
 
+	events_api "github.com/nextmn/srv6/internal/events/api"
 	tasks_api "github.com/nextmn/srv6/internal/tasks/api"
 	"github.com/sirupsen/logrus"
 )
@@ -18,16 +20,44 @@ type Registry struct {
 	Tasks            []tasks_api.Task
 	cancelFuncs      []context.CancelFunc
 	initializedTasks int
+	events           events_api.Publisher // state transitions of tasks
+
+	// tasks started at runtime, by group
+	mu      sync.Mutex
+	ctx     context.Context // nil until init of registered tasks is done
+	groups  map[string]*group
+	ordered []string // names of groups, in start order
+}
+
+// Tasks started and stopped together at runtime
+type group struct {
+	tasks  []tasks_api.Task
+	cancel context.CancelFunc
 }
 
-func NewRegistry() *Registry {
+func NewRegistry(events events_api.Publisher) *Registry {
 	return &Registry{
 		Tasks:            make([]tasks_api.Task, 0),
 		cancelFuncs:      make([]context.CancelFunc, 0),
 		initializedTasks: 0,
+		events:           events,
+		groups:           make(map[string]*group),
+		ordered:          make([]string, 0),
 	}
 }
 
+// Publish a state transition of a task
+func (r *Registry) publish(name string, state string, err error) {
+	if r.events == nil {
+		return
+	}
+	ev := events_api.TaskEvent{Task: name, State: state}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	r.events.Publish(events_api.TaskState, ev)
+}
+
 // Register a new task
 func (r *Registry) Register(task tasks_api.Task) {
 	logrus.WithFields(logrus.Fields{
@@ -49,25 +79,127 @@ func (r *Registry) RunInit(ctx context.Context) error {
 			}
 			taskCtx, cancel := context.WithCancel(ctx)
 			r.cancelFuncs = append(r.cancelFuncs, cancel)
-			if err := t.RunInit(taskCtx); err != nil {
-				logrus.WithError(err).WithFields(logrus.Fields{
-					"task-name":   t.NameInit(),
-					"task-status": "failure",
-				}).Error("Task runtime failure")
+			if err := r.initTask(taskCtx, t); err != nil {
 				return fmt.Errorf("Run init failure")
 			}
-			logrus.WithFields(logrus.Fields{
-				"task-name":   t.NameInit(),
-				"task-status": "success",
-			}).Info("Task runtime success")
 		}
 		r.initializedTasks += 1
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctx = ctx
 	return nil
 }
 
+// Init a task, and publish its new state
+func (r *Registry) initTask(ctx context.Context, t tasks_api.Task) error {
+	if err := t.RunInit(ctx); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"task-name":   t.NameInit(),
+			"task-status": "failure",
+		}).Error("Task runtime failure")
+		r.publish(t.NameBase(), "init-failed", err)
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"task-name":   t.NameInit(),
+		"task-status": "success",
+	}).Info("Task runtime success")
+	r.publish(t.NameBase(), "running", nil)
+	return nil
+}
+
+// Exit a task, and publish its new state
+func (r *Registry) exitTask(t tasks_api.Task) error {
+	if err := t.RunExit(); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"task-name":   t.NameExit(),
+			"task-status": "failure",
+		}).Error("Task runtime failure")
+		r.publish(t.NameBase(), "exit-failed", err)
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"task-name":   t.NameExit(),
+		"task-status": "success",
+	}).Info("Task runtime success")
+	r.publish(t.NameBase(), "stopped", nil)
+	return nil
+}
+
+// Start a group of tasks at runtime, after init of registered tasks.
+// On failure, tasks of the group already started are stopped.
+func (r *Registry) Start(name string, tasks ...tasks_api.Task) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx == nil {
+		return fmt.Errorf("Tasks cannot be started before the end of init")
+	}
+	if _, exists := r.groups[name]; exists {
+		return fmt.Errorf("Group of tasks %s is already started", name)
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	g := &group{tasks: make([]tasks_api.Task, 0, len(tasks)), cancel: cancel}
+	for _, t := range tasks {
+		logrus.WithFields(logrus.Fields{
+			"task-name":   t.NameBase(),
+			"task-status": "registered",
+			"task-group":  name,
+		}).Info("Task registration")
+		if err := r.initTask(ctx, t); err != nil {
+			r.stopGroup(g)
+			return err
+		}
+		g.tasks = append(g.tasks, t)
+	}
+	r.groups[name] = g
+	r.ordered = append(r.ordered, name)
+	return nil
+}
+
+// Stop a group of tasks started at runtime.
+// On failure, the group is kept with the tasks still running, so Stop can be retried.
+func (r *Registry) Stop(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.groups[name]
+	if !ok {
+		return fmt.Errorf("Group of tasks %s is not started", name)
+	}
+	if err := r.stopGroup(g); err != nil {
+		return err
+	}
+	delete(r.groups, name)
+	r.ordered = slices.DeleteFunc(r.ordered, func(n string) bool { return n == name })
+	return nil
+}
+
+// Exit tasks of the group in reverse order; all tasks are exited even on failure
+func (r *Registry) stopGroup(g *group) error {
+	g.cancel()
+	var failure error
+	for _, t := range slices.Backward(g.tasks) {
+		if !t.State() {
+			continue
+		}
+		if err := r.exitTask(t); err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
 // Run exit tasks
 func (r *Registry) RunExit() {
+	// tasks started at runtime depend on registered tasks
+	r.mu.Lock()
+	for _, name := range slices.Backward(r.ordered) {
+		r.stopGroup(r.groups[name])
+		delete(r.groups, name)
+	}
+	r.ordered = r.ordered[:0]
+	r.ctx = nil
+	r.mu.Unlock()
 	for _, cancel := range slices.Backward(r.cancelFuncs) {
 		cancel()
 	}
@@ -75,17 +207,7 @@ func (r *Registry) RunExit() {
 		if !t.State() {
 			continue
 		}
-		if err := t.RunExit(); err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
-				"task-name":   t.NameExit(),
-				"task-status": "failure",
-			}).Error("Task runtime failure")
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"task-name":   t.NameExit(),
-				"task-status": "success",
-			}).Info("Task runtime success")
-		}
+		r.exitTask(t)
 	}
 }
 
@@ -0,0 +1,71 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Task failing to exit the first failures times
+type flakyTask struct {
+	WithName
+	WithState
+	failures int
+	exits    int
+}
+
+func newFlakyTask(name string, failures int) *flakyTask {
+	return &flakyTask{WithName: NewName(name), WithState: NewState(), failures: failures}
+}
+
+func (t *flakyTask) RunInit(ctx context.Context) error {
+	t.state = true
+	return nil
+}
+
+func (t *flakyTask) RunExit() error {
+	t.exits++
+	if t.exits <= t.failures {
+		return fmt.Errorf("Exit failure")
+	}
+	t.state = false
+	return nil
+}
+
+func TestRegistryStopRetry(t *testing.T) {
+	r := NewRegistry(nil)
+	if err := r.Start("group", newFlakyTask("first", 0)); err == nil {
+		t.Fatal("group started before the end of init")
+	}
+	if err := r.RunInit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first, second := newFlakyTask("first", 0), newFlakyTask("second", 1)
+	if err := r.Start("group", first, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start("group", newFlakyTask("other", 0)); err == nil {
+		t.Error("group started twice")
+	}
+	if err := r.Stop("group"); err == nil {
+		t.Fatal("failure of exit not returned")
+	}
+	if first.State() || !second.State() {
+		t.Fatal("tasks of the group must be exited, except the failed one")
+	}
+	if err := r.Stop("group"); err != nil {
+		t.Fatalf("retry failed: %s", err)
+	}
+	if first.exits != 1 || second.exits != 2 || second.State() {
+		t.Errorf("got %d and %d exits, want 1 and 2", first.exits, second.exits)
+	}
+	if err := r.Stop("group"); err == nil {
+		t.Error("group stopped twice")
+	}
+	r.RunExit()
+}
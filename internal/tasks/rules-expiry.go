@@ -0,0 +1,65 @@
+// Copyright 2024 Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+
+	app_api "github.com/nextmn/srv6/internal/app/api"
+	"github.com/nextmn/srv6/internal/config"
+	"github.com/nextmn/srv6/internal/ctrl"
+)
+
+// TaskRulesExpiry disables or deletes expired rules
+type TaskRulesExpiry struct {
+	WithName
+	WithState
+	conf     *config.RulesExpiry
+	registry app_api.Registry
+	cancel   context.CancelFunc
+}
+
+// Create a new TaskRulesExpiry
+func NewTaskRulesExpiry(name string, conf *config.RulesExpiry, registry app_api.Registry) *TaskRulesExpiry {
+	return &TaskRulesExpiry{
+		WithName:  NewName(name),
+		WithState: NewState(),
+		conf:      conf,
+		registry:  registry,
+		cancel:    nil,
+	}
+}
+
+// Init
+func (t *TaskRulesExpiry) RunInit(ctx context.Context) error {
+	if t.registry == nil {
+		return fmt.Errorf("Registry is nil")
+	}
+	db, ok := t.registry.DB()
+	if !ok {
+		return fmt.Errorf("No database in the registry")
+	}
+	controller, _ := t.registry.ControllerRegistry()
+	e, err := ctrl.NewRulesExpiry(t.conf, db, controller, t.registry.Events())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	go e.Run(ctx)
+	t.state = true
+	return nil
+}
+
+// Exit
+func (t *TaskRulesExpiry) RunExit() error {
+	t.state = false
+	if t.cancel != nil {
+		t.cancel()
+	}
+	return nil
+}
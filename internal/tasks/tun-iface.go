@@ -21,11 +21,11 @@ type TaskTunIface struct {
 }
 
 // Create a new Task for TunIface
-func NewTaskTunIface(name string, iface_name string, registry app_api.Registry) *TaskTunIface {
+func NewTaskTunIface(name string, iface_name string, queues int, offload bool, registry app_api.Registry) *TaskTunIface {
 	return &TaskTunIface{
 		WithName:  NewName(name),
 		WithState: NewState(),
-		iface:     iproute2.NewTunIface(iface_name),
+		iface:     iproute2.NewTunIface(iface_name, queues, offload),
 		registry:  registry,
 	}
 }
@@ -69,6 +69,7 @@ func main() {
 			return nil
 		},
 		Commands: []*cli.Command{
+			dbCommand,
 			{
 				Name:  "healthcheck",
 				Usage: "check status of the node",